@@ -0,0 +1,65 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// adaptiveMinSamples is the minimum number of samples in the baseline before
+// the adaptive threshold is used.
+const adaptiveMinSamples = 30
+
+// baseline is the rolling mean and standard deviation of the recent Y
+// averages.
+//
+// It is used to derive a motion threshold that follows the slow changes in
+// the scene, like clouds or the camera auto-exposure.
+type baseline struct {
+	// window is the age of the oldest sample kept.
+	window  time.Duration
+	samples []yLevel
+	sum     float64
+	sumSq   float64
+}
+
+// add adds a sample and evicts the ones older than the window.
+func (b *baseline) add(l yLevel) {
+	b.samples = append(b.samples, l)
+	v := float64(l.yavg)
+	b.sum += v
+	b.sumSq += v * v
+	i := 0
+	for ; i < len(b.samples) && l.t.Sub(b.samples[i].t) > b.window; i++ {
+		v = float64(b.samples[i].yavg)
+		b.sum -= v
+		b.sumSq -= v * v
+	}
+	if i != 0 {
+		b.samples = append(b.samples[:0], b.samples[i:]...)
+	}
+}
+
+// stats returns the mean and the standard deviation of the samples.
+func (b *baseline) stats() (float64, float64) {
+	n := float64(len(b.samples))
+	if n == 0 {
+		return 0, 0
+	}
+	mean := b.sum / n
+	// Clamp since the floating point errors could make it slightly negative.
+	return mean, math.Sqrt(max(b.sumSq/n-mean*mean, 0))
+}
+
+// threshold returns mean + k*stddev, but never less than floor. It returns
+// floor until there are enough samples.
+func (b *baseline) threshold(k, floor float32) float32 {
+	if len(b.samples) < adaptiveMinSamples {
+		return floor
+	}
+	mean, stddev := b.stats()
+	return max(float32(mean+float64(k)*stddev), floor)
+}
@@ -0,0 +1,80 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBaseline(t *testing.T) {
+	t0 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	b := baseline{window: 10 * time.Second}
+	for i := 0; i < adaptiveMinSamples-1; i++ {
+		b.add(yLevel{t: t0.Add(time.Duration(i) * 100 * time.Millisecond), yavg: float32(i%2) + 1})
+	}
+	if got := b.threshold(3, 0.5); got != 0.5 {
+		t.Fatalf("not enough samples: %g", got)
+	}
+	b.add(yLevel{t: t0.Add(time.Duration(adaptiveMinSamples-1) * 100 * time.Millisecond), yavg: 2})
+	// Alternating 1 and 2: mean 1.5, stddev 0.5.
+	if mean, stddev := b.stats(); math.Abs(mean-1.5) > 1e-9 || math.Abs(stddev-0.5) > 1e-9 {
+		t.Fatal(mean, stddev)
+	}
+	if got := b.threshold(3, 0.5); got != 3 {
+		t.Fatal(got)
+	}
+	if got := b.threshold(3, 4); got != 4 {
+		t.Fatalf("floor: %g", got)
+	}
+	// The old samples are evicted.
+	b.add(yLevel{t: t0.Add(time.Minute), yavg: 7})
+	if len(b.samples) != 1 {
+		t.Fatal(len(b.samples))
+	}
+	if mean, stddev := b.stats(); math.Abs(mean-7) > 1e-9 || stddev > 1e-6 {
+		t.Fatal(mean, stddev)
+	}
+}
+
+func TestFilterMotionAdaptive(t *testing.T) {
+	mo := motionOptions{yThreshold: 1, adaptiveK: 10, adaptiveWindow: time.Minute, motionExpiration: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan yLevel)
+	events := make(chan motionEvent, 10)
+	m := &metrics{}
+	go func() {
+		_ = filterMotion(ctx, &mo, m, nil, ch, nil, events, make(chan struct{}, 1))
+	}()
+	t0 := time.Now()
+	i := 0
+	send := func(yavg float32) {
+		ch <- yLevel{frame: i, t: t0.Add(time.Duration(i) * 10 * time.Millisecond), yavg: yavg}
+		i++
+	}
+	// A noisy scene: 0.4 and 0.6 alternate so the mean is 0.5 and the stddev
+	// 0.1.
+	for i < adaptiveMinSamples {
+		send(0.4 + 0.2*float32(i%2))
+	}
+	// Above the fixed threshold but not the adaptive one.
+	send(1.2)
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+	send(3)
+	if e := <-events; !e.start || e.yavg != 3 {
+		t.Fatalf("%+v", e)
+	}
+	// The event is sent after the threshold is updated.
+	if got := m.status(time.Now()).Threshold; got <= 1.5 || got >= 3 {
+		t.Fatal(got)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// httpAuth protects the web server. The zero value doesn't require
+// authentication.
+type httpAuth struct {
+	// user and pass enable HTTP Basic authentication.
+	user string
+	pass string
+	// token enables bearer token authentication, either with the
+	// "Authorization: Bearer <token>" header or the "token" query argument for
+	// clients that can't set headers.
+	token string
+}
+
+func (a *httpAuth) enabled() bool {
+	return a.user != "" || a.token != ""
+}
+
+// wrap returns a handler that requires authentication before calling h.
+//
+// /healthz is not protected so it can be used by a supervisor.
+func (a *httpAuth) wrap(h http.Handler) http.Handler {
+	if !a.enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/healthz" || a.check(req) {
+			h.ServeHTTP(w, req)
+			return
+		}
+		slog.Warn("http", "remote", req.RemoteAddr, "path", req.URL.Path, "msg", "unauthorized")
+		if a.user != "" {
+			w.Header().Add("WWW-Authenticate", `Basic realm="record-videos", charset="UTF-8"`)
+		}
+		if a.token != "" {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="record-videos"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// check returns true if the request has valid credentials.
+func (a *httpAuth) check(req *http.Request) bool {
+	if a.user != "" {
+		if u, p, ok := req.BasicAuth(); ok && secureEqual(u, a.user) && secureEqual(p, a.pass) {
+			return true
+		}
+	}
+	if a.token != "" {
+		if t, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok && secureEqual(t, a.token) {
+			return true
+		}
+		if t := req.URL.Query().Get("token"); t != "" && secureEqual(t, a.token) {
+			return true
+		}
+	}
+	return false
+}
+
+// secureEqual compares a and b in constant time. The values are hashed first
+// so their length is not leaked either.
+func secureEqual(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
@@ -0,0 +1,49 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	a := httpAuth{user: "user", pass: "pass", token: "secret"}
+	h := a.wrap(ok)
+	data := []struct {
+		path  string
+		setup func(req *http.Request)
+		want  int
+	}{
+		{"/list", func(req *http.Request) {}, 401},
+		{"/healthz", func(req *http.Request) {}, 200},
+		{"/list", func(req *http.Request) { req.SetBasicAuth("user", "pass") }, 200},
+		{"/list", func(req *http.Request) { req.SetBasicAuth("user", "wrong") }, 401},
+		{"/list", func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") }, 200},
+		{"/list", func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") }, 401},
+		{"/mpjpeg?token=secret", func(req *http.Request) {}, 200},
+	}
+	for i, l := range data {
+		req := httptest.NewRequest("GET", l.path, nil)
+		l.setup(req)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != l.want {
+			t.Errorf("#%d: got %d, want %d", i, w.Code, l.want)
+		}
+		if w.Code == 401 && len(w.Header().Values("WWW-Authenticate")) != 2 {
+			t.Errorf("#%d: %q", i, w.Header().Values("WWW-Authenticate"))
+		}
+	}
+	// Disabled.
+	a = httpAuth{}
+	w := httptest.NewRecorder()
+	a.wrap(ok).ServeHTTP(w, httptest.NewRequest("GET", "/list", nil))
+	if w.Code != 200 {
+		t.Fatal(w.Code)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"strconv"
+)
+
+// The bounding box of the motion is computed by ffmpeg but drawbox can't use
+// per-frame metadata, so it is drawn on the MJPEG frames instead. It is only
+// done in the debug styles. The box is only on the MJPEG stream and the
+// snapshots taken from it: the recordings, the clips and the pre-roll, which
+// is read from its own ffmpeg output, are not affected.
+
+// bboxMinVal is the minimum luminance of the edges considered as motion for
+// the bounding box. The edges of the noise are darker.
+const bboxMinVal = 64
+
+// motionBBox computes the bounding box of the motion on the edge detected
+// frames and prints it to pipe #3, before YAVG.
+var motionBBox = chain{
+	filter("bbox=min_val=" + strconv.Itoa(bboxMinVal)),
+	"metadata=print:key=lavfi.bbox.x1:file='pipe\\:3':direct=1",
+	"metadata=print:key=lavfi.bbox.y1:file='pipe\\:3':direct=1",
+	"metadata=print:key=lavfi.bbox.x2:file='pipe\\:3':direct=1",
+	"metadata=print:key=lavfi.bbox.y2:file='pipe\\:3':direct=1",
+}
+
+// bboxStyles is the styles where the motion bounding box is drawn, with the
+// number of side by side panels showing the frame.
+var bboxStyles = map[style]int{"motion_only": 1, "overlay": 1, "both": 2}
+
+// motionBoxDecorator returns a teeMimePart decorator drawing the bounding box
+// of the motion recorded in m. It is red when the motion level is above the
+// threshold, yellow otherwise.
+func motionBoxDecorator(m *metrics, w, h, panels int) func([]byte) []byte {
+	return func(b []byte) []byte {
+		c := color.RGBA{255, 255, 0, 255}
+		if m.yavg() >= math.Float32frombits(m.threshold.Load()) {
+			c = color.RGBA{255, 0, 0, 255}
+		}
+		return drawMotionBox(b, m.motionBox(), w, h, panels, c)
+	}
+}
+
+// drawMotionBox draws box, in the coordinates of the motion image of size
+// (w, h), on each panel of the JPEG frame b. It returns b unmodified on
+// failure.
+func drawMotionBox(b []byte, box image.Rectangle, w, h, panels int, c color.Color) []byte {
+	if box.Empty() || w <= 0 || h <= 0 || panels <= 0 {
+		return b
+	}
+	src, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		return b
+	}
+	bounds := src.Bounds()
+	img := image.NewRGBA(bounds)
+	draw.Draw(img, bounds, src, bounds.Min, draw.Src)
+	pw := bounds.Dx() / panels
+	// Scale to the frame, which is larger than the motion image and may be
+	// downscaled with -mjpeg-scale.
+	thickness := max(2, bounds.Dy()/240)
+	for i := 0; i < panels; i++ {
+		r := image.Rect(
+			bounds.Min.X+i*pw+box.Min.X*pw/w,
+			bounds.Min.Y+box.Min.Y*bounds.Dy()/h,
+			bounds.Min.X+i*pw+box.Max.X*pw/w,
+			bounds.Min.Y+box.Max.Y*bounds.Dy()/h,
+		)
+		strokeRect(img, r, thickness, c)
+	}
+	out := bytes.Buffer{}
+	if err = jpeg.Encode(&out, img, &jpeg.Options{Quality: 85}); err != nil {
+		return b
+	}
+	return out.Bytes()
+}
+
+// strokeRect draws the outline of r on img.
+func strokeRect(img draw.Image, r image.Rectangle, thickness int, c color.Color) {
+	u := image.NewUniform(c)
+	t := thickness
+	for _, side := range []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+t),
+		image.Rect(r.Min.X, r.Max.Y-t, r.Max.X, r.Max.Y),
+		image.Rect(r.Min.X, r.Min.Y, r.Min.X+t, r.Max.Y),
+		image.Rect(r.Max.X-t, r.Min.Y, r.Max.X, r.Max.Y),
+	} {
+		draw.Draw(img, side.Intersect(img.Bounds()), u, image.Point{}, draw.Src)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+func TestMotionBBoxStyles(t *testing.T) {
+	for _, s := range validStyles {
+		got := constructFilterGraph(&ffmpegOptions{s: s, w: 640, h: 480}).String()
+		if want := bboxStyles[s] != 0; strings.Contains(got, "bbox=") != want {
+			t.Fatalf("%s: %q", s, got)
+		}
+	}
+}
+
+func TestProcessMetadataBBox(t *testing.T) {
+	in := "frame:1    pts:1       pts_time:0.1\n" +
+		"lavfi.bbox.x1=10\n" +
+		"frame:1    pts:1       pts_time:0.1\n" +
+		"lavfi.bbox.y1=20\n" +
+		"frame:1    pts:1       pts_time:0.1\n" +
+		"lavfi.bbox.x2=29\n" +
+		"frame:1    pts:1       pts_time:0.1\n" +
+		"lavfi.bbox.y2=39\n" +
+		"frame:1    pts:1       pts_time:0.1\n" +
+		"lavfi.signalstats.YAVG=1.5\n"
+	ch := make(chan yLevel, 10)
+	m := &metrics{}
+	if err := processMetadata(context.Background(), &ptsBase{}, m, 0, strings.NewReader(in), ch); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.motionBox(), image.Rect(10, 20, 30, 40); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// A frame without motion clears it.
+	in = "frame:2    pts:2       pts_time:0.2\n" +
+		"lavfi.signalstats.YAVG=0\n"
+	if err := processMetadata(context.Background(), &ptsBase{}, m, 0, strings.NewReader(in), ch); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.motionBox(); !got.Empty() {
+		t.Fatal(got)
+	}
+}
+
+func TestDrawMotionBox(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	red := color.RGBA{255, 0, 0, 255}
+	// The motion image is 50x25 and the frame has two panels of 100x100.
+	out := drawMotionBox(buf.Bytes(), image.Rect(10, 5, 20, 15), 50, 25, 2, red)
+	img, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	isRed := func(x, y int) bool {
+		r, g, b, _ := img.At(x, y).RGBA()
+		return r > 0xC000 && g < 0x4000 && b < 0x4000
+	}
+	// Top left corner in each panel, the center stays black.
+	for _, p := range []image.Point{{20, 20}, {120, 20}, {38, 58}, {138, 58}} {
+		if !isRed(p.X, p.Y) {
+			t.Fatalf("%v is not red", p)
+		}
+	}
+	if isRed(30, 40) || isRed(130, 40) {
+		t.Fatal("the inside is not empty")
+	}
+	// Nothing to draw.
+	if got := drawMotionBox(buf.Bytes(), image.Rectangle{}, 50, 25, 1, red); !bytes.Equal(got, buf.Bytes()) {
+		t.Fatal("unexpected change")
+	}
+}
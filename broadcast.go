@@ -0,0 +1,58 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// eventBroadcaster fans out the motion events to the /events clients.
+//
+// A slow client misses events instead of blocking the others.
+type eventBroadcaster struct {
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+// subscribe returns a channel receiving the events published from now on.
+//
+// The channel is closed and unregistered when ctx is canceled.
+func (e *eventBroadcaster) subscribe(ctx context.Context) <-chan []byte {
+	ch := make(chan []byte, 16)
+	e.mu.Lock()
+	if e.subs == nil {
+		e.subs = map[chan []byte]struct{}{}
+	}
+	e.subs[ch] = struct{}{}
+	e.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		e.mu.Lock()
+		delete(e.subs, ch)
+		e.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+// publish sends b to all the subscribers. It doesn't block.
+func (e *eventBroadcaster) publish(b []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for ch := range e.subs {
+		select {
+		case ch <- b:
+		default:
+		}
+	}
+}
+
+// active returns true if there's at least one subscriber.
+func (e *eventBroadcaster) active() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.subs) != 0
+}
@@ -0,0 +1,42 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestEventBroadcaster(t *testing.T) {
+	e := eventBroadcaster{}
+	// Not received by anyone.
+	e.publish([]byte("0"))
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	ch1 := e.subscribe(ctx1)
+	ch2 := e.subscribe(ctx2)
+	e.publish([]byte("1"))
+	if got := string(<-ch1); got != "1" {
+		t.Fatal(got)
+	}
+	if got := string(<-ch2); got != "1" {
+		t.Fatal(got)
+	}
+	cancel1()
+	if _, ok := <-ch1; ok {
+		t.Fatal("expected closed channel")
+	}
+	e.publish([]byte("2"))
+	if got := string(<-ch2); got != "2" {
+		t.Fatal(got)
+	}
+	e.mu.Lock()
+	n := len(e.subs)
+	e.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("got %d subscribers", n)
+	}
+}
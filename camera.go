@@ -0,0 +1,272 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// sources is a list of video sources, specified by repeating the flag.
+type sources []string
+
+func (s *sources) Set(v string) error {
+	if v == "" {
+		return errors.New("empty source")
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *sources) String() string {
+	return strings.Join(*s, ", ")
+}
+
+// cameraOptions is the configuration of one camera.
+type cameraOptions struct {
+	// root is the directory to store the camera's recordings into.
+	root string
+	fo   *ffmpegOptions
+	mo   *motionOptions
+}
+
+// newCameras returns the options of each camera in cfgs, using fo and mo as
+// the template.
+//
+// A single unnamed camera records directly in root. Otherwise each camera
+// records in its own subdirectory of root named after its name or its index,
+// e.g. "cam1", and its name and MQTT topic are suffixed with it. The settings
+// of cfgs override the template's.
+//
+// telegramToken is used for the cameras with their own Telegram chat.
+func newCameras(root string, cfgs []cameraConfig, fo *ffmpegOptions, mo *motionOptions, telegramToken string) ([]*cameraOptions, error) {
+	if len(cfgs) > 1 && fo.outputPipe != "" {
+		return nil, errors.New("-output-pipe can't be used with multiple cameras")
+	}
+	ids := map[string]bool{}
+	roots := map[string]bool{}
+	srcs := map[string]bool{}
+	out := make([]*cameraOptions, len(cfgs))
+	for i, cfg := range cfgs {
+		id := cfg.name
+		if id == "" {
+			id = "cam" + strconv.Itoa(i)
+		}
+		c := &cameraOptions{root: root, fo: fo, mo: mo}
+		named := len(cfgs) > 1 || cfg.name != ""
+		if named {
+			c.root = filepath.Join(root, id)
+			c.fo = &ffmpegOptions{}
+			c.mo = &motionOptions{}
+			*c.fo = *fo
+			*c.mo = *mo
+			name := id
+			if fo.name != "" {
+				name = fo.name + " " + id
+			}
+			c.fo.name = name
+			c.mo.name = name
+			if mo.preroll != nil {
+				c.mo.preroll = &frameRing{maxAge: mo.preroll.maxAge}
+			}
+			if m := mo.smtp; m != nil {
+				// Each camera is throttled independently.
+				c.mo.smtp = &smtpMailer{addr: m.addr, from: m.from, to: m.to, user: m.user, password: m.password, interval: m.interval}
+			}
+		}
+		if cfg.root != "" {
+			c.root = cfg.root
+			if !filepath.IsAbs(c.root) {
+				c.root = filepath.Join(root, c.root)
+			}
+		}
+		c.root = filepath.Clean(c.root)
+		if ids[id] {
+			return nil, fmt.Errorf("camera %q: duplicate name", id)
+		}
+		if roots[c.root] {
+			return nil, fmt.Errorf("camera %q: root %q is used by another camera", id, c.root)
+		}
+		if srcs[cfg.src] {
+			return nil, fmt.Errorf("camera %q: src %q is used by another camera", id, cfg.src)
+		}
+		ids[id] = true
+		roots[c.root] = true
+		srcs[cfg.src] = true
+		if c.root != root {
+			if err := os.MkdirAll(c.root, 0o755); err != nil {
+				return nil, err
+			}
+		}
+		c.fo.src = cfg.src
+		if err := c.configure(&cfg, id, named, mo, telegramToken); err != nil {
+			return nil, fmt.Errorf("camera %q: %w", id, err)
+		}
+		out[i] = c
+	}
+	return out, nil
+}
+
+// configure applies the camera specific settings of cfg.
+//
+// mo is the template; the MQTT client of a named camera gets its own topic.
+func (c *cameraOptions) configure(cfg *cameraConfig, id string, named bool, mo *motionOptions, telegramToken string) error {
+	if cfg.mask != "" {
+		c.fo.mask = cfg.mask
+		c.mo.maskCoverage = float32(cfg.coverage)
+	}
+	if cfg.yavg != 0 {
+		c.mo.yThreshold = float32(cfg.yavg)
+	}
+	if cfg.style != "" {
+		c.fo.s = cfg.style
+	}
+	if len(cfg.webhooks) != 0 {
+		c.mo.webhooks = cfg.webhooks
+	}
+	if cfg.discord != "" {
+		c.mo.discord = cfg.discord
+	}
+	if cfg.smtpTo != "" {
+		m := mo.smtp
+		if m == nil {
+			return errors.New("smtp-to requires -smtp-host")
+		}
+		var err error
+		if c.mo.smtp, err = newSMTPMailer(m.addr, m.from, cfg.smtpTo, m.user, m.password, m.interval); err != nil {
+			return err
+		}
+	}
+	if cfg.telegramChat != "" {
+		if telegramToken == "" {
+			return errors.New("telegram-chat requires -telegram-token")
+		}
+		c.mo.telegram = &telegramBot{token: telegramToken, chat: cfg.telegramChat}
+	}
+	m := mo.mqtt
+	if m == nil {
+		if cfg.mqttTopic != "" {
+			return errors.New("mqtt-topic requires -mqtt-broker")
+		}
+		return nil
+	}
+	if !named && cfg.mqttTopic == "" {
+		return nil
+	}
+	topic := m.topic
+	clientID := m.clientID
+	if named {
+		topic += "/" + id
+		// A broker disconnects the previous client when a client ID is reused.
+		clientID += "-" + id
+	}
+	if cfg.mqttTopic != "" {
+		topic = cfg.mqttTopic
+	}
+	var err error
+	c.mo.mqtt, err = newMQTTClient(m.broker, topic, m.user, m.password, clientID)
+	return err
+}
+
+// runCamera runs the recording and motion detection pipeline of a camera
+// until ctx is canceled or ffmpeg exits with -d.
+//
+// cs is the camera's state shared with the web server. Its tm and eb are
+// optional.
+func runCamera(ctx context.Context, c *cameraOptions, cs *camera, ro *runOptions) error {
+	fo, mo, root, m, tm := c.fo, c.mo, c.root, cs.met, cs.tm
+	ffmpegLog := ro.ffmpegLog
+	args, err := buildFFMPEGCmd(fo)
+	if err != nil {
+		return err
+	}
+	if l, ok := ffmpegLog.(*logWriter); ok {
+		// Count the errors of this camera's ffmpeg.
+		ffmpegLog = &logWriter{name: l.name, level: l.level, errors: &m.ffmpegErrors}
+	}
+	ffmpegLog = &frameRateWatcher{w: ffmpegLog, fps: fo.fps, m: m}
+	var outputPipe *os.File
+	if fo.outputPipe != "" {
+		// Opening a named pipe blocks until there's a reader.
+		slog.Info("output-pipe", "msg", "opening", "p", fo.outputPipe)
+		// #nosec G304
+		if outputPipe, err = os.OpenFile(fo.outputPipe, os.O_WRONLY|os.O_CREATE, 0o644); err != nil {
+			return err
+		}
+		defer func() {
+			if err2 := outputPipe.Close(); err2 != nil {
+				slog.Error("output-pipe", "err", err2)
+			}
+		}()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eg, ctx := errgroup.WithContext(ctx)
+
+	var hist *yavgHistory
+	if ro.vtt {
+		// Keep enough to cover a long event.
+		hist = &yavgHistory{maxAge: 30 * time.Minute}
+	}
+	ch := make(chan yLevel, 10)
+	events := make(chan motionEvent, 10)
+	// stalled is also signaled by POST /mask.
+	stalled := cs.restart
+	if stalled == nil {
+		stalled = make(chan struct{}, 1)
+	}
+	eg.Go(func() error {
+		defer close(events)
+		err2 := filterMotion(ctx, mo, m, hist, ch, cs.trigger, events, stalled)
+		slog.Info("filterMotion", "msg", "exit", "err", err2)
+		return err2
+	})
+	eg.Go(func() error {
+		// Stop the camera once the pipeline is done, e.g. with -d.
+		defer cancel()
+		err2 := processMotion(ctx, mo, m, root, hist, tm, cs.eb, events)
+		slog.Info("processMotion", "msg", "exit", "err", err2)
+		return err2
+	})
+	eg.Go(func() error {
+		// Transparently restart ffmpeg when network or USB goes down as long as
+		// the context is not canceled.
+		defer close(ch)
+		const maxBackoff = 30 * time.Second
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			started := time.Now()
+			err2 := runFFMPEG(ctx, root, args, outputPipe, ffmpegLog, tm, mo.preroll, m, ch, stalled)
+			slog.Info("ffmpeg", "msg", "exit", "attempt", attempt, "err", err2)
+			if ctx.Err() != nil || fo.d > 0 || isFileSource(fo.src) {
+				// ffmpeg always return an error, so ignore it. A video file is
+				// processed only once.
+				return nil
+			}
+			if time.Since(started) > time.Minute {
+				// It was working fine for a while, retry promptly.
+				backoff = time.Second
+			}
+			slog.Warn("ffmpeg", "msg", "restarting", "attempt", attempt+1, "in", backoff)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(backoff):
+			}
+			m.ffmpegRestarts.Add(1)
+			backoff = min(2*backoff, maxBackoff)
+		}
+	})
+	return eg.Wait()
+}
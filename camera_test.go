@@ -0,0 +1,144 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewCameras(t *testing.T) {
+	root := t.TempDir()
+	fo := &ffmpegOptions{name: "home"}
+	mo := &motionOptions{name: "home", preroll: &frameRing{maxAge: time.Second}}
+	cams, err := newCameras(root, []cameraConfig{{src: "/dev/video0"}}, fo, mo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cams) != 1 || cams[0].root != root || cams[0].fo != fo || fo.src != "/dev/video0" {
+		t.Fatalf("%+v", cams[0])
+	}
+
+	mqtt, err := newMQTTClient("tcp://localhost", "record-videos/motion", "", "", "record-videos-host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mo.mqtt = mqtt
+	if cams, err = newCameras(root, []cameraConfig{{src: "/dev/video0"}, {src: "/dev/video2"}}, fo, mo, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(cams) != 2 {
+		t.Fatal(len(cams))
+	}
+	c := cams[1]
+	if c.root != filepath.Join(root, "cam1") || c.fo.src != "/dev/video2" || c.fo.name != "home cam1" || c.mo.name != "home cam1" {
+		t.Fatalf("%+v", c)
+	}
+	if c.mo.preroll == mo.preroll || c.mo.preroll == cams[0].mo.preroll || c.mo.preroll.maxAge != time.Second {
+		t.Fatal("the pre-roll buffer must not be shared")
+	}
+	if c.mo.mqtt.topic != "record-videos/motion/cam1" || c.mo.mqtt.clientID != "record-videos-host-cam1" {
+		t.Fatalf("%+v", c.mo.mqtt)
+	}
+	if fi, err := os.Stat(c.root); err != nil || !fi.IsDir() {
+		t.Fatal(err)
+	}
+	// The template is not modified.
+	if fo.src != "/dev/video0" || fo.name != "home" {
+		t.Fatalf("%+v", fo)
+	}
+
+	fo.outputPipe = "fifo"
+	if _, err = newCameras(root, []cameraConfig{{src: "a"}, {src: "b"}}, fo, mo, ""); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestNewCamerasConfig(t *testing.T) {
+	root := t.TempDir()
+	fo := &ffmpegOptions{mask: "all.png", s: "normal"}
+	mo := &motionOptions{yThreshold: 1, webhooks: webhooks{"https://example.com/all"}}
+	mqtt, err := newMQTTClient("tcp://localhost", "record-videos/motion", "", "", "record-videos-host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mo.mqtt = mqtt
+	if mo.smtp, err = newSMTPMailer("smtp.example.com", "cam@example.com", "all@example.com", "", "", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	cfgs := []cameraConfig{
+		{
+			name:         "door",
+			src:          "/dev/video0",
+			mask:         "door.png",
+			coverage:     0.5,
+			yavg:         2.5,
+			style:        "motion_only",
+			webhooks:     webhooks{"https://example.com/door"},
+			mqttTopic:    "home/door",
+			smtpTo:       "door@example.com",
+			telegramChat: "-100",
+		},
+		{src: "/dev/video2", root: filepath.Join(root, "other", "garage")},
+	}
+	cams, err := newCameras(root, cfgs, fo, mo, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cams[0]
+	if c.root != filepath.Join(root, "door") || c.fo.name != "door" || c.fo.mask != "door.png" || c.fo.s != "motion_only" {
+		t.Fatalf("%+v", c.fo)
+	}
+	if c.mo.yThreshold != 2.5 || c.mo.maskCoverage != 0.5 || !slices.Equal(c.mo.webhooks, webhooks{"https://example.com/door"}) {
+		t.Fatalf("%+v", c.mo)
+	}
+	if c.mo.mqtt.topic != "home/door" || c.mo.mqtt.clientID != "record-videos-host-door" {
+		t.Fatalf("%+v", c.mo.mqtt)
+	}
+	if !slices.Equal(c.mo.smtp.to, []string{"door@example.com"}) || c.mo.telegram == nil || c.mo.telegram.chat != "-100" {
+		t.Fatalf("%+v", c.mo)
+	}
+	c = cams[1]
+	if c.root != filepath.Join(root, "other", "garage") || c.fo.name != "cam1" || c.fo.mask != "all.png" || c.mo.yThreshold != 1 || !slices.Equal(c.mo.webhooks, webhooks{"https://example.com/all"}) {
+		t.Fatalf("%+v", c)
+	}
+	if c.mo.mqtt.topic != "record-videos/motion/cam1" || c.mo.telegram != nil || !slices.Equal(c.mo.smtp.to, []string{"all@example.com"}) {
+		t.Fatalf("%+v", c.mo)
+	}
+	if fi, err := os.Stat(c.root); err != nil || !fi.IsDir() {
+		t.Fatal(err)
+	}
+	// The template is not modified.
+	if fo.mask != "all.png" || mo.yThreshold != 1 || mo.mqtt.topic != "record-videos/motion" {
+		t.Fatalf("%+v", fo)
+	}
+
+	for _, bad := range []struct {
+		cfgs []cameraConfig
+		want string
+	}{
+		{[]cameraConfig{{name: "a", src: "1"}, {name: "a", src: "2"}}, "duplicate name"},
+		{[]cameraConfig{{src: "1"}, {src: "1"}}, "src"},
+		{[]cameraConfig{{src: "1", root: "x"}, {src: "2", root: "x"}}, "root"},
+		{[]cameraConfig{{name: "a", src: "1"}, {src: "2", root: "a"}}, "root"},
+		{[]cameraConfig{{src: "1", telegramChat: "1"}}, "-telegram-token"},
+	} {
+		if _, err := newCameras(root, bad.cfgs, fo, mo, ""); err == nil || !strings.Contains(err.Error(), bad.want) {
+			t.Errorf("%+v: %v", bad.cfgs, err)
+		}
+	}
+	mo.mqtt = nil
+	mo.smtp = nil
+	if _, err = newCameras(root, []cameraConfig{{src: "1", mqttTopic: "a"}}, fo, mo, ""); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = newCameras(root, []cameraConfig{{src: "1", smtpTo: "a@example.com"}}, fo, mo, ""); err == nil {
+		t.Fatal("expected error")
+	}
+}
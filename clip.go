@@ -0,0 +1,174 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// clipMode determines how a motion clip is cut out of the continuous
+// recording.
+type clipMode string
+
+func (c *clipMode) Set(v string) error {
+	options := ""
+	for i, x := range validClipModes {
+		if v == string(x) {
+			*c = x
+			return nil
+		}
+		if i != 0 {
+			options += ", "
+		}
+		options += string(x)
+	}
+	return errors.New("invalid clip mode. Supported values are: " + options)
+}
+
+func (c *clipMode) String() string {
+	return string(*c)
+}
+
+// validClipModes is the valid clip mode values for buildClipCmd.
+//
+// "copy" is fast and uses nearly no CPU but the clip can only start on a
+// keyframe, so it may include a few extra seconds before the event.
+//
+// "precise" re-encodes the clip with the same encoder settings as the
+// recording so it starts and ends exactly on the requested bounds. It costs
+// about as much CPU as the live encoding for the duration of the clip.
+var validClipModes = []clipMode{"copy", "precise"}
+
+// buildClipCmd builds the command line to exec ffmpeg to extract [start, end]
+// out of the segments files into dst.
+//
+// files must be sorted and the first one must start at or before start. enc is
+// the video encoder arguments used by the "precise" mode, as returned by
+// ffmpegOptions.videoEncoderArgs.
+func buildClipCmd(files []string, start, end time.Time, mode clipMode, enc []string, dst string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no segment to extract from")
+	}
+	first, err := fileTime(files[0])
+	if err != nil {
+		return nil, err
+	}
+	offset := start.Sub(first)
+	if offset < 0 {
+		offset = 0
+	}
+	args := []string{
+		"ffmpeg",
+		"-hide_banner",
+		"-nostats",
+		"-loglevel", "repeat+warning",
+		"-y",
+		// Input seeking: with stream copy it snaps to the keyframe preceding the
+		// offset. When re-encoding, frames before the offset are decoded and
+		// discarded so the cut is frame accurate.
+		"-ss", fmt.Sprintf("%.3f", offset.Seconds()),
+		"-i", "concat:" + strings.Join(files, "|"),
+		"-t", fmt.Sprintf("%.3f", end.Sub(start).Seconds()),
+	}
+	switch mode {
+	case "copy":
+		args = append(args, "-c", "copy")
+	case "precise":
+		if len(enc) == 0 {
+			return nil, errors.New("the precise clip mode requires the encoder arguments")
+		}
+		args = append(args, enc...)
+		args = append(args, "-c:a", "copy")
+	default:
+		return nil, errors.New("unknown clip mode " + string(mode))
+	}
+	return append(args, "-movflags", "+faststart", dst), nil
+}
+
+// playlistSegments returns the segments listed in the motion playlist name in
+// root, sorted.
+func playlistSegments(root, name string) ([]string, error) {
+	// #nosec G304
+	f, err := os.Open(filepath.Join(root, name))
+	if err != nil {
+		return nil, err
+	}
+	durations, err := parseM3U8(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, err
+	}
+	// The names are sortable.
+	return slices.Sorted(maps.Keys(durations)), nil
+}
+
+// buildClipStreamCmd builds the command line to exec ffmpeg to mux the
+// segments files into a fragmented MP4 written to stdout.
+//
+// A regular MP4 can't be streamed since its index is written at the end.
+func buildClipStreamCmd(files []string) []string {
+	return []string{
+		"ffmpeg",
+		"-hide_banner",
+		"-nostats",
+		"-loglevel", "repeat+warning",
+		"-i", "concat:" + strings.Join(files, "|"),
+		"-c", "copy",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-f", "mp4",
+		"pipe:1",
+	}
+}
+
+// clipSegments returns the segments in root covering [start, end], sorted.
+// The first one starts at or before start.
+func clipSegments(root string, start, end time.Time) ([]string, error) {
+	// A segment can be up to 30s long, see generateMotionRecording.
+	files, err := findTSFiles(root, start.Add(-30*time.Second), end)
+	if err != nil {
+		return nil, err
+	}
+	// Skip the segments that end before start.
+	for len(files) > 1 {
+		next, err := fileTime(files[1])
+		if err != nil {
+			return nil, err
+		}
+		if next.After(start) {
+			break
+		}
+		files = files[1:]
+	}
+	return files, nil
+}
+
+// generateClip muxes the segments covering [start, end] into a MP4 file named
+// after t.
+//
+// Segments do not align with the event bounds. With the "copy" mode, the clip
+// starts on the keyframe preceding start so it can include a few more seconds.
+func generateClip(ctx context.Context, root string, t, start, end time.Time, mode clipMode, enc []string) error {
+	files, err := clipSegments(root, start, end)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	name := t.Format("2006-01-02T15-04-05") + ".mp4"
+	err = ffmpegToFile(ctx, root, name, nil, func(dst string) ([]string, error) {
+		return buildClipCmd(files, start, end, mode, enc, dst)
+	})
+	if err == nil {
+		slog.Info("clip", "name", name, "segments", len(files))
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBuildClipCmd(t *testing.T) {
+	files := []string{"2024-01-02T03-04-00.ts", "2024-01-02T03-04-04.ts"}
+	start := time.Date(2024, 1, 2, 3, 4, 2, 0, time.Local)
+	end := start.Add(5 * time.Second)
+	// The precise mode re-encodes like the recording.
+	o := ffmpegOptions{codec: "libx265", crf: 28, preset: "slow"}
+	enc, err := o.videoEncoderArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := []string{
+		"ffmpeg", "-hide_banner", "-nostats", "-loglevel", "repeat+warning", "-y",
+		"-ss", "2.000",
+		"-i", "concat:2024-01-02T03-04-00.ts|2024-01-02T03-04-04.ts",
+		"-t", "5.000",
+	}
+	data := []struct {
+		mode clipMode
+		enc  []string
+		want []string
+	}{
+		{"copy", nil, []string{"-c", "copy"}},
+		{"copy", enc, []string{"-c", "copy"}},
+		{"precise", enc, []string{"-c:v", "libx265", "-preset", "slow", "-crf", "28", "-c:a", "copy"}},
+	}
+	for i, l := range data {
+		got, err := buildClipCmd(files, start, end, l.mode, l.enc, "out.mp4")
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		want := slices.Concat(prefix, l.want, []string{"-movflags", "+faststart", "out.mp4"})
+		if !slices.Equal(got, want) {
+			t.Fatalf("#%d: got  %q\nwant %q", i, got, want)
+		}
+	}
+	for i, l := range []struct {
+		files []string
+		mode  clipMode
+		enc   []string
+	}{
+		{files, "precise", nil},
+		{files, "bad", enc},
+		{nil, "copy", nil},
+	} {
+		if _, err = buildClipCmd(l.files, start, end, l.mode, l.enc, "out.mp4"); err == nil {
+			t.Fatalf("#%d: expected error", i)
+		}
+	}
+}
+
+func TestPlaylistSegments(t *testing.T) {
+	root := t.TempDir()
+	data := "#EXTM3U\n" +
+		"#EXTINF:4.000000,\n2024-01-01T00-00-04.ts\n" +
+		"#EXTINF:4.000000,\n2024-01-01T00-00-00.ts\n"
+	if err := os.WriteFile(filepath.Join(root, "2024-01-01T00-00-00.m3u8"), []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	files, err := playlistSegments(root, "2024-01-01T00-00-00.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"2024-01-01T00-00-00.ts", "2024-01-01T00-00-04.ts"}; !slices.Equal(files, want) {
+		t.Fatalf("got %q", files)
+	}
+	args := buildClipStreamCmd(files)
+	if i := slices.Index(args, "-i"); i == -1 || args[i+1] != "concat:2024-01-01T00-00-00.ts|2024-01-01T00-00-04.ts" {
+		t.Fatalf("unexpected args: %q", args)
+	}
+	if args[len(args)-1] != "pipe:1" {
+		t.Fatalf("unexpected args: %q", args)
+	}
+}
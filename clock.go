@@ -0,0 +1,201 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// maxClockSkew is the maximum difference with the NTP server before the clock
+// is considered unsynchronized.
+const maxClockSkew = 2 * time.Second
+
+// ntpEpochOffset is the number of seconds between 1900 and 1970.
+const ntpEpochOffset = 2208988800
+
+// sntpOffset queries a NTP server and returns the local clock offset. A
+// positive value means the local clock is behind.
+//
+// It implements the client side of SNTPv4 as described in RFC 4330.
+func sntpOffset(ctx context.Context, server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		return 0, err
+	}
+	req := make([]byte, 48)
+	// LI=0, VN=4, Mode=3 (client).
+	req[0] = 0x23
+	t1 := time.Now()
+	if _, err = conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return 0, err
+	}
+	return parseSNTPResponse(resp[:n], t1, time.Now())
+}
+
+// parseSNTPResponse returns the local clock offset from a server response. t1
+// and t4 are the local times the request was sent and the response received.
+func parseSNTPResponse(resp []byte, t1, t4 time.Time) (time.Duration, error) {
+	if len(resp) < 48 || resp[0]&7 != 4 {
+		return 0, errors.New("unexpected NTP response")
+	}
+	t2 := ntpTime(resp[32:40])
+	t3 := ntpTime(resp[40:48])
+	return (t2.Sub(t1) + t3.Sub(t4)) / 2, nil
+}
+
+// ntpTime decodes a 64 bits NTP timestamp.
+func ntpTime(b []byte) time.Time {
+	sec := int64(binary.BigEndian.Uint32(b[:4])) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:])) * int64(time.Second) >> 32
+	return time.Unix(sec, frac)
+}
+
+// clockSynced returns true if the system clock appears to be synchronized.
+//
+// When ntpServer is set, the local clock is compared against it. Otherwise on
+// linux, systemd-timesyncd's status is used. The result is only a best guess
+// on other OSes.
+func clockSynced(ctx context.Context, ntpServer string) (bool, error) {
+	// No recording can legitimately happen before this project was written.
+	if time.Now().Year() < 2024 {
+		return false, nil
+	}
+	if ntpServer != "" {
+		offset, err := sntpOffset(ctx, ntpServer)
+		if err != nil {
+			return false, err
+		}
+		if offset > maxClockSkew || offset < -maxClockSkew {
+			slog.Warn("clock", "server", ntpServer, "offset", offset)
+			return false, nil
+		}
+		return true, nil
+	}
+	if runtime.GOOS == "linux" {
+		out, err := exec.CommandContext(ctx, "timedatectl", "show", "-p", "NTPSynchronized", "--value").Output()
+		if err != nil {
+			return false, err
+		}
+		return parseTimedatectl(out)
+	}
+	return true, nil
+}
+
+// parseTimedatectl parses the output of
+// "timedatectl show -p NTPSynchronized --value".
+func parseTimedatectl(out []byte) (bool, error) {
+	switch v := string(bytes.TrimSpace(out)); v {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected timedatectl output %q", v)
+	}
+}
+
+// clockCheckInterval is how often monitorClock checks the clock.
+const clockCheckInterval = 10 * time.Minute
+
+// clockStatus is the result of the last clock check, shared by the cameras
+// for /status.
+type clockStatus struct {
+	// known is false when the state couldn't be determined.
+	known  atomic.Bool
+	synced atomic.Bool
+}
+
+func (c *clockStatus) set(synced bool, err error) {
+	c.synced.Store(synced)
+	c.known.Store(err == nil)
+}
+
+// get returns nil when the state couldn't be determined.
+func (c *clockStatus) get() *bool {
+	if c == nil || !c.known.Load() {
+		return nil
+	}
+	v := c.synced.Load()
+	return &v
+}
+
+// checkClock warns when the system clock is not synchronized, and optionally
+// waits for up to wait for it to become synchronized. The result is stored in
+// cs.
+func checkClock(ctx context.Context, ntpServer string, wait time.Duration, cs *clockStatus) error {
+	end := time.Now().Add(wait)
+	for {
+		ctx2, cancel := context.WithTimeout(ctx, 5*time.Second)
+		ok, err := clockSynced(ctx2, ntpServer)
+		cancel()
+		cs.set(ok, err)
+		if ok {
+			return nil
+		}
+		if err != nil {
+			slog.Warn("clock", "msg", "can't determine if the clock is synchronized", "err", err)
+		} else {
+			slog.Warn("clock", "msg", "the clock is not synchronized; recordings may be misnamed")
+		}
+		if time.Now().After(end) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// monitorClock checks the clock every clockCheckInterval until ctx is canceled,
+// so /status reflects when the clock gets synchronized after startup. The
+// changes are logged.
+func monitorClock(ctx context.Context, ntpServer string, cs *clockStatus) {
+	t := time.NewTicker(clockCheckInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		ctx2, cancel := context.WithTimeout(ctx, 5*time.Second)
+		ok, err := clockSynced(ctx2, ntpServer)
+		cancel()
+		before := cs.get()
+		cs.set(ok, err)
+		if after := cs.get(); (before == nil) != (after == nil) || (before != nil && *before != *after) {
+			slog.Info("clock", "synchronized", ok, "err", err)
+		}
+	}
+}
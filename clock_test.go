@@ -0,0 +1,128 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// putNTPTime encodes t as a 64 bits NTP timestamp.
+func putNTPTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b[:4], uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:], uint32((int64(t.Nanosecond())<<32)/int64(time.Second)))
+}
+
+// sntpResponse returns a server response with the receive and transmit
+// timestamps t2 and t3.
+func sntpResponse(t2, t3 time.Time) []byte {
+	b := make([]byte, 48)
+	// LI=0, VN=4, Mode=4 (server).
+	b[0] = 0x24
+	putNTPTime(b[32:40], t2)
+	putNTPTime(b[40:48], t3)
+	return b
+}
+
+func TestNTPTime(t *testing.T) {
+	want := time.Date(2024, 1, 2, 3, 4, 5, 500_000_000, time.UTC)
+	b := make([]byte, 8)
+	putNTPTime(b, want)
+	if got := ntpTime(b); got.Sub(want).Abs() > time.Microsecond {
+		t.Fatalf("%s != %s", got, want)
+	}
+	if got := ntpTime(make([]byte, 8)); got.Year() != 1900 {
+		t.Fatal(got)
+	}
+}
+
+func TestParseSNTPResponse(t *testing.T) {
+	t1 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	t4 := t1.Add(100 * time.Millisecond)
+	// The server is 10s ahead and took 20ms to respond.
+	t2 := t1.Add(10*time.Second + 40*time.Millisecond)
+	t3 := t2.Add(20 * time.Millisecond)
+	got, err := parseSNTPResponse(sntpResponse(t2, t3), t1, t4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := got - 10*time.Second; d.Abs() > time.Millisecond {
+		t.Fatal(got)
+	}
+	bad := sntpResponse(t2, t3)
+	// Mode 3 is a client request.
+	bad[0] = 0x23
+	if _, err = parseSNTPResponse(bad, t1, t4); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = parseSNTPResponse(bad[:40], t1, t4); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSNTPOffset(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	go func() {
+		b := make([]byte, 48)
+		_, addr, err2 := c.ReadFrom(b)
+		if err2 != nil {
+			return
+		}
+		now := time.Now().Add(-time.Minute)
+		_, _ = c.WriteTo(sntpResponse(now, now), addr)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, err := sntpOffset(ctx, c.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := got + time.Minute; d.Abs() > time.Second {
+		t.Fatal(got)
+	}
+}
+
+func TestParseTimedatectl(t *testing.T) {
+	if ok, err := parseTimedatectl([]byte("yes\n")); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if ok, err := parseTimedatectl([]byte("no\n")); ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if _, err := parseTimedatectl([]byte("Failed to connect to bus\n")); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestClockStatus(t *testing.T) {
+	var nilStatus *clockStatus
+	if nilStatus.get() != nil {
+		t.Fatal("expected unknown")
+	}
+	c := &clockStatus{}
+	if c.get() != nil {
+		t.Fatal("expected unknown")
+	}
+	c.set(true, nil)
+	if v := c.get(); v == nil || !*v {
+		t.Fatal(v)
+	}
+	c.set(false, errors.New("timedatectl not found"))
+	if c.get() != nil {
+		t.Fatal("expected unknown")
+	}
+	c.set(false, nil)
+	if v := c.get(); v == nil || *v {
+		t.Fatal(v)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig sets the flags of fs that were not specified on the command line
+// from the YAML or JSON file p.
+//
+// The keys are the flag names without the leading dash, e.g. "pre-capture:
+// 10s". The flags that can be repeated, like -src, accept a list. Unknown keys
+// are reported as an error.
+//
+// The "cameras" key is a list of cameras with their own settings, see
+// cameraConfig. It is returned.
+func loadConfig(fs *flag.FlagSet, p string) ([]cameraConfig, error) {
+	// #nosec G304
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("-config: %w", err)
+	}
+	// JSON is a subset of YAML.
+	var cfg map[string]any
+	if err = yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("-config %q: %w", p, err)
+	}
+	var cams []cameraConfig
+	if v, ok := cfg["cameras"]; ok {
+		if cams, err = parseCameras(v); err != nil {
+			return nil, fmt.Errorf("-config %q: %w", p, err)
+		}
+		delete(cfg, "cameras")
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var unknown []string
+	for _, k := range slices.Sorted(maps.Keys(cfg)) {
+		if fs.Lookup(k) == nil || k == "config" {
+			unknown = append(unknown, k)
+			continue
+		}
+		if set[k] {
+			// The command line has precedence.
+			continue
+		}
+		values, ok := cfg[k].([]any)
+		if !ok {
+			values = []any{cfg[k]}
+		}
+		for _, v := range values {
+			s, err := configString(v)
+			if err == nil {
+				err = fs.Set(k, s)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("-config %q: %s: %w", p, k, err)
+			}
+		}
+	}
+	if len(unknown) != 0 {
+		return nil, fmt.Errorf("-config %q: unknown keys: %s", p, strings.Join(unknown, ", "))
+	}
+	return cams, nil
+}
+
+// cameraConfig is an entry of the "cameras" list of the config file.
+//
+// The keys are the names of the flags that can be set per camera, plus
+// "root". The zero values use the flags.
+type cameraConfig struct {
+	// name is the camera name. It is also the name of the camera's
+	// subdirectory and the suffix of its MQTT topic.
+	name string
+	src  string
+	// root is the directory to record into, relative to -root.
+	root         string
+	mask         string
+	yavg         float64
+	style        style
+	webhooks     webhooks
+	discord      discordWebhook
+	mqttTopic    string
+	smtpTo       string
+	telegramChat string
+
+	// coverage is the fraction of the frame not masked by mask, with
+	// -mask-normalize. It is computed by mainImpl.
+	coverage float64
+}
+
+// errUnknownKey is returned by cameraConfig.set for an unsupported key.
+var errUnknownKey = errors.New("unknown key")
+
+// set sets the value of key k.
+func (c *cameraConfig) set(k, v string) error {
+	switch k {
+	case "name":
+		if v == "" || v != filepath.Base(v) || v == "." || v == ".." {
+			return fmt.Errorf("invalid name %q; it must be usable as a directory name", v)
+		}
+		c.name = v
+	case "src":
+		if v == "" {
+			return errors.New("empty source")
+		}
+		c.src = v
+	case "root":
+		c.root = v
+	case "mask":
+		c.mask = v
+	case "yavg":
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		if f <= 0 {
+			return errors.New("must be positive")
+		}
+		c.yavg = f
+	case "style":
+		return c.style.Set(v)
+	case "webhook":
+		return c.webhooks.Set(v)
+	case "discord-webhook":
+		return c.discord.Set(v)
+	case "mqtt-topic":
+		c.mqttTopic = v
+	case "smtp-to":
+		c.smtpTo = v
+	case "telegram-chat":
+		c.telegramChat = v
+	default:
+		return errUnknownKey
+	}
+	return nil
+}
+
+// parseCameras parses the "cameras" list of the config file.
+func parseCameras(v any) ([]cameraConfig, error) {
+	list, ok := v.([]any)
+	if !ok || len(list) == 0 {
+		return nil, errors.New("cameras must be a non-empty list")
+	}
+	out := make([]cameraConfig, len(list))
+	for i, e := range list {
+		m, ok := e.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("cameras #%d: must be a map", i)
+		}
+		var unknown []string
+		for _, k := range slices.Sorted(maps.Keys(m)) {
+			values, ok := m[k].([]any)
+			if !ok {
+				values = []any{m[k]}
+			} else if k != "webhook" {
+				return nil, fmt.Errorf("cameras #%d: %s: must be a single value", i, k)
+			}
+			for _, v := range values {
+				s, err := configString(v)
+				if err == nil {
+					err = out[i].set(k, s)
+				}
+				if errors.Is(err, errUnknownKey) {
+					unknown = append(unknown, k)
+					break
+				}
+				if err != nil {
+					return nil, fmt.Errorf("cameras #%d: %s: %w", i, k, err)
+				}
+			}
+		}
+		if len(unknown) != 0 {
+			return nil, fmt.Errorf("cameras #%d: unknown keys: %s", i, strings.Join(unknown, ", "))
+		}
+		if out[i].src == "" {
+			return nil, fmt.Errorf("cameras #%d: src is required", i)
+		}
+	}
+	return out, nil
+}
+
+// configString returns the flag value of a scalar decoded from the config
+// file.
+func configString(v any) (string, error) {
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return x, nil
+	case bool:
+		return strconv.FormatBool(x), nil
+	case int:
+		return strconv.Itoa(x), nil
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	newFlags := func() (*flag.FlagSet, *sources, *time.Duration, *bool, *float64, *int) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		var srcs sources
+		fs.Var(&srcs, "src", "")
+		return fs, &srcs, fs.Duration("pre-capture", 5*time.Second, ""), fs.Bool("vtt", false, ""), fs.Float64("yavg", 1, ""), fs.Int("fps", 15, "")
+	}
+	dir := t.TempDir()
+	yml := filepath.Join(dir, "config.yaml")
+	data := "# Living room.\nsrc:\n  - /dev/video0\n  - /dev/video2\npre-capture: 10s\nvtt: true\nyavg: 1.5\nfps: 30\n"
+	if err := os.WriteFile(yml, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs, srcs, preCapture, vtt, yavg, fps := newFlags()
+	// The command line has precedence.
+	if err := fs.Parse([]string{"-fps", "10"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(fs, yml); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(*srcs, sources{"/dev/video0", "/dev/video2"}) || *preCapture != 10*time.Second || !*vtt || *yavg != 1.5 || *fps != 10 {
+		t.Fatal(*srcs, *preCapture, *vtt, *yavg, *fps)
+	}
+
+	js := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(js, []byte(`{"src": "/dev/video1", "fps": 5}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs, srcs, _, _, _, fps = newFlags()
+	if _, err := loadConfig(fs, js); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(*srcs, sources{"/dev/video1"}) || *fps != 5 {
+		t.Fatal(*srcs, *fps)
+	}
+
+	for _, bad := range []struct{ data, want string }{
+		{"fps: 5\nfoo: 1\nbar: 2\n", "unknown keys: bar, foo"},
+		{"fps: abc\n", "fps"},
+		{"fps: {a: 1}\n", "unsupported value"},
+		{"config: other.yaml\n", "unknown keys: config"},
+		{"- a\n", "cannot unmarshal"},
+		{"cameras: a\n", "non-empty list"},
+		{"cameras:\n  - name: a\n", "src is required"},
+		{"cameras:\n  - src: a\n    fps: 5\n", "unknown keys: fps"},
+		{"cameras:\n  - src: a\n    name: ../a\n", "invalid name"},
+		{"cameras:\n  - src: a\n    yavg: -1\n", "must be positive"},
+		{"cameras:\n  - src: a\n    style: foo\n", "invalid style"},
+		{"cameras:\n  - src: a\n    webhook: ftp://a\n", "webhook"},
+		{"cameras:\n  - src: [a, b]\n", "single value"},
+	} {
+		if err := os.WriteFile(yml, []byte(bad.data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		fs, _, _, _, _, _ = newFlags()
+		fs.String("config", "", "")
+		if _, err := loadConfig(fs, yml); err == nil || !strings.Contains(err.Error(), bad.want) {
+			t.Errorf("%q: %v", bad.data, err)
+		}
+	}
+	if _, err := loadConfig(fs, filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestLoadConfigCameras(t *testing.T) {
+	dir := t.TempDir()
+	yml := filepath.Join(dir, "config.yaml")
+	data := `fps: 10
+cameras:
+  - name: door
+    src: /dev/video0
+    mask: door.png
+    yavg: 2.5
+    style: motion_only
+    webhook:
+      - https://example.com/a
+      - https://example.com/b
+    mqtt-topic: home/door
+    smtp-to: a@example.com
+    telegram-chat: "-100"
+  - src: /dev/video2
+    root: /mnt/garage
+    discord-webhook: https://discord.com/api/webhooks/1/a
+`
+	if err := os.WriteFile(yml, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fps := fs.Int("fps", 15, "")
+	cams, err := loadConfig(fs, yml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *fps != 10 {
+		t.Fatal(*fps)
+	}
+	want := []cameraConfig{
+		{
+			name:         "door",
+			src:          "/dev/video0",
+			mask:         "door.png",
+			yavg:         2.5,
+			style:        "motion_only",
+			webhooks:     webhooks{"https://example.com/a", "https://example.com/b"},
+			mqttTopic:    "home/door",
+			smtpTo:       "a@example.com",
+			telegramChat: "-100",
+		},
+		{
+			src:     "/dev/video2",
+			root:    "/mnt/garage",
+			discord: "https://discord.com/api/webhooks/1/a",
+		},
+	}
+	if len(cams) != len(want) {
+		t.Fatal(cams)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(cams[i], want[i]) {
+			t.Errorf("#%d: %+v != %+v", i, cams[i], want[i])
+		}
+	}
+
+	js := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(js, []byte(`{"cameras": [{"src": "/dev/video1", "yavg": 2}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cams, err = loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), js); err != nil {
+		t.Fatal(err)
+	}
+	if len(cams) != 1 || cams[0].src != "/dev/video1" || cams[0].yavg != 2 {
+		t.Fatal(cams)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// discordMessage is the subset of the Discord webhook payload that is used.
+//
+// See https://discord.com/developers/docs/resources/webhook#execute-webhook
+type discordMessage struct {
+	Username string         `json:"username,omitempty"`
+	Embeds   []discordEmbed `json:"embeds"`
+}
+
+type discordEmbed struct {
+	Title     string         `json:"title"`
+	Timestamp string         `json:"timestamp"`
+	Fields    []discordField `json:"fields,omitempty"`
+	Image     *discordImage  `json:"image,omitempty"`
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordImage struct {
+	URL string `json:"url"`
+}
+
+// newDiscordMessage returns the message posted when the motion starts. When
+// photo is true, the embed shows the attached snapshot.
+func newDiscordMessage(name string, t time.Time, yavg float32, photo bool) *discordMessage {
+	e := discordEmbed{
+		Title:     "Motion detected",
+		Timestamp: t.Format(time.RFC3339),
+		Fields:    []discordField{{Name: "YAVG", Value: fmt.Sprintf("%.1f", yavg), Inline: true}},
+	}
+	if name != "" {
+		e.Title += " on " + name
+		e.Fields = append([]discordField{{Name: "Camera", Value: name, Inline: true}}, e.Fields...)
+	}
+	if photo {
+		e.Image = &discordImage{URL: "attachment://snapshot.jpg"}
+	}
+	return &discordMessage{Username: "record-videos", Embeds: []discordEmbed{e}}
+}
+
+// discordWebhook is a Discord webhook URL, e.g.
+// https://discord.com/api/webhooks/<id>/<token>.
+type discordWebhook string
+
+func (d *discordWebhook) Set(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("invalid Discord webhook %q; must be an https URL", v)
+	}
+	*d = discordWebhook(v)
+	return nil
+}
+
+func (d *discordWebhook) String() string {
+	return string(*d)
+}
+
+// send posts m to the webhook. When photo is set, the JPEG is attached as
+// snapshot.jpg.
+//
+// Like the generic webhooks, the call is bounded by webhookTimeout.
+func (d discordWebhook) send(ctx context.Context, m *discordMessage, photo string) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var body io.Reader = bytes.NewReader(j)
+	contentType := "application/json"
+	if photo != "" {
+		// #nosec G304
+		img, err := os.ReadFile(photo)
+		if err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{}
+		w := multipart.NewWriter(buf)
+		_ = w.WriteField("payload_json", string(j))
+		f, err := w.CreateFormFile("files[0]", "snapshot.jpg")
+		if err != nil {
+			return err
+		}
+		_, _ = f.Write(img)
+		if err = w.Close(); err != nil {
+			return err
+		}
+		body = buf
+		contentType = w.FormDataContentType()
+	}
+	// #nosec G107
+	req, err := http.NewRequestWithContext(ctx, "POST", string(d), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// The URL contains the token; don't log it.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscordMessage(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	b, err := json.Marshal(newDiscordMessage("door", ts, 1.25, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"username":"record-videos","embeds":[{"title":"Motion detected on door","timestamp":"2024-01-02T03:04:05Z",` +
+		`"fields":[{"name":"Camera","value":"door","inline":true},{"name":"YAVG","value":"1.2","inline":true}],` +
+		`"image":{"url":"attachment://snapshot.jpg"}}]}`
+	if string(b) != want {
+		t.Fatalf("got  %s\nwant %s", b, want)
+	}
+	b, err = json.Marshal(newDiscordMessage("", ts, 2, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"username":"record-videos","embeds":[{"title":"Motion detected","timestamp":"2024-01-02T03:04:05Z",` +
+		`"fields":[{"name":"YAVG","value":"2.0","inline":true}]}]}`
+	if string(b) != want {
+		t.Fatalf("got  %s\nwant %s", b, want)
+	}
+}
+
+func TestDiscordSend(t *testing.T) {
+	type call struct {
+		payload, photo string
+	}
+	var calls []call
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c := call{}
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+			if err := req.ParseMultipartForm(1 << 20); err != nil {
+				t.Error(err)
+			}
+			c.payload = req.FormValue("payload_json")
+			if f, _, err := req.FormFile("files[0]"); err == nil {
+				b, _ := io.ReadAll(f)
+				c.photo = string(b)
+			}
+		} else {
+			b, _ := io.ReadAll(req.Body)
+			c.payload = string(b)
+		}
+		calls = append(calls, c)
+		if req.URL.Path == "/bad" {
+			http.Error(w, `{"message": "Unknown Webhook"}`, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	m := &discordMessage{Embeds: []discordEmbed{{Title: "a"}}}
+	d := discordWebhook(srv.URL + "/ok")
+	if err := d.send(ctx, m, ""); err != nil {
+		t.Fatal(err)
+	}
+	photo := filepath.Join(t.TempDir(), "a.jpg")
+	if err := os.WriteFile(photo, []byte("jpeg"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.send(ctx, m, photo); err != nil {
+		t.Fatal(err)
+	}
+	d = discordWebhook(srv.URL + "/bad")
+	if err := d.send(ctx, m, ""); err == nil || !strings.Contains(err.Error(), "Unknown Webhook") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p := `{"embeds":[{"title":"a","timestamp":""}]}`
+	want := []call{{payload: p}, {payload: p, photo: "jpeg"}, {payload: p}}
+	if len(calls) != len(want) {
+		t.Fatalf("got %d calls, want %d", len(calls), len(want))
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("#%d: got %+v, want %+v", i, calls[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diskCapInterval is how often the disk usage is checked with -max-disk.
+const diskCapInterval = time.Minute
+
+// diskCapProtect is the age under which the files are never evicted, and the
+// segments referenced by a motion playlist are kept. It covers the live
+// stream and the motion recordings still being generated.
+const diskCapProtect = time.Hour
+
+// diskCapLowWater is the fraction of the cap to go down to once it is
+// exceeded, so the eviction doesn't run on every check.
+const diskCapLowWater = 0.9
+
+// byteSize is a size in bytes, specified with an optional unit like "50GB" or
+// "1.5TiB".
+type byteSize int64
+
+func (b *byteSize) Set(v string) error {
+	s := strings.TrimSpace(v)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	num, unit := s, ""
+	if i != -1 {
+		num, unit = s[:i], strings.TrimSpace(s[i:])
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	mult, ok := byteUnits[strings.ToUpper(unit)]
+	if !ok {
+		return fmt.Errorf("invalid size unit %q; use B, KB, MB, GB, TB or KiB, MiB, GiB, TiB", unit)
+	}
+	*b = byteSize(f * float64(mult))
+	return nil
+}
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+// byteUnits is the multiplier of each unit accepted by byteSize.
+var byteUnits = map[string]int64{
+	"": 1, "B": 1,
+	"K": 1000, "KB": 1000, "KIB": 1 << 10,
+	"M": 1000 * 1000, "MB": 1000 * 1000, "MIB": 1 << 20,
+	"G": 1000 * 1000 * 1000, "GB": 1000 * 1000 * 1000, "GIB": 1 << 30,
+	"T": 1000 * 1000 * 1000 * 1000, "TB": 1000 * 1000 * 1000 * 1000, "TIB": 1 << 40,
+}
+
+// diskFile is a recording file considered for eviction.
+type diskFile struct {
+	root string
+	// name is relative to root, e.g. "2024-01-02/03-04-05.ts".
+	name string
+	t    time.Time
+	size int64
+}
+
+// listRecordings returns the recording files in root and its day directories.
+//
+// Files not named after a time, like all.m3u8, are ignored.
+func listRecordings(root string) ([]diskFile, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var out []diskFile
+	add := func(name string, e os.DirEntry) {
+		// The DASH chunks are not named after their time; -max-disk is rejected
+		// with -container dash.
+		switch filepath.Ext(name) {
+		case ".ts", ".m3u8", ".vtt", ".mp4", ".jpg", ".gif":
+		default:
+			return
+		}
+		t, err2 := fileTime(name)
+		if err2 != nil {
+			return
+		}
+		if fi, err2 := e.Info(); err2 == nil {
+			out = append(out, diskFile{root: root, name: name, t: t, size: fi.Size()})
+		}
+	}
+	for _, e := range entries {
+		n := e.Name()
+		if !e.IsDir() {
+			add(n, e)
+			continue
+		}
+		if _, err2 := time.ParseInLocation(time.DateOnly, n, time.Local); err2 != nil {
+			continue
+		}
+		sub, err2 := os.ReadDir(filepath.Join(root, n))
+		if err2 != nil {
+			err = err2
+			continue
+		}
+		for _, e2 := range sub {
+			if !e2.IsDir() {
+				add(n+"/"+e2.Name(), e2)
+			}
+		}
+	}
+	return out, err
+}
+
+// recentSegments returns the segments referenced by the motion playlists in
+// files that are newer than cutoff, per root.
+func recentSegments(files []diskFile, cutoff time.Time) map[string]struct{} {
+	keep := map[string]struct{}{}
+	for _, f := range files {
+		if !strings.HasSuffix(f.name, ".m3u8") || f.t.Before(cutoff) {
+			continue
+		}
+		// #nosec G304
+		r, err := os.Open(filepath.Join(f.root, f.name))
+		if err != nil {
+			continue
+		}
+		segments, err := parseM3U8(r)
+		_ = r.Close()
+		if err != nil {
+			slog.Warn("disk", "p", f.name, "err", err)
+		}
+		for s := range segments {
+			keep[filepath.Join(f.root, s)] = struct{}{}
+		}
+	}
+	return keep
+}
+
+// enforceDiskCap deletes the oldest segments and clips of roots until their
+// total size is under the low water mark, when it exceeds maxBytes.
+//
+// The files newer than diskCapProtect and the segments referenced by a motion
+// playlist newer than diskCapProtect are never deleted. The motion playlists
+// left without any segment are deleted afterward. It returns the total size
+// before the eviction and the number of bytes deleted.
+func enforceDiskCap(roots []string, maxBytes int64, now time.Time) (int64, int64, error) {
+	var files []diskFile
+	var err error
+	for _, root := range roots {
+		f, err2 := listRecordings(root)
+		if err2 != nil {
+			err = err2
+		}
+		files = append(files, f...)
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	if total <= maxBytes {
+		return total, 0, err
+	}
+	cutoff := now.Add(-diskCapProtect)
+	keep := recentSegments(files, cutoff)
+	sort.SliceStable(files, func(i, j int) bool { return files[i].t.Before(files[j].t) })
+	target := int64(float64(maxBytes) * diskCapLowWater)
+	left := total
+	var freed int64
+	deleted := 0
+	for _, f := range files {
+		if left <= target || !f.t.Before(cutoff) {
+			break
+		}
+		// The playlists and their small companions are deleted once orphaned.
+		if ext := filepath.Ext(f.name); ext != ".ts" && ext != ".mp4" {
+			continue
+		}
+		p := filepath.Join(f.root, f.name)
+		if _, ok := keep[p]; ok {
+			continue
+		}
+		if err2 := os.Remove(p); err2 != nil {
+			if !errors.Is(err2, os.ErrNotExist) {
+				err = err2
+			}
+			continue
+		}
+		left -= f.size
+		freed += f.size
+		deleted++
+	}
+	for _, root := range roots {
+		n, err2 := deleteOrphanedPlaylists(root)
+		if err2 != nil {
+			err = err2
+		}
+		deleted += n
+		removeEmptyDays(root, now)
+	}
+	if deleted != 0 {
+		slog.Info("disk", "msg", "evicted", "files", deleted, "bytes", freed, "usage", total-freed)
+	}
+	return total, freed, err
+}
+
+// deleteOrphanedPlaylists deletes the motion playlists in root which segments
+// were all deleted, along with their .vtt, .gif and .jpg. It returns the
+// number of files deleted.
+func deleteOrphanedPlaylists(root string) (int, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() || !strings.HasSuffix(n, ".m3u8") || n == "all.m3u8" {
+			continue
+		}
+		// #nosec G304
+		f, err2 := os.Open(filepath.Join(root, n))
+		if err2 != nil {
+			continue
+		}
+		segments, err2 := parseM3U8(f)
+		_ = f.Close()
+		if err2 != nil || len(segments) == 0 {
+			// Possibly still being generated.
+			continue
+		}
+		orphaned := true
+		for s := range segments {
+			if _, err2 = os.Stat(filepath.Join(root, s)); err2 == nil {
+				orphaned = false
+				break
+			}
+		}
+		if !orphaned {
+			continue
+		}
+		i, err2 := deleteRecording(root, n, false)
+		deleted += i
+		if err2 != nil {
+			err = err2
+		}
+	}
+	return deleted, err
+}
+
+// removeEmptyDays deletes the empty day directories in root before today.
+//
+// Today's directory is kept since ffmpeg creates it right before writing a
+// segment in it.
+func removeEmptyDays(root string, now time.Time) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	today := now.Format(time.DateOnly)
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() >= today {
+			continue
+		}
+		if _, err = time.ParseInLocation(time.DateOnly, e.Name(), time.Local); err == nil {
+			// os.Remove fails on a non-empty directory.
+			_ = os.Remove(filepath.Join(root, e.Name()))
+		}
+	}
+}
+
+// runDiskCap enforces maxBytes on roots periodically until ctx is canceled.
+func runDiskCap(ctx context.Context, roots []string, maxBytes int64) {
+	t := time.NewTicker(diskCapInterval)
+	defer t.Stop()
+	for {
+		total, freed, err := enforceDiskCap(roots, maxBytes, time.Now())
+		if err != nil {
+			slog.Error("disk", "err", err)
+		}
+		slog.Debug("disk", "usage", total, "max", maxBytes, "freed", freed)
+		if total-freed > maxBytes {
+			slog.Warn("disk", "msg", "still over the cap; the recent recordings are never deleted", "usage", total-freed, "max", maxBytes)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestByteSize(t *testing.T) {
+	data := []struct {
+		in   string
+		want int64
+	}{
+		{"0", 0},
+		{"1234", 1234},
+		{"10B", 10},
+		{"50GB", 50 * 1000 * 1000 * 1000},
+		{"50gb", 50 * 1000 * 1000 * 1000},
+		{"1.5TiB", 3 << 39},
+		{"2 MiB", 2 << 20},
+		{"3k", 3000},
+	}
+	for i, l := range data {
+		var b byteSize
+		if err := b.Set(l.in); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if int64(b) != l.want {
+			t.Fatalf("#%d: %q: got %d, want %d", i, l.in, b, l.want)
+		}
+	}
+	for _, in := range []string{"", "GB", "-1GB", "1XB", "1.2.3MB"} {
+		var b byteSize
+		if err := b.Set(in); err == nil {
+			t.Fatalf("%q: expected error", in)
+		}
+	}
+}
+
+func TestEnforceDiskCap(t *testing.T) {
+	root := t.TempDir()
+	seg := strings.Repeat("x", 100)
+	files := map[string]string{
+		"all.m3u8":               "",
+		"2024-01-01/00-00-00.ts": seg,
+		"2024-01-01/00-00-04.ts": seg,
+		"2024-01-02/00-00-00.ts": seg,
+		"2024-01-02/00-00-04.ts": seg,
+		"2024-01-02/02-00-00.ts": seg,
+		"2024-01-01T00-00-00.m3u8": "#EXTM3U\n" +
+			"#EXTINF:4.000000,\n2024-01-01/00-00-00.ts\n",
+		"2024-01-01T00-00-00.jpg": "",
+		"2024-01-02T01-30-00.m3u8": "#EXTM3U\n" +
+			"#EXTINF:4.000000,\n2024-01-02/00-00-04.ts\n",
+	}
+	for n, c := range files {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(n)), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, n), []byte(c), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Date(2024, 1, 2, 2, 0, 10, 0, time.Local)
+	total, freed, err := enforceDiskCap([]string{root}, 10000, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed != 0 {
+		t.Fatalf("under the cap but freed %d bytes", freed)
+	}
+	// Everything old and not used by the recent playlist is evicted: the
+	// segments are 500 bytes and the cap is 250, so the low water mark is 225.
+	total2, freed, err := enforceDiskCap([]string{root}, 250, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total2 != total || freed != 300 {
+		t.Fatalf("got total %d, %d freed; want %d, 300", total2, freed, total)
+	}
+	var got []string
+	err = filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			got = append(got, filepath.ToSlash(strings.TrimPrefix(p, root+string(filepath.Separator))))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"2024-01-02/00-00-04.ts",
+		"2024-01-02/02-00-00.ts",
+		"2024-01-02T01-30-00.m3u8",
+		"all.m3u8",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got  %q\nwant %q", got, want)
+	}
+	// The emptied older day directory is deleted.
+	if _, err = os.Stat(filepath.Join(root, "2024-01-01")); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
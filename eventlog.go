@@ -0,0 +1,86 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventLog appends the motion events as JSON lines to a file per day.
+//
+// It is a durable local record of the events, independent of the webhook
+// receivers being up. It is safe for concurrent use so it can be shared by the
+// cameras.
+type eventLog struct {
+	// p is the path as specified with -event-log, e.g. "events.jsonl". The day
+	// is inserted before the extension, e.g. "events-2024-01-02.jsonl".
+	p string
+
+	mu  sync.Mutex
+	day string
+	f   *os.File
+}
+
+// eventLogName returns the name of the file for the day of t.
+func eventLogName(p string, t time.Time) string {
+	ext := filepath.Ext(p)
+	return strings.TrimSuffix(p, ext) + "-" + t.Format("2006-01-02") + ext
+}
+
+// write appends p as a JSON line to the file of the day of t.
+//
+// Errors are logged and otherwise ignored so the pipeline keeps running.
+func (e *eventLog) write(t time.Time, p *webhookPayload) {
+	d, err := json.Marshal(p)
+	if err != nil {
+		slog.Error("event-log", "err", err)
+		return
+	}
+	d = append(d, '\n')
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if day := t.Format("2006-01-02"); day != e.day || e.f == nil {
+		e.closeLocked()
+		name := eventLogName(e.p, t)
+		// #nosec G304
+		if e.f, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+			slog.Error("event-log", "p", name, "err", err)
+			return
+		}
+		e.day = day
+	}
+	// A single write with O_APPEND never interleaves with another writer.
+	if _, err = e.f.Write(d); err == nil {
+		// Events are rare, make sure they survive a power loss.
+		err = e.f.Sync()
+	}
+	if err != nil {
+		slog.Error("event-log", "p", e.f.Name(), "err", err)
+		// Reopen on the next event.
+		e.closeLocked()
+	}
+}
+
+// close closes the current file.
+func (e *eventLog) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closeLocked()
+}
+
+func (e *eventLog) closeLocked() {
+	if e.f != nil {
+		if err := e.f.Close(); err != nil {
+			slog.Error("event-log", "p", e.f.Name(), "err", err)
+		}
+		e.f = nil
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventLog(t *testing.T) {
+	if got := eventLogName("/var/log/events.jsonl", time.Date(2024, 1, 2, 23, 0, 0, 0, time.Local)); got != "/var/log/events-2024-01-02.jsonl" {
+		t.Fatal(got)
+	}
+	d := t.TempDir()
+	e := &eventLog{p: filepath.Join(d, "events.jsonl")}
+	defer e.close()
+	t1 := time.Date(2024, 1, 2, 23, 59, 0, 0, time.Local)
+	t2 := t1.Add(30 * time.Second)
+	t3 := t1.Add(2 * time.Minute)
+	e.write(t1, &webhookPayload{Version: webhookVersion, Motion: true, Time: t1, YAVG: 2})
+	e.write(t2, &webhookPayload{Version: webhookVersion, Time: t2, Start: &t1, End: &t2, Playlist: "2024-01-02T23-59-00.m3u8"})
+	e.write(t3, &webhookPayload{Version: webhookVersion, Motion: true, Time: t3, YAVG: 3})
+
+	b, err := os.ReadFile(filepath.Join(d, "events-2024-01-02.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%q", lines)
+	}
+	var p webhookPayload
+	if err = json.Unmarshal([]byte(lines[1]), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Motion || p.Playlist != "2024-01-02T23-59-00.m3u8" || p.Start == nil || !p.Start.Equal(t1) {
+		t.Fatalf("%+v", p)
+	}
+	if b, err = os.ReadFile(filepath.Join(d, "events-2024-01-03.jsonl")); err != nil || strings.Count(string(b), "\n") != 1 {
+		t.Fatal(string(b), err)
+	}
+
+	// Errors are not fatal.
+	e2 := &eventLog{p: filepath.Join(d, "missing", "events.jsonl")}
+	e2.write(t1, &webhookPayload{})
+	e2.close()
+}
@@ -0,0 +1,201 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	//go:embed html/export.html
+	exportHTML string
+
+	exportTmpl = template.Must(template.New("").Parse(exportHTML))
+)
+
+// exportMetadata is the metadata.json file included in an export.
+type exportMetadata struct {
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Segments []string  `json:"segments"`
+}
+
+// exportEvent bundles the motion recording playlist found in root into dst, a
+// ZIP file that can be opened offline.
+//
+// The ZIP contains the recording as a MP4 file, a poster image, the .vtt
+// track if present, a metadata.json file and an index.html player. enc is used
+// by the "precise" mode, see buildClipCmd.
+func exportEvent(ctx context.Context, root, playlist string, mode clipMode, enc []string, dst string) error {
+	base := strings.TrimSuffix(filepath.Base(playlist), ".m3u8")
+	// #nosec G304
+	f, err := os.Open(filepath.Join(root, base+".m3u8"))
+	if err != nil {
+		return err
+	}
+	durations, err := parseM3U8(f)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	if len(durations) == 0 {
+		return fmt.Errorf("%s.m3u8 doesn't list any segment", base)
+	}
+	// The names are sortable.
+	files := slices.Sorted(maps.Keys(durations))
+	start, err := fileTime(files[0])
+	if err != nil {
+		return err
+	}
+	last, err := fileTime(files[len(files)-1])
+	if err != nil {
+		return err
+	}
+	end := last.Add(time.Duration(durations[files[len(files)-1]] * float64(time.Second)))
+
+	tmp, err := os.MkdirTemp("", "record-videos-export")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	args, err := buildClipCmd(files, start, end, mode, enc, filepath.Join(tmp, "event.mp4"))
+	if err != nil {
+		return err
+	}
+	if err = cmdFFMPEG(ctx, root, args, nil, ffmpegStderr).Run(); err != nil {
+		return fmt.Errorf("failed to extract the clip: %w", err)
+	}
+	// Take the poster in the middle of the event, it's more likely to show
+	// what triggered it than the pre-capture.
+	args = []string{
+		"ffmpeg", "-hide_banner", "-nostats", "-loglevel", "repeat+warning", "-y",
+		"-ss", fmt.Sprintf("%.3f", end.Sub(start).Seconds()/2),
+		"-i", "event.mp4",
+		"-frames:v", "1", "-q:v", "2",
+		"poster.jpg",
+	}
+	if err = cmdFFMPEG(ctx, tmp, args, nil, ffmpegStderr).Run(); err != nil {
+		return fmt.Errorf("failed to extract the poster: %w", err)
+	}
+
+	data := map[string]string{
+		"Name":   base,
+		"Start":  start.Format(time.DateTime),
+		"End":    end.Format(time.DateTime),
+		"Video":  "event.mp4",
+		"Poster": "poster.jpg",
+	}
+	// #nosec G304
+	if b, err := os.ReadFile(filepath.Join(root, base+".vtt")); err == nil {
+		if err = os.WriteFile(filepath.Join(tmp, "event.vtt"), b, 0o600); err != nil {
+			return err
+		}
+		data["VTT"] = "event.vtt"
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	m, err := json.MarshalIndent(exportMetadata{Name: base, Start: start, End: end, Segments: files}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(tmp, "metadata.json"), m, 0o600); err != nil {
+		return err
+	}
+	if err = writeExportIndex(filepath.Join(tmp, "index.html"), data); err != nil {
+		return err
+	}
+	if err = zipDir(dst, tmp, base); err != nil {
+		return err
+	}
+	slog.Info("export", "playlist", base+".m3u8", "dst", dst)
+	return nil
+}
+
+// writeExportIndex writes the offline HTML player.
+func writeExportIndex(name string, data map[string]string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err = exportTmpl.Execute(f, data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// zipDir writes all the files in dir into the ZIP file dst, inside the
+// directory prefix.
+func zipDir(dst, dir, prefix string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	z := zip.NewWriter(f)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err = zipFile(z, filepath.Join(dir, e.Name()), prefix+"/"+e.Name()); err != nil {
+			_ = z.Close()
+			_ = f.Close()
+			return err
+		}
+	}
+	if err = z.Close(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func zipFile(z *zip.Writer, src, name string) error {
+	// #nosec G304
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	fi, err := r.Stat()
+	if err != nil {
+		return err
+	}
+	h, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	// Videos and images are already compressed.
+	h.Method = zip.Deflate
+	if ext := filepath.Ext(name); ext == ".mp4" || ext == ".jpg" {
+		h.Method = zip.Store
+	}
+	w, err := z.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestZipDir(t *testing.T) {
+	dir := t.TempDir()
+	data := map[string]string{"Name": "2024-01-02T03-04-05", "Video": "event.mp4", "Poster": "poster.jpg", "VTT": "event.vtt"}
+	if err := writeExportIndex(filepath.Join(dir, "index.html"), data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "event.mp4"), []byte("video"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "out.zip")
+	if err := zipDir(dst, dir, "2024-01-02T03-04-05"); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.OpenReader(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	got := map[string]string{}
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[f.Name] = string(b)
+	}
+	if len(got) != 2 || got["2024-01-02T03-04-05/event.mp4"] != "video" {
+		t.Fatalf("unexpected content: %q", got)
+	}
+	if s := got["2024-01-02T03-04-05/index.html"]; !strings.Contains(s, `<track kind="subtitles" label="YAVG" src="event.vtt" />`) {
+		t.Fatalf("missing track:\n%s", s)
+	}
+}
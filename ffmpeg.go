@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -12,7 +13,9 @@ import (
 	"log/slog"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -92,36 +95,135 @@ func (f filterGraph) String() string {
 	return out
 }
 
+// appendToSink appends filters to the chain of the stream that outputs to
+// sink.
+func (f filterGraph) appendToSink(sink string, filters ...filter) {
+	for i := range f {
+		for _, s := range f[i].sinks {
+			if s == sink {
+				f[i].chain = append(f[i].chain, filters...)
+				return
+			}
+		}
+	}
+	panic("internal error: unknown sink " + sink)
+}
+
+// filterNames returns the name of the filters used, sorted and deduplicated.
+func (f filterGraph) filterNames() []string {
+	var out []string
+	for _, s := range f {
+		for _, x := range s.chain {
+			n, _, _ := strings.Cut(string(x), "=")
+			// A filter can be named, e.g. "drawtext@ts".
+			n, _, _ = strings.Cut(n, "@")
+			out = append(out, n)
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
 // The rest is specific to this project.
 
-// Well known filters.
-var (
-	// drawTimestamp draws the current timestamp as an overlay.
-	drawTimestamp filter = "drawtext@1=" +
-		"fontfile=/usr/share/fonts/truetype/noto/NotoSansMono-Regular.ttf:" +
-		"text='%{localtime\\:%Y-%m-%d %T}':" +
-		"x=(w-text_w-10):" +
-		"y=(h-text_h-10):" +
-		"fontsize=48:" +
+// escapeFilterArg escapes a filter option value so it can be used as-is in a
+// filter graph description.
+//
+// There are two levels of escaping, see
+// https://ffmpeg.org/ffmpeg-filters.html#Notes-on-filtergraph-escaping
+func escapeFilterArg(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `:`, `\:`, `'`, `\'`).Replace(s)
+	return strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`, `'`, `\'`).Replace(s)
+}
+
+// defaultFont is the font used by the drawtext filters when none is
+// specified.
+const defaultFont = "/usr/share/fonts/truetype/noto/NotoSansMono-Regular.ttf"
+
+// defaultFonts is the monospace fonts to try per OS when -font is not
+// specified, in order of preference.
+var defaultFonts = map[string][]string{
+	"darwin": {
+		"/System/Library/Fonts/Menlo.ttc",
+		"/System/Library/Fonts/Monaco.ttf",
+		"/Library/Fonts/Arial Unicode.ttf",
+	},
+	"linux": {
+		defaultFont,
+		"/usr/share/fonts/truetype/dejavu/DejaVuSansMono.ttf",
+		"/usr/share/fonts/dejavu/DejaVuSansMono.ttf",
+		"/usr/share/fonts/TTF/DejaVuSansMono.ttf",
+		"/usr/share/fonts/truetype/liberation/LiberationMono-Regular.ttf",
+	},
+	"windows": {
+		"C:/Windows/Fonts/consola.ttf",
+		"C:/Windows/Fonts/cour.ttf",
+	},
+}
+
+// findFont returns font if it exists, otherwise the first default font for
+// the OS that exists.
+func findFont(font string) (string, error) {
+	if font != "" {
+		if _, err := os.Stat(font); err != nil {
+			return "", fmt.Errorf("-font: %w", err)
+		}
+		return font, nil
+	}
+	for _, f := range defaultFonts[runtime.GOOS] {
+		if _, err := os.Stat(f); err == nil {
+			return f, nil
+		}
+	}
+	return "", errors.New("no font found; install fonts-noto-mono or fonts-dejavu-core, or use -font")
+}
+
+// defaultTimestampFormat is the default strftime format of the timestamp
+// overlay.
+const defaultTimestampFormat = "%Y-%m-%d %T"
+
+// escapeExpansion escapes a string used as an argument in a drawtext text
+// expansion sequence like %{localtime:...}.
+func escapeExpansion(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`, `}`, `\}`).Replace(s)
+}
+
+// drawTimestamp draws the current timestamp as an overlay.
+//
+// format is a strftime format. It must not contain a single quote.
+func drawTimestamp(font, format string, p position, size int) filter {
+	x, y := p.xy()
+	return filter("drawtext@1=" +
+		"fontfile=" + escapeFilterArg(font) + ":" +
+		"text='%{localtime\\:" + escapeExpansion(format) + "}':" +
+		"x=" + x + ":" +
+		"y=" + y + ":" +
+		"fontsize=" + strconv.Itoa(size) + ":" +
 		"fontcolor=white:" +
 		"box=1:" +
-		"boxcolor=black@0.5"
+		"boxcolor=black@0.5")
+}
 
-	// drawYAVG draws the YAVG on the image for debugging. Requires signalstats.
-	//
-	// TODO: Figure out how to round the number printed out.
-	drawYAVG filter = "drawtext=" +
-		"fontfile=/usr/share/fonts/truetype/noto/NotoSansMono-Regular.ttf:" +
+// drawYAVG draws the YAVG on the image for debugging. Requires signalstats.
+//
+// TODO: Figure out how to round the number printed out.
+func drawYAVG(font string) filter {
+	return filter("drawtext=" +
+		"fontfile=" + escapeFilterArg(font) + ":" +
 		"text='%{metadata\\:lavfi.signalstats.YAVG}':" +
 		"x=10:" +
 		"y=10:" +
 		"fontsize=48:" +
 		"fontcolor=white:" +
 		"box=1:" +
-		"boxcolor=black@0.5"
+		"boxcolor=black@0.5")
+}
 
+// Well known filters.
+var (
 	// scaleHalf reduces the image by half on both dimensions, to reduce the
-	// processing power required by 75%.
+	// processing power required by 75%. It is only used when there is no mask
+	// to match, otherwise use scaleTo(halfDims(w, h)).
 	//
 	// https://ffmpeg.org/ffmpeg-filters.html#scale-1
 	scaleHalf filter = "scale=w=iw/2:h=ih/2"
@@ -146,8 +248,95 @@ var (
 	//
 	//lint:ignore U1000 not used because of keep-alive
 	printFilteredYAVGtoPipe filter = "metadata=print:key=lavfi.signalstats.YAVG:function=greater:value=0.1:file='pipe\\:3':direct=1"
+
+	// audioLevel measures the audio RMS level 10 times per second. The sample
+	// rate is reduced first so the measurement rate doesn't depend on the
+	// device.
+	audioLevel = chain{"aresample=8000", "asetnsamples=n=800:p=0", "astats=metadata=1:reset=1"}
+
+	// printZone2YAVGtoPipe prints YAVG of the second detection zone to pipe
+	// #7.
+	//
+	// Pipe #7 is the fifth pipe specified in exec.Cmd.ExtraFiles.
+	printZone2YAVGtoPipe filter = "metadata=print:key=lavfi.signalstats.YAVG:file='pipe\\:7':direct=1"
+
+	// printAudioLevelToPipe prints the audio RMS level to pipe #6.
+	//
+	// Pipe #6 is the fourth pipe specified in exec.Cmd.ExtraFiles.
+	printAudioLevelToPipe filter = "ametadata=print:key=lavfi.astats.Overall.RMS_level:file='pipe\\:6':direct=1"
 )
 
+// position is the corner of the frame where a text overlay is drawn.
+type position string
+
+func (p *position) Set(v string) error {
+	options := ""
+	for i, x := range validPositions {
+		if v == string(x) {
+			*p = x
+			return nil
+		}
+		if i != 0 {
+			options += ", "
+		}
+		options += string(x)
+	}
+	return errors.New("invalid position. Supported values are: " + options)
+}
+
+func (p *position) String() string {
+	return string(*p)
+}
+
+// validPositions is top-left, top-right, bottom-left and bottom-right.
+var validPositions = []position{"tl", "tr", "bl", "br"}
+
+// xy returns the drawtext expressions to draw the text at this position.
+func (p position) xy() (string, string) {
+	switch p {
+	case "tl":
+		return "10", "10"
+	case "tr":
+		return "(w-text_w-10)", "10"
+	case "bl":
+		return "10", "(h-text_h-10)"
+	case "br":
+		return "(w-text_w-10)", "(h-text_h-10)"
+	default:
+		panic("unknown position " + p)
+	}
+}
+
+// drawLabel draws a fixed text, like the camera name, as an overlay.
+func drawLabel(font, text string, p position) filter {
+	x, y := p.xy()
+	return filter("drawtext@3=" +
+		"fontfile=" + escapeFilterArg(font) + ":" +
+		"expansion=none:" +
+		"text=" + escapeFilterArg(text) + ":" +
+		"x=" + x + ":" +
+		"y=" + y + ":" +
+		"fontsize=48:" +
+		"fontcolor=white:" +
+		"box=1:" +
+		"boxcolor=black@0.5")
+}
+
+// drawFrameCounter draws the frame number and presentation timestamp as an
+// overlay, to debug synchronization issues.
+func drawFrameCounter(font string, p position) filter {
+	x, y := p.xy()
+	return filter("drawtext@2=" +
+		"fontfile=" + escapeFilterArg(font) + ":" +
+		"text='frame %{n} pts %{pts}':" +
+		"x=" + x + ":" +
+		"y=" + y + ":" +
+		"fontsize=48:" +
+		"fontcolor=white:" +
+		"box=1:" +
+		"boxcolor=black@0.5")
+}
+
 type style string
 
 func (s *style) Set(v string) error {
@@ -169,240 +358,354 @@ func (s *style) String() string {
 	return string(*s)
 }
 
-// validStyles is the valid style values for constructFilterGraph.
-var validStyles = []style{"normal", "normal_no_mask", "motion_only", "overlay", "both"}
+// validStyles is the valid style values for constructStyle.
+var validStyles = []style{"normal", "normal_no_mask", "motion_only", "overlay", "both", "raw"}
+
+// resolveStyle returns the style to use when mask is the -mask value.
+//
+// All the styles but "normal_no_mask" consume the mask input. Without a mask,
+// "normal" is equivalent to "normal_no_mask" which is cheaper, and the other
+// styles get a full frame white mask synthesized by buildFFMPEGCmd.
+func resolveStyle(s style, mask string) style {
+	if mask != "" || s == "normal_no_mask" {
+		return s
+	}
+	if s == "normal" {
+		slog.Info("ffmpeg", "msg", "no -mask; using -style normal_no_mask")
+		return "normal_no_mask"
+	}
+	slog.Info("ffmpeg", "msg", "no -mask; synthesizing a full frame mask", "style", s)
+	return s
+}
 
 // constructFilterGraph constructs the argument for -filter_complex.
-func constructFilterGraph(s style, w, h int) filterGraph {
-	halfSize := strconv.Itoa(w/2) + "x" + strconv.Itoa(h/2)
-	switch s {
-	case "normal":
-		return filterGraph{
+func constructFilterGraph(o *ffmpegOptions) filterGraph {
+	font := o.fontFile
+	if font == "" {
+		font = defaultFont
+	}
+	format := o.timestampFormat
+	if format == "" {
+		format = defaultTimestampFormat
+	}
+	pos := o.timestampPos
+	if pos == "" {
+		pos = "br"
+	}
+	size := o.timestampSize
+	if size <= 0 {
+		size = 48
+	}
+	ts := drawTimestamp(font, format, pos, size)
+	if o.noTimestamp {
+		// Use a pass-through filter so the [out] sink stays wired the same way
+		// in all the styles.
+		ts = "null"
+	}
+	fg := constructStyle(o.s, o.w, o.h, ts, drawYAVG(font))
+	if o.name != "" {
+		fg.appendToSink("[out]", drawLabel(font, o.name, "tl"))
+	}
+	if o.frameCounter != "" {
+		fg.appendToSink("[out]", drawFrameCounter(font, o.frameCounter))
+	}
+	if o.extraFilter != "" {
+		// Last so it applies to the overlays too. The motion detection is done
+		// on another branch.
+		fg.appendToSink("[out]", o.extraFilter)
+	}
+	if o.audio != "" {
+		// The audio is the third input, after the mask.
+		fg = append(fg, stream{
+			sources: []string{"[2:a]"},
+			chain:   buildChain(audioLevel, printAudioLevelToPipe, "anullsink"),
+		})
+	}
+	if o.mask2 != "" {
+		fg = appendZone2(fg, o)
+	}
+	if isFileSource(o.src) {
+		// A video file has its own frame size while the styles, the masks and the
+		// overlays are sized for w x h.
+		fg = append(filterGraph{
 			{
 				sources: []string{"[0:v]"},
-				chain:   buildChain("hqdn3d", "split=2"),
-				sinks:   []string{"[src1]", "[src2]"},
+				chain:   buildChain(scaleTo(o.w, o.h)),
+				sinks:   []string{"[vin]"},
 			},
-			{
-				sources: []string{"[1:v]"},
-				chain:   buildChain("scale=" + halfSize),
-				sinks:   []string{"[mask]"},
-			},
-			{
-				sources: []string{"[src1]"},
-				chain:   buildChain(scaleHalf),
-				sinks:   []string{"[srcHalf]"},
-			},
-			{
-				sources: []string{"[srcHalf][mask]"},
-				chain:   buildChain("alphamerge"),
-				sinks:   []string{"[alpha]"},
-			},
-			{
-				chain: buildChain("color=color=black:size=" + halfSize),
-				sinks: []string{"[black]"},
-			},
-			{
-				sources: []string{"[black][alpha]"},
-				chain:   buildChain("overlay"),
-				sinks:   []string{"[masked]"},
-			},
-			{
+		}, renameSource(fg, "[0:v]", "[vin]")...)
+	}
+	return fg
+}
+
+// renameSource replaces the source from with to in fg.
+func renameSource(fg filterGraph, from, to string) filterGraph {
+	for i := range fg {
+		for j, s := range fg[i].sources {
+			if s == from {
+				fg[i].sources[j] = to
+			}
+		}
+	}
+	return fg
+}
+
+// appendZone2 adds the motion detection of the second zone, masked with
+// o.mask2, to fg.
+//
+// The source is split so the style is not affected. The YAVG of the zone is
+// printed to its own pipe.
+func appendZone2(fg filterGraph, o *ffmpegOptions) filterGraph {
+	fg = renameSource(fg, "[0:v]", "[v0]")
+	// The mask of the zone is the last input, after the optional audio.
+	in := "[2:v]"
+	if o.audio != "" {
+		in = "[3:v]"
+	}
+	hw, hh := halfDims(o.w, o.h)
+	fg = append(filterGraph{
+		{
+			sources: []string{"[0:v]"},
+			chain:   buildChain("split=2"),
+			sinks:   []string{"[v0]", "[zone2src]"},
+		},
+	}, fg...)
+	fg = append(fg,
+		scaleMask(in, hw, hh, "[zone2mask]"),
+		stream{
+			sources: []string{"[zone2src]"},
+			chain:   buildChain("hqdn3d", scaleTo(hw, hh)),
+			sinks:   []string{"[zone2half]"},
+		})
+	fg = append(fg, maskedMotion("zone2", "[zone2half]", "[zone2mask]", hw, hh)...)
+	return append(fg, stream{
+		sources: []string{"[zone2masked]"},
+		chain:   buildChain(motionEdgeDetect, "signalstats", printZone2YAVGtoPipe, "nullsink"),
+	})
+}
+
+// halfDims returns the size of the frame used for motion detection, half of
+// w x h rounded down to even dimensions.
+//
+// The source and the mask are both scaled to this exact size so alphamerge and
+// overlay never see a size mismatch, e.g. with a 1281x721 camera.
+func halfDims(w, h int) (int, int) {
+	return (w / 2) &^ 1, (h / 2) &^ 1
+}
+
+// videoSize returns w x h formatted as an ffmpeg video size.
+func videoSize(w, h int) string {
+	return strconv.Itoa(w) + "x" + strconv.Itoa(h)
+}
+
+// scaleTo returns a scale filter to w x h.
+func scaleTo(w, h int) filter {
+	return filter("scale=" + videoSize(w, h))
+}
+
+// The building blocks of the styles. The motion detection is done on a half
+// size frame, w x h as returned by halfDims.
+
+// denoiseSplit denoises the camera input and splits it into [src1] and [src2].
+func denoiseSplit() stream {
+	return stream{
+		sources: []string{"[0:v]"},
+		chain:   buildChain("hqdn3d", "split=2"),
+		sinks:   []string{"[src1]", "[src2]"},
+	}
+}
+
+// scaleMask scales the mask in to w x h. It is split when there are multiple
+// sinks.
+func scaleMask(in string, w, h int, sinks ...string) stream {
+	c := buildChain(scaleTo(w, h))
+	if len(sinks) > 1 {
+		c = append(c, filter("split="+strconv.Itoa(len(sinks))))
+	}
+	return stream{sources: []string{in}, chain: c, sinks: sinks}
+}
+
+// halfSource scales [src1] to w x h into [srcHalf].
+func halfSource(w, h int) stream {
+	return stream{
+		sources: []string{"[src1]"},
+		chain:   buildChain(scaleTo(w, h)),
+		sinks:   []string{"[srcHalf]"},
+	}
+}
+
+// maskedMotion blacks out the pixels of src that are outside of mask, both of
+// size w x h. The result is [<prefix>masked].
+func maskedMotion(prefix, src, mask string, w, h int) filterGraph {
+	alpha := "[" + prefix + "alpha]"
+	black := "[" + prefix + "black]"
+	return filterGraph{
+		{
+			sources: []string{src + mask},
+			chain:   buildChain("alphamerge"),
+			sinks:   []string{alpha},
+		},
+		{
+			chain: buildChain("color=color=black:size=" + videoSize(w, h)),
+			sinks: []string{black},
+		},
+		{
+			sources: []string{black + alpha},
+			chain:   buildChain("overlay"),
+			sinks:   []string{"[" + prefix + "masked]"},
+		},
+	}
+}
+
+// redMask paints in red the pixels that are outside of mask, of size w x h,
+// into [maskedred] to visualize the area ignored by the motion detection.
+func redMask(mask string, w, h int) filterGraph {
+	return filterGraph{
+		{
+			chain: buildChain("color=color=red:size=" + videoSize(w, h)),
+			sinks: []string{"[red]"},
+		},
+		{
+			sources: []string{mask},
+			chain:   buildChain("lut=y=negval"),
+			sinks:   []string{"[maskneg]"},
+		},
+		{
+			sources: []string{"[red][maskneg]"},
+			chain:   buildChain("alphamerge"),
+			sinks:   []string{"[maskedred]"},
+		},
+	}
+}
+
+// timestamped draws the timestamp on [src2], followed by the extra filters,
+// into sink.
+func timestamped(drawTimestamp filter, sink string, extra ...any) stream {
+	return stream{
+		sources: []string{"[src2]"},
+		chain:   buildChain(append([]any{drawTimestamp}, extra...)...),
+		sinks:   []string{sink},
+	}
+}
+
+// constructStyle constructs the filter graph for the style.
+//
+// drawTimestamp and drawYAVG are the text overlays to use.
+func constructStyle(s style, w, h int, drawTimestamp, drawYAVG filter) filterGraph {
+	hw, hh := halfDims(w, h)
+	var fg filterGraph
+	switch s {
+	case "normal":
+		fg = append(fg, denoiseSplit(), scaleMask("[1:v]", hw, hh, "[mask]"), halfSource(hw, hh))
+		fg = append(fg, maskedMotion("", "[srcHalf]", "[mask]", hw, hh)...)
+		fg = append(fg,
+			stream{
 				sources: []string{"[masked]"},
 				chain:   buildChain(motionEdgeDetect, "signalstats", printYAVGtoPipe, "nullsink"),
 			},
-			{
-				sources: []string{"[src2]"},
-				chain:   buildChain(drawTimestamp),
-				sinks:   []string{"[out]"},
-			},
-		}
+			timestamped(drawTimestamp, "[out]"))
 	case "normal_no_mask":
-		return filterGraph{
-			{
-				sources: []string{"[0:v]"},
-				chain:   buildChain("hqdn3d", "split=2"),
-				sinks:   []string{"[src1]", "[src2]"},
-			},
-			{
+		fg = append(fg,
+			denoiseSplit(),
+			stream{
 				sources: []string{"[src1]"},
 				chain:   buildChain(scaleHalf, motionEdgeDetect, "signalstats", printYAVGtoPipe, "nullsink"),
 			},
-			{
-				sources: []string{"[src2]"},
-				chain:   buildChain(drawTimestamp),
-				sinks:   []string{"[out]"},
-			},
-		}
+			timestamped(drawTimestamp, "[out]"))
 	case "motion_only":
-		return filterGraph{
-			{
+		fg = append(fg,
+			stream{
 				sources: []string{"[0:v]"},
-				chain:   buildChain("hqdn3d", scaleHalf),
+				chain:   buildChain("hqdn3d", scaleTo(hw, hh)),
 				sinks:   []string{"[src]"},
 			},
-			{
-				sources: []string{"[1:v]"},
-				chain:   buildChain("scale="+halfSize, "split=2"),
-				sinks:   []string{"[mask1]", "[mask2]"},
-			},
-			{
-				sources: []string{"[src][mask1]"},
-				chain:   buildChain("alphamerge"),
-				sinks:   []string{"[alpha]"},
-			},
-			{
-				chain: buildChain("color=color=black:size=" + halfSize),
-				sinks: []string{"[black]"},
-			},
-			{
-				sources: []string{"[black][alpha]"},
-				chain:   buildChain("overlay"),
-				sinks:   []string{"[masked]"},
-			},
-			{
-				sources: []string{"[masked]"},
-				chain:   buildChain(motionEdgeDetect, "signalstats", printYAVGtoPipe),
-				sinks:   []string{"[motion]"},
-			},
-			{
-				chain: buildChain("color=color=red:size=" + halfSize),
-				sinks: []string{"[red]"},
-			},
-			{
-				sources: []string{"[mask2]"},
-				chain:   buildChain("lut=y=negval"),
-				sinks:   []string{"[maskneg]"},
-			},
-			{
-				sources: []string{"[red][maskneg]"},
-				chain:   buildChain("alphamerge"),
-				sinks:   []string{"[maskedred]"},
-			},
-			{
-				sources: []string{"[motion][maskedred]"},
-				chain:   buildChain("overlay", "scale=iw*2:ih*2"),
-				sinks:   []string{"[out]"},
-			},
-		}
+			scaleMask("[1:v]", hw, hh, "[mask1]", "[mask2]"))
+		fg = append(fg, maskedMotion("", "[src]", "[mask1]", hw, hh)...)
+		fg = append(fg, stream{
+			sources: []string{"[masked]"},
+			chain:   buildChain(motionEdgeDetect, motionBBox, "signalstats", printYAVGtoPipe),
+			sinks:   []string{"[motion]"},
+		})
+		fg = append(fg, redMask("[mask2]", hw, hh)...)
+		fg = append(fg, stream{
+			sources: []string{"[motion][maskedred]"},
+			chain:   buildChain("overlay", "scale=iw*2:ih*2"),
+			sinks:   []string{"[out]"},
+		})
 	case "overlay":
-		return filterGraph{
-			{
-				sources: []string{"[0:v]"},
-				chain:   buildChain("hqdn3d", "split=2"),
-				sinks:   []string{"[src1]", "[src2]"},
-			},
-			{
-				sources: []string{"[1:v]"},
-				chain:   buildChain("scale=" + halfSize),
-				sinks:   []string{"[mask]"},
-			},
-			{
-				sources: []string{"[src1]"},
-				chain:   buildChain(scaleHalf),
-				sinks:   []string{"[srcHalf]"},
-			},
-			{
-				sources: []string{"[srcHalf][mask]"},
-				chain:   buildChain("alphamerge"),
-				sinks:   []string{"[alpha]"},
-			},
-			{
-				chain: buildChain("color=color=black:size=" + halfSize),
-				sinks: []string{"[black]"},
-			},
-			{
-				sources: []string{"[black][alpha]"},
-				chain:   buildChain("overlay"),
-				sinks:   []string{"[masked]"},
-			},
-			{
+		fg = append(fg, denoiseSplit(), scaleMask("[1:v]", hw, hh, "[mask]"), halfSource(hw, hh))
+		fg = append(fg, maskedMotion("", "[srcHalf]", "[mask]", hw, hh)...)
+		fg = append(fg,
+			stream{
 				sources: []string{"[masked]"},
-				chain:   buildChain(motionEdgeDetect, "signalstats", printYAVGtoPipe, drawYAVG, "scale=iw*2:ih*2"),
+				chain:   buildChain(motionEdgeDetect, motionBBox, "signalstats", printYAVGtoPipe, drawYAVG, scaleTo(w, h)),
 				sinks:   []string{"[motion]"},
 			},
-			{
+			stream{
 				sources: []string{"[src2]", "[motion]"},
 				chain:   buildChain("blend=lighten", drawTimestamp),
 				sinks:   []string{"[out]"},
-			},
-		}
+			})
 	case "both":
-		return filterGraph{
-			{
-				sources: []string{"[0:v]"},
-				chain:   buildChain("hqdn3d", "split=2"),
-				sinks:   []string{"[src1]", "[src2]"},
-			},
-			{
-				sources: []string{"[1:v]"},
-				chain:   buildChain("scale="+halfSize, "split=2"),
-				sinks:   []string{"[mask1]", "[mask2]"},
-			},
-			{
-				sources: []string{"[src1]"},
-				chain:   buildChain(scaleHalf),
-				sinks:   []string{"[srcHalf]"},
-			},
-			{
-				sources: []string{"[srcHalf][mask1]"},
-				chain:   buildChain("alphamerge"),
-				sinks:   []string{"[alpha]"},
-			},
-			{
-				chain: buildChain("color=color=black:size=" + halfSize),
-				sinks: []string{"[black]"},
-			},
-			{
-				sources: []string{"[black][alpha]"},
-				chain:   buildChain("overlay"),
-				sinks:   []string{"[masked]"},
-			},
-			{
+		fg = append(fg, denoiseSplit(), scaleMask("[1:v]", hw, hh, "[mask1]", "[mask2]"), halfSource(hw, hh))
+		fg = append(fg, maskedMotion("", "[srcHalf]", "[mask1]", hw, hh)...)
+		fg = append(fg,
+			stream{
 				sources: []string{"[masked]"},
-				chain:   buildChain(motionEdgeDetect, "signalstats", printYAVGtoPipe, drawYAVG),
+				chain:   buildChain(motionEdgeDetect, motionBBox, "signalstats", printYAVGtoPipe, drawYAVG),
 				sinks:   []string{"[motion]"},
 			},
-			{
-				sources: []string{"[src2]"},
-				chain:   buildChain(drawTimestamp, "pad='iw*2':ih"),
-				sinks:   []string{"[overlay1]"},
-			},
-			{
-				chain: buildChain("color=color=red:size=" + halfSize),
-				sinks: []string{"[red]"},
-			},
-			{
-				sources: []string{"[mask2]"},
-				chain:   buildChain("lut=y=negval"),
-				sinks:   []string{"[maskneg]"},
-			},
-			{
-				sources: []string{"[red][maskneg]"},
-				chain:   buildChain("alphamerge"),
-				sinks:   []string{"[maskedred]"},
-			},
-			{
+			timestamped(drawTimestamp, "[overlay1]", "pad='iw*2':ih"))
+		fg = append(fg, redMask("[mask2]", hw, hh)...)
+		fg = append(fg,
+			stream{
 				sources: []string{"[motion][maskedred]"},
 				chain:   buildChain("overlay", "scale=iw*2:ih*2"),
 				sinks:   []string{"[overlay2]"},
 			},
-			{
+			stream{
 				sources: []string{"[overlay1][overlay2]"},
 				chain:   buildChain("overlay='w'"),
 				sinks:   []string{"[out]"},
+			})
+	case "raw":
+		// Like "normal" but the recording is not denoised to keep the details.
+		// The motion detection is still denoised to keep the same sensitivity.
+		fg = append(fg,
+			stream{
+				sources: []string{"[0:v]"},
+				chain:   buildChain("split=2"),
+				sinks:   []string{"[src1]", "[src2]"},
 			},
-		}
+			scaleMask("[1:v]", hw, hh, "[mask]"),
+			stream{
+				sources: []string{"[src1]"},
+				chain:   buildChain("hqdn3d", scaleTo(hw, hh)),
+				sinks:   []string{"[srcHalf]"},
+			})
+		fg = append(fg, maskedMotion("", "[srcHalf]", "[mask]", hw, hh)...)
+		fg = append(fg,
+			stream{
+				sources: []string{"[masked]"},
+				chain:   buildChain(motionEdgeDetect, "signalstats", printYAVGtoPipe, "nullsink"),
+			},
+			timestamped(drawTimestamp, "[out]"))
 	default:
 		panic("unknown style " + s)
 	}
+	return fg
 }
 
 // ffmpegOptions is the options to pass to ffmpeg to retrieve the video.
 type ffmpegOptions struct {
-	// src is the source video.
+	// src is the source video. A video file is prefixed with "file:", see
+	// resolveSource.
 	src string
-	// mask is an optional file path to a mask.
+	// realtime reads a video file source at its native frame rate to simulate
+	// a camera. It is ignored for the other sources.
+	realtime bool
+	// mask is an optional file path to a mask, or a data URI generated from
+	// -roi.
 	mask string
 	// w, h, fps are frame size and frame rate.
 	w, h, fps int
@@ -410,27 +713,388 @@ type ffmpegOptions struct {
 	d time.Duration
 	// s controls the video format generated, see style's documentation.
 	s style
-	// codec is one of h264 or libx265. libx265 takes about twice the CPU usage.
-	codec string
+	// codec is one of validCodecs. libx265 takes about twice the CPU usage.
+	codec codec
+	// crf is the constant rate factor. 0 selects the codec's default.
+	crf int
+	// preset is the encoder speed preset. Defaults to "fast".
+	preset string
+	// container is the continuous recording format, either "hls" (MPEG-TS
+	// segments) or "dash" (fragmented MP4 segments). Defaults to "hls".
+	container string
+	// segmentDuration is the target duration of the segments. Defaults to 4s.
+	// Segments are cut on keyframes so the actual duration varies.
+	segmentDuration time.Duration
+	// dailyDirs writes the segments in a directory per day, e.g.
+	// 2006-01-02/15-04-05.ts, so each directory stays small.
+	dailyDirs bool
+	// segmentWallclock cuts the HLS segments on wall clock boundaries, e.g.
+	// :00, :04, :08, so the segment file names are predictable.
+	segmentWallclock bool
+	// profile is the optional encoder profile, e.g. "baseline" for maximum
+	// compatibility with older playback devices. See validProfiles.
+	profile string
+	// profileLevel is the optional encoder level, e.g. "3.1". It is named this
+	// way to not be confused with level below.
+	profileLevel string
+	// fontFile is the font used by the text overlays. Defaults to defaultFont.
+	fontFile string
+	// timestampFormat is the strftime format of the timestamp overlay.
+	// Defaults to defaultTimestampFormat.
+	timestampFormat string
+	// timestampPos is the position of the timestamp overlay. Defaults to
+	// bottom-right.
+	timestampPos position
+	// timestampSize is the font size of the timestamp overlay. Defaults to 48.
+	timestampSize int
+	// noTimestamp disables the timestamp overlay, e.g. when the video is fed
+	// to downstream analytics.
+	noTimestamp bool
+	// name is an optional label drawn at the top left, e.g. the camera or site
+	// name.
+	name string
+	// frameCounter is the position of the frame counter overlay. It is disabled
+	// when empty.
+	frameCounter position
+	// extraFilter is an optional user specified filter chain appended verbatim
+	// to the recorded video, e.g. "eq=brightness=0.06".
+	extraFilter filter
+	// audio is the optional audio device to record and to measure the sound
+	// level of, e.g. "hw:1" with ALSA.
+	audio string
+	// mask2 is an optional file path to the mask of a second detection zone,
+	// which has its own threshold.
+	mask2 string
+	// outputPipe is an optional path to a named pipe (FIFO) or a file to write
+	// a MPEG-TS stream to, for custom downstream processing.
+	outputPipe string
+	// preroll outputs the frames as recorded, at full resolution and frame
+	// rate, as a MultiPart JPEG stream for the in-memory pre-roll.
+	preroll bool
 	// mpjpeg determines is the MultiPart JPEG stream is enabled.
 	mpjpeg bool
+	// mpjpegPeak sends all the frames to the MultiPart JPEG stream so the one
+	// with the highest YAVG per second is selected by teeMimePart. It costs
+	// more CPU to encode the JPEGs.
+	mpjpegPeak bool
+	// mpjpegFPS is the frame rate of the MultiPart JPEG stream. Defaults to 1.
+	// It is ignored with mpjpegPeak.
+	mpjpegFPS float64
+	// mpjpegQuality is the JPEG qscale of the MultiPart JPEG stream, between 1
+	// and 31, lower is better. Defaults to 2.
+	mpjpegQuality int
+	// mpjpegScale optionally reduces the resolution of the MultiPart JPEG
+	// stream. The recording is not affected.
+	mpjpegScale scaleSpec
 	// level determines ffmpeg's output.
 	//
 	// It is recommended to use "repeat+warning". Using "repeat+level+debug" can
 	// be useful as it prints out filtergraph information per frame. The amount
 	// of data generated is impractical in steady state.
 	level string
+	// inputArgs are extra arguments for the camera input, after the built-in
+	// ones so they can override them.
+	inputArgs []string
+	// outputArgs are extra arguments for the continuous recording output, after
+	// the built-in ones so they can override them.
+	outputArgs []string
 
 	_ struct{}
 }
 
+// scaleSpec is a downscaling specification, either a width in pixels like
+// "640" or a fraction of the size like "0.5". The aspect ratio is preserved.
+type scaleSpec struct {
+	width    int
+	fraction float64
+}
+
+func (s *scaleSpec) Set(v string) error {
+	if w, err := strconv.Atoi(v); err == nil {
+		if w < 2 {
+			return fmt.Errorf("invalid width %d; must be at least 2", w)
+		}
+		*s = scaleSpec{width: w}
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f <= 0 || f >= 1 {
+		return fmt.Errorf("invalid scale %q; must be a width in pixels or a fraction between 0 and 1", v)
+	}
+	*s = scaleSpec{fraction: f}
+	return nil
+}
+
+func (s *scaleSpec) String() string {
+	if s.width != 0 {
+		return strconv.Itoa(s.width)
+	}
+	if s.fraction != 0 {
+		return strconv.FormatFloat(s.fraction, 'f', -1, 64)
+	}
+	return ""
+}
+
+// filter returns the scale filter, or an empty filter when no scaling is
+// requested. The dimensions are rounded to even values.
+func (s *scaleSpec) filter() filter {
+	if s.width != 0 {
+		return filter("scale=w='min(" + strconv.Itoa(s.width) + ",iw)':h=-2")
+	}
+	if s.fraction != 0 {
+		return filter("scale=w=trunc(iw*" + strconv.FormatFloat(s.fraction, 'f', -1, 64) + "/2)*2:h=-2")
+	}
+	return ""
+}
+
+// codec is a video encoder supported by ffmpeg.
+type codec string
+
+func (c *codec) Set(v string) error {
+	options := ""
+	for i, x := range validCodecs {
+		if v == string(x) {
+			*c = x
+			return nil
+		}
+		if i != 0 {
+			options += ", "
+		}
+		options += string(x)
+	}
+	return errors.New("invalid codec. Supported values are: " + options)
+}
+
+func (c *codec) String() string {
+	return string(*c)
+}
+
+// validCodecs is the valid codec values.
+//
+// h264_v4l2m2m and h264_omx are the hardware encoders on a Raspberry Pi and
+// h264_videotoolbox on macOS. libvpx-vp9 and libaom-av1 can't be stored in
+// MPEG-TS so they require the dash container. "auto" is replaced with the
+// best hardware encoder found by resolveCodec.
+var validCodecs = []codec{"h264", "libx265", "libvpx-vp9", "libaom-av1", "h264_v4l2m2m", "h264_omx", "h264_videotoolbox", "auto"}
+
+// hardwareCodecs is the hardware H.264 encoders to try for -codec auto, by
+// order of preference, per OS.
+//
+// h264_omx is deprecated in favor of h264_v4l2m2m but is the only one
+// available on older Raspberry Pi OS releases.
+var hardwareCodecs = map[string][]codec{
+	"darwin": {"h264_videotoolbox"},
+	"linux":  {"h264_v4l2m2m", "h264_omx"},
+}
+
+// parseEncoders returns the video encoders listed by "ffmpeg -encoders".
+func parseEncoders(b []byte) map[codec]bool {
+	out := map[codec]bool{}
+	// Skip the legend, which ends with a line of dashes.
+	_, b, _ = bytes.Cut(b, []byte("------\n"))
+	for _, l := range strings.Split(string(b), "\n") {
+		// The lines look like:
+		//  V....D h264_v4l2m2m         V4L2 mem2mem H.264 encoder wrapper (codec h264)
+		if f := strings.Fields(l); len(f) >= 2 && len(f[0]) == 6 && f[0][0] == 'V' {
+			out[codec(f[1])] = true
+		}
+	}
+	return out
+}
+
+// resolveCodec returns c, or the best hardware encoder that works when c is
+// "auto". It falls back to h264 if none is found.
+//
+// An encoder can be compiled in ffmpeg without the hardware being present, so
+// each candidate is tried on a few frames.
+func resolveCodec(ctx context.Context, c codec) codec {
+	if c != "auto" {
+		return c
+	}
+	// #nosec G204
+	out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-encoders").Output()
+	if err != nil {
+		slog.Warn("codec", "msg", "failed to list the encoders", "err", err)
+	}
+	available := parseEncoders(out)
+	for _, hw := range hardwareCodecs[runtime.GOOS] {
+		if !available[hw] {
+			continue
+		}
+		rc, _ := hw.encoderArgs(0, "")
+		args := []string{"ffmpeg", "-hide_banner", "-loglevel", "error", "-f", "lavfi", "-i", "testsrc=size=320x240:rate=15", "-frames:v", "15", "-c:v", string(hw)}
+		args = append(args, rc...)
+		args = append(args, "-f", "null", "-")
+		// #nosec G204
+		if out, err = exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
+			slog.Info("codec", "msg", "hardware encoder is not usable", "codec", hw, "err", err, "out", string(bytes.TrimSpace(out)))
+			continue
+		}
+		slog.Info("codec", "auto", hw)
+		return hw
+	}
+	slog.Info("codec", "msg", "no hardware encoder found", "auto", "h264")
+	return "h264"
+}
+
+// mpegtsCompatible returns true if the codec can be stored in MPEG-TS.
+func (c codec) mpegtsCompatible() bool {
+	return c != "libvpx-vp9" && c != "libaom-av1"
+}
+
+// validPresets is the presets supported by libx264 and libx265, from fastest
+// to slowest.
+var validPresets = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow", "placebo"}
+
+// encoderArgs returns the rate control and speed arguments for the codec.
+//
+// crf is the constant rate factor, lower is better quality; 0 selects the
+// codec's default. preset is the speed preset; an empty value
+// selects "fast".
+func (c codec) encoderArgs(crf int, preset string) ([]string, error) {
+	switch c {
+	case "auto":
+		return nil, errors.New("codec auto must be resolved with resolveCodec")
+	case "libvpx-vp9", "libaom-av1":
+		if preset != "" {
+			return nil, fmt.Errorf("codec %s doesn't support -preset", c)
+		}
+		if crf == 0 {
+			crf = 35
+		} else if crf < 0 || crf > 63 {
+			return nil, fmt.Errorf("invalid crf %d for codec %s; must be between 1 and 63", crf, c)
+		}
+		// -b:v 0 is required for constant quality mode.
+		// https://trac.ffmpeg.org/wiki/Encode/VP9
+		// https://trac.ffmpeg.org/wiki/Encode/AV1
+		out := []string{"-crf", strconv.Itoa(crf), "-b:v", "0"}
+		if c == "libvpx-vp9" {
+			out = append(out, "-deadline", "realtime")
+		} else {
+			out = append(out, "-usage", "realtime")
+		}
+		return append(out, "-cpu-used", "8", "-row-mt", "1"), nil
+	case "h264_v4l2m2m", "h264_omx", "h264_videotoolbox":
+		// Hardware encoders ignore -crf.
+		if preset != "" || crf != 0 {
+			return nil, fmt.Errorf("codec %s doesn't support -crf nor -preset", c)
+		}
+		return []string{"-b:v", "2M"}, nil
+	default:
+		if preset == "" {
+			preset = "fast"
+		} else if !slices.Contains(validPresets, preset) {
+			return nil, fmt.Errorf("invalid preset %q. Supported values are: %s", preset, strings.Join(validPresets, ", "))
+		}
+		if crf == 0 {
+			crf = 30
+		} else if crf < 0 || crf > 51 {
+			return nil, fmt.Errorf("invalid crf %d; must be between 1 and 51", crf)
+		}
+		return []string{"-preset", preset, "-crf", strconv.Itoa(crf)}, nil
+	}
+}
+
+// validProfiles is the profiles supported by each codec.
+//
+// The first entries use 8 bits 4:2:0 chroma subsampling, which is what most
+// playback devices support.
+var validProfiles = map[string][]string{
+	"h264":    {"baseline", "main", "high", "high10", "high422", "high444"},
+	"libx265": {"main", "main10", "main12", "main422-10", "main444-8", "mainstillpicture"},
+}
+
+// validLevels is the levels supported by each codec.
+var validLevels = map[string][]string{
+	"h264":    {"1", "1b", "1.1", "1.2", "1.3", "2", "2.1", "2.2", "3", "3.1", "3.2", "4", "4.1", "4.2", "5", "5.1", "5.2", "6", "6.1", "6.2"},
+	"libx265": {"1", "2", "2.1", "3", "3.1", "4", "4.1", "5", "5.1", "5.2", "6", "6.1", "6.2"},
+}
+
+// profileArgs returns the encoder arguments to select the profile and level
+// for the codec.
+func profileArgs(codec, profile, level string) ([]string, error) {
+	var out []string
+	if profile != "" {
+		p, ok := validProfiles[codec]
+		if !ok {
+			return nil, fmt.Errorf("codec %q doesn't support selecting a profile", codec)
+		}
+		if !slices.Contains(p, profile) {
+			return nil, fmt.Errorf("invalid profile %q for codec %q. Supported values are: %s", profile, codec, strings.Join(p, ", "))
+		}
+		out = append(out, "-profile:v", profile)
+		// Cameras frequently output 4:2:2 and the encoder would then silently
+		// select a 4:2:2 profile. Force 4:2:0 for the 8 bits profiles.
+		if profile == "baseline" || profile == "main" || profile == "high" {
+			out = append(out, "-pix_fmt", "yuv420p")
+		}
+	}
+	if level != "" {
+		l, ok := validLevels[codec]
+		if !ok {
+			return nil, fmt.Errorf("codec %q doesn't support selecting a level", codec)
+		}
+		if !slices.Contains(l, level) {
+			return nil, fmt.Errorf("invalid level %q for codec %q. Supported values are: %s", level, codec, strings.Join(l, ", "))
+		}
+		if codec == "libx265" {
+			// libx265 doesn't support -level.
+			out = append(out, "-x265-params", "level-idc="+level)
+		} else {
+			out = append(out, "-level:v", level)
+		}
+	}
+	return out, nil
+}
+
+// resolveSource returns src prefixed with ffmpeg's "file:" protocol when it is
+// a video file, either with a "file://" prefix or a regular file that exists.
+// Devices like /dev/video0 and network sources are returned as is.
+func resolveSource(src string) string {
+	if p, ok := strings.CutPrefix(src, "file://"); ok {
+		return "file:" + p
+	}
+	if fi, err := os.Stat(src); err == nil && fi.Mode().IsRegular() {
+		return "file:" + src
+	}
+	return src
+}
+
+// isFileSource returns true if src, as returned by resolveSource, is a video
+// file.
+//
+// A video file is read natively by ffmpeg, without the capture and low latency
+// flags, which permits running the whole pipeline on a recording.
+func isFileSource(src string) bool {
+	return strings.HasPrefix(src, "file:")
+}
+
 // buildFFMPEGCmd builds the command line to exec ffmpeg.
 //
 // Outputs:
-// - HLS and all.m3u8 into the current working directory.
+// - HLS and all.m3u8 (or DASH and all.mpd) into the current working directory.
 // - YAVG metadata to the first pipe in ExtraFiles.
 // - Mime encoded JPEG stream to the second pipe in ExtraFiles, if mpjpeg is true.
+// - MPEG-TS stream to the third pipe in ExtraFiles, if outputPipe is set.
+// - Audio level metadata to the fourth pipe in ExtraFiles, if audio is set.
+// - YAVG metadata of the second zone to the fifth pipe in ExtraFiles, if mask2
+// is set.
+// - Mime encoded JPEG stream of the recorded frames to the sixth pipe in
+// ExtraFiles, if preroll is true.
 func buildFFMPEGCmd(o *ffmpegOptions) ([]string, error) {
+	// Encoding options, shared by the outputs that need to be encoded.
+	enc, err := o.videoEncoderArgs()
+	if err != nil {
+		return nil, err
+	}
+	if !o.codec.mpegtsCompatible() {
+		if o.container != "dash" {
+			return nil, fmt.Errorf("codec %s requires -container dash", o.codec)
+		}
+		if o.outputPipe != "" {
+			return nil, fmt.Errorf("codec %s can't be used with an output pipe", o.codec)
+		}
+	}
 	args := []string{
 		"ffmpeg",
 		"-hide_banner",
@@ -442,7 +1106,13 @@ func buildFFMPEGCmd(o *ffmpegOptions) ([]string, error) {
 		// present.
 		//"-hwaccel", "auto",
 	}
-	if strings.HasPrefix(o.src, "tcp://") {
+	if isFileSource(o.src) {
+		// Let ffmpeg detect the file format. The frame rate is the file's, the
+		// frame size is scaled to w x h by the filter graph.
+		if o.realtime {
+			args = append(args, "-re")
+		}
+	} else if strings.HasPrefix(o.src, "tcp://") {
 		// This is hardcoding the raspivid use case. Create an issue if this is a
 		// problem.
 		args = append(args, "-f", "h264")
@@ -466,40 +1136,84 @@ func buildFFMPEGCmd(o *ffmpegOptions) ([]string, error) {
 			"-analyzeduration", "0",
 			"-video_size", strconv.Itoa(o.w)+"x"+strconv.Itoa(o.h))
 	}
-	args = append(args,
-		// Warning: the camera driver may decide another framerate. Sadly this fact
-		// is output by ffmpeg at info level, not warning level. Use the "-v" flag
-		// to see it. It looks like:
-		//	[video4linux2,v4l2 @ 0x63b48c816180] The driver changed the time per frame from 1/15 to 1/10
-		"-framerate", strconv.Itoa(o.fps),
-		"-i", o.src,
-	)
+	if !isFileSource(o.src) {
+		args = append(args,
+			// Warning: the camera driver may decide another framerate. Sadly this
+			// fact is output by ffmpeg at info level, not warning level. Use the
+			// "-v" flag to see it. It looks like:
+			//	[video4linux2,v4l2 @ 0x63b48c816180] The driver changed the time per frame from 1/15 to 1/10
+			// frameRateWatcher detects it and filterMotion measures the actual
+			// frame rate in any case.
+			"-framerate", strconv.Itoa(o.fps),
+		)
+	}
+	args = append(args, o.inputArgs...)
+	args = append(args, "-i", o.src)
 	if o.mask != "" {
 		args = append(args, "-i", o.mask)
 	} else {
+		// A white mask doesn't mask anything. It is resized to the frame size by
+		// the style. It is always added, even when not used with
+		// "normal_no_mask", so the inputs after it have a stable index.
 		args = append(args, "-f", "lavfi", "-i", "color=color=white:size=32x32")
 	}
-	fg := constructFilterGraph(o.s, o.w, o.h)
+	if o.audio != "" {
+		a, err := audioInputArgs(o.audio)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a...)
+	}
+	if o.mask2 != "" {
+		args = append(args, "-i", o.mask2)
+	}
+	fg := constructFilterGraph(o)
 	hlsOut := "[out]"
+	// Split the output when there are other outputs than HLS.
+	outs := []string{"[outHLS]"}
+	if o.mpjpeg {
+		outs = append(outs, "[out2]")
+	}
+	if o.outputPipe != "" {
+		outs = append(outs, "[outPipe]")
+	}
+	if o.preroll {
+		outs = append(outs, "[outPreroll]")
+	}
+	if len(outs) > 1 {
+		fg = append(fg, stream{
+			sources: []string{"[out]"},
+			chain:   buildChain("split=" + strconv.Itoa(len(outs))),
+			sinks:   outs,
+		})
+		hlsOut = "[outHLS]"
+	}
 	// MJPEG stream (optional)
 	if o.mpjpeg {
 		// Append the mpjpeg specific filterGraph.
-		fg = append(fg,
-			stream{
-				sources: []string{"[out]"},
-				chain:   buildChain("split=2"),
-				sinks:   []string{"[outHLS]", "[out2]"},
-			},
-			// TODO: Select the frame with the highest YAVG value in the past second.
-			// This would increase jitter slightly but would make a much better
+		var c chain
+		if o.mpjpegPeak {
+			// The frame with the highest YAVG value in the past second is selected
+			// in teeMimePart. This increases jitter slightly but makes a much better
 			// visual when in style "motion_only" or "both".
+			c = buildChain("null")
+		} else {
+			fps := "1"
+			if o.mpjpegFPS > 0 {
+				fps = strconv.FormatFloat(o.mpjpegFPS, 'f', -1, 64)
+			}
+			c = buildChain("fps=fps=" + fps)
+		}
+		if f := o.mpjpegScale.filter(); f != "" {
+			c = append(c, f)
+		}
+		fg = append(fg,
 			stream{
 				sources: []string{"[out2]"},
-				chain:   buildChain("fps=fps=1"),
+				chain:   c,
 				sinks:   []string{"[outMPJPEG]"},
 			},
 		)
-		hlsOut = "[outHLS]"
 	}
 	args = append(args,
 		"-filter_complex", fg.String(),
@@ -510,39 +1224,177 @@ func buildFFMPEGCmd(o *ffmpegOptions) ([]string, error) {
 		args = append(args, "-t", fmt.Sprintf("%.1fs", float64(o.d)/float64(time.Second)))
 	}
 
-	// HLS:
+	// Continuous recording:
+	args = append(args, "-map", hlsOut)
+	args = append(args, enc...)
+	if o.audio != "" {
+		args = append(args, "-map", "2:a", "-c:a", "aac", "-b:a", "64k")
+	}
 	args = append(args,
-		"-map", hlsOut,
-		"-c:v", o.codec,
-		"-preset", "fast",
-		"-crf", "30",
-		"-f", "hls",
 		"-metadata", "service_provider='https://github.com/maruel/record-videos'",
 		"-metadata", "service_name='ffmpeg'",
-		"-hls_list_size", "0",
-		"-strftime", "1",
-		"-hls_allow_cache", "1",
-		"-hls_flags", "independent_segments",
-		"-hls_segment_filename", "%Y-%m-%dT%H-%M-%S.ts",
-		"all.m3u8",
 	)
+	segDur := "4"
+	if o.segmentDuration > 0 {
+		segDur = strconv.FormatFloat(o.segmentDuration.Seconds(), 'f', -1, 64)
+	}
+	switch o.container {
+	case "", "hls":
+		if o.segmentWallclock {
+			if o.dailyDirs {
+				// The segment muxer can't create the directories.
+				return nil, errors.New("wall clock aligned segments can't be written in daily directories")
+			}
+			// The hls muxer can't align on the clock, use the segment muxer instead
+			// which generates a compatible playlist.
+			// https://ffmpeg.org/ffmpeg-formats.html#segment_002c-stream_005fsegment_002c-ssegment
+			//
+			// A segment can only be cut on a keyframe, so force one every second.
+			// The cut happens on the first keyframe after the clock boundary, so it
+			// is at most one second late. This increases the file size a bit.
+			args = append(args,
+				"-force_key_frames", "expr:gte(t,n_forced*1)",
+				"-f", "segment",
+				"-segment_time", segDur,
+				"-segment_atclocktime", "1",
+				"-segment_format", "mpegts",
+				"-segment_list", "all.m3u8",
+				"-segment_list_type", "m3u8",
+				"-segment_list_size", "0",
+				"-segment_list_flags", "+live",
+				"-strftime", "1",
+				"%Y-%m-%dT%H-%M-%S.ts",
+			)
+			break
+		}
+		args = append(args,
+			"-f", "hls",
+			"-hls_list_size", "0",
+			"-strftime", "1",
+		)
+		segName := "%Y-%m-%dT%H-%M-%S.ts"
+		if o.dailyDirs {
+			segName = "%Y-%m-%d/%H-%M-%S.ts"
+			args = append(args, "-strftime_mkdir", "1")
+		}
+		args = append(args,
+			"-hls_allow_cache", "1",
+			"-hls_time", segDur,
+			"-hls_flags", "independent_segments",
+			"-hls_segment_filename", segName,
+			"all.m3u8",
+		)
+	case "dash":
+		if o.segmentWallclock {
+			return nil, errors.New("wall clock aligned segments require the hls container")
+		}
+		if o.dailyDirs {
+			return nil, errors.New("daily directories require the hls container")
+		}
+		// https://ffmpeg.org/ffmpeg-formats.html#dash-2
+		// The segments are fragmented MP4. The motion playlists are not generated
+		// since they reference MPEG-TS segments.
+		args = append(args,
+			"-f", "dash",
+			"-window_size", "0",
+			"-seg_duration", segDur,
+			"-use_template", "1",
+			"-use_timeline", "1",
+			"-init_seg_name", "init-$RepresentationID$.m4s",
+			"-media_seg_name", "chunk-$RepresentationID$-$Number%08d$.m4s",
+			"all.mpd",
+		)
+	default:
+		return nil, fmt.Errorf("invalid container %q. Supported values are: hls, dash", o.container)
+	}
+	if len(o.outputArgs) != 0 {
+		// Insert them before the output file name, which is always last.
+		out := args[len(args)-1]
+		args = append(append(args[:len(args)-1], o.outputArgs...), out)
+	}
 
 	// MPJPEG stream
 	if o.mpjpeg {
+		q := 2
+		if o.mpjpegQuality != 0 {
+			if o.mpjpegQuality < 1 || o.mpjpegQuality > 31 {
+				return nil, fmt.Errorf("invalid MJPEG quality %d; must be between 1 and 31", o.mpjpegQuality)
+			}
+			q = o.mpjpegQuality
+		}
 		// https://ffmpeg.org/ffmpeg-all.html#pipe
 		args = append(args,
 			"-map", "[outMPJPEG]",
 			"-f", "mpjpeg",
-			"-q", "2",
+			"-boundary_tag", mpjpegBoundary,
+			"-q", strconv.Itoa(q),
 			//"-qscale:v", "2",
 			"pipe:4",
 		)
 		// Sequence of images (don't forget to disable h264)
 		//args = append(args, "-", "2", "output_frames_%04d.jpg")
 	}
+
+	// Custom downstream processing (optional). It is encoded a second time,
+	// which doubles the CPU usage for encoding.
+	if o.outputPipe != "" {
+		args = append(args, "-map", "[outPipe]")
+		args = append(args, enc...)
+		args = append(args, "-f", "mpegts", "pipe:5")
+	}
+
+	// Pre-roll (optional). Unlike the MJPEG stream, the frames are neither
+	// downscaled nor decimated so the pre-roll looks like the recording.
+	if o.preroll {
+		args = append(args,
+			"-map", "[outPreroll]",
+			"-f", "mpjpeg",
+			"-boundary_tag", mpjpegBoundary,
+			"-q", "2",
+			"pipe:8",
+		)
+	}
 	return args, nil
 }
 
+// videoEncoderArgs returns the arguments to encode the video with the codec,
+// crf, preset, profile and level of o.
+//
+// They are also used to re-encode the "precise" clips.
+func (o *ffmpegOptions) videoEncoderArgs() ([]string, error) {
+	profile, err := profileArgs(string(o.codec), o.profile, o.profileLevel)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := o.codec.encoderArgs(o.crf, o.preset)
+	if err != nil {
+		return nil, err
+	}
+	enc := []string{"-c:v", string(o.codec)}
+	enc = append(enc, rc...)
+	return append(enc, profile...), nil
+}
+
+// audioInputArgs returns the ffmpeg arguments to capture the audio device dev.
+func audioInputArgs(dev string) ([]string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		// The audio device index, e.g. "0", as listed by
+		// ffmpeg -f avfoundation -list_devices true -i "".
+		return []string{"-f", "avfoundation", "-i", ":" + dev}, nil
+	case "linux":
+		return []string{"-f", "alsa", "-i", dev}, nil
+	case "windows":
+		return []string{"-f", "dshow", "-i", "audio=" + dev}, nil
+	default:
+		return nil, errors.New("audio is not implemented for this OS")
+	}
+}
+
+// ffmpegStderr receives the stderr of the short lived ffmpeg processes, e.g.
+// to generate the clips and the snapshots. It is replaced with -log-ffmpeg.
+var ffmpegStderr io.Writer = os.Stderr
+
 // cmdFFMPEG constructs the *exec.Cmd to run ffmpeg.
 func cmdFFMPEG(ctx context.Context, root string, args []string, handles []*os.File, stderr io.Writer) *exec.Cmd {
 	slog.Debug("exec", "args", args)
@@ -557,3 +1409,269 @@ func cmdFFMPEG(ctx context.Context, root string, args []string, handles []*os.Fi
 	cmd.ExtraFiles = handles
 	return cmd
 }
+
+// ffmpegToFile generates the file name in root with the ffmpeg command
+// returned by build.
+//
+// build is called with the temporary file to write to so a partial file is
+// never served. It keeps the extension of name so ffmpeg knows the format. The
+// temporary file is deleted on failure. stdin is optional.
+func ffmpegToFile(ctx context.Context, root, name string, stdin io.Reader, build func(dst string) ([]string, error)) error {
+	ext := filepath.Ext(name)
+	tmp := strings.TrimSuffix(name, ext) + ".tmp" + ext
+	args, err := build(tmp)
+	if err != nil {
+		return err
+	}
+	cmd := cmdFFMPEG(ctx, root, args, nil, ffmpegStderr)
+	cmd.Stdin = stdin
+	if err = cmd.Run(); err != nil {
+		_ = os.Remove(filepath.Join(root, tmp))
+		return fmt.Errorf("failed to generate %s: %w", name, err)
+	}
+	return os.Rename(filepath.Join(root, tmp), filepath.Join(root, name))
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	safe := true
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("_@%+=:,./-", c)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// splitArgs splits s into arguments like a POSIX shell, without expansion.
+//
+// Arguments are separated by white space. Single quotes preserve everything
+// literally, double quotes and the backslash escape the next character.
+func splitArgs(s string) ([]string, error) {
+	var out []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			if quote == '"' && c != '"' && c != '\\' {
+				// Inside double quotes, the backslash is only special before a
+				// double quote or a backslash.
+				cur.WriteByte('\\')
+			}
+			cur.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inArg = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				out = append(out, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(c)
+			inArg = true
+		}
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		out = append(out, cur.String())
+	}
+	return out, nil
+}
+
+// shellCommand returns the command line to run args in root from a POSIX
+// shell, as done by runFFMPEG.
+//
+// The pipes in ExtraFiles are redirected to /dev/null, except the output pipe
+// if set, so the command can be copy-pasted as is.
+func shellCommand(root string, args []string, outputPipe string) string {
+	out := "cd " + shellQuote(root) + " &&"
+	for _, a := range args {
+		out += " " + shellQuote(a)
+	}
+	p := "/dev/null"
+	if outputPipe != "" {
+		p = outputPipe
+	}
+	return out + " 3>/dev/null 4>/dev/null 5>" + shellQuote(p) + " 6>/dev/null 7>/dev/null 8>/dev/null"
+}
+
+// minFFMPEGMajor is the oldest ffmpeg major version supported.
+const minFFMPEGMajor = 4
+
+// parseFFMPEGVersion returns the major version in the output of
+// "ffmpeg -version". It returns 0 when it can't be determined, e.g. for a
+// build from git like "N-113345-g0123456789".
+func parseFFMPEGVersion(b []byte) int {
+	// ffmpeg version 6.1.1-3ubuntu5 Copyright (c) 2000-2023 the FFmpeg developers
+	l, _, _ := strings.Cut(string(b), "\n")
+	f := strings.Fields(l)
+	if len(f) < 3 || f[0] != "ffmpeg" || f[1] != "version" {
+		return 0
+	}
+	v, _, _ := strings.Cut(strings.TrimPrefix(f[2], "n"), ".")
+	major, _ := strconv.Atoi(v)
+	return major
+}
+
+// parseFilters returns the filters listed by "ffmpeg -filters".
+func parseFilters(b []byte) map[string]bool {
+	out := map[string]bool{}
+	for _, l := range strings.Split(string(b), "\n") {
+		// The lines look like:
+		//  TSC signalstats       V->V       Generate statistics from video analysis.
+		if f := strings.Fields(l); len(f) >= 3 && len(f[0]) == 3 && strings.Contains(f[2], "->") {
+			out[f[1]] = true
+		}
+	}
+	return out
+}
+
+// checkFFMPEG verifies that ffmpeg is installed, recent enough and has the
+// filters used by the filter graph built from o.
+//
+// Otherwise ffmpeg would fail in the pipeline, with an error that is easy to
+// miss, until the watchdog gives up.
+func checkFFMPEG(ctx context.Context, o *ffmpegOptions) error {
+	p, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return errors.New("ffmpeg was not found in PATH; install it, e.g. 'sudo apt install ffmpeg' or 'brew install ffmpeg'")
+	}
+	out, err := exec.CommandContext(ctx, p, "-hide_banner", "-version").Output()
+	if err != nil {
+		return fmt.Errorf("failed to run %s -version: %w", p, err)
+	}
+	if v := parseFFMPEGVersion(out); v != 0 && v < minFFMPEGMajor {
+		return fmt.Errorf("%s is version %d, version %d or later is required", p, v, minFFMPEGMajor)
+	}
+	if out, err = exec.CommandContext(ctx, p, "-hide_banner", "-filters").Output(); err != nil {
+		return fmt.Errorf("failed to run %s -filters: %w", p, err)
+	}
+	available := parseFilters(out)
+	var missing []string
+	for _, n := range constructFilterGraph(o).filterNames() {
+		if !available[n] {
+			missing = append(missing, n)
+		}
+	}
+	if len(missing) != 0 {
+		// drawtext requires ffmpeg to be built with libfreetype, which some
+		// minimal builds omit.
+		return fmt.Errorf("%s doesn't support the filters %s; install a full build of ffmpeg", p, strings.Join(missing, ", "))
+	}
+	if o.fontFile != "" {
+		if _, err = os.Stat(o.fontFile); err != nil {
+			return fmt.Errorf("font for the text overlays: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateFilterGraphTimeout bounds the time taken by validateFilterGraph.
+const validateFilterGraphTimeout = 10 * time.Second
+
+// validateFilterGraphArgs returns the command line used by
+// validateFilterGraph.
+//
+// The filter graph and its outputs are the ones from buildFFMPEGCmd but the
+// camera is replaced with a short synthetic source and the outputs are
+// discarded.
+func validateFilterGraphArgs(o *ffmpegOptions) ([]string, error) {
+	cmd, err := buildFFMPEGCmd(o)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.Index(cmd, "-filter_complex")
+	if i == -1 {
+		return nil, errors.New("internal error: no filter graph")
+	}
+	args := []string{
+		"ffmpeg",
+		"-hide_banner",
+		"-nostats",
+		"-loglevel", "error",
+		"-f", "lavfi",
+		"-t", "1",
+		"-i", "color=color=black:size=" + strconv.Itoa(o.w) + "x" + strconv.Itoa(o.h) + ":rate=" + strconv.Itoa(o.fps),
+	}
+	if o.mask != "" {
+		args = append(args, "-i", o.mask)
+	} else {
+		args = append(args, "-f", "lavfi", "-i", "color=color=white:size=32x32")
+	}
+	if o.audio != "" {
+		args = append(args, "-f", "lavfi", "-t", "1", "-i", "anullsrc=r=48000:cl=mono")
+	}
+	if o.mask2 != "" {
+		args = append(args, "-i", o.mask2)
+	}
+	args = append(args, "-filter_complex", cmd[i+1])
+	for j := i + 2; j < len(cmd)-1; j++ {
+		if cmd[j] == "-map" && strings.HasPrefix(cmd[j+1], "[") {
+			args = append(args, "-map", cmd[j+1], "-f", "null", "-")
+		}
+	}
+	return args, nil
+}
+
+// validateFilterGraph verifies that ffmpeg accepts the filter graph built
+// from o by processing one second of a synthetic source.
+//
+// Otherwise a malformed filter graph is only reported once the camera is
+// opened, with an error that is easy to miss.
+func validateFilterGraph(ctx context.Context, o *ffmpegOptions) error {
+	args, err := validateFilterGraphArgs(o)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, validateFilterGraphTimeout)
+	defer cancel()
+	// The metadata is written to the pipes, discard it.
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+	var stderr bytes.Buffer
+	cmd := cmdFFMPEG(ctx, "", args, []*os.File{null, null, null, null, null, null}, &stderr)
+	cmd.Stdout = nil
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("validating the filter graph took more than %s; use -validate-graph=false to skip", validateFilterGraphTimeout)
+		}
+		return fmt.Errorf("ffmpeg rejected the filter graph: %w\n%s\n\nfilter graph: %s", err, bytes.TrimSpace(stderr.Bytes()), args[slices.Index(args, "-filter_complex")+1])
+	}
+	return nil
+}
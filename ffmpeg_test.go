@@ -4,11 +4,790 @@
 
 package main
 
-import "testing"
+import (
+	"context"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata/")
 
 func Test(t *testing.T) {
 	// Just make sure it doesn't crash.
 	for _, s := range validStyles {
-		t.Logf("%q", constructFilterGraph(s, 640, 480).String())
+		t.Logf("%q", constructFilterGraph(&ffmpegOptions{s: s, w: 640, h: 480}).String())
+	}
+}
+
+// TestFilterGraphGolden compares the filter graphs against
+// testdata/filtergraph/. Run "go test -run TestFilterGraphGolden -update" to
+// regenerate them after changing a filter, then review the diff.
+func TestFilterGraphGolden(t *testing.T) {
+	data := []struct {
+		name string
+		o    ffmpegOptions
+	}{
+		{"both_all", ffmpegOptions{s: "both", w: 1280, h: 720, name: "Garage", frameCounter: "bl", audio: "hw:1", timestampFormat: "%T", timestampPos: "tr", timestampSize: 24}},
+		{"normal_font", ffmpegOptions{s: "normal", w: 1920, h: 1080, fontFile: "C:/Windows/Fonts/consola.ttf"}},
+		{"normal_name_audio", ffmpegOptions{s: "normal", w: 640, h: 480, name: "Front door", audio: "hw:1"}},
+		{"normal_no_timestamp", ffmpegOptions{s: "normal", w: 640, h: 480, noTimestamp: true}},
+		{"overlay_frame_counter", ffmpegOptions{s: "overlay", w: 640, h: 480, frameCounter: "tl"}},
+		{"normal_zone2", ffmpegOptions{s: "normal", w: 640, h: 480, mask2: "zone2.png"}},
+		{"motion_only_zone2_audio", ffmpegOptions{s: "motion_only", w: 640, h: 480, mask2: "zone2.png", audio: "hw:1"}},
+		{"overlay_file_zone2", ffmpegOptions{src: "file:sample.mp4", s: "overlay", w: 640, h: 480, mask2: "zone2.png"}},
+	}
+	for _, s := range validStyles {
+		data = append(data, struct {
+			name string
+			o    ffmpegOptions
+		}{string(s), ffmpegOptions{s: s, w: 640, h: 480}})
+	}
+	for _, l := range data {
+		t.Run(l.name, func(t *testing.T) {
+			// One stream per line to make the diffs readable.
+			got := ""
+			for _, x := range constructFilterGraph(&l.o) {
+				got += x.String() + "\n"
+			}
+			p := filepath.Join("testdata", "filtergraph", l.name+".txt")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(p, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatalf("%v; run with -update to create it", err)
+			}
+			if got != string(want) {
+				t.Fatalf("%s differs; run with -update and review the diff\ngot:\n%s\nwant:\n%s", p, got, want)
+			}
+		})
+	}
+}
+
+func TestFrameCounter(t *testing.T) {
+	for _, s := range validStyles {
+		for _, p := range validPositions {
+			got := constructFilterGraph(&ffmpegOptions{s: s, w: 640, h: 480, frameCounter: p}).String()
+			if strings.Count(got, "%{n}") != 1 {
+				t.Fatalf("%s %s: %q", s, p, got)
+			}
+		}
+	}
+}
+
+func TestFont(t *testing.T) {
+	for _, s := range validStyles {
+		got := constructFilterGraph(&ffmpegOptions{s: s, w: 640, h: 480, fontFile: "/fonts/Mono.ttf"}).String()
+		if !strings.Contains(got, "drawtext") {
+			// motion_only has no text overlay.
+			continue
+		}
+		if strings.Contains(got, defaultFont) || !strings.Contains(got, "fontfile=/fonts/Mono.ttf:") {
+			t.Fatalf("%s: %q", s, got)
+		}
+	}
+	if got := escapeFilterArg("C:/Windows/Fonts/consola.ttf"); got != `C\\:/Windows/Fonts/consola.ttf` {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	want := map[position]string{
+		"tl": "x=10:y=10:",
+		"tr": "x=(w-text_w-10):y=10:",
+		"bl": "x=10:y=(h-text_h-10):",
+		"br": "x=(w-text_w-10):y=(h-text_h-10):",
+	}
+	for _, p := range validPositions {
+		got := constructFilterGraph(&ffmpegOptions{s: "normal", w: 640, h: 480, timestampFormat: "%H:%M", timestampPos: p, timestampSize: 24}).String()
+		if !strings.Contains(got, "text='%{localtime\\:%H\\:%M}':"+want[p]+"fontsize=24:") {
+			t.Fatalf("%s: %q", p, got)
+		}
+	}
+	// The default is unchanged.
+	got := constructFilterGraph(&ffmpegOptions{s: "normal", w: 640, h: 480}).String()
+	if !strings.Contains(got, "text='%{localtime\\:%Y-%m-%d %T}':x=(w-text_w-10):y=(h-text_h-10):fontsize=48:") {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestNoTimestamp(t *testing.T) {
+	for _, s := range validStyles {
+		with := constructFilterGraph(&ffmpegOptions{s: s, w: 640, h: 480}).String()
+		if s != "motion_only" && strings.Count(with, "drawtext@1=") != 1 {
+			// motion_only has no text overlay.
+			t.Fatalf("%s: %q", s, with)
+		}
+		fg := constructFilterGraph(&ffmpegOptions{s: s, w: 640, h: 480, noTimestamp: true})
+		got := fg.String()
+		if strings.Contains(got, "drawtext@1=") || strings.Contains(got, "localtime") {
+			t.Fatalf("%s: %q", s, got)
+		}
+		// [out] must still be produced exactly once.
+		if n := strings.Count(got, "[out]"); n != 1 {
+			t.Fatalf("%s: %d [out]: %q", s, n, got)
+		}
+		for _, x := range fg {
+			if len(x.chain) == 0 {
+				t.Fatalf("%s: empty chain: %q", s, got)
+			}
+		}
+	}
+}
+
+func TestName(t *testing.T) {
+	for _, s := range validStyles {
+		without := constructFilterGraph(&ffmpegOptions{s: s, w: 640, h: 480}).String()
+		if strings.Contains(without, "drawtext@3") {
+			t.Fatalf("%s: %q", s, without)
+		}
+		got := constructFilterGraph(&ffmpegOptions{s: s, w: 640, h: 480, name: "Front door: it's [1]"}).String()
+		if !strings.Contains(got, `expansion=none:text=Front door\\: it\\\'s \[1\]:x=10:y=10:`) {
+			t.Fatalf("%s: %q", s, got)
+		}
+	}
+}
+
+func TestProfileArgs(t *testing.T) {
+	got, err := profileArgs("h264", "baseline", "3.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-profile:v", "baseline", "-pix_fmt", "yuv420p", "-level:v", "3.1"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("%q != %q", got, want)
+	}
+	if got, err = profileArgs("libx265", "main10", "4.1"); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"-profile:v", "main10", "-x265-params", "level-idc=4.1"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("%q != %q", got, want)
+	}
+	if _, err = profileArgs("libx265", "baseline", ""); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSegmentWallclock(t *testing.T) {
+	args, err := buildFFMPEGCmd(&ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15, codec: "h264", segmentWallclock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.Index(args, "-segment_atclocktime"); i == -1 || args[i+1] != "1" {
+		t.Fatalf("missing -segment_atclocktime: %q", args)
+	}
+	if slices.Contains(args, "hls") {
+		t.Fatalf("unexpected hls muxer: %q", args)
+	}
+	if _, err = buildFFMPEGCmd(&ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15, codec: "h264", container: "dash", segmentWallclock: true}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestDailyDirs(t *testing.T) {
+	o := ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15, codec: "h264", dailyDirs: true}
+	args, err := buildFFMPEGCmd(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.Index(args, "-hls_segment_filename"); i == -1 || args[i+1] != "%Y-%m-%d/%H-%M-%S.ts" {
+		t.Fatalf("unexpected -hls_segment_filename: %q", args)
+	}
+	if !slices.Contains(args, "-strftime_mkdir") {
+		t.Fatalf("missing -strftime_mkdir: %q", args)
+	}
+	o.segmentWallclock = true
+	if _, err = buildFFMPEGCmd(&o); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSegmentDuration(t *testing.T) {
+	o := ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15, codec: "h264"}
+	args, err := buildFFMPEGCmd(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.Index(args, "-hls_time"); i == -1 || args[i+1] != "4" {
+		t.Fatalf("unexpected -hls_time: %q", args)
+	}
+	o.segmentDuration = 2500 * time.Millisecond
+	if args, err = buildFFMPEGCmd(&o); err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.Index(args, "-hls_time"); i == -1 || args[i+1] != "2.5" {
+		t.Fatalf("unexpected -hls_time: %q", args)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	var c codec
+	if err := c.Set("libx264x"); err == nil {
+		t.Fatal("expected error")
+	}
+	base := ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15}
+	o := base
+	o.codec = "libvpx-vp9"
+	if _, err := buildFFMPEGCmd(&o); err == nil {
+		t.Fatal("expected error")
+	}
+	o.container = "dash"
+	args, err := buildFFMPEGCmd(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.Index(args, "-c:v"); i == -1 || !slices.Equal(args[i:i+6], []string{"-c:v", "libvpx-vp9", "-crf", "35", "-b:v", "0"}) {
+		t.Fatalf("%q", args)
+	}
+	o = base
+	o.codec = "h264_v4l2m2m"
+	if args, err = buildFFMPEGCmd(&o); err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(args, "-crf") {
+		t.Fatalf("%q", args)
+	}
+}
+
+func TestParseEncoders(t *testing.T) {
+	out := []byte(`Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+ V....D h264_v4l2m2m         V4L2 mem2mem H.264 encoder wrapper (codec h264)
+ A....D aac                  AAC (Advanced Audio Coding)
+`)
+	got := parseEncoders(out)
+	if !got["libx264"] || !got["h264_v4l2m2m"] || got["aac"] || got["="] || len(got) != 2 {
+		t.Fatal(got)
+	}
+	if c := resolveCodec(context.Background(), "libx265"); c != "libx265" {
+		t.Fatal(c)
+	}
+}
+
+func TestEncoderArgs(t *testing.T) {
+	o := ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15, codec: "h264", crf: 23, preset: "slow"}
+	args, err := buildFFMPEGCmd(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.Index(args, "-c:v"); i == -1 || !slices.Equal(args[i:i+6], []string{"-c:v", "h264", "-preset", "slow", "-crf", "23"}) {
+		t.Fatalf("%q", args)
+	}
+	for _, bad := range []ffmpegOptions{
+		{codec: "h264", crf: 52},
+		{codec: "h264", preset: "sluggish"},
+		{codec: "libvpx-vp9", preset: "fast"},
+		{codec: "h264_v4l2m2m", crf: 20},
+		{codec: "h264_omx", preset: "fast"},
+		{codec: "auto"},
+	} {
+		if _, err = bad.codec.encoderArgs(bad.crf, bad.preset); err == nil {
+			t.Errorf("%+v: expected error", bad)
+		}
+	}
+}
+
+func TestParseFFMPEGVersion(t *testing.T) {
+	for _, l := range []struct {
+		in   string
+		want int
+	}{
+		{"ffmpeg version 6.1.1-3ubuntu5 Copyright (c) 2000-2023 the FFmpeg developers\nbuilt with gcc 13", 6},
+		{"ffmpeg version n4.4.2 Copyright (c) 2000-2021 the FFmpeg developers", 4},
+		{"ffmpeg version 3.4.8-0ubuntu0.2 Copyright (c) 2000-2020 the FFmpeg developers", 3},
+		{"ffmpeg version N-113345-g0123456789 Copyright (c) 2000-2024 the FFmpeg developers", 0},
+		{"", 0},
+	} {
+		if got := parseFFMPEGVersion([]byte(l.in)); got != l.want {
+			t.Errorf("%q: got %d, want %d", l.in, got, l.want)
+		}
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+	out := []byte(`Filters:
+  T.. = Timeline support
+  .S. = Slice threading
+  ..C = Command support
+  A = Audio input/output
+  V = Video input/output
+ TSC signalstats       V->V       Generate statistics from video analysis.
+ ... split             V->N       Pass on the input to N video outputs.
+ ..C drawtext          V->V       Draw text on top of video frames using libfreetype library.
+`)
+	got := parseFilters(out)
+	if !got["signalstats"] || !got["split"] || !got["drawtext"] || len(got) != 3 {
+		t.Fatal(got)
+	}
+}
+
+func TestFilterNames(t *testing.T) {
+	o := ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15, codec: "h264"}
+	got := constructFilterGraph(&o).filterNames()
+	for _, n := range []string{"drawtext", "signalstats", "split"} {
+		if !slices.Contains(got, n) {
+			t.Errorf("missing %q in %q", n, got)
+		}
+	}
+	if !slices.IsSorted(got) || len(slices.Compact(slices.Clone(got))) != len(got) {
+		t.Fatal(got)
+	}
+	for _, n := range got {
+		if strings.ContainsAny(n, "=@") {
+			t.Fatal(got)
+		}
+	}
+}
+
+func TestFFMPEGToFile(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	root := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var tmp string
+	err := ffmpegToFile(ctx, root, "a.mp4", strings.NewReader("data"), func(dst string) ([]string, error) {
+		tmp = dst
+		return []string{"sh", "-c", "cat > " + dst}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmp != "a.tmp.mp4" {
+		t.Fatal(tmp)
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "a.mp4")); err != nil || string(b) != "data" {
+		t.Fatal(string(b), err)
+	}
+	// The partial file is deleted on failure.
+	err = ffmpegToFile(ctx, root, "b.gif", nil, func(dst string) ([]string, error) {
+		return []string{"sh", "-c", "echo partial > " + dst + "; exit 1"}, nil
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Fatal(entries)
+	}
+}
+
+func TestAudio(t *testing.T) {
+	o := ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15, codec: "h264", audio: "hw:1"}
+	fg := constructFilterGraph(&o)
+	if got := fg.String(); !strings.Contains(got, ";[2:a]aresample=8000,asetnsamples=n=800:p=0,astats=metadata=1:reset=1,ametadata=print:key=lavfi.astats.Overall.RMS_level:file='pipe\\:6':direct=1,anullsink") {
+		t.Fatal(got)
+	}
+	if names := fg.filterNames(); !slices.Contains(names, "astats") || !slices.Contains(names, "ametadata") {
+		t.Fatal(names)
+	}
+	args, err := buildFFMPEGCmd(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.Index(args, "2:a"); i == -1 || args[i-1] != "-map" || args[i+1] != "-c:a" {
+		t.Fatalf("missing audio map: %q", args)
+	}
+	o.audio = ""
+	if got := constructFilterGraph(&o).String(); strings.Contains(got, "astats") {
+		t.Fatal(got)
+	}
+}
+
+func TestMJPEGFPS(t *testing.T) {
+	o := ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15, codec: "h264", mpjpeg: true}
+	for _, l := range []struct {
+		fps  float64
+		want string
+	}{{0, "[out2]fps=fps=1[outMPJPEG]"}, {5, "[out2]fps=fps=5[outMPJPEG]"}, {0.5, "[out2]fps=fps=0.5[outMPJPEG]"}} {
+		o.mpjpegFPS = l.fps
+		args, err := buildFFMPEGCmd(&o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i := slices.Index(args, "-filter_complex"); i == -1 || !strings.HasSuffix(args[i+1], l.want) {
+			t.Fatalf("%g: %q", l.fps, args)
+		}
+	}
+}
+
+func TestMJPEGQuality(t *testing.T) {
+	o := ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15, codec: "h264", mpjpeg: true}
+	for _, l := range []struct {
+		q    int
+		want string
+	}{{0, "2"}, {1, "1"}, {31, "31"}} {
+		o.mpjpegQuality = l.q
+		args, err := buildFFMPEGCmd(&o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i := slices.Index(args, "-q"); i == -1 || args[i+1] != l.want || args[len(args)-1] != "pipe:4" {
+			t.Fatalf("%d: %q", l.q, args)
+		}
+	}
+	o.mpjpegQuality = 32
+	if _, err := buildFFMPEGCmd(&o); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestMJPEGScale(t *testing.T) {
+	var s scaleSpec
+	for _, v := range []string{"0", "1", "1.5", "-0.5", "abc"} {
+		if err := s.Set(v); err == nil {
+			t.Fatalf("%q: expected error", v)
+		}
+	}
+	o := ffmpegOptions{src: "/dev/video0", s: "both", w: 640, h: 480, fps: 15, codec: "h264", mpjpeg: true, outputPipe: "/tmp/fifo"}
+	for _, l := range []struct {
+		v    string
+		want string
+	}{
+		{"320", "[out2]fps=fps=1,scale=w='min(320,iw)':h=-2[outMPJPEG]"},
+		{"0.5", "[out2]fps=fps=1,scale=w=trunc(iw*0.5/2)*2:h=-2[outMPJPEG]"},
+	} {
+		if err := o.mpjpegScale.Set(l.v); err != nil {
+			t.Fatal(err)
+		}
+		if got := o.mpjpegScale.String(); got != l.v {
+			t.Fatalf("got %q, want %q", got, l.v)
+		}
+		args, err := buildFFMPEGCmd(&o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := slices.Index(args, "-filter_complex")
+		if i == -1 {
+			t.Fatal(args)
+		}
+		// Only the MJPEG branch is scaled, not the recording nor the output pipe.
+		streams := strings.Split(args[i+1], ";")
+		for _, st := range streams {
+			if strings.Contains(st, "min(320") || strings.Contains(st, "iw*0.5") {
+				if st != l.want {
+					t.Fatalf("got %q, want %q", st, l.want)
+				}
+			}
+		}
+		if !slices.Contains(streams, l.want) {
+			t.Fatalf("missing %q in %q", l.want, streams)
+		}
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	d := t.TempDir()
+	p := filepath.Join(d, "sample.mp4")
+	if err := os.WriteFile(p, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []struct {
+		src  string
+		want string
+	}{
+		{p, "file:" + p},
+		{"file://" + p, "file:" + p},
+		{"file://missing.mp4", "file:missing.mp4"},
+		{filepath.Join(d, "missing.mp4"), filepath.Join(d, "missing.mp4")},
+		// A directory is not a video file.
+		{d, d},
+		{"tcp://127.0.0.1:8000", "tcp://127.0.0.1:8000"},
+	} {
+		if got := resolveSource(l.src); got != l.want {
+			t.Fatalf("%q: got %q, want %q", l.src, got, l.want)
+		}
+	}
+	o := ffmpegOptions{src: "file:" + p, s: "normal", w: 640, h: 480, fps: 15, codec: "h264"}
+	args, err := buildFFMPEGCmd(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.Index(args, "-i")
+	if i == -1 || args[i+1] != "file:"+p {
+		t.Fatalf("%q", args)
+	}
+	// No capture nor low latency input flags.
+	for _, a := range []string{"-re", "-f", "-framerate", "-video_size", "-fflags"} {
+		if slices.Contains(args[:i], a) {
+			t.Fatalf("unexpected %s: %q", a, args)
+		}
+	}
+	o.realtime = true
+	if args, err = buildFFMPEGCmd(&o); err != nil {
+		t.Fatal(err)
+	}
+	if i := slices.Index(args, "-re"); i == -1 || i > slices.Index(args, "-i") {
+		t.Fatalf("%q", args)
+	}
+	// The file is scaled to w x h before the style.
+	if got := constructFilterGraph(&o).String(); !strings.HasPrefix(got, "[0:v]scale=640x480[vin];[vin]") || strings.Contains(got[len("[0:v]"):], "[0:v]") {
+		t.Fatal(got)
+	}
+}
+
+func TestValidateFilterGraph(t *testing.T) {
+	o := ffmpegOptions{s: "both", w: 640, h: 480, fps: 15, codec: "h264", mpjpeg: true, audio: "hw:1", outputPipe: "/tmp/fifo", preroll: true, level: "error"}
+	args, err := validateFilterGraphArgs(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := buildFFMPEGCmd(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i, j := slices.Index(args, "-filter_complex"), slices.Index(cmd, "-filter_complex"); args[i+1] != cmd[j+1] {
+		t.Fatalf("%q", args)
+	}
+	want := "-map [outHLS] -f null - -map [outMPJPEG] -f null - -map [outPipe] -f null - -map [outPreroll] -f null -"
+	if got := strings.Join(args, " "); !strings.HasSuffix(got, want) || !strings.Contains(got, "anullsrc") || strings.Contains(got, "hw:1") {
+		t.Fatalf("%q", args)
+	}
+	if _, err = exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg not found")
+	}
+	for _, s := range validStyles {
+		o := ffmpegOptions{s: s, w: 320, h: 240, fps: 5, codec: "h264", mpjpeg: true, level: "error"}
+		if o.fontFile, err = findFont(""); err != nil {
+			t.Skip(err)
+		}
+		if err = validateFilterGraph(context.Background(), &o); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	for _, l := range []struct {
+		in, want string
+	}{
+		{"", "''"},
+		{"-filter_complex", "-filter_complex"},
+		{"/dev/video0", "/dev/video0"},
+		{"FaceTime HD Camera", "'FaceTime HD Camera'"},
+		{"[0:v]hqdn3d,split=2[src1][src2]", "'[0:v]hqdn3d,split=2[src1][src2]'"},
+		{`file='pipe\:3'`, `'file='\''pipe\:3'\'''`},
+	} {
+		if got := shellQuote(l.in); got != l.want {
+			t.Fatalf("%q: got %s, want %s", l.in, got, l.want)
+		}
+	}
+	o := ffmpegOptions{src: "/dev/video0", s: "both", w: 640, h: 480, fps: 15, codec: "h264", mpjpeg: true, name: "Front door: it's [1]"}
+	args, err := buildFFMPEGCmd(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := shellCommand("/var/rec", args, "")
+	if !strings.HasPrefix(got, "cd /var/rec && ffmpeg -hide_banner ") || !strings.HasSuffix(got, " 3>/dev/null 4>/dev/null 5>/dev/null 6>/dev/null 7>/dev/null 8>/dev/null") {
+		t.Fatal(got)
+	}
+	if _, err = exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	// The shell must see the exact same arguments.
+	l := ""
+	for _, a := range args {
+		l += " " + shellQuote(a)
+	}
+	out, err := exec.Command("sh", "-c", "printf '%s\\n'"+l).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Join(args, "\n") + "\n"; string(out) != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestZone2(t *testing.T) {
+	o := ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15, codec: "h264", mask: "mask.png", mask2: "zone2.png", audio: "hw:1"}
+	args, err := buildFFMPEGCmd(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The inputs are the camera, the mask, the audio and the second zone mask.
+	var inputs []string
+	for i, a := range args {
+		if a == "-i" {
+			inputs = append(inputs, args[i+1])
+		}
+	}
+	if len(inputs) != 4 || inputs[1] != "mask.png" || inputs[3] != "zone2.png" {
+		t.Fatalf("%q", inputs)
+	}
+	fg := args[slices.Index(args, "-filter_complex")+1]
+	if !strings.Contains(fg, "[3:v]scale=320x240[zone2mask]") || !strings.Contains(fg, "file='pipe\\:7'") || !strings.HasPrefix(fg, "[0:v]split=2[v0][zone2src];[v0]hqdn3d") {
+		t.Fatal(fg)
+	}
+}
+
+func TestOddDimensions(t *testing.T) {
+	if w, h := halfDims(1281, 721); w != 640 || h != 360 {
+		t.Fatal(w, h)
+	}
+	if w, h := halfDims(1100, 620); w != 550 || h != 310 {
+		t.Fatal(w, h)
+	}
+	// The source and the masks must be scaled to the same size, otherwise
+	// alphamerge and overlay fail.
+	for _, s := range validStyles {
+		if s == "normal_no_mask" {
+			continue
+		}
+		t.Run(string(s), func(t *testing.T) {
+			fg := constructFilterGraph(&ffmpegOptions{s: s, w: 1281, h: 721, mask2: "zone2.png"}).String()
+			if strings.Contains(fg, "iw/2") {
+				t.Fatal(fg)
+			}
+			for _, want := range []string{"[src1]scale=640x360", "[1:v]scale=640x360", "[zone2src]hqdn3d,scale=640x360", "[2:v]scale=640x360", "color=color=black:size=640x360"} {
+				if want == "[src1]scale=640x360" {
+					switch s {
+					case "motion_only":
+						want = "[v0]hqdn3d,scale=640x360"
+					case "raw":
+						want = "[src1]hqdn3d,scale=640x360"
+					}
+				}
+				if !strings.Contains(fg, want) {
+					t.Fatalf("missing %q:\n%s", want, fg)
+				}
+			}
+			if s == "overlay" && !strings.Contains(fg, "scale=1281x721[motion]") {
+				t.Fatal(fg)
+			}
+		})
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	data := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"-thread_queue_size 1024", []string{"-thread_queue_size", "1024"}},
+		{" -a\t b\n", []string{"-a", "b"}},
+		{`-metadata 'title=My camera'`, []string{"-metadata", "title=My camera"}},
+		{`-metadata "title=it's \"here\" \n"`, []string{"-metadata", `title=it's "here" \n`}},
+		{`a\ b 'c\d' ''`, []string{"a b", `c\d`, ""}},
+	}
+	for i, l := range data {
+		got, err := splitArgs(l.in)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !slices.Equal(got, l.want) {
+			t.Fatalf("#%d: %q != %q", i, got, l.want)
+		}
+	}
+	for _, in := range []string{`'a`, `"a`, `a\`} {
+		if _, err := splitArgs(in); err == nil {
+			t.Fatal(in)
+		}
+	}
+}
+
+func TestExtraArgs(t *testing.T) {
+	for _, container := range []string{"hls", "dash"} {
+		o := ffmpegOptions{src: "/dev/video0", s: "normal", w: 640, h: 480, fps: 15, codec: "h264", container: container, inputArgs: []string{"-thread_queue_size", "1024"}, outputArgs: []string{"-pix_fmt", "yuv420p"}}
+		args, err := buildFFMPEGCmd(&o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := slices.Index(args, "-i")
+		if i < 2 || args[i-2] != "-thread_queue_size" || args[i-1] != "1024" || args[i+1] != "/dev/video0" {
+			t.Fatalf("%q", args)
+		}
+		out := "all.m3u8"
+		if container == "dash" {
+			out = "all.mpd"
+		}
+		j := slices.Index(args, out)
+		if j < 2 || args[j-2] != "-pix_fmt" || args[j-1] != "yuv420p" {
+			t.Fatalf("%q", args)
+		}
+	}
+}
+
+func TestExtraFilter(t *testing.T) {
+	for _, s := range validStyles {
+		t.Run(string(s), func(t *testing.T) {
+			o := ffmpegOptions{s: s, w: 640, h: 480, frameCounter: "tl", extraFilter: "eq=brightness=0.06"}
+			fg := constructFilterGraph(&o)
+			n := 0
+			for _, x := range fg {
+				if !slices.Contains(x.chain, "eq=brightness=0.06") {
+					continue
+				}
+				n++
+				// Only on the recording path, after the overlays.
+				if !slices.Contains(x.sinks, "[out]") || x.chain[len(x.chain)-1] != "eq=brightness=0.06" {
+					t.Fatal(x.String())
+				}
+			}
+			if n != 1 {
+				t.Fatal(fg.String())
+			}
+		})
+	}
+}
+
+func TestResolveStyle(t *testing.T) {
+	data := []struct {
+		s    style
+		mask string
+		want style
+	}{
+		{"normal", "", "normal_no_mask"},
+		{"normal", "mask.png", "normal"},
+		{"normal_no_mask", "", "normal_no_mask"},
+		{"motion_only", "", "motion_only"},
+		{"overlay", "", "overlay"},
+		{"both", "mask.png", "both"},
+	}
+	for i, l := range data {
+		if got := resolveStyle(l.s, l.mask); got != l.want {
+			t.Fatalf("#%d: %q != %q", i, got, l.want)
+		}
+	}
+}
+
+func TestRawStyle(t *testing.T) {
+	var s style
+	if err := s.Set("raw"); err != nil || s != "raw" {
+		t.Fatal(s, err)
+	}
+	o := ffmpegOptions{s: s, w: 640, h: 480, mask: "mask.png"}
+	fg := constructFilterGraph(&o)
+	for _, x := range fg {
+		if slices.Contains(x.sinks, "[out]") {
+			// Only the timestamp is drawn on the recording.
+			if x.String() != "[src2]"+drawTimestamp(defaultFont, defaultTimestampFormat, "br", 48).String()+"[out]" {
+				t.Fatal(x.String())
+			}
+		}
+		if slices.Contains(x.sources, "[0:v]") && slices.Contains(x.chain, "hqdn3d") {
+			t.Fatalf("the recording is denoised: %s", fg.String())
+		}
+	}
+	// The motion detection is still done.
+	if n := strings.Count(fg.String(), printYAVGtoPipe.String()); n != 1 {
+		t.Fatal(fg.String())
 	}
 }
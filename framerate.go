@@ -0,0 +1,99 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fpsMeasureAfter is the duration of video after which the actual frame rate
+// is measured. Cameras often deliver the first frames irregularly.
+const fpsMeasureAfter = 5 * time.Second
+
+// fpsTolerance is the relative difference between the requested and the
+// actual frame rate above which a warning is logged.
+const fpsTolerance = 0.1
+
+// measureFPS returns the frame rate of the video given the frame number and
+// its presentation timestamp.
+func measureFPS(frame int, pts time.Duration) float64 {
+	if pts <= 0 {
+		return 0
+	}
+	return math.Round(float64(frame)/pts.Seconds()*100) / 100
+}
+
+// fpsMismatch returns true when actual differs significantly from the
+// requested frame rate.
+func fpsMismatch(requested int, actual float64) bool {
+	return requested > 0 && actual > 0 && math.Abs(actual-float64(requested)) > fpsTolerance*float64(requested)
+}
+
+// parseDriverFrameRate returns the frame rate imposed by the v4l2 driver when
+// line is the message ffmpeg prints about it, e.g.
+//
+//	[video4linux2,v4l2 @ 0x63b48c816180] The driver changed the time per frame from 1/15 to 1/10
+func parseDriverFrameRate(line string) (float64, bool) {
+	_, rest, ok := strings.Cut(line, "The driver changed the time per frame from ")
+	if !ok {
+		return 0, false
+	}
+	_, to, ok := strings.Cut(rest, " to ")
+	if !ok {
+		return 0, false
+	}
+	n, d, ok := strings.Cut(strings.TrimSpace(to), "/")
+	num, err1 := strconv.Atoi(n)
+	den, err2 := strconv.Atoi(d)
+	if !ok || err1 != nil || err2 != nil || num <= 0 || den <= 0 {
+		return 0, false
+	}
+	return float64(den) / float64(num), true
+}
+
+// frameRateWatcher forwards ffmpeg's stderr to w and detects when the driver
+// changed the frame rate.
+//
+// ffmpeg prints it at info level, so it is only seen with -v or -logdir.
+// Otherwise filterMotion detects the mismatch from the timestamps.
+type frameRateWatcher struct {
+	w io.Writer
+	// fps is the requested frame rate.
+	fps int
+	m   *metrics
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (f *frameRateWatcher) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buf = append(f.buf, b...)
+	for {
+		i := bytes.IndexByte(f.buf, '\n')
+		if i == -1 {
+			break
+		}
+		if fps, ok := parseDriverFrameRate(string(f.buf[:i])); ok {
+			slog.Warn("ffmpeg", "msg", "the driver changed the frame rate; use a mode listed by v4l2-ctl --list-formats-ext", "fps", f.fps, "actual", fps)
+			f.m.setFPS(float32(fps))
+		}
+		f.buf = f.buf[i+1:]
+	}
+	if len(f.buf) == 0 {
+		// Release the memory.
+		f.buf = nil
+	}
+	return n, err
+}
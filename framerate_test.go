@@ -0,0 +1,56 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMeasureFPS(t *testing.T) {
+	if got := measureFPS(50, 5*time.Second); got != 10 {
+		t.Fatal(got)
+	}
+	if got := measureFPS(0, 0); got != 0 {
+		t.Fatal(got)
+	}
+	if fpsMismatch(15, 14.6) || !fpsMismatch(15, 10) || fpsMismatch(0, 10) {
+		t.Fatal("unexpected")
+	}
+}
+
+func TestParseDriverFrameRate(t *testing.T) {
+	if fps, ok := parseDriverFrameRate("[video4linux2,v4l2 @ 0x63b48c816180] The driver changed the time per frame from 1/15 to 1/10"); !ok || fps != 10 {
+		t.Fatal(fps, ok)
+	}
+	if fps, ok := parseDriverFrameRate("[video4linux2,v4l2 @ 0x1] The driver changed the time per frame from 1/30 to 1001/30000"); !ok || fps < 29.97 || fps > 29.98 {
+		t.Fatal(fps, ok)
+	}
+	for _, l := range []string{"", "frame=10", "The driver changed the time per frame from 1/15 to 0/10"} {
+		if _, ok := parseDriverFrameRate(l); ok {
+			t.Errorf("%q: expected failure", l)
+		}
+	}
+}
+
+func TestFrameRateWatcher(t *testing.T) {
+	buf := bytes.Buffer{}
+	m := metrics{}
+	f := &frameRateWatcher{w: &buf, fps: 15, m: &m}
+	in := "[info] Input #0\n[video4linux2,v4l2 @ 0x1] The driver changed the time per frame from 1/15 to 1/10\n"
+	// Split the line across writes.
+	for _, s := range []string{in[:40], in[40:]} {
+		if n, err := f.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatal(n, err)
+		}
+	}
+	if buf.String() != in {
+		t.Fatalf("%q", buf.String())
+	}
+	if s := m.status(time.Now()); s.FPS != 10 {
+		t.Fatal(s.FPS)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// The GIF preview is kept small so it can be attached to notifications.
+const (
+	gifMaxDuration = 5 * time.Second
+	gifMaxWidth    = 480
+	gifFPS         = 5
+)
+
+// buildGIFCmd builds the command line to exec ffmpeg to convert up to
+// gifMaxDuration of the segments files, starting at start, into an animated
+// GIF dst.
+//
+// files must be sorted and the first one must start at or before start.
+func buildGIFCmd(files []string, start, end time.Time, dst string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no segment to extract from")
+	}
+	first, err := fileTime(files[0])
+	if err != nil {
+		return nil, err
+	}
+	offset := max(start.Sub(first), 0)
+	d := min(end.Sub(start), gifMaxDuration)
+	// A palette generated from the clip itself looks much better than the
+	// default 256 colors palette.
+	vf := fmt.Sprintf("fps=%d,scale='min(%d,iw)':-2:flags=lanczos,split[a][b];[a]palettegen=stats_mode=diff[p];[b][p]paletteuse=dither=bayer", gifFPS, gifMaxWidth)
+	return []string{
+		"ffmpeg",
+		"-hide_banner",
+		"-nostats",
+		"-loglevel", "repeat+warning",
+		"-y",
+		"-ss", fmt.Sprintf("%.3f", offset.Seconds()),
+		"-i", "concat:" + strings.Join(files, "|"),
+		"-t", fmt.Sprintf("%.3f", d.Seconds()),
+		"-an",
+		"-vf", vf,
+		"-loop", "0",
+		dst,
+	}, nil
+}
+
+// gifName returns the name of the GIF preview of the motion event started at
+// t.
+func gifName(t time.Time) string {
+	return t.Format("2006-01-02T15-04-05") + ".gif"
+}
+
+// generateGIF generates the GIF preview of the motion event that started at t
+// and ended at end.
+func generateGIF(ctx context.Context, root string, t, end time.Time) error {
+	files, err := clipSegments(root, t, end)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	name := gifName(t)
+	err = ffmpegToFile(ctx, root, name, nil, func(dst string) ([]string, error) {
+		return buildGIFCmd(files, t, end, dst)
+	})
+	if err == nil {
+		slog.Info("gif", "name", name, "segments", len(files))
+	}
+	return err
+}
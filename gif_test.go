@@ -0,0 +1,40 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBuildGIFCmd(t *testing.T) {
+	files := []string{"2024-01-02T03-04-00.ts", "2024-01-02T03-04-04.ts", "2024-01-02T03-04-08.ts"}
+	start := time.Date(2024, 1, 2, 3, 4, 2, 0, time.Local)
+	got, err := buildGIFCmd(files, start, start.Add(time.Minute), "out.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ffmpeg", "-hide_banner", "-nostats", "-loglevel", "repeat+warning", "-y",
+		"-ss", "2.000",
+		"-i", "concat:2024-01-02T03-04-00.ts|2024-01-02T03-04-04.ts|2024-01-02T03-04-08.ts",
+		// Capped to gifMaxDuration.
+		"-t", "5.000",
+		"-an",
+		"-vf", "fps=5,scale='min(480,iw)':-2:flags=lanczos,split[a][b];[a]palettegen=stats_mode=diff[p];[b][p]paletteuse=dither=bayer",
+		"-loop", "0",
+		"out.gif",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got  %q\nwant %q", got, want)
+	}
+	if got, err = buildGIFCmd(files, start, start.Add(2*time.Second), "out.gif"); err != nil || got[11] != "2.000" {
+		t.Fatal(got, err)
+	}
+	if _, err = buildGIFCmd(nil, start, start, "out.gif"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lmittmann/tint"
+	"github.com/mattn/go-colorable"
+	"github.com/mattn/go-isatty"
+)
+
+// logFormat is the format of the log lines.
+type logFormat string
+
+func (l *logFormat) Set(v string) error {
+	options := ""
+	for i, x := range validLogFormats {
+		if v == string(x) {
+			*l = x
+			return nil
+		}
+		if i != 0 {
+			options += ", "
+		}
+		options += string(x)
+	}
+	return errors.New("invalid log format. Supported values are: " + options)
+}
+
+func (l *logFormat) String() string {
+	return string(*l)
+}
+
+// validLogFormats is the valid log format values for newLogHandler.
+//
+// "text" is meant for a human reading a terminal, "json" for a log collector
+// like Loki.
+var validLogFormats = []logFormat{"text", "json"}
+
+// newLogHandler returns a slog handler writing to f in the format l.
+//
+// Colors are used in text format when f is a terminal.
+func newLogHandler(f *os.File, l logFormat, level slog.Leveler) slog.Handler {
+	if l == "json" {
+		return &jsonHandler{slog.NewJSONHandler(f, &slog.HandlerOptions{Level: level})}
+	}
+	return tint.NewHandler(colorable.NewColorable(f), &tint.Options{
+		Level:       level,
+		TimeFormat:  time.TimeOnly,
+		NoColor:     !isatty.IsTerminal(f.Fd()),
+		ReplaceAttr: trimFloat64,
+	})
+}
+
+// jsonHandler renames the "msg" attributes to "detail".
+//
+// The log calls use the message as the component name and pass the actual
+// message as a "msg" attribute. The JSON output would otherwise contain the
+// key twice, which most parsers resolve by dropping one of them.
+type jsonHandler struct {
+	slog.Handler
+}
+
+func (j *jsonHandler) Handle(ctx context.Context, r slog.Record) error {
+	r2 := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == slog.MessageKey {
+			a.Key = "detail"
+		}
+		r2.AddAttrs(a)
+		return true
+	})
+	return j.Handler.Handle(ctx, r2)
+}
+
+func (j *jsonHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &jsonHandler{j.Handler.WithAttrs(attrs)}
+}
+
+func (j *jsonHandler) WithGroup(name string) slog.Handler {
+	return &jsonHandler{j.Handler.WithGroup(name)}
+}
+
+// logWriter is an io.Writer that emits each line written to it as a log
+// entry.
+//
+// It is used to fold ffmpeg's stderr into the structured logs. The level of
+// each line is parsed from ffmpeg's "[warning]" like prefix, which is printed
+// with "-loglevel level+...".
+type logWriter struct {
+	name string
+	// level is the level of the lines without a level prefix.
+	level slog.Level
+	// errors, when set, is incremented for every line at error level or above.
+	errors *atomic.Int64
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (l *logWriter) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = append(l.buf, b...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i == -1 {
+			break
+		}
+		l.emit(string(l.buf[:i]))
+		l.buf = l.buf[i+1:]
+	}
+	if len(l.buf) == 0 {
+		// Release the memory.
+		l.buf = nil
+	}
+	return len(b), nil
+}
+
+func (l *logWriter) emit(line string) {
+	// ffmpeg uses \r to update progress lines in place.
+	if line = strings.TrimSpace(strings.ReplaceAll(line, "\r", " ")); line == "" {
+		return
+	}
+	level, line, ok := parseFFMPEGLevel(line)
+	if !ok {
+		level = l.level
+	}
+	if level >= slog.LevelError && l.errors != nil {
+		l.errors.Add(1)
+	}
+	slog.Log(context.Background(), level, l.name, "msg", line)
+}
+
+var _ io.Writer = (*logWriter)(nil)
+
+// ffmpegLevels maps ffmpeg's log levels to slog's.
+var ffmpegLevels = map[string]slog.Level{
+	"panic":   slog.LevelError,
+	"fatal":   slog.LevelError,
+	"error":   slog.LevelError,
+	"warning": slog.LevelWarn,
+	"info":    slog.LevelInfo,
+	"verbose": slog.LevelDebug,
+	"debug":   slog.LevelDebug,
+	"trace":   slog.LevelDebug,
+}
+
+// parseFFMPEGLevel returns the level of a line printed by ffmpeg and the line
+// without the level prefix.
+//
+// The level follows the optional context, e.g.
+// "[mjpeg @ 0x5581f3c0] [error] unable to decode APP fields".
+func parseFFMPEGLevel(line string) (slog.Level, string, bool) {
+	for i := 0; i < len(line) && line[i] == '['; {
+		j := strings.IndexByte(line[i:], ']')
+		if j == -1 {
+			break
+		}
+		if level, ok := ffmpegLevels[line[i+1:i+j]]; ok {
+			return level, line[:i] + strings.TrimLeft(line[i+j+1:], " "), true
+		}
+		i += j + 1
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+	}
+	return 0, line, false
+}
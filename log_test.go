@@ -0,0 +1,111 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFormat(t *testing.T) {
+	var l logFormat
+	if err := l.Set("json"); err != nil || l != "json" {
+		t.Fatal(l, err)
+	}
+	if err := l.Set("xml"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	buf := bytes.Buffer{}
+	h := &jsonHandler{slog.NewJSONHandler(&buf, nil)}
+	slog.New(h).With("cam", 1).Info("ffmpeg", "msg", "exit", "attempt", 2)
+	got := map[string]any{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["msg"] != "ffmpeg" || got["detail"] != "exit" || got["attempt"] != 2. || got["cam"] != 1. {
+		t.Fatal(buf.String())
+	}
+	if strings.Count(buf.String(), `"msg"`) != 1 {
+		t.Fatal(buf.String())
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	buf := bytes.Buffer{}
+	old := slog.Default()
+	defer slog.SetDefault(old)
+	slog.SetDefault(slog.New(&jsonHandler{slog.NewJSONHandler(&buf, nil)}))
+	w := &logWriter{name: "ffmpeg"}
+	for _, s := range []string{"[mjpeg @ 0x1] unable", " to decode\n\nframe=1\rframe=2\n", "partial"} {
+		if n, err := w.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatal(n, err)
+		}
+	}
+	var got []string
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		m := map[string]any{}
+		if err := json.Unmarshal([]byte(l), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m["msg"] != "ffmpeg" {
+			t.Fatal(l)
+		}
+		got = append(got, m["detail"].(string))
+	}
+	if len(got) != 2 || got[0] != "[mjpeg @ 0x1] unable to decode" || got[1] != "frame=1 frame=2" {
+		t.Fatalf("%q", got)
+	}
+	if string(w.buf) != "partial" {
+		t.Fatalf("%q", w.buf)
+	}
+}
+
+func TestParseFFMPEGLevel(t *testing.T) {
+	for _, l := range []struct {
+		in    string
+		level slog.Level
+		out   string
+		ok    bool
+	}{
+		{"[mjpeg @ 0x5581f3c0] [error] unable to decode APP fields", slog.LevelError, "[mjpeg @ 0x5581f3c0] unable to decode APP fields", true},
+		{"[warning] Guessed Channel Layout", slog.LevelWarn, "Guessed Channel Layout", true},
+		{"[video4linux2,v4l2 @ 0x1] [info] The driver changed the time per frame", slog.LevelInfo, "[video4linux2,v4l2 @ 0x1] The driver changed the time per frame", true},
+		{"[out#0/hls @ 0x1] [verbose] Output file #0", slog.LevelDebug, "[out#0/hls @ 0x1] Output file #0", true},
+		{"[mjpeg @ 0x1] unable to decode", 0, "[mjpeg @ 0x1] unable to decode", false},
+		{"frame=1 [error] not a prefix", 0, "frame=1 [error] not a prefix", false},
+		{"[unterminated", 0, "[unterminated", false},
+	} {
+		level, out, ok := parseFFMPEGLevel(l.in)
+		if level != l.level || out != l.out || ok != l.ok {
+			t.Errorf("%q: got %v, %q, %t", l.in, level, out, ok)
+		}
+	}
+}
+
+func TestLogWriterLevel(t *testing.T) {
+	buf := bytes.Buffer{}
+	old := slog.Default()
+	defer slog.SetDefault(old)
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	m := metrics{}
+	w := &logWriter{name: "ffmpeg", level: slog.LevelWarn, errors: &m.ffmpegErrors}
+	_, _ = w.Write([]byte("[error] a\n[fatal] b\n[debug] c\nd\n"))
+	got := buf.String()
+	for _, want := range []string{"level=ERROR msg=ffmpeg msg=a", "level=ERROR msg=ffmpeg msg=b", "level=DEBUG msg=ffmpeg msg=c", "level=WARN msg=ffmpeg msg=d"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in %q", want, got)
+		}
+	}
+	if n := m.status(time.Now()).FFMPEGErrors; n != 2 {
+		t.Fatal(n)
+	}
+}
@@ -10,6 +10,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
@@ -20,12 +21,14 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"time"
+	// Embed the time zone database for -tz on minimal systems.
+	_ "time/tzdata"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/lmittmann/tint"
-	"github.com/mattn/go-colorable"
-	"github.com/mattn/go-isatty"
 	slogmulti "github.com/samber/slog-multi"
 	"golang.org/x/sync/errgroup"
 )
@@ -38,8 +41,164 @@ func trimFloat64(groups []string, attr slog.Attr) slog.Attr {
 	return attr
 }
 
+// runOptions is the configuration shared by all the cameras.
+type runOptions struct {
+	// addr is the address of the web server. The server is disabled when
+	// empty.
+	addr      string
+	auth      *httpAuth
+	tlsConfig *tls.Config
+	// healthTimeout is the maximum age of the last frame for /healthz.
+	healthTimeout time.Duration
+	// maxPartSize and maxClients configure the MJPEG streams.
+	maxPartSize int64
+	maxClients  int
+	// ffmpegLog receives ffmpeg's stderr.
+	ffmpegLog io.Writer
+	// vtt writes the motion level as a subtitle track of each motion recording.
+	vtt bool
+	// maxDisk is the maximum size used by the recordings of all the cameras. 0
+	// means unlimited.
+	maxDisk int64
+	// retention is the maximum age of the recordings. 0 means unlimited.
+	retention time.Duration
+	// activeHours is when the cameras record. Always when empty.
+	activeHours schedule
+	// serveInactive keeps the web server running outside of activeHours.
+	serveInactive bool
+	// ntpServer is -ntp-server, used to monitor the clock into clock.
+	ntpServer string
+	// clock is optional.
+	clock *clockStatus
+
+	_ struct{}
+}
+
 // run is the main loop.
-func run(ctx context.Context, root, addr string, fo *ffmpegOptions, ffmpegLog io.Writer, mo *motionOptions) error {
+//
+// It runs the pipeline of each camera and the web server shared by them.
+//
+// Outside of activeHours, only the pipelines are stopped. The web server
+// keeps running unless serveInactive is false; the live view has no frame
+// then.
+func run(ctx context.Context, cams []*cameraOptions, ro *runOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	eg, ctx := errgroup.WithContext(ctx)
+	// The MJPEG server keeps running across ffmpeg restarts.
+	states := make([]*camera, len(cams))
+	for i, c := range cams {
+		// Files left behind if the process was killed while writing them.
+		if n, err := removeTempFiles(c.root, time.Now()); err != nil {
+			slog.Warn("cleanup", "root", c.root, "err", err)
+		} else if n != 0 {
+			slog.Info("cleanup", "root", c.root, "tmp", n)
+		}
+		cs := &camera{root: c.root, met: &metrics{started: time.Now(), activeHours: ro.activeHours, motionHours: c.mo.motionHours, clock: ro.clock}, trigger: make(chan triggerRequest), restart: make(chan struct{}, 1), w: c.fo.w, h: c.fo.h}
+		if strings.HasSuffix(c.fo.mask, ".png") && c.mo.maskCoverage == 0 {
+			// The coverage is only computed at startup.
+			cs.mask = c.fo.mask
+		}
+		if ro.addr != "" {
+			cs.tm = &teeMimePart{maxPartSize: ro.maxPartSize, maxClients: ro.maxClients}
+			if c.fo.mpjpegPeak {
+				cs.tm.peak = cs.met.yavg
+			}
+			if panels := bboxStyles[c.fo.s]; panels != 0 {
+				// The motion is detected on a half size image.
+				hw, hh := halfDims(c.fo.w, c.fo.h)
+				cs.tm.decorate = motionBoxDecorator(cs.met, hw, hh, panels)
+			}
+			cs.eb = &eventBroadcaster{}
+		}
+		states[i] = cs
+	}
+	for _, cs := range states {
+		cs.restartMask = func() {
+			for _, other := range states {
+				if other.mask == cs.mask {
+					select {
+					case other.restart <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}
+	}
+	serveAlways := len(ro.activeHours) == 0 || ro.serveInactive
+	if ro.addr != "" && serveAlways {
+		wait, err := startServer(ctx, ro.addr, states, ro.healthTimeout, ro.auth, ro.tlsConfig)
+		if err != nil {
+			return err
+		}
+		eg.Go(wait)
+	}
+	// The housekeeping keeps running outside of the active hours.
+	if ro.maxDisk > 0 {
+		roots := make([]string, len(cams))
+		for i, c := range cams {
+			roots[i] = c.root
+		}
+		eg.Go(func() error {
+			runDiskCap(ctx, roots, ro.maxDisk)
+			return nil
+		})
+	}
+	if ro.clock != nil {
+		eg.Go(func() error {
+			monitorClock(ctx, ro.ntpServer, ro.clock)
+			return nil
+		})
+	}
+	if ro.retention > 0 {
+		for _, c := range cams {
+			eg.Go(func() error {
+				enforceRetention(ctx, c.root, ro.retention)
+				return nil
+			})
+		}
+	}
+	for _, c := range cams {
+		if c.mo.mqtt != nil {
+			// Keep the connection to the broker outside of the active hours.
+			eg.Go(func() error {
+				return c.mo.mqtt.run(ctx)
+			})
+		}
+	}
+	eg.Go(func() error {
+		// Stop the server once the pipelines are done, e.g. with -d.
+		defer cancel()
+		return ro.activeHours.run(ctx, func(ctx context.Context) error {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			eg, ctx := errgroup.WithContext(ctx)
+			if ro.addr != "" && !serveAlways {
+				wait, err := startServer(ctx, ro.addr, states, ro.healthTimeout, ro.auth, ro.tlsConfig)
+				if err != nil {
+					return err
+				}
+				eg.Go(wait)
+			}
+			for i, c := range cams {
+				eg.Go(func() error {
+					// Stop the other cameras once one is done, e.g. with -d.
+					defer cancel()
+					return runCamera(ctx, c, states[i], ro)
+				})
+			}
+			return eg.Wait()
+		})
+	})
+	return eg.Wait()
+}
+
+// runFFMPEG runs ffmpeg once, until it exits, ctx is canceled or stalled is
+// signaled.
+//
+// The metadata, mpjpeg, audio level, second zone and pre-roll pipes are
+// created for each run. outputPipe, tm and preroll are optional.
+func runFFMPEG(ctx context.Context, root string, args []string, outputPipe *os.File, ffmpegLog io.Writer, tm *teeMimePart, preroll *frameRing, m *metrics, ch chan<- yLevel, stalled <-chan struct{}) error {
 	// References:
 	// - https://ffmpeg.org/ffmpeg-all.html
 	// - https://ffmpeg.org/ffmpeg-codecs.html
@@ -48,6 +207,13 @@ func run(ctx context.Context, root, addr string, fo *ffmpegOptions, ffmpegLog io
 	// - https://trac.ffmpeg.org/wiki/Capture/Webcam
 	//   ffmpeg -hide_banner -f v4l2 -list_formats all -i /dev/video3
 	// - https://trac.ffmpeg.org/wiki/Encode/H.264
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Discard a stale signal from the previous run.
+	select {
+	case <-stalled:
+	default:
+	}
 	metadataR, metadataW, err := os.Pipe()
 	if err != nil {
 		return err
@@ -59,6 +225,7 @@ func run(ctx context.Context, root, addr string, fo *ffmpegOptions, ffmpegLog io
 	}()
 	mpjpegR, mpjpegW, err := os.Pipe()
 	if err != nil {
+		_ = metadataW.Close()
 		return err
 	}
 	defer func() {
@@ -66,116 +233,290 @@ func run(ctx context.Context, root, addr string, fo *ffmpegOptions, ffmpegLog io
 			slog.Error("mpjpegR", "err", err2)
 		}
 	}()
+	audioR, audioW, err := os.Pipe()
+	if err != nil {
+		_ = metadataW.Close()
+		_ = mpjpegW.Close()
+		return err
+	}
 	defer func() {
-		if err2 := mpjpegW.Close(); err2 != nil {
-			slog.Error("mpjpegW", "err", err2)
+		if err2 := audioR.Close(); err2 != nil {
+			slog.Error("audioR", "err", err2)
 		}
 	}()
-	args, err := buildFFMPEGCmd(fo)
+	zone2R, zone2W, err := os.Pipe()
 	if err != nil {
-		if err2 := metadataW.Close(); err2 != nil {
-			slog.Error("metadataW", "err", err2)
+		_ = metadataW.Close()
+		_ = mpjpegW.Close()
+		_ = audioW.Close()
+		return err
+	}
+	defer func() {
+		if err2 := zone2R.Close(); err2 != nil {
+			slog.Error("zone2R", "err", err2)
 		}
+	}()
+	prerollR, prerollW, err := os.Pipe()
+	if err != nil {
+		_ = metadataW.Close()
+		_ = mpjpegW.Close()
+		_ = audioW.Close()
+		_ = zone2W.Close()
 		return err
 	}
-	eg, ctx := errgroup.WithContext(ctx)
-	if addr != "" {
-		if err = startServer(ctx, addr, mpjpegR, root); err != nil {
-			if err2 := metadataW.Close(); err2 != nil {
-				slog.Error("metadataW", "err", err2)
-			}
-			return err
+	defer func() {
+		if err2 := prerollR.Close(); err2 != nil {
+			slog.Error("prerollR", "err", err2)
 		}
+	}()
+	// The audio level is on pipe #6 so the output pipe's slot is left closed
+	// when not used.
+	handles := []*os.File{metadataW, mpjpegW, outputPipe, audioW, zone2W, prerollW}
+	cmd := cmdFFMPEG(ctx, root, args, handles, ffmpegLog)
+	err = cmd.Start()
+	// The child process has its own copy of the write ends. Closing ours permits
+	// the readers to get EOF when ffmpeg exits.
+	if err2 := metadataW.Close(); err2 != nil {
+		slog.Error("metadataW", "err", err2)
+	}
+	if err2 := mpjpegW.Close(); err2 != nil {
+		slog.Error("mpjpegW", "err", err2)
+	}
+	if err2 := audioW.Close(); err2 != nil {
+		slog.Error("audioW", "err", err2)
+	}
+	if err2 := zone2W.Close(); err2 != nil {
+		slog.Error("zone2W", "err", err2)
+	}
+	if err2 := prerollW.Close(); err2 != nil {
+		slog.Error("prerollW", "err", err2)
+	}
+	if err != nil {
+		return err
 	}
 
-	start := time.Now().Round(10 * time.Millisecond)
-	ch := make(chan yLevel, 10)
-	events := make(chan motionEvent, 10)
-	eg.Go(func() error {
-		defer close(ch)
-		err2 := processMetadata(start, metadataR, ch)
+	var wg sync.WaitGroup
+	// pts_time starts at 0 on each run. The video and the audio share the
+	// same timeline.
+	base := &ptsBase{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err2 := processMetadata(ctx, base, m, 0, metadataR, ch)
 		slog.Info("processMetadata", "msg", "exit", "err", err2)
-		return err2
-	})
-	eg.Go(func() error {
-		defer close(events)
-		err2 := filterMotion(ctx, mo, start, ch, events)
-		slog.Info("filterMotion", "msg", "exit", "err", err2)
-		return err2
-	})
-	eg.Go(func() error {
-		err2 := processMotion(ctx, mo, root, events)
-		slog.Info("processMotion", "msg", "exit", "err", err2)
-		return err2
-	})
-	eg.Go(func() error {
-		// TODO: Transparently restart ffmpeg when network or USB goes down as long as
-		// the context is not canceled.
-		// One challenge is when the TCP stream stops, it's the keep-alive that
-		// detects that ffmpeg needs to be restarted, so the processMetadata should
-		// be associated with the code here.
-		// TODO: Does this requires us to get rid of start?
-
-		// This is necessary because processMetadata doesn't accept a context.
-		defer func() {
-			if err2 := metadataW.Close(); err2 != nil {
-				slog.Error("metadataW", "err", err2)
-			}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Nothing is written without -audio; it gets EOF when ffmpeg exits.
+		err2 := processMetadata(ctx, base, m, 0, audioR, ch)
+		slog.Debug("processMetadata", "msg", "audio exit", "err", err2)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// Nothing is written without -mask2; it gets EOF when ffmpeg exits.
+		err2 := processMetadata(ctx, base, m, 2, zone2R, ch)
+		slog.Debug("processMetadata", "msg", "zone 2 exit", "err", err2)
+	}()
+	if tm != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err2 := tm.listen(ctx, mpjpegR, mpjpegBoundary)
+			slog.Info("teeMimePart", "msg", "exit", "err", err2)
 		}()
-		//for ctx.Err() == nil {
-		// If any of the eg.Go() call above returns an error, this will kill ffmpeg
-		// via ctx.
-		cmd := cmdFFMPEG(ctx, root, args, []*os.File{metadataW, mpjpegW}, ffmpegLog)
-		if err2 := cmd.Start(); err2 != nil {
-			return err2
-		}
-		// ffmpeg always return an error, so ignore it.
-		err2 := cmd.Wait()
-		slog.Info("ffmpeg", "msg", "exit", "err", err2)
-		//}
-		return nil
-	})
-	return eg.Wait()
+	}
+	if preroll != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err2 := preroll.listen(ctx, prerollR)
+			slog.Debug("preroll", "msg", "exit", "err", err2)
+		}()
+	}
+	go func() {
+		select {
+		case <-stalled:
+			slog.Warn("ffmpeg", "msg", "stalled; killing")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err = cmd.Wait()
+	// The readers get EOF now that ffmpeg exited.
+	wg.Wait()
+	return err
 }
 
 func mainImpl() error {
 	var level slog.LevelVar
 	level.Set(slog.LevelInfo)
-	hldr := tint.NewHandler(colorable.NewColorable(os.Stderr), &tint.Options{
-		Level:       &level,
-		TimeFormat:  time.TimeOnly,
-		NoColor:     !isatty.IsTerminal(os.Stderr.Fd()),
-		ReplaceAttr: trimFloat64,
-	})
+	hldr := newLogHandler(os.Stderr, "text", &level)
 	slog.SetDefault(slog.New(hldr))
-	src := flag.String("src", "", "source to use: either a local device or a remote port, see README.md for more information")
-	mask := flag.String("mask", "", "image mask to use; white means area to detect. Automatically resized to frame size")
+	var srcs sources
+	flag.Var(&srcs, "src", "source to use: either a local device, a remote port or a video file, see README.md for more information; repeat to record multiple cameras")
+	mask := flag.String("mask", "", "image mask to use, a file or an http(s) URL downloaded at startup; white means area to detect. Automatically resized to frame size")
+	var thresholds thresholdSchedule
+	flag.Var(&thresholds, "threshold-schedule", "-yavg by time of day, e.g. \"06:00=1.0,20:00=2.5\" to be less sensitive at night")
+	var region roi
+	flag.Var(&region, "roi", "region of interest as polygons in normalized coordinates, e.g. \"0.1,0.1 0.9,0.1 0.9,0.9\"; separate polygons with ';'. Alternative to -mask")
+	mask2 := flag.String("mask2", "", "image mask of a second detection zone with its own sensitivity, see -yavg2")
+	maskNormalize := flag.Bool("mask-normalize", false, "divide the Y average by the fraction of the frame not masked so -yavg doesn't depend on the mask size")
 	w := flag.Int("w", 1280, "width")
 	h := flag.Int("h", 720, "height")
 	fps := flag.Int("fps", 15, "frame rate")
+	realtime := flag.Bool("realtime", true, "with a video file -src, read it at its native frame rate to simulate a camera; when false, the file is processed as fast as possible and the event times don't match the video")
+	printCmd := flag.Bool("print-cmd", false, "print the ffmpeg command of each camera, quoted for a shell, then exit")
+	validateGraph := flag.Bool("validate-graph", true, "verify that ffmpeg accepts the filter graph with a synthetic source before starting")
+	checkMode := flag.Bool("check-mode", true, "on linux, verify that the v4l2 device supports -w, -h and -fps before starting")
 	d := flag.Duration("d", 0, "record for a specified duration (for testing)")
 	s := validStyles[0]
 	flag.Var(&s, "style", "style to use")
-	codec := flag.String("codec", "h264", "codec to use; libx265 takes significantly more CPU")
+	name := flag.String("name", "", "camera or site name to draw at the top left of the video")
+	font := flag.String("font", "", "font file for the text overlays; defaults to a monospace font found on the system")
+	timestampFormat := flag.String("timestamp-format", defaultTimestampFormat, "strftime format of the timestamp overlay")
+	timestampPos := position("br")
+	flag.Var(&timestampPos, "timestamp-pos", "position of the timestamp overlay; one of tl, tr, bl, br")
+	timestampSize := flag.Int("timestamp-size", 48, "font size of the timestamp overlay")
+	extraFilter := flag.String("extra-filter", "", "ffmpeg filters appended verbatim to the recorded video, e.g. \"eq=brightness=0.06,unsharp\"")
+	noTimestamp := flag.Bool("no-timestamp", false, "disable the timestamp overlay, e.g. when the video is fed to downstream analytics")
+	var frameCounter position
+	flag.Var(&frameCounter, "frame-counter", "draw the frame number and timestamp at this position to debug synchronization issues; one of tl, tr, bl, br")
+	vcodec := validCodecs[0]
+	flag.Var(&vcodec, "codec", "codec to use; libx265 takes significantly more CPU, h264_v4l2m2m is the hardware encoder on a Raspberry Pi, auto selects a hardware encoder if one works, libvpx-vp9 and libaom-av1 require -container dash")
+	crf := flag.Int("crf", 0, "constant rate factor, lower is better quality and larger files; defaults to 30 for h264 and libx265 and 35 for VP9 and AV1")
+	preset := flag.String("preset", "", "encoder speed preset for h264 and libx265, e.g. ultrafast on a Raspberry Pi or slow on a desktop; defaults to fast")
+	container := flag.String("container", "hls", "continuous recording format: hls (MPEG-TS segments) or dash (fragmented MP4 segments); motion recordings require hls")
+	segmentDuration := flag.Duration("segment-duration", 4*time.Second, "target duration of the segments; they are cut on keyframes so the actual duration varies")
+	dailyDirs := flag.Bool("daily-dirs", false, "write the segments in a directory per day to keep the directories small")
+	segmentWallclock := flag.Bool("segment-wallclock", false, "cut the HLS segments on wall clock boundaries (every 4s from midnight) so their names are predictable; forces a keyframe every second")
+	profile := flag.String("profile", "", "encoder profile, e.g. baseline, main or high for h264; use baseline for maximum device compatibility")
+	profileLevel := flag.String("level", "", "encoder level, e.g. 3.1 or 4.1")
+	clips := flag.Bool("clips", false, "also generate a MP4 clip for each motion event, easier to share than a playlist")
+	eventLogPath := flag.String("event-log", "", "append each motion event as a JSON line to this file, e.g. events.jsonl; a new file is started every day, e.g. events-2024-01-02.jsonl")
+	posters := flag.Bool("posters", false, "also generate a JPEG poster of each motion recording, shown by /videos before the video is played; uses the frame with the most motion with -vtt")
+	gif := flag.Bool("gif", false, "also generate a small animated GIF preview of each motion event, e.g. for notifications")
+	cm := validClipModes[0]
+	flag.Var(&cm, "clip-trim", "how MP4 clips are trimmed: copy is fast but starts on a keyframe, precise re-encodes the clip")
+	ov := validOverlaps[0]
+	flag.Var(&ov, "overlap", "what to do with motion events whose recording windows overlap: separate or merge")
 	yavg := flag.Float64("yavg", 1., "Y average sensitivity, higher value means lower sensitivity")
+	yavg2 := flag.Float64("yavg2", 0, "Y average sensitivity of the -mask2 zone; defaults to -yavg")
+	audio := flag.String("audio", "", "audio device to record, e.g. \"hw:1\" with ALSA on linux or the device index on macOS; loud sounds also trigger the motion events")
+	audioThreshold := flag.Float64("audio-threshold", -25, "audio RMS level in dBFS above which a sound triggers an event with -audio; 0 is the loudest")
+	adaptive := flag.Float64("adaptive", 0, "detect motion when the Y average exceeds the mean plus this many standard deviations of the recent frames without motion, e.g. 4; -yavg is the lower bound; 0 disables")
+	adaptiveWindow := flag.Duration("adaptive-window", time.Minute, "duration of the recent frames used by -adaptive")
+	yavgLog := flag.Duration("yavg-log", 0, "log the peak Y average at most once per interval instead of every frame; every frame is still logged with -v")
+	genRetries := flag.Int("gen-retries", 2, "number of times to retry generating a motion recording when no segment is found yet")
+	retention := flag.Duration("retention", 0, "delete the recordings older than this duration, e.g. 168h; segments used by a more recent motion recording are kept")
+	var maxDisk byteSize
+	flag.Var(&maxDisk, "max-disk", "delete the oldest recordings when they use more than this size, e.g. 50GB; the last hour is always kept")
 	root := flag.String("root", ".", "root directory to store videos into")
+	mjpegPeak := flag.Bool("mjpeg-peak", false, "show the frame with the most motion of each second in the MJPEG stream instead of an arbitrary one; uses more CPU")
+	mjpegFPS := flag.Float64("mjpeg-fps", 1, "frame rate of the MJPEG stream, e.g. 5 for a smoother preview or 0.5 on a slow uplink; can't exceed -fps")
+	mjpegQuality := flag.Int("mjpeg-quality", 2, "JPEG quality of the MJPEG stream between 1 and 31; lower is better quality but larger frames")
+	var mjpegScale scaleSpec
+	flag.Var(&mjpegScale, "mjpeg-scale", "reduce the resolution of the MJPEG stream to this width in pixels, e.g. 640, or to this fraction, e.g. 0.5; the recording is not affected")
+	maxPartSize := flag.Int64("mjpeg-max-part", defaultMaxPartSize, "maximum size in bytes of a MJPEG frame; larger frames are dropped")
+	maxClients := flag.Int("max-clients", 0, "maximum number of concurrent /mpjpeg clients per camera; 0 means unlimited")
+	ffmpegInputArgs := flag.String("ffmpeg-input-args", "", "extra ffmpeg arguments for the camera input, quoted like a shell, e.g. \"-thread_queue_size 1024\"; for power users")
+	ffmpegOutputArgs := flag.String("ffmpeg-output-args", "", "extra ffmpeg arguments for the continuous recording output, quoted like a shell, e.g. \"-pix_fmt yuv420p\"; for power users")
+	outputPipe := flag.String("output-pipe", "", "named pipe (FIFO) to also write a MPEG-TS stream to for custom downstream processing; ffmpeg stalls if nothing reads it")
+	export := flag.String("export", "", "export a motion recording playlist in -root, e.g. 2024-01-02T03-04-05.m3u8, as a standalone ZIP with an offline HTML player in the current directory then exit; uses -clip-trim")
+	authUser := flag.String("auth-user", "", "require HTTP Basic authentication with this user name")
+	authPass := flag.String("auth-pass", "", "password for -auth-user; defaults to $AUTH_PASS")
+	authToken := flag.String("auth-token", "", "require this bearer token, either in the Authorization header or the token query argument; defaults to $AUTH_TOKEN")
+	cert := flag.String("cert", "", "TLS certificate file to serve HTTPS; requires -key")
+	key := flag.String("key", "", "TLS private key file")
+	acmeDomain := flag.String("acme-domain", "", "domain name to get a TLS certificate for from Let's Encrypt; the server must be reachable on port 443")
+	healthTimeout := flag.Duration("health-timeout", 15*time.Second, "/healthz fails when ffmpeg didn't report a frame for this long")
 	addr := flag.String("addr", "", "optional address to listen to to serve MJPEG")
 	onEventStart := flag.String("on-event-start", "", "script to run on motion event start")
 	onEventEnd := flag.String("on-event-end", "", "script to run on motion event start")
-	webhook := flag.String("webhook", "", "webhook to call on motion events")
-	verbose := flag.Bool("v", false, "enable verbosity")
+	var hooks webhooks
+	flag.Var(&hooks, "webhook", "webhook to call on motion events; can be repeated")
+	preCapture := flag.Duration("pre-capture", 5*time.Second, "duration to include in a motion recording before the motion is detected")
+	postCapture := flag.Duration("post-capture", 2*time.Second, "duration to include in a motion recording after the motion expired")
+	motionExpiration := flag.Duration("motion-expiration", 5*time.Second, "duration without motion after which a motion event ends")
+	ignoreFirstFrames := flag.Int("ignore-first-frames", 10, "ignore motion in the first frames, when many cameras auto-focus")
+	ignoreFirstMoments := flag.Duration("ignore-first-moments", 5*time.Second, "ignore motion when the stream starts, when many cameras adjust the exposure")
+	preroll := flag.Bool("preroll", false, "keep the last -pre-capture of frames in memory so the motion recordings include it even when the segments are missing; uses up to -pre-capture * -fps full resolution JPEG frames of memory")
+	minEvent := flag.Duration("min-event", 0, "ignore motion that doesn't last at least this duration, e.g. a flash of light")
+	watchdog := flag.Duration("watchdog", defaultWatchdog, "restart ffmpeg when no frame was received for this duration; increase it for slow sources or long exposures")
+	cooldown := flag.Duration("cooldown", 0, "merge motion events separated by less than this duration into a single event")
+	snapshots := flag.Bool("snapshots", false, "save a JPEG when motion starts")
+	mqttBroker := flag.String("mqtt-broker", "", "MQTT broker to publish motion events to, e.g. tcp://homeassistant.local:1883")
+	mqttTopic := flag.String("mqtt-topic", "record-videos/motion", "MQTT topic to publish the motion events to as retained messages")
+	mqttUser := flag.String("mqtt-user", "", "MQTT user name")
+	mqttPassword := flag.String("mqtt-password", "", "MQTT password; defaults to $MQTT_PASSWORD")
+	webhookRetries := flag.Int("webhook-retries", 3, "number of times a failed webhook call is retried with exponential backoff")
+	var discord discordWebhook
+	flag.Var(&discord, "discord-webhook", "Discord webhook URL to post a message to when motion starts")
+	smtpHost := flag.String("smtp-host", "", "SMTP server to email the motion start to, e.g. smtp.gmail.com:587; port 465 uses implicit TLS")
+	smtpFrom := flag.String("smtp-from", "", "sender address of the emails")
+	smtpTo := flag.String("smtp-to", "", "comma separated recipients of the emails")
+	smtpUser := flag.String("smtp-user", "", "SMTP user name")
+	smtpPassword := flag.String("smtp-password", "", "SMTP password; defaults to $SMTP_PASSWORD")
+	telegramToken := flag.String("telegram-token", "", "Telegram bot token to send a message when motion starts; defaults to $TELEGRAM_TOKEN")
+	telegramChat := flag.String("telegram-chat", "", "Telegram chat ID to send the motion messages to; requires -telegram-token")
+	var activeHours schedule
+	flag.Var(&activeHours, "active-hours", "only record during these hours, e.g. \"08:00-18:00\" or \"mon-fri 08:00-18:00;sat 10:00-14:00\"; ffmpeg is stopped outside")
+	serveInactive := flag.Bool("serve-inactive", true, "keep the web server and the live view running outside of -active-hours; the live view has no frame then")
+	var motionHours schedule
+	flag.Var(&motionHours, "motion-hours", "only act on motion during these hours, same format as -active-hours; recording and the live view keep running outside")
+	var post postPipeline
+	flag.Var(&post, "post", "post-processing steps to run on each finalized motion recording, e.g. \"transcode:crf=32;upload:url=https://example.com/clips/;delete\"; steps are "+strings.Join(validPostSteps, ", "))
+	vtt := flag.Bool("vtt", false, "write the motion level as a .vtt subtitle track alongside each motion recording")
+	ntpServer := flag.String("ntp-server", "", "NTP server to compare the clock against at startup, e.g. pool.ntp.org; defaults to systemd-timesyncd's status on linux")
+	clockWait := flag.Duration("clock-wait", 0, "wait up to this duration at startup for the clock to be synchronized, e.g. on a Raspberry Pi without a RTC")
+	tz := flag.String("tz", "", "IANA time zone for the overlay and the file names, e.g. America/Montreal; defaults to the host's. Use UTC to keep the file names sortable across DST changes")
+	verbose := flag.Bool("v", false, "enable verbosity; same as -log-level DEBUG")
+	var logLevel slog.Level
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "minimum level to log: DEBUG, INFO, WARN or ERROR")
+	logFmt := logFormat("text")
+	flag.Var(&logFmt, "log-format", "format of the log lines: text for a terminal or json for a log collector")
+	logFFMPEG := flag.Bool("log-ffmpeg", false, "re-emit each line ffmpeg writes to stderr as a log entry at the level ffmpeg printed it, instead of forwarding it as is")
 	l := flag.String("logdir", "", "directory to log files to; reduces output to stderr")
+	config := flag.String("config", "", "YAML or JSON file whose keys are flag names, e.g. \"pre-capture: 10s\"; flags on the command line take precedence")
 	flag.Parse()
 
 	if flag.NArg() != 0 {
 		return errors.New("unexpected argument")
 	}
+	var cfgs []cameraConfig
+	if *config != "" {
+		var err error
+		if cfgs, err = loadConfig(flag.CommandLine, *config); err != nil {
+			return err
+		}
+	}
+	if *tz != "" {
+		loc, err := time.LoadLocation(*tz)
+		if err != nil {
+			return fmt.Errorf("-tz: %w", err)
+		}
+		// Used to name and find the motion recordings.
+		time.Local = loc
+		// ffmpeg's strftime segment names and localtime overlay use the TZ
+		// environment variable, which is inherited by the child process.
+		if err = os.Setenv("TZ", *tz); err != nil {
+			return err
+		}
+	}
+	level.Set(logLevel)
+	if logFmt != "text" {
+		hldr = newLogHandler(os.Stderr, logFmt, &level)
+		slog.SetDefault(slog.New(hldr))
+	}
 	ffmpegLevel := "repeat+warning"
 	if *verbose {
-		level.Set(slog.LevelDebug)
+		level.Set(min(level.Level(), slog.LevelDebug))
+	}
+	if level.Level() <= slog.LevelDebug {
 		ffmpegLevel = "repeat+info"
 	}
-	ffmpegLog := os.Stderr
+	var ffmpegLog io.Writer = os.Stderr
 	if *l != "" {
 		l2, err := filepath.Abs(*l)
 		if err != nil {
@@ -186,25 +527,39 @@ func mainImpl() error {
 			return err
 		}
 		defer f.Close()
+		// The file gets everything unless a level was explicitly requested.
+		fileLevel := slog.LevelDebug
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "log-level" {
+				fileLevel = level.Level()
+			}
+		})
 		// Revert back log to warning.
 		level.Set(slog.LevelWarn)
-		hldr2 := tint.NewHandler(f, &tint.Options{
-			Level:       slog.LevelDebug,
-			TimeFormat:  time.TimeOnly,
-			NoColor:     true,
-			ReplaceAttr: trimFloat64,
-		})
+		hldr2 := newLogHandler(f, logFmt, fileLevel)
 		slog.SetDefault(slog.New(slogmulti.Fanout(hldr, hldr2)))
-		ffmpegLog, err = os.OpenFile(filepath.Join(l2, "ffmpeg.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o666)
-		if err != nil {
-			return err
+		if !*logFFMPEG {
+			f2, err := os.OpenFile(filepath.Join(l2, "ffmpeg.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o666)
+			if err != nil {
+				return err
+			}
+			defer f2.Close()
+			ffmpegLog = f2
 		}
-		defer ffmpegLog.Close()
 		ffmpegLevel = "repeat+level+verbose"
 		if *verbose {
 			ffmpegLevel = "repeat+level+debug"
 		}
 	}
+	if *logFFMPEG {
+		// Print the level so it can be parsed back.
+		if !strings.Contains(ffmpegLevel, "+level") {
+			ffmpegLevel = strings.Replace(ffmpegLevel, "repeat+", "repeat+level+", 1)
+		}
+		ffmpegLog = &logWriter{name: "ffmpeg"}
+		// The other ffmpeg processes only print warnings and errors.
+		ffmpegStderr = &logWriter{name: "ffmpeg", level: slog.LevelWarn}
+	}
 
 	// Quit whenever SIGINT is received.
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
@@ -240,7 +595,30 @@ func mainImpl() error {
 	} else if !fi.IsDir() {
 		return fmt.Errorf("-root %q is not a directory", *root)
 	}
-	if *src == "" {
+	if vcodec == "auto" {
+		if vcodec = resolveCodec(ctx, vcodec); vcodec != "h264" && (*crf != 0 || *preset != "") {
+			// They only apply to the software fallback.
+			slog.Warn("codec", "msg", "-crf and -preset are ignored by the hardware encoder", "codec", vcodec)
+			*crf = 0
+			*preset = ""
+		}
+	}
+	if *export != "" {
+		// The "precise" mode re-encodes like the recording.
+		o := ffmpegOptions{codec: vcodec, crf: *crf, preset: *preset, profile: *profile, profileLevel: *profileLevel}
+		enc, err := o.videoEncoderArgs()
+		if err != nil {
+			return err
+		}
+		return exportEvent(ctx, *root, *export, cm, enc, strings.TrimSuffix(filepath.Base(*export), ".m3u8")+".zip")
+	}
+	if len(cfgs) != 0 && len(srcs) != 0 {
+		return errors.New("-src can't be used with cameras in -config")
+	}
+	for _, src := range srcs {
+		cfgs = append(cfgs, cameraConfig{src: src})
+	}
+	if len(cfgs) == 0 {
 		var out []byte
 		var err error
 		switch runtime.GOOS {
@@ -252,7 +630,12 @@ func mainImpl() error {
 			if out, err = c.CombinedOutput(); err != nil {
 				return fmt.Errorf("fail to run v4l2-ctl, try 'sudo apt install v4l-utils'? %w", err)
 			}
-			// TODO gather resolutions too: v4l2-ctl --list-formats-ext -d (dev)
+			// Append the modes supported by each device. Metadata devices have none.
+			for _, dev := range parseV4L2Devices(out) {
+				if modes, err2 := listV4L2Formats(ctx, dev); err2 == nil && len(modes) != 0 {
+					out = fmt.Appendf(out, "\n%s:\n%s\n", dev, formatV4L2Modes(modes))
+				}
+			}
 		case "windows":
 			c := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-f", "dshow", "-list_devices", "true", "-i", "")
 			out, _ = c.CombinedOutput()
@@ -261,31 +644,393 @@ func mainImpl() error {
 		}
 		return fmt.Errorf("-src not specified, here's what has been found:\n\n%s", bytes.TrimSpace(out))
 	}
+	hasFile := false
+	for i := range cfgs {
+		cfgs[i].src = resolveSource(cfgs[i].src)
+		hasFile = hasFile || isFileSource(cfgs[i].src)
+	}
+	setRealtime := false
+	flag.Visit(func(f *flag.Flag) {
+		setRealtime = setRealtime || f.Name == "realtime"
+	})
+	if setRealtime && !hasFile {
+		return errors.New("-realtime requires a video file -src")
+	}
+	for _, cfg := range cfgs {
+		src := cfg.src
+		if !*checkMode || runtime.GOOS != "linux" || !strings.HasPrefix(src, "/dev/") {
+			continue
+		}
+		// ffmpeg's error is cryptic when the mode is not supported.
+		if modes, err2 := listV4L2Formats(ctx, src); err2 != nil {
+			slog.Warn("v4l2", "msg", "can't validate -w, -h and -fps", "src", src, "err", err2)
+		} else if err = checkV4L2Mode(modes, *w, *h, *fps); err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+	}
+	masks := []*string{mask, mask2}
+	for i := range cfgs {
+		masks = append(masks, &cfgs[i].mask)
+	}
+	for _, p := range masks {
+		if !isMaskURL(*p) {
+			continue
+		}
+		u := *p
+		if *p, err = fetchMask(ctx, u); err != nil {
+			return err
+		}
+		defer os.Remove(*p)
+		slog.Info("mask", "url", u, "p", *p)
+	}
+	if *retention != 0 && *container == "dash" {
+		// The DASH chunks are numbered, not named after their time, and all.mpd
+		// references all of them.
+		return errors.New("-retention can't be used with -container dash")
+	}
+	if maxDisk != 0 && *container == "dash" {
+		// Same as -retention.
+		return errors.New("-max-disk can't be used with -container dash")
+	}
+	coverage := 0.
+	if len(region) != 0 {
+		if *mask != "" {
+			return errors.New("-roi and -mask are mutually exclusive")
+		}
+		img := region.render(*w, *h)
+		if coverage = imageCoverage(img); coverage < 0.01 {
+			return errors.New("-roi is too small")
+		}
+		if *mask, err = roiDataURI(img); err != nil {
+			return err
+		}
+		if !*maskNormalize {
+			coverage = 0
+		}
+	} else if *maskNormalize && *mask != "" {
+		if coverage, err = maskCoverage(*mask); err != nil {
+			return err
+		}
+		if coverage < 0.01 {
+			return fmt.Errorf("-mask %q masks the whole frame", *mask)
+		}
+	} else if *maskNormalize && !slices.ContainsFunc(cfgs, func(c cameraConfig) bool { return c.mask != "" }) {
+		return errors.New("-mask-normalize requires -mask or -roi")
+	}
+	if coverage != 0 {
+		slog.Info("mask", "coverage", coverage)
+	}
+	for i := range cfgs {
+		if cfgs[i].mask == "" || !*maskNormalize {
+			continue
+		}
+		if cfgs[i].coverage, err = maskCoverage(cfgs[i].mask); err != nil {
+			return err
+		}
+		if cfgs[i].coverage < 0.01 {
+			return fmt.Errorf("mask %q masks the whole frame", cfgs[i].mask)
+		}
+		slog.Info("mask", "src", cfgs[i].src, "coverage", cfgs[i].coverage)
+	}
+	coverage2 := 0.
+	if *mask2 == "" {
+		if *yavg2 != 0 {
+			return errors.New("-yavg2 requires -mask2")
+		}
+	} else {
+		if *yavg2 == 0 {
+			*yavg2 = *yavg
+		}
+		if *yavg2 <= 0 {
+			return errors.New("-yavg2 must be positive")
+		}
+		if *maskNormalize {
+			if coverage2, err = maskCoverage(*mask2); err != nil {
+				return err
+			}
+			if coverage2 < 0.01 {
+				return fmt.Errorf("-mask2 %q masks the whole frame", *mask2)
+			}
+			slog.Info("mask2", "coverage", coverage2)
+		}
+	}
+	clock := &clockStatus{}
+	if err = checkClock(ctx, *ntpServer, *clockWait, clock); err != nil {
+		return err
+	}
+	if strings.Contains(*timestampFormat, "'") {
+		return errors.New("-timestamp-format can't contain a single quote")
+	}
+	auth := &httpAuth{user: *authUser, pass: *authPass, token: *authToken}
+	if auth.user != "" && auth.pass == "" {
+		auth.pass = os.Getenv("AUTH_PASS")
+	}
+	if auth.token == "" {
+		auth.token = os.Getenv("AUTH_TOKEN")
+	}
+	if (auth.user == "") != (auth.pass == "") {
+		return errors.New("-auth-user and -auth-pass must be used together")
+	}
+	if auth.enabled() && *addr == "" {
+		return errors.New("authentication requires -addr")
+	}
+	tlsConfig, err := serverTLSConfig(*cert, *key, *acmeDomain)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil && *addr == "" {
+		return errors.New("-cert and -acme-domain require -addr")
+	}
+	if *preCapture < 0 {
+		return errors.New("-pre-capture must be positive")
+	}
+	if *preroll && *preCapture == 0 {
+		return errors.New("-preroll requires -pre-capture")
+	}
+	if *postCapture < 0 {
+		return errors.New("-post-capture must be positive")
+	}
+	if *motionExpiration < 0 {
+		return errors.New("-motion-expiration must be positive")
+	}
+	if *ignoreFirstFrames < 0 {
+		return errors.New("-ignore-first-frames must be positive")
+	}
+	if *ignoreFirstMoments < 0 {
+		return errors.New("-ignore-first-moments must be positive")
+	}
+	if *minEvent < 0 {
+		return errors.New("-min-event must be positive")
+	}
+	if *watchdog <= 0 {
+		return errors.New("-watchdog must be positive")
+	}
+	if *cooldown < 0 {
+		return errors.New("-cooldown must be positive")
+	}
+	if *adaptive < 0 {
+		return errors.New("-adaptive must be positive")
+	}
+	if *adaptive > 0 && *adaptiveWindow <= 0 {
+		return errors.New("-adaptive-window must be positive")
+	}
+	if *webhookRetries < 0 {
+		return errors.New("-webhook-retries must be positive")
+	}
+	if *mjpegFPS <= 0 {
+		return errors.New("-mjpeg-fps must be positive")
+	}
+	if *mjpegFPS > float64(*fps) {
+		return errors.New("-mjpeg-fps can't be higher than -fps")
+	}
+	if *mjpegQuality < 1 || *mjpegQuality > 31 {
+		return errors.New("-mjpeg-quality must be between 1 and 31")
+	}
+	if *mjpegPeak && *mjpegFPS != 1 {
+		return errors.New("-mjpeg-fps can't be used with -mjpeg-peak")
+	}
+	if *maxClients < 0 {
+		return errors.New("-max-clients must be positive")
+	}
+	var mqtt *mqttClient
+	if *mqttBroker != "" {
+		if *mqttPassword == "" {
+			*mqttPassword = os.Getenv("MQTT_PASSWORD")
+		}
+		host, _ := os.Hostname()
+		var err error
+		if mqtt, err = newMQTTClient(*mqttBroker, *mqttTopic, *mqttUser, *mqttPassword, "record-videos-"+host); err != nil {
+			return err
+		}
+	}
+	var mailer *smtpMailer
+	if *smtpHost != "" {
+		if *smtpPassword == "" {
+			*smtpPassword = os.Getenv("SMTP_PASSWORD")
+		}
+		var err error
+		if mailer, err = newSMTPMailer(*smtpHost, *smtpFrom, *smtpTo, *smtpUser, *smtpPassword, *cooldown); err != nil {
+			return err
+		}
+	}
+	if *telegramToken == "" {
+		*telegramToken = os.Getenv("TELEGRAM_TOKEN")
+	}
+	var telegram *telegramBot
+	if *telegramChat != "" {
+		if *telegramToken == "" {
+			return errors.New("-telegram-chat requires -telegram-token")
+		}
+		telegram = &telegramBot{token: *telegramToken, chat: *telegramChat}
+	}
+	if *audioThreshold > 0 {
+		return errors.New("-audio-threshold must be negative or zero, in dBFS")
+	}
+	if *segmentDuration < 500*time.Millisecond {
+		return errors.New("-segment-duration must be at least 500ms")
+	}
+	if *timestampSize <= 0 {
+		return errors.New("-timestamp-size must be positive")
+	}
+	emptyFilter := false
+	flag.Visit(func(f *flag.Flag) {
+		emptyFilter = emptyFilter || (f.Name == "extra-filter" && strings.TrimSpace(*extraFilter) == "")
+	})
+	if emptyFilter {
+		return errors.New("-extra-filter must not be empty")
+	}
+	if *extraFilter != "" {
+		slog.Warn("ffmpeg", "msg", "-extra-filter is inserted verbatim in the filter graph", "filter", *extraFilter)
+	}
+	inputArgs, err := splitArgs(*ffmpegInputArgs)
+	if err != nil {
+		return fmt.Errorf("-ffmpeg-input-args: %w", err)
+	}
+	outputArgs, err := splitArgs(*ffmpegOutputArgs)
+	if err != nil {
+		return fmt.Errorf("-ffmpeg-output-args: %w", err)
+	}
+	fontFile, err := findFont(*font)
+	if err != nil {
+		return err
+	}
 	fo := &ffmpegOptions{
-		src:   *src,
-		mask:  *mask,
-		w:     *w,
-		h:     *h,
-		fps:   *fps,
-		d:     *d,
-		s:     s,
-		codec: *codec,
+		mask:             *mask,
+		w:                *w,
+		h:                *h,
+		fps:              *fps,
+		realtime:         *realtime,
+		d:                *d,
+		s:                s,
+		codec:            vcodec,
+		crf:              *crf,
+		preset:           *preset,
+		container:        *container,
+		segmentDuration:  *segmentDuration,
+		dailyDirs:        *dailyDirs,
+		segmentWallclock: *segmentWallclock,
+		profile:          *profile,
+		profileLevel:     *profileLevel,
+		fontFile:         fontFile,
+		timestampFormat:  *timestampFormat,
+		timestampPos:     timestampPos,
+		timestampSize:    *timestampSize,
+		noTimestamp:      *noTimestamp,
+		name:             *name,
+		frameCounter:     frameCounter,
+		extraFilter:      filter(strings.TrimSpace(*extraFilter)),
+		audio:            *audio,
+		mask2:            *mask2,
+		outputPipe:       *outputPipe,
 		// Enable mpjpeg encoding only if the server is running.
-		mpjpeg: *addr != "",
-		level:  ffmpegLevel,
+		mpjpeg:        *addr != "",
+		preroll:       *preroll,
+		mpjpegPeak:    *mjpegPeak,
+		mpjpegFPS:     *mjpegFPS,
+		mpjpegQuality: *mjpegQuality,
+		mpjpegScale:   mjpegScale,
+		level:         ffmpegLevel,
+		inputArgs:     inputArgs,
+		outputArgs:    outputArgs,
 	}
 	mo := &motionOptions{
 		yThreshold:         float32(*yavg),
-		motionExpiration:   5 * time.Second,
-		preCapture:         5 * time.Second,
-		postCapture:        2 * time.Second,
-		ignoreFirstFrames:  10,
-		ignoreFirstMoments: 5 * time.Second,
+		audio:              *audio != "",
+		audioThreshold:     float32(*audioThreshold),
+		thresholds:         thresholds,
+		adaptiveK:          float32(*adaptive),
+		adaptiveWindow:     *adaptiveWindow,
+		motionExpiration:   *motionExpiration,
+		watchdog:           *watchdog,
+		preCapture:         *preCapture,
+		postCapture:        *postCapture,
+		ignoreFirstFrames:  *ignoreFirstFrames,
+		fps:                *fps,
+		ignoreFirstMoments: *ignoreFirstMoments,
+		segmentDuration:    *segmentDuration,
+		reprocess:          time.Minute,
+		genRetries:         *genRetries,
+		maskCoverage:       float32(coverage),
+		zone2Threshold:     float32(*yavg2),
+		zone2Coverage:      float32(coverage2),
+		yLogInterval:       *yavgLog,
+		clips:              *clips,
+		gif:                *gif,
+		posters:            *posters,
+		clipMode:           cm,
+		overlap:            ov,
+		motionHours:        motionHours,
+		post:               post,
 		onEventStart:       *onEventStart,
 		onEventEnd:         *onEventEnd,
-		webhook:            *webhook,
+		webhooks:           hooks,
+		name:               *name,
+		webhookRetries:     *webhookRetries,
+		mqtt:               mqtt,
+		telegram:           telegram,
+		discord:            discord,
+		smtp:               mailer,
+		snapshots:          *snapshots,
+		cooldown:           *cooldown,
+		minEvent:           *minEvent,
+	}
+	if cm == "precise" {
+		if mo.clipEncoder, err = fo.videoEncoderArgs(); err != nil {
+			return err
+		}
+	}
+	if *preroll {
+		mo.preroll = &frameRing{maxAge: *preCapture}
+	}
+	if *eventLogPath != "" {
+		mo.eventLog = &eventLog{p: *eventLogPath}
+		defer mo.eventLog.close()
+	}
+	cams, err := newCameras(*root, cfgs, fo, mo, *telegramToken)
+	if err != nil {
+		return err
+	}
+	for _, c := range cams {
+		c.fo.s = resolveStyle(c.fo.s, c.fo.mask)
+	}
+	if *printCmd {
+		for _, c := range cams {
+			args, err2 := buildFFMPEGCmd(c.fo)
+			if err2 != nil {
+				return err2
+			}
+			fmt.Println(shellCommand(c.root, args, c.fo.outputPipe))
+		}
+		return nil
+	}
+	for _, c := range cams {
+		if err = checkFFMPEG(ctx, c.fo); err != nil {
+			return err
+		}
+		if !*validateGraph {
+			continue
+		}
+		if err = validateFilterGraph(ctx, c.fo); err != nil {
+			return err
+		}
+	}
+	ro := &runOptions{
+		addr:          *addr,
+		auth:          auth,
+		tlsConfig:     tlsConfig,
+		healthTimeout: *healthTimeout,
+		maxPartSize:   *maxPartSize,
+		maxClients:    *maxClients,
+		ffmpegLog:     ffmpegLog,
+		vtt:           *vtt,
+		maxDisk:       int64(maxDisk),
+		retention:     *retention,
+		activeHours:   activeHours,
+		serveInactive: *serveInactive,
+		ntpServer:     *ntpServer,
+		clock:         clock,
 	}
-	return run(ctx, *root, *addr, fo, ffmpegLog, mo)
+	return run(ctx, cams, ro)
 }
 
 func main() {
@@ -0,0 +1,50 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestRunFFMPEG(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip(err)
+	}
+	ctx := context.Background()
+	ch := make(chan yLevel, 10)
+	stalled := make(chan struct{}, 1)
+	// Fake ffmpeg writing the metadata to pipe:3.
+	args := []string{"sh", "-c", "printf 'frame:12 pts:12 pts_time:0.8\\nlavfi.signalstats.YAVG=1.5\\n' >&3"}
+	if err := runFFMPEG(ctx, t.TempDir(), args, nil, io.Discard, nil, nil, &metrics{}, ch, stalled); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case l := <-ch:
+		if l.frame != 12 || l.pts.Round(time.Millisecond) != 800*time.Millisecond || l.yavg != 1.5 {
+			t.Fatalf("unexpected %+v", l)
+		}
+	default:
+		t.Fatal("expected a yLevel")
+	}
+
+	// A stall kills the process.
+	args = []string{"sh", "-c", "exec sleep 10"}
+	stalled <- struct{}{}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		stalled <- struct{}{}
+	}()
+	start := time.Now()
+	if err := runFFMPEG(ctx, t.TempDir(), args, nil, io.Discard, nil, nil, &metrics{}, ch, stalled); err == nil {
+		t.Fatal("expected error")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("took %s", d)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxMaskSize is the maximum size of a mask downloaded with -mask or uploaded
+// with POST /mask.
+const maxMaskSize = 16 << 20
+
+// fetchMaskTimeout is the maximum duration to download a mask.
+const fetchMaskTimeout = time.Minute
+
+// isMaskURL returns true if the -mask value is an URL to download.
+func isMaskURL(v string) bool {
+	return strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://")
+}
+
+// fetchMask downloads the mask at u to a temporary file and returns its path.
+// The caller must delete the file.
+//
+// The file extension is the image format since ffmpeg selects the decoder
+// with it.
+func fetchMask(ctx context.Context, u string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchMaskTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch -mask %s: %s", u, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxMaskSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxMaskSize {
+		return "", fmt.Errorf("-mask %s is larger than %d bytes", u, maxMaskSize)
+	}
+	_, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode -mask %s: %w", u, err)
+	}
+	f, err := os.CreateTemp("", "record-videos-mask-*."+format)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(b)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// checkMask verifies that b is a PNG with the same aspect ratio as a w x h
+// frame. The mask is resized to the frame size by ffmpeg.
+func checkMask(b []byte, w, h int) error {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to decode the mask: %w", err)
+	}
+	if format != "png" {
+		return fmt.Errorf("the mask must be a PNG, got %s", format)
+	}
+	if cfg.Width*h != cfg.Height*w {
+		return fmt.Errorf("the mask is %dx%d, it must have the same aspect ratio as the frame, %dx%d", cfg.Width, cfg.Height, w, h)
+	}
+	return nil
+}
+
+// writeMask replaces the mask file p with b atomically, so ffmpeg never reads
+// a partial file.
+func writeMask(p string, b []byte) error {
+	// #nosec G306
+	if err := os.WriteFile(p+".tmp", b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
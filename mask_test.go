@@ -0,0 +1,80 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func encodeMask(t *testing.T, w, h int, format string) []byte {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	var buf bytes.Buffer
+	var err error
+	if format == "png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchMask(t *testing.T) {
+	masks := map[string][]byte{"/mask.png": encodeMask(t, 64, 36, "png"), "/mask.jpg": encodeMask(t, 64, 36, "jpeg"), "/bad.png": []byte("not an image")}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, ok := masks[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		_, _ = w.Write(b)
+	}))
+	defer s.Close()
+	if !isMaskURL(s.URL+"/mask.png") || isMaskURL("mask.png") {
+		t.Fatal("isMaskURL")
+	}
+	for name, ext := range map[string]string{"/mask.png": ".png", "/mask.jpg": ".jpeg"} {
+		p, err := fetchMask(context.Background(), s.URL+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(p)
+		_ = os.Remove(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(p, ext) || !bytes.Equal(b, masks[name]) {
+			t.Fatalf("%s: %s", name, p)
+		}
+	}
+	for _, name := range []string{"/missing.png", "/bad.png"} {
+		if _, err := fetchMask(context.Background(), s.URL+name); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestCheckMask(t *testing.T) {
+	if err := checkMask(encodeMask(t, 640, 360, "png"), 1280, 720); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMask(encodeMask(t, 640, 480, "png"), 1280, 720); err == nil {
+		t.Fatal("expected aspect ratio error")
+	}
+	if err := checkMask(encodeMask(t, 640, 360, "jpeg"), 1280, 720); err == nil {
+		t.Fatal("expected format error")
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// metrics is the state of the process exposed on /metrics and /status.
+//
+// It is shared by the goroutines started by run() so all the fields are
+// atomic.
+type metrics struct {
+	motionEvents atomic.Int64
+	inMotion     atomic.Bool
+	lastYAVG     atomic.Uint32
+	// threshold is the motion threshold used for the last frame, as float32
+	// bits. It changes with -threshold-schedule and -adaptive.
+	threshold atomic.Uint32
+	// fps is the actual frame rate, as float32 bits. It can differ from -fps
+	// when the driver imposes another one.
+	fps            atomic.Uint32
+	ffmpegRestarts atomic.Int64
+	// ffmpegErrors is the number of error lines printed by ffmpeg, with
+	// -log-ffmpeg.
+	ffmpegErrors atomic.Int64
+	recordings   atomic.Int64
+	// lastFrame is the time of the last frame reported by ffmpeg, in
+	// nanoseconds since the epoch.
+	lastFrame atomic.Int64
+	// lastEvent is the time of the last motion start or end, in nanoseconds
+	// since the epoch.
+	lastEvent atomic.Int64
+	// lastSnapshot is the name of the last snapshot saved, with -snapshots.
+	lastSnapshot atomic.Pointer[string]
+	// box is the bounding box of the motion in the last frame, in the debug
+	// styles. It is nil when there's none.
+	box atomic.Pointer[image.Rectangle]
+	// samples are the recent motion levels, for /yavg.
+	samples yavgRing
+	// started is when run() started. It is not modified afterward.
+	started time.Time
+	// activeHours is -active-hours. It is not modified afterward.
+	activeHours schedule
+	// motionHours is -motion-hours. It is not modified afterward.
+	motionHours schedule
+	// clock is optional and shared by the cameras.
+	clock *clockStatus
+}
+
+// status is the JSON content of /status.
+type status struct {
+	InMotion       bool       `json:"in_motion"`
+	LastEvent      *time.Time `json:"last_event,omitempty"`
+	LastSnapshot   string     `json:"last_snapshot,omitempty"`
+	YAVG           float32    `json:"yavg"`
+	Threshold      float32    `json:"threshold,omitempty"`
+	FPS            float32    `json:"fps,omitempty"`
+	Uptime         string     `json:"uptime"`
+	FFMPEGRestarts int64      `json:"ffmpeg_restarts"`
+	FFMPEGErrors   int64      `json:"ffmpeg_errors,omitempty"`
+	// Active is set with -active-hours, ffmpeg is stopped when false.
+	Active *bool `json:"active,omitempty"`
+	// ActiveUntil and InactiveUntil are when the active state changes, with
+	// -active-hours.
+	ActiveUntil   *time.Time `json:"active_until,omitempty"`
+	InactiveUntil *time.Time `json:"inactive_until,omitempty"`
+	// MotionActive is set with -motion-hours, the motion events are ignored
+	// when false.
+	MotionActive *bool `json:"motion_active,omitempty"`
+	// ClockSynced is whether the system clock is synchronized. It is not set
+	// when it can't be determined.
+	ClockSynced *bool `json:"clock_synced,omitempty"`
+}
+
+// status returns the current state.
+func (m *metrics) status(now time.Time) status {
+	s := status{
+		InMotion:       m.inMotion.Load(),
+		YAVG:           m.yavg(),
+		Threshold:      math.Float32frombits(m.threshold.Load()),
+		FPS:            math.Float32frombits(m.fps.Load()),
+		Uptime:         now.Sub(m.started).Round(time.Second).String(),
+		FFMPEGRestarts: m.ffmpegRestarts.Load(),
+		FFMPEGErrors:   m.ffmpegErrors.Load(),
+	}
+	if v := m.lastEvent.Load(); v != 0 {
+		t := time.Unix(0, v)
+		s.LastEvent = &t
+	}
+	if p := m.lastSnapshot.Load(); p != nil {
+		s.LastSnapshot = *p
+	}
+	if len(m.activeHours) != 0 {
+		a := m.activeHours.active(now)
+		s.Active = &a
+		if n := m.activeHours.next(now); !n.IsZero() {
+			if a {
+				s.ActiveUntil = &n
+			} else {
+				s.InactiveUntil = &n
+			}
+		}
+	}
+	if len(m.motionHours) != 0 {
+		a := m.motionHours.active(now)
+		s.MotionActive = &a
+	}
+	s.ClockSynced = m.clock.get()
+	return s
+}
+
+func (m *metrics) setLastFrame(t time.Time) {
+	m.lastFrame.Store(t.UnixNano())
+}
+
+// frameAge returns how long ago the last frame was received. It returns false
+// if no frame was received yet.
+func (m *metrics) frameAge(now time.Time) (time.Duration, bool) {
+	v := m.lastFrame.Load()
+	if v == 0 {
+		return 0, false
+	}
+	return now.Sub(time.Unix(0, v)), true
+}
+
+func (m *metrics) setYAVG(v float32) {
+	m.lastYAVG.Store(math.Float32bits(v))
+}
+
+func (m *metrics) setThreshold(v float32) {
+	m.threshold.Store(math.Float32bits(v))
+}
+
+func (m *metrics) setBox(r image.Rectangle) {
+	if r.Empty() {
+		m.box.Store(nil)
+	} else {
+		m.box.Store(&r)
+	}
+}
+
+// motionBox returns the bounding box of the motion in the last frame, which
+// may be empty.
+func (m *metrics) motionBox() image.Rectangle {
+	if r := m.box.Load(); r != nil {
+		return *r
+	}
+	return image.Rectangle{}
+}
+
+func (m *metrics) setFPS(v float32) {
+	m.fps.Store(math.Float32bits(v))
+}
+
+func (m *metrics) yavg() float32 {
+	return math.Float32frombits(m.lastYAVG.Load())
+}
+
+// writePrometheus writes the metrics in the Prometheus text exposition format.
+//
+// cs is the state of the MJPEG clients.
+//
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+func (m *metrics) writePrometheus(w io.Writer, cs clientStats) error {
+	inMotion := 0
+	if m.inMotion.Load() {
+		inMotion = 1
+	}
+	items := []struct {
+		name, kind, help string
+		v                any
+	}{
+		{"record_videos_motion_events_total", "counter", "Number of motion events.", m.motionEvents.Load()},
+		{"record_videos_in_motion", "gauge", "1 if motion is currently detected.", inMotion},
+		{"record_videos_yavg", "gauge", "Last Y average value.", m.yavg()},
+		{"record_videos_fps", "gauge", "Actual frame rate of the camera.", math.Float32frombits(m.fps.Load())},
+		{"record_videos_mjpeg_clients", "gauge", "Number of connected MJPEG clients.", cs.current},
+		{"record_videos_mjpeg_clients_peak", "gauge", "Highest number of connected MJPEG clients.", cs.peak},
+		{"record_videos_mjpeg_dropped_frames_total", "counter", "Number of frames dropped because a MJPEG client was too slow.", cs.dropped},
+		{"record_videos_mjpeg_rejected_total", "counter", "Number of MJPEG clients rejected because of -max-clients.", cs.rejected},
+		{"record_videos_ffmpeg_restarts_total", "counter", "Number of times ffmpeg was restarted.", m.ffmpegRestarts.Load()},
+		{"record_videos_ffmpeg_errors_total", "counter", "Number of error lines printed by ffmpeg, with -log-ffmpeg.", m.ffmpegErrors.Load()},
+		{"record_videos_motion_recordings_total", "counter", "Number of motion recordings generated.", m.recordings.Load()},
+	}
+	for _, i := range items {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", i.name, i.help, i.name, i.kind, i.name, i.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWritePrometheus(t *testing.T) {
+	m := metrics{}
+	m.motionEvents.Add(3)
+	m.inMotion.Store(true)
+	m.setYAVG(1.5)
+	b := strings.Builder{}
+	if err := m.writePrometheus(&b, clientStats{current: 2, peak: 3, dropped: 4}); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	for _, want := range []string{
+		"# TYPE record_videos_motion_events_total counter\nrecord_videos_motion_events_total 3\n",
+		"\nrecord_videos_in_motion 1\n",
+		"\nrecord_videos_yavg 1.5\n",
+		"\nrecord_videos_mjpeg_clients 2\n",
+		"\nrecord_videos_mjpeg_clients_peak 3\n",
+		"\nrecord_videos_mjpeg_dropped_frames_total 4\n",
+		"\nrecord_videos_ffmpeg_restarts_total 0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("missing %q in:\n%s", want, got)
+		}
+	}
+}
+
+func TestMetricsFrameAge(t *testing.T) {
+	m := metrics{}
+	now := time.Now()
+	if _, ok := m.frameAge(now); ok {
+		t.Fatal("expected no frame")
+	}
+	m.setLastFrame(now.Add(-2 * time.Second))
+	if age, ok := m.frameAge(now); !ok || age != 2*time.Second {
+		t.Fatalf("got %s, %t", age, ok)
+	}
+}
+
+func TestMetricsStatus(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := metrics{started: now.Add(-time.Hour)}
+	m.inMotion.Store(true)
+	m.setYAVG(1.5)
+	m.ffmpegRestarts.Add(2)
+	b, err := json.Marshal(m.status(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"in_motion":true,"yavg":1.5,"uptime":"1h0m0s","ffmpeg_restarts":2}`; string(b) != want {
+		t.Fatalf("got  %s\nwant %s", b, want)
+	}
+	m.lastEvent.Store(now.Add(-time.Minute).UnixNano())
+	snap := "2024-01-02T03-03-05-motion.jpg"
+	m.lastSnapshot.Store(&snap)
+	s := m.status(now)
+	if s.LastEvent == nil || !s.LastEvent.Equal(now.Add(-time.Minute)) || s.LastSnapshot != snap {
+		t.Fatalf("%+v", s)
+	}
+}
+
+func TestMetricsStatusActiveHours(t *testing.T) {
+	now := time.Date(2024, 1, 2, 10, 0, 0, 0, time.Local)
+	m := metrics{started: now}
+	if err := m.activeHours.Set("08:00-18:00"); err != nil {
+		t.Fatal(err)
+	}
+	s := m.status(now)
+	if s.Active == nil || !*s.Active || s.ActiveUntil == nil || !s.ActiveUntil.Equal(now.Add(8*time.Hour)) || s.InactiveUntil != nil {
+		t.Fatalf("%+v", s)
+	}
+	s = m.status(now.Add(10 * time.Hour))
+	if s.Active == nil || *s.Active || s.InactiveUntil == nil || !s.InactiveUntil.Equal(now.Add(22*time.Hour)) || s.ActiveUntil != nil {
+		t.Fatalf("%+v", s)
+	}
+}
+
+func TestMetricsStatusMotionHours(t *testing.T) {
+	now := time.Date(2024, 1, 2, 23, 0, 0, 0, time.Local)
+	m := metrics{started: now}
+	if s := m.status(now); s.MotionActive != nil {
+		t.Fatalf("%+v", s)
+	}
+	if err := m.motionHours.Set("22:00-06:00"); err != nil {
+		t.Fatal(err)
+	}
+	if s := m.status(now); s.MotionActive == nil || !*s.MotionActive {
+		t.Fatalf("%+v", s)
+	}
+	b, err := json.Marshal(m.status(now.Add(8 * time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"motion_active":false`) {
+		t.Fatal(string(b))
+	}
+}
+
+func TestMetricsStatusClock(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := metrics{started: now, clock: &clockStatus{}}
+	m.clock.set(false, nil)
+	b, err := json.Marshal(m.status(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"clock_synced":false`) {
+		t.Fatal(string(b))
+	}
+}
@@ -12,15 +12,22 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
+	"io/fs"
 	"log/slog"
+	"maps"
 	"math"
-	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -30,36 +37,210 @@ type motionOptions struct {
 	// average pixel brightness when two frames are subtracted and then an edge
 	// detection algorithm is ran over.
 	yThreshold float32
+	// thresholds overrides yThreshold by time of day when set.
+	thresholds thresholdSchedule
+	// adaptiveK enables the adaptive threshold when non-zero. Motion is then
+	// detected when YAVG exceeds mean + adaptiveK*stddev of the recent frames
+	// without motion. yThreshold, or thresholds, is the lower bound.
+	adaptiveK float32
+	// adaptiveWindow is the duration of the frames used for the adaptive
+	// threshold baseline.
+	adaptiveWindow time.Duration
 	// motionExpiration is the duration after which a motion is timed out.
 	motionExpiration time.Duration
+	// watchdog is the duration without video frames after which ffmpeg is
+	// restarted. Defaults to defaultWatchdog.
+	watchdog time.Duration
+	// minEvent is the minimum duration of motion for an event to be started.
+	// Shorter motions are ignored.
+	minEvent time.Duration
+	// preroll keeps the last preCapture of frames in memory, when set, so the
+	// motion recordings include the pre-capture even when the segments are
+	// missing.
+	preroll *frameRing
+	// cooldown delays the end of an event. Motion detected during the cooldown
+	// continues the event, so bursts of motion are merged into a single event.
+	cooldown time.Duration
 	// preCapture is the duration to record before the motion is detected.
 	preCapture time.Duration
 	// postCapture is the duration to record after the motion is timed out.
 	postCapture time.Duration
+	// fps is the requested frame rate, to detect when the driver imposes
+	// another one. 0 disables the check.
+	fps int
 	// ignoreFirstFrames ignores motion detection from these initial frames. Many
 	// cameras will auto-focus and cause a lot of artificial motion when starting
 	// up.
 	ignoreFirstFrames int
 	// ignoreFirstMoments ignores motion detection when the stream starts.
 	ignoreFirstMoments time.Duration
+	// maskCoverage is the fraction of the frame that is not masked, between 0
+	// and 1. When set, YAVG is divided by it so yThreshold has the same meaning
+	// independent of the mask size. 0 disables normalization.
+	maskCoverage float32
+	// zone2Threshold is the motion threshold of the second detection zone,
+	// see ffmpegOptions.mask2. 0 means there is no second zone.
+	zone2Threshold float32
+	// zone2Coverage is maskCoverage for the second zone.
+	zone2Coverage float32
+	// segmentDuration is the nominal duration of the segments, used for
+	// segments not yet listed in all.m3u8.
+	segmentDuration time.Duration
+	// reprocess is the delay before regenerating a motion recording, so the
+	// encoder had time to write the segments.
+	reprocess time.Duration
+	// genRetries is the number of times to retry generating a motion
+	// recording when no segment is found.
+	genRetries int
+	// yLogInterval is the minimum interval between yLevel logs at info level.
+	// The peak value within the interval is logged. When 0, every frame with
+	// some motion is logged.
+	yLogInterval time.Duration
+	// clips determines if a MP4 clip is generated for each motion event, in
+	// addition to the .m3u8 playlist.
+	clips bool
+	// gif determines if an animated GIF preview is generated for each motion
+	// event.
+	gif bool
+	// posters determines if a JPEG poster is generated for each motion
+	// recording, shown by /videos before the video is played.
+	posters bool
+	// clipMode determines how MP4 clips are trimmed to the event bounds.
+	clipMode clipMode
+	// clipEncoder is the video encoder arguments of the "precise" clip mode.
+	clipEncoder []string
+	// overlap determines what happens when the windows of consecutive motion
+	// events overlap. See validOverlaps.
+	overlap overlap
+	// motionHours limits when motion events are acted upon. Detection still
+	// runs outside of it but no recording is generated and no notification is
+	// sent. Empty means always.
+	motionHours schedule
+	// post is the post-processing pipeline to run on each finalized motion
+	// recording.
+	post postPipeline
 
 	// onEventStart is a script to run upon motion detection.
 	onEventStart string
 	// onEventEnd is a script to run upon motion timeout.
 	onEventEnd string
-	// webhook is a webhook to call with application/json content
+	// webhooks are the webhooks to call with application/json content
 	// `{"motion":true}` upon motion and a second time with false upon timeout.
-	webhook string
+	webhooks webhooks
+	// snapshots saves a JPEG when the motion starts.
+	snapshots bool
+	// mqtt publishes the webhook payload as a retained message when set. It is
+	// run by run().
+	mqtt *mqttClient
+	// name is the camera name sent in the webhooks.
+	name string
+	// webhookRetries is the number of times a failed webhook call is retried.
+	webhookRetries int
+	// audio enables triggering the events on loud sounds, when -audio is set.
+	audio bool
+	// audioThreshold is the audio RMS level in dBFS above which a sound is
+	// considered like motion.
+	audioThreshold float32
+	// eventLog appends each event to a JSON lines file when set. It is shared
+	// by the cameras.
+	eventLog *eventLog
+	// telegram sends a message, with the snapshot if any, to a Telegram chat
+	// when the motion starts when set.
+	telegram *telegramBot
+	// discord posts a message, with the snapshot if any, to a Discord webhook
+	// when the motion starts when set.
+	discord discordWebhook
+	// smtp emails the motion start, with the snapshot if any, when set.
+	smtp *smtpMailer
 
 	_ struct{}
 }
 
+// overlap determines how motion recordings with overlapping windows are
+// handled.
+type overlap string
+
+func (o *overlap) Set(v string) error {
+	options := ""
+	for i, x := range validOverlaps {
+		if v == string(x) {
+			*o = x
+			return nil
+		}
+		if i != 0 {
+			options += ", "
+		}
+		options += string(x)
+	}
+	return errors.New("invalid overlap. Supported values are: " + options)
+}
+
+func (o *overlap) String() string {
+	return string(*o)
+}
+
+// validOverlaps is the valid overlap values.
+//
+// "separate" generates one recording per motion event, even if they share
+// segments.
+//
+// "merge" folds events whose windows overlap into the earliest one, so a
+// single recording covers the union of the windows.
+var validOverlaps = []overlap{"separate", "merge"}
+
 // yLevel is the level of Y channel average on the image, which is the
 // amount of edge movements detected.
+//
+// With -audio, it is the audio level instead when audio is true.
 type yLevel struct {
 	frame int
-	t     time.Time
-	yavg  float32
+	// pts is the presentation time since ffmpeg started.
+	pts  time.Duration
+	t    time.Time
+	yavg float32
+	// audio is true when this is an audio sample. Only t and rms are set.
+	audio bool
+	// rms is the audio RMS level in dBFS. It is -Inf on silence.
+	rms float32
+	// zone is 2 for a frame of the second detection zone, see -mask2, and 0
+	// otherwise.
+	zone int
+}
+
+// yavgHistory keeps the recent yLevel samples in memory so they can be
+// written alongside the motion recordings.
+type yavgHistory struct {
+	// maxAge is the duration of samples to keep.
+	maxAge time.Duration
+
+	mu      sync.Mutex
+	samples []yLevel
+}
+
+func (y *yavgHistory) add(l yLevel) {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	y.samples = append(y.samples, l)
+	cutoff := l.t.Add(-y.maxAge)
+	i := 0
+	for ; i < len(y.samples) && y.samples[i].t.Before(cutoff); i++ {
+	}
+	if i != 0 {
+		y.samples = append(y.samples[:0], y.samples[i:]...)
+	}
+}
+
+// get returns the samples between start and end inclusively.
+func (y *yavgHistory) get(start, end time.Time) []yLevel {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	var out []yLevel
+	for _, l := range y.samples {
+		if !l.t.Before(start) && !l.t.After(end) {
+			out = append(out, l)
+		}
+	}
+	return out
 }
 
 // motionEvent is a processed yLevel to determine when motion started and
@@ -67,58 +248,282 @@ type yLevel struct {
 type motionEvent struct {
 	t     time.Time
 	start bool
+	// yavg is the motion level that triggered the event.
+	yavg float32
+	// forced is true when the event was started by POST /trigger. It is
+	// recorded even outside of -motion-hours.
+	forced bool
+	// zone is the detection zone that started the event, 1 for -mask and 2
+	// for -mask2. It is only set when there is a second zone and the event was
+	// started by motion.
+	zone int
+}
+
+// imageCoverage returns the average luminance of the image between 0 and 1.
+func imageCoverage(img image.Image) float64 {
+	b := img.Bounds()
+	if b.Empty() {
+		return 0
+	}
+	total := 0.
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			total += float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+		}
+	}
+	return total / 255. / float64(b.Dx()*b.Dy())
+}
+
+// maskCoverage returns the fraction of the mask that is white, which is the
+// area where motion is detected.
+func maskCoverage(path string) (float64, error) {
+	// #nosec G304
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode mask %q: %w", path, err)
+	}
+	return imageCoverage(img), nil
 }
 
-// processMetadata processes metadata from ffmpeg's metadata:print filter.
+// processMetadata processes metadata from ffmpeg's metadata:print and
+// ametadata:print filters.
 //
 // It expects data in the form:
 //
 //	frame:1336 pts:1336    pts_time:53.44
 //	lavfi.signalstats.YAVG=0.213281
-func processMetadata(start time.Time, r io.Reader, ch chan<- yLevel) error {
+//
+// or for the audio level:
+//
+//	frame:10   pts:8000    pts_time:1
+//	lavfi.astats.Overall.RMS_level=-43.519581
+//
+// In the debug styles, the bounding box of the motion is printed before YAVG
+// as lavfi.bbox.x1, y1, x2 and y2. It is recorded in m.
+//
+// zone is 2 for the second detection zone, its frames are tagged and not
+// recorded in m. It is 0 otherwise.
+//
+// base converts pts_time to wall clock time. It is shared by the readers of
+// an ffmpeg run and a new one is used when ffmpeg is restarted, so
+// processMetadata can be called again on the new pipes while ch stays open.
+// The time of each video frame is recorded in m for liveness checks.
+//
+// A malformed line is logged and skipped. It returns when r returns EOF or ctx
+// is canceled.
+func processMetadata(ctx context.Context, base *ptsBase, m *metrics, zone int, r io.Reader, ch chan<- yLevel) error {
 	b := bufio.NewScanner(r)
 	frame := 0
 	var ptsTime time.Duration
-	yavg := 0.
-	var err2 error
+	// box is the bounding box of the current frame.
+	var box image.Rectangle
 	for b.Scan() {
 		l := b.Text()
+		if k, v, ok := strings.Cut(l, "="); ok && strings.HasPrefix(k, "lavfi.bbox.") {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				slog.Warn("metadata", "msg", "unexpected output", "l", l)
+				continue
+			}
+			switch k[len("lavfi.bbox."):] {
+			case "x1":
+				box.Min.X = i
+			case "y1":
+				box.Min.Y = i
+			case "x2":
+				// The coordinates are inclusive.
+				box.Max.X = i + 1
+			case "y2":
+				box.Max.Y = i + 1
+			}
+			continue
+		}
 		//slog.Debug("metadata", "l", l)
 		if a, ok := strings.CutPrefix(l, "lavfi.signalstats.YAVG="); ok {
-			if yavg, err2 = strconv.ParseFloat(a, 32); err2 != nil {
-				slog.Error("metadata", "err", err2)
-				return fmt.Errorf("unexpected metadata output: %q", l)
+			yavg, err := strconv.ParseFloat(a, 32)
+			if err != nil {
+				slog.Warn("metadata", "msg", "unexpected output", "l", l, "err", err)
+				continue
 			}
 			yavg = math.Round(yavg*100) * 0.01
-			ch <- yLevel{frame: frame, t: start.Add(ptsTime).Round(100 * time.Millisecond), yavg: float32(yavg)}
+			if zone == 0 {
+				m.setLastFrame(time.Now())
+				m.setBox(box)
+			}
+			box = image.Rectangle{}
+			select {
+			case ch <- yLevel{frame: frame, pts: ptsTime, t: base.time(ptsTime), yavg: float32(yavg), zone: zone}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if a, ok := strings.CutPrefix(l, "lavfi.astats.Overall.RMS_level="); ok {
+			// ParseFloat supports "-inf".
+			rms, err := strconv.ParseFloat(a, 32)
+			if err != nil {
+				slog.Warn("metadata", "msg", "unexpected output", "l", l, "err", err)
+				continue
+			}
+			select {
+			case ch <- yLevel{t: base.time(ptsTime), audio: true, rms: float32(math.Round(rms*10) * 0.1)}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 			continue
 		}
 		f := strings.Fields(l)
 		if len(f) != 3 || !strings.HasPrefix(f[0], "frame:") || !strings.HasPrefix(f[2], "pts_time:") {
-			slog.Error("metadata", "f", f)
-			return fmt.Errorf("unexpected metadata output: %q", l)
+			slog.Warn("metadata", "msg", "unexpected output", "l", l)
+			continue
 		}
-		if frame, err2 = strconv.Atoi(f[0][len("frame:"):]); err2 != nil {
-			slog.Error("metadata", "err", err2)
-			return fmt.Errorf("unexpected metadata output: %q", l)
+		n, err := strconv.Atoi(f[0][len("frame:"):])
+		if err != nil {
+			slog.Warn("metadata", "msg", "unexpected output", "l", l, "err", err)
+			continue
 		}
-		v := 0.
-		if v, err2 = strconv.ParseFloat(f[2][len("pts_time:"):], 32); err2 != nil {
-			slog.Error("metadata", "err", err2)
-			return fmt.Errorf("unexpected metadata output: %q", l)
+		v, err := strconv.ParseFloat(f[2][len("pts_time:"):], 32)
+		if err != nil {
+			slog.Warn("metadata", "msg", "unexpected output", "l", l, "err", err)
+			continue
 		}
+		frame = n
 		ptsTime = time.Duration(v * float64(time.Second))
 	}
-	_ = frame
 	return b.Err()
 }
 
+// ptsBase converts the pts_time printed by ffmpeg, which starts at 0 on each
+// run, to wall clock time.
+//
+// The base is set on the first conversion instead of when ffmpeg is started
+// since opening the camera can take a few seconds.
+type ptsBase struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (p *ptsBase) time(pts time.Duration) time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.t.IsZero() {
+		p.t = time.Now().Add(-pts).Round(10 * time.Millisecond)
+	}
+	return p.t.Add(pts).Round(100 * time.Millisecond)
+}
+
+// defaultWatchdog is the default duration without video frames after which
+// ffmpeg is restarted.
+const defaultWatchdog = 10 * time.Second
+
 // filterMotion converts raw Y data into motion detection events.
-func filterMotion(ctx context.Context, mo *motionOptions, start time.Time, ch <-chan yLevel, events chan<- motionEvent) error {
+//
+// hist and triggers are optional. stalled is signaled when no video frame was
+// received for mo.watchdog. Every frame counts as a sign of life, whatever its
+// YAVG, so a dark but alive stream is not restarted; the audio samples don't.
+// triggers forces events, which last at least the requested duration even if
+// the motion stopped.
+func filterMotion(ctx context.Context, mo *motionOptions, m *metrics, hist *yavgHistory, ch <-chan yLevel, triggers <-chan triggerRequest, events chan<- motionEvent, stalled chan<- struct{}) error {
 	// TODO: Get the ready signal from MPJPEG reader!
 	done := ctx.Done()
+	wd := mo.watchdog
+	if wd <= 0 {
+		wd = defaultWatchdog
+	}
+	watchdog := time.NewTimer(wd)
+	defer watchdog.Stop()
+	// heartbeat logs the state of the pipeline every half watchdog interval,
+	// to distinguish a static scene, where the frames are not logged, from a
+	// stalled pipeline.
+	heartbeat := time.NewTicker(wd / 2)
+	defer heartbeat.Stop()
+	// lastSeen is the last video frame received and heartbeatFrames the number
+	// of frames received since the last heartbeat.
+	var lastSeen yLevel
+	heartbeatFrames := 0
 	var motionTimeout <-chan time.Time
 	inMotion := false
+	// When mo.cooldown is set, the end of the event is delayed until
+	// cooldownDone. Motion in the meantime continues the event.
+	var cooldownDone <-chan time.Time
+	var pendingEnd time.Time
+	// lastThreshold is the threshold used for the previous frame, to log the
+	// changes with mo.thresholds.
+	var lastThreshold float32
+	// base is the baseline of the frames without motion, with mo.adaptiveK.
+	var base *baseline
+	if mo.adaptiveK > 0 {
+		base = &baseline{window: mo.adaptiveWindow}
+	}
+	// firstMotion is the first frame with motion of an event not yet confirmed
+	// because it didn't last mo.minEvent yet.
+	var firstMotion time.Time
+	// trigger is the motion level that started the current event.
+	var trigger float32
+	// triggerZone is the detection zone that started the current event.
+	var triggerZone int
+	// eventStart is when the current event started.
+	var eventStart time.Time
+	// triggerDone is set while an event forced with triggers is in progress.
+	var triggerDone <-chan time.Time
+	var triggerEnd time.Time
+	// endEvent ends the current event at t, after mo.cooldown if set.
+	endEvent := func(t time.Time) error {
+		if mo.cooldown > 0 {
+			pendingEnd = t
+			cooldownDone = time.After(mo.cooldown)
+			return nil
+		}
+		// processMotion stops reading events when it fails.
+		select {
+		case events <- motionEvent{t: t.Round(100 * time.Millisecond), start: false, yavg: trigger, zone: triggerZone}:
+		case <-done:
+			return ctx.Err()
+		}
+		inMotion = false
+		m.inMotion.Store(false)
+		m.lastEvent.Store(t.UnixNano())
+		return nil
+	}
+	// lastFrame is the previous frame number, to detect that ffmpeg restarted
+	// and measure the frame rate again.
+	lastFrame := -1
+	fpsMeasured := false
+	// onMotion is called for each frame or audio sample above its threshold.
+	onMotion := func(t time.Time, level float32, zone int) error {
+		motionTimeout = time.After(mo.motionExpiration - time.Since(t))
+		cooldownDone = nil
+		if !inMotion && firstMotion.IsZero() {
+			firstMotion = t
+			trigger = level
+			triggerZone = zone
+		}
+		if !inMotion && t.Sub(firstMotion) >= mo.minEvent {
+			// The event starts at the first frame with motion so the pre-capture
+			// is relative to it.
+			inMotion = true
+			m.inMotion.Store(true)
+			m.motionEvents.Add(1)
+			m.lastEvent.Store(firstMotion.UnixNano())
+			select {
+			case events <- motionEvent{t: firstMotion, start: true, yavg: trigger, zone: triggerZone}:
+			case <-done:
+				return ctx.Err()
+			}
+			eventStart = firstMotion
+			firstMotion = time.Time{}
+		}
+		return nil
+	}
+	// Aggregation of the logs when yLogInterval is set.
+	var peak yLevel
+	var peakStart time.Time
+	peakFrames := 0
 	for {
 		select {
 		case <-done:
@@ -127,27 +532,190 @@ func filterMotion(ctx context.Context, mo *motionOptions, start time.Time, ch <-
 			if !ok {
 				return nil
 			}
+			if l.audio {
+				if mo.audio && l.rms >= mo.audioThreshold {
+					slog.Debug("filterMotion", "msg", "loud sound", "t", l.t.Format("2006-01-02T15:04:05.00"), "rms", l.rms)
+					// The event's motion level is 0 when started by a sound.
+					if err := onMotion(l.t, 0, 0); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if l.zone == 2 {
+				// The second zone is evaluated independently but it shares the
+				// events.
+				if mo.zone2Coverage > 0 {
+					l.yavg = float32(math.Round(float64(l.yavg/mo.zone2Coverage)*100) * 0.01)
+				}
+				if l.frame >= mo.ignoreFirstFrames && l.pts >= mo.ignoreFirstMoments && l.yavg >= mo.zone2Threshold {
+					slog.Debug("filterMotion", "msg", "motion in zone 2", "t", l.t.Format("2006-01-02T15:04:05.00"), "yavg", l.yavg)
+					if err := onMotion(l.t, l.yavg, 2); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			watchdog.Reset(wd)
+			lastSeen = l
+			heartbeatFrames++
+			if mo.maskCoverage > 0 {
+				// The masked area is black so it dilutes the average.
+				l.yavg = float32(math.Round(float64(l.yavg/mo.maskCoverage)*100) * 0.01)
+			}
+			m.setYAVG(l.yavg)
+			if l.frame < lastFrame {
+				fpsMeasured = false
+			}
+			lastFrame = l.frame
+			if !fpsMeasured && l.pts >= fpsMeasureAfter {
+				fpsMeasured = true
+				fps := measureFPS(l.frame, l.pts)
+				m.setFPS(float32(fps))
+				if fpsMismatch(mo.fps, fps) {
+					slog.Warn("filterMotion", "msg", "the frame rate differs from -fps; the driver may have changed it", "fps", mo.fps, "actual", fps)
+				} else {
+					slog.Debug("filterMotion", "fps", fps)
+				}
+			}
+			if hist != nil {
+				hist.add(l)
+			}
 			// Since we do not use printFilteredYAVGtoPipe anymore so we can use the
 			// motion level output as a keep-alive, we need to filter out logs.
 			if l.yavg > 0.1 {
-				slog.Info("yLevel", "t", l.t.Format("2006-01-02T15:04:05.00"), "f", l.frame, "yavg", l.yavg)
+				if mo.yLogInterval <= 0 {
+					slog.Info("yLevel", "t", l.t.Format("2006-01-02T15:04:05.00"), "f", l.frame, "yavg", l.yavg)
+				} else {
+					slog.Debug("yLevel", "t", l.t.Format("2006-01-02T15:04:05.00"), "f", l.frame, "yavg", l.yavg)
+					if peakFrames == 0 {
+						peakStart = l.t
+					}
+					if l.yavg > peak.yavg {
+						peak = l
+					}
+					peakFrames++
+				}
+			}
+			if peakFrames != 0 && l.t.Sub(peakStart) >= mo.yLogInterval {
+				slog.Info("yLevel", "t", peak.t.Format("2006-01-02T15:04:05.00"), "f", peak.frame, "yavg", peak.yavg, "frames", peakFrames)
+				peak = yLevel{}
+				peakFrames = 0
 			}
-			if l.frame >= mo.ignoreFirstFrames && l.t.Sub(start) >= mo.ignoreFirstMoments && l.yavg >= mo.yThreshold {
-				motionTimeout = time.After(mo.motionExpiration - time.Since(l.t))
-				if !inMotion {
-					inMotion = true
-					events <- motionEvent{t: l.t, start: true}
+			threshold := mo.yThreshold
+			if len(mo.thresholds) != 0 {
+				if threshold = mo.thresholds.at(l.t); threshold != lastThreshold {
+					slog.Info("filterMotion", "msg", "threshold changed", "threshold", threshold)
+					lastThreshold = threshold
 				}
 			}
+			if base != nil {
+				threshold = base.threshold(mo.adaptiveK, threshold)
+				slog.Debug("filterMotion", "threshold", threshold)
+			}
+			m.setThreshold(threshold)
+			m.samples.add(yavgSample{Frame: l.frame, T: l.t, YAVG: l.yavg, Threshold: threshold})
+			if l.frame >= mo.ignoreFirstFrames && l.pts >= mo.ignoreFirstMoments && l.yavg >= threshold {
+				zone := 0
+				if mo.zone2Threshold > 0 {
+					zone = 1
+				}
+				if err := onMotion(l.t, l.yavg, zone); err != nil {
+					return err
+				}
+			} else if base != nil && !inMotion && firstMotion.IsZero() && l.frame >= mo.ignoreFirstFrames && l.pts >= mo.ignoreFirstMoments {
+				// Only the frames without motion are used so an event doesn't raise
+				// its own threshold.
+				base.add(l)
+			}
 		case t := <-motionTimeout:
-			events <- motionEvent{t: t.Round(100 * time.Millisecond), start: false}
+			motionTimeout = nil
+			if !inMotion {
+				// The motion didn't last mo.minEvent.
+				slog.Info("filterMotion", "msg", "motion too short; ignored", "t", firstMotion.Format("2006-01-02T15:04:05.00"), "yavg", trigger)
+				firstMotion = time.Time{}
+				continue
+			}
+			if triggerDone != nil {
+				// The forced event ends with triggerDone.
+				continue
+			}
+			if err := endEvent(t); err != nil {
+				return err
+			}
+		case tr := <-triggers:
+			now := time.Now()
+			if triggerDone != nil {
+				// A second call ends the forced event.
+				slog.Info("filterMotion", "msg", "trigger stopped", "t", now.Format("2006-01-02T15:04:05.00"))
+				triggerDone = nil
+				r := newTriggerReply(eventStart, mo.clips)
+				r.Stopped = true
+				tr.reply <- r
+				if motionTimeout == nil {
+					if err := endEvent(now); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			slog.Info("filterMotion", "msg", "triggered", "t", now.Format("2006-01-02T15:04:05.00"), "d", tr.d)
+			triggerDone = time.After(tr.d)
+			triggerEnd = now.Add(tr.d)
+			cooldownDone = nil
+			if !inMotion {
+				inMotion = true
+				firstMotion = time.Time{}
+				trigger = 0
+				triggerZone = 0
+				eventStart = now.Round(100 * time.Millisecond)
+				m.inMotion.Store(true)
+				m.motionEvents.Add(1)
+				m.lastEvent.Store(eventStart.UnixNano())
+				select {
+				case events <- motionEvent{t: eventStart, start: true, forced: true}:
+				case <-done:
+					return ctx.Err()
+				}
+			}
+			r := newTriggerReply(eventStart, mo.clips)
+			r.End = &triggerEnd
+			tr.reply <- r
+		case t := <-triggerDone:
+			triggerDone = nil
+			if motionTimeout == nil {
+				if err := endEvent(t); err != nil {
+					return err
+				}
+			}
+		case <-cooldownDone:
+			// No motion during the cooldown, the event ended at pendingEnd.
+			cooldownDone = nil
+			select {
+			case events <- motionEvent{t: pendingEnd.Round(100 * time.Millisecond), start: false, yavg: trigger, zone: triggerZone}:
+			case <-done:
+				return ctx.Err()
+			}
 			inMotion = false
+			m.inMotion.Store(false)
+			m.lastEvent.Store(pendingEnd.UnixNano())
 
-		case <-time.After(10 * time.Second):
+		case <-heartbeat.C:
+			if heartbeatFrames != 0 {
+				slog.Debug("filterMotion", "msg", "heartbeat", "frames", heartbeatFrames, "f", lastSeen.frame, "t", lastSeen.t.Format("2006-01-02T15:04:05.00"), "yavg", lastSeen.yavg)
+			} else {
+				slog.Debug("filterMotion", "msg", "heartbeat; no frame", "f", lastSeen.frame, "t", lastSeen.t.Format("2006-01-02T15:04:05.00"))
+			}
+			heartbeatFrames = 0
+		case <-watchdog.C:
 			// It's dead jim. It can happen when the USB port hangs, or if the remote
-			// TCP died. It's easier to just quit, and have systemd restart the
-			// process.
-			return errors.New("no events for more than 10s")
+			// TCP died. Ask for ffmpeg to be restarted.
+			slog.Warn("filterMotion", "msg", "no frames; restarting ffmpeg", "watchdog", wd)
+			select {
+			case stalled <- struct{}{}:
+			default:
+			}
+			watchdog.Reset(wd)
 		}
 	}
 }
@@ -156,16 +724,176 @@ func filterMotion(ctx context.Context, mo *motionOptions, start time.Time, ch <-
 var m3u8Tmpl = template.Must(template.New("").Parse(`#EXTM3U
 #EXT-X-VERSION:6
 #EXT-X-ALLOW-CACHE:YES
-#EXT-X-TARGETDURATION:4
+#EXT-X-TARGETDURATION:{{.TargetDuration}}
 #EXT-X-MEDIA-SEQUENCE:0
 #EXT-X-INDEPENDENT-SEGMENTS
-{{range .}}#EXTINF:4.000000,
-{{.}}
+{{range .Segments}}{{if .Discontinuity}}#EXT-X-DISCONTINUITY
+{{end}}#EXTINF:{{printf "%.6f" .Duration}},
+{{.Name}}
 {{end}}`))
 
+// dailySegmentFormat is the name of the segments, relative to root, when
+// they are partitioned per day.
+const dailySegmentFormat = time.DateOnly + "/15-04-05"
+
+// nominalSegmentDuration is the duration used for segments that are not
+// listed in all.m3u8.
+const nominalSegmentDuration = 4.
+
+// m3u8Segment is a segment in a .m3u8 HLS playlist.
+type m3u8Segment struct {
+	Name     string
+	Duration float64
+	// Discontinuity is set when the segment is not the continuation of the
+	// previous one, e.g. after a pre-roll.
+	Discontinuity bool
+}
+
+// parseM3U8 returns the duration in seconds of each segment listed in a
+// .m3u8 HLS playlist.
+func parseM3U8(r io.Reader) (map[string]float64, error) {
+	out := map[string]float64{}
+	b := bufio.NewScanner(r)
+	d := -1.
+	for b.Scan() {
+		l := strings.TrimSpace(b.Text())
+		if a, ok := strings.CutPrefix(l, "#EXTINF:"); ok {
+			a, _, _ = strings.Cut(a, ",")
+			v, err := strconv.ParseFloat(a, 64)
+			if err != nil {
+				return out, fmt.Errorf("unexpected m3u8 line: %q", l)
+			}
+			d = v
+		} else if l != "" && !strings.HasPrefix(l, "#") && d >= 0 {
+			out[l] = d
+			d = -1
+		}
+	}
+	return out, b.Err()
+}
+
+// segmentDurations returns the duration of each file as listed in all.m3u8,
+// falling back to nominal for files not yet listed. nominal defaults to
+// nominalSegmentDuration.
+func segmentDurations(root string, files []string, nominal time.Duration) []m3u8Segment {
+	fallback := nominal.Seconds()
+	if fallback <= 0 {
+		fallback = nominalSegmentDuration
+	}
+	durations := liveDurations.get(filepath.Join(root, "all.m3u8"))
+	out := make([]m3u8Segment, len(files))
+	for i, n := range files {
+		d, ok := durations[n]
+		if !ok {
+			d = fallback
+		}
+		out[i] = m3u8Segment{Name: n, Duration: d}
+	}
+	return out
+}
+
+// liveDurations caches the segment durations read from all.m3u8.
+var liveDurations = durationCache{}
+
+// durationCache caches the segment durations listed in live playlists.
+//
+// ffmpeg only appends to the live playlist so only the new lines are parsed
+// on each call. Segments are never evicted from the cache, even when ffmpeg
+// drops them from the playlist.
+type durationCache struct {
+	mu    sync.Mutex
+	files map[string]*playlistIndex
+}
+
+type playlistIndex struct {
+	// off is the offset right after the last segment parsed.
+	off int64
+	// tail is the last segment line parsed, to detect when the file is
+	// rewritten, e.g. when ffmpeg is restarted.
+	tail      []byte
+	durations map[string]float64
+}
+
+// get returns the durations of the segments listed in the playlist at path.
+//
+// The returned map must not be modified.
+func (c *durationCache) get(path string) map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.files == nil {
+		c.files = map[string]*playlistIndex{}
+	}
+	p := c.files[path]
+	if p == nil {
+		p = &playlistIndex{durations: map[string]float64{}}
+		c.files[path] = p
+	}
+	if err := p.update(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("segmentDurations", "err", err)
+	}
+	return maps.Clone(p.durations)
+}
+
+// update parses the lines appended to the playlist since the last call.
+func (p *playlistIndex) update(path string) error {
+	// #nosec G304
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if p.off != 0 {
+		// Confirm the file was only appended to, otherwise parse it again.
+		start := p.off - int64(len(p.tail))
+		b := make([]byte, len(p.tail))
+		if _, err = f.ReadAt(b, start); err != nil || !bytes.Equal(b, p.tail) {
+			p.off = 0
+			p.tail = nil
+		}
+	}
+	if _, err = f.Seek(p.off, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	// Only consume up to the last segment line, a partial entry is parsed on
+	// the next call.
+	d := -1.
+	for pos := 0; ; {
+		i := bytes.IndexByte(data[pos:], '\n')
+		if i == -1 {
+			return nil
+		}
+		raw := data[pos : pos+i+1]
+		pos += i + 1
+		l := strings.TrimSpace(string(raw))
+		if a, ok := strings.CutPrefix(l, "#EXTINF:"); ok {
+			a, _, _ = strings.Cut(a, ",")
+			v, err := strconv.ParseFloat(a, 64)
+			if err != nil {
+				return fmt.Errorf("unexpected m3u8 line: %q", l)
+			}
+			d = v
+		} else if l != "" && !strings.HasPrefix(l, "#") && d >= 0 {
+			p.durations[l] = d
+			d = -1
+			p.off += int64(pos)
+			p.tail = slices.Clone(raw)
+			data = data[pos:]
+			pos = 0
+		}
+	}
+}
+
+// findTSFiles returns the segments in [start, end], sorted.
+//
+// The segments are either directly in root or in a per-day directory when
+// -daily-dirs is used. Only the day directories overlapping [start, end] are
+// read. The names are sortable so the lexical comparison works across
+// midnight.
 func findTSFiles(root string, start, end time.Time) ([]string, error) {
-	// TODO: would be better to not load the whole directory list, or at least
-	// partition per day or something.
 	entries, err := os.ReadDir(root)
 	if err != nil {
 		return nil, err
@@ -174,39 +902,151 @@ func findTSFiles(root string, start, end time.Time) ([]string, error) {
 	s := start.Format("2006-01-02T15-04-05") + ".ts"
 	e := end.Format("2006-01-02T15-04-05") + ".ts"
 	for _, entry := range entries {
-		if n := entry.Name(); strings.HasSuffix(n, ".ts") && n >= s && n <= e {
+		if n := entry.Name(); !entry.IsDir() && strings.HasSuffix(n, ".ts") && !strings.Contains(n, "-preroll") && !isTempFile(n) && n >= s && n <= e {
 			out = append(out, n)
 		}
 	}
-	slog.Debug("findTSFiles", "start", s, "end", e, "total", len(entries), "found", len(out))
-	return out, err
+	total := len(entries)
+	s = start.Format(dailySegmentFormat) + ".ts"
+	e = end.Format(dailySegmentFormat) + ".ts"
+	for d := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, start.Location()); !d.After(end); d = d.AddDate(0, 0, 1) {
+		dir := d.Format(time.DateOnly)
+		if entries, err = os.ReadDir(filepath.Join(root, dir)); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		total += len(entries)
+		for _, entry := range entries {
+			if n := dir + "/" + entry.Name(); strings.HasSuffix(n, ".ts") && !isTempFile(n) && n >= s && n <= e {
+				out = append(out, n)
+			}
+		}
+	}
+	slog.Debug("findTSFiles", "start", start, "end", end, "total", total, "found", len(out))
+	return out, nil
+}
+
+// formatVTTTime formats a duration as a WebVTT timestamp.
+func formatVTTTime(d time.Duration) string {
+	d = d.Round(time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", int(d/time.Hour), int(d/time.Minute)%60, int(d/time.Second)%60, int(d/time.Millisecond)%1000)
+}
+
+// writeVTT writes the YAVG samples as a WebVTT subtitle track in a temporary
+// file then renames it.
+//
+// origin is the start time of the recording the track is synchronized to.
+// Consecutive samples with the same value are merged in a single cue.
+func writeVTT(name string, origin time.Time, samples []yLevel) error {
+	buf := bytes.Buffer{}
+	buf.WriteString("WEBVTT\n")
+	for i := 0; i < len(samples); {
+		j := i + 1
+		for ; j < len(samples) && samples[j].yavg == samples[i].yavg; j++ {
+		}
+		end := samples[i].t.Add(100 * time.Millisecond)
+		if j < len(samples) {
+			end = samples[j].t
+		}
+		if s := samples[i].t.Sub(origin); s >= 0 && end.After(samples[i].t) {
+			fmt.Fprintf(&buf, "\n%s --> %s\nYAVG %.2f\n", formatVTTTime(s), formatVTTTime(end.Sub(origin)), samples[i].yavg)
+		}
+		i = j
+	}
+	// #nosec G306
+	if err := os.WriteFile(name+".tmp", buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
 }
 
 // generateM3U8 writes a .m3u8 in a temporary file then renames it.
-func generateM3U8(root string, t, start, end time.Time) error {
+//
+// When hist is not nil, a .vtt subtitle track with the YAVG values is written
+// alongside. When preroll is not 0, the pre-roll of the event is used if the
+// segments do not cover it, see prependPreroll.
+//
+// It returns the number of segments found. No file is written when there is
+// none.
+func generateM3U8(root string, hist *yavgHistory, segmentDuration time.Duration, t, start, end time.Time, preroll time.Duration) (int, error) {
 	files, err := findTSFiles(root, start, end)
-	if err != nil || len(files) == 0 {
-		return err
+	if err != nil {
+		return 0, err
+	}
+	segments := segmentDurations(root, files, segmentDuration)
+	if preroll > 0 {
+		segments = prependPreroll(root, segments, t, preroll)
+	}
+	if len(segments) == 0 {
+		return 0, nil
 	}
 	slog.Debug("generateM3U8", "t", t, "start", start, "end", end, "files", files)
-	name := filepath.Join(root, t.Format("2006-01-02T15-04-05")+".m3u8")
+	base := filepath.Join(root, t.Format("2006-01-02T15-04-05"))
+	name := base + ".m3u8"
 	// #nosec G304
 	f, err := os.Create(name + ".tmp")
 	if err != nil {
-		return err
+		return 0, err
 	}
-	err = m3u8Tmpl.Execute(f, files)
+	target := 0.
+	for _, seg := range segments {
+		target = max(target, seg.Duration)
+	}
+	err = m3u8Tmpl.Execute(f, map[string]any{"TargetDuration": int(math.Ceil(target)), "Segments": segments})
 	if err2 := f.Close(); err == nil {
 		err = err2
 	}
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return os.Rename(name+".tmp", name)
+	if err = os.Rename(name+".tmp", name); err != nil || hist == nil {
+		return len(segments), err
+	}
+	origin := t.Add(-preroll)
+	if segments[0].Name != prerollName(t) {
+		if origin, err = fileTime(segments[0].Name); err != nil {
+			return len(segments), err
+		}
+	}
+	return len(segments), writeVTT(base+".vtt", origin, hist.get(origin, end))
+}
+
+// prependPreroll prepends the pre-roll of the event that started at t, with
+// the duration preroll, when the segments do not cover it.
+//
+// The segments ending before t are then skipped since the pre-roll covers
+// them.
+func prependPreroll(root string, segments []m3u8Segment, t time.Time, preroll time.Duration) []m3u8Segment {
+	name := prerollName(t)
+	if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+		return segments
+	}
+	if len(segments) != 0 {
+		if first, err := fileTime(segments[0].Name); err == nil && !first.After(t.Add(-preroll)) {
+			return segments
+		}
+	}
+	for len(segments) > 1 {
+		if next, err := fileTime(segments[1].Name); err != nil || next.After(t) {
+			break
+		}
+		segments = segments[1:]
+	}
+	out := append([]m3u8Segment{{Name: name, Duration: preroll.Seconds()}}, segments...)
+	if len(out) > 1 {
+		out[1].Discontinuity = true
+	}
+	return out
 }
 
-func generateMotionRecording(root string, t, start, end time.Time) error {
-	// TODO: Instead of generating m3u8 files, create MP4 file.
+// generateMotionRecording generates the recording for a motion event.
+//
+// It returns the number of segments found.
+func generateMotionRecording(root string, hist *yavgHistory, segmentDuration time.Duration, t, start, end time.Time, preroll time.Duration) (int, error) {
+	// TODO: Instead of generating m3u8 files, create MP4 file. -clips does it in
+	// addition to the m3u8 file, see generateClip.
 	// It will be performant and much easier to manage! This enables us to keep X
 	// last days of full recording as .ts files and motion for Y last days as
 	// .mp4, where Y is significantly larger than X.
@@ -218,7 +1058,71 @@ func generateMotionRecording(root string, t, start, end time.Time) error {
 	// -seek_timestamp
 	// libx264 can buffer 30s at a time.
 	// -stats_enc_pre -stats_enc_pre_fmt pts
-	return generateM3U8(root, t, start.Add(-30*time.Second), end)
+	return generateM3U8(root, hist, segmentDuration, t, start.Add(-30*time.Second), end, preroll)
+}
+
+// pendingGen is a motion recording to regenerate once all its segments are
+// written.
+type pendingGen struct {
+	// t is the motion start, which determines the recording name.
+	t time.Time
+	// start and end is the window of segments to include.
+	start, end time.Time
+	// retries is the number of times the recording was retried because no
+	// segment was found.
+	retries int
+	// retryAt is when to retry generating the recording, if later than end.
+	retryAt time.Time
+	// preroll is the duration of the pre-roll, if any.
+	preroll time.Duration
+}
+
+// due returns the time after which the recording can be generated.
+func (p *pendingGen) due() time.Time {
+	if p.retryAt.After(p.end) {
+		return p.retryAt
+	}
+	return p.end
+}
+
+// coalesceGen merges the pending recordings whose windows overlap into the
+// earliest one.
+//
+// It returns the merged list sorted by start time and the recordings that were
+// folded into another one.
+func coalesceGen(toGen []pendingGen) ([]pendingGen, []pendingGen) {
+	toGen = slices.Clone(toGen)
+	slices.SortStableFunc(toGen, func(a, b pendingGen) int { return a.start.Compare(b.start) })
+	var out, folded []pendingGen
+	for _, l := range toGen {
+		if len(out) != 0 {
+			if p := &out[len(out)-1]; !l.start.After(p.end) {
+				if l.end.After(p.end) {
+					p.end = l.end
+				}
+				folded = append(folded, l)
+				continue
+			}
+		}
+		out = append(out, l)
+	}
+	return out, folded
+}
+
+// mergePendingGen coalesces the overlapping pending recordings and deletes
+// the recordings that became redundant.
+func mergePendingGen(root string, toGen []pendingGen) []pendingGen {
+	toGen, folded := coalesceGen(toGen)
+	for _, l := range folded {
+		slog.Info("processMotion", "msg", "merged", "t", l.t.Format("2006-01-02T15:04:05.00"))
+		base := filepath.Join(root, l.t.Format("2006-01-02T15-04-05"))
+		for _, n := range []string{base + ".m3u8", base + ".vtt"} {
+			if err := os.Remove(n); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				slog.Error("processMotion", "p", n, "err", err)
+			}
+		}
+	}
+	return toGen
 }
 
 // runCmd runs a command and give it at most 1 minute to run.
@@ -233,27 +1137,103 @@ func runCmd(ctx context.Context, a string) error {
 }
 
 // processMotion reacts to motion start and stop events.
-func processMotion(ctx context.Context, mo *motionOptions, root string, ch <-chan motionEvent) error {
+//
+// hist, tm and eb are optional. tm is used for the snapshots. eb receives the
+// same payload as the webhooks.
+func processMotion(ctx context.Context, mo *motionOptions, m *metrics, root string, hist *yavgHistory, tm *teeMimePart, eb *eventBroadcaster, ch <-chan motionEvent) error {
 	// We do not limit the GOP (group of pictures) value in the encoder (libx264,
 	// libx265, etc) so it can buffer 30s at a time. This is what we want, we
 	// want continuous recording to be highly efficient. The downside is that it
 	// creates a delay to generate the motion recordings.
-	const reprocess = time.Minute
-	var toGen [][3]time.Time
+	reprocess := mo.reprocess
+	var toGen []pendingGen
 	var lastMotion time.Time
+	// preroll is the duration of the pre-roll of the current event, if any.
+	// The pre-rolls are encoded concurrently.
+	var preroll time.Duration
+	var prerolls sync.WaitGroup
+	// notifications are the Telegram, Discord and email notifications being
+	// delivered.
+	var notifications sync.WaitGroup
+	// media are the clips, GIFs and posters being encoded. They are encoded
+	// one recording at a time so ffmpeg doesn't starve the live capture.
+	var media sync.WaitGroup
+	mediaSem := make(chan struct{}, 1)
 	var retryGen <-chan time.Time
+	// suppressed is set when the current event started outside of
+	// mo.motionHours, so its end is ignored too.
+	suppressed := false
+	var pp *postProcessor
+	if len(mo.post) != 0 {
+		pp = newPostProcessor(root, mo.post)
+		defer pp.wait()
+	}
+	var wn *webhookNotifier
+	if len(mo.webhooks) != 0 {
+		wn = newWebhookNotifier(ctx, mo.webhooks, mo.webhookRetries)
+		defer wn.wait()
+	}
 	done := ctx.Done()
 loop:
 	for {
 		select {
 		case n := <-retryGen:
-			for len(toGen) != 0 {
-				if l := toGen[0]; n.After(l[2]) {
-					// Best effort.
-					if err := generateMotionRecording(root, l[0], l[1], l[2]); err != nil {
-						return err
+			if mo.overlap == "merge" {
+				toGen = mergePendingGen(root, toGen)
+			}
+			for len(toGen) != 0 && n.After(toGen[0].due()) {
+				// Best effort.
+				l := toGen[0]
+				toGen = toGen[1:]
+				found, err := generateMotionRecording(root, hist, mo.segmentDuration, l.t, l.start, l.end, l.preroll)
+				if err != nil {
+					return err
+				}
+				if found != 0 {
+					m.recordings.Add(1)
+				}
+				if found != 0 && (mo.clips || mo.gif || mo.posters) {
+					media.Add(1)
+					go func() {
+						defer media.Done()
+						select {
+						case mediaSem <- struct{}{}:
+						case <-done:
+							return
+						}
+						defer func() { <-mediaSem }()
+						// Best effort.
+						if mo.clips {
+							if err := generateClip(ctx, root, l.t, l.start, l.end, mo.clipMode, mo.clipEncoder); err != nil {
+								slog.Error("clip", "t", l.t.Format("2006-01-02T15:04:05.00"), "err", err)
+							}
+						}
+						if mo.gif {
+							if err := generateGIF(ctx, root, l.t, l.end); err != nil {
+								slog.Error("gif", "t", l.t.Format("2006-01-02T15:04:05.00"), "err", err)
+							}
+						}
+						if mo.posters {
+							if err := generatePoster(ctx, root, hist, l.t, l.end); err != nil {
+								slog.Error("poster", "t", l.t.Format("2006-01-02T15:04:05.00"), "err", err)
+							}
+						}
+					}()
+				}
+				if found != 0 && pp != nil {
+					pp.process(ctx, l.t.Format("2006-01-02T15-04-05"))
+				}
+				if found == 0 {
+					// The segments may not have been written yet, e.g. slow disk or clock
+					// skew.
+					if l.retries < mo.genRetries {
+						l.retries++
+						l.retryAt = n.Add(reprocess)
+						slog.Info("processMotion", "msg", "no segment found; retrying", "t", l.t.Format("2006-01-02T15:04:05.00"), "retries", l.retries)
+						toGen = append(toGen, l)
+					} else {
+						slog.Warn("processMotion", "msg", "no segment found; giving up", "t", l.t.Format("2006-01-02T15:04:05.00"))
 					}
-					toGen = toGen[1:]
 				}
 			}
 			if len(toGen) != 0 {
@@ -268,19 +1248,93 @@ loop:
 				break loop
 			}
 			slog.Info("motionEvent", "t", event.t.Format("2006-01-02T15:04:05.00"), "start", event.start)
+			if event.start {
+				suppressed = !event.forced && !mo.motionHours.active(event.t)
+			}
+			if suppressed {
+				slog.Info("motionEvent", "msg", "outside of motion hours; ignored")
+				continue
+			}
 			if event.start {
 				// Create a simple m3u8 file. Will be populated later.
 				lastMotion = event.t
+				preroll = 0
+				if mo.preroll != nil {
+					if frames := mo.preroll.snapshot(event.t); len(frames) != 0 {
+						_, preroll = prerollRate(frames)
+						prerolls.Add(1)
+						go func() {
+							defer prerolls.Done()
+							// Best effort.
+							if err := savePreroll(ctx, root, event.t, frames); err != nil {
+								slog.Error("preroll", "t", event.t.Format("2006-01-02T15:04:05.00"), "err", err)
+							}
+						}()
+					}
+				}
 			}
 			start := lastMotion.Add(-mo.preCapture)
 			end := event.t.Add(reprocess + mo.postCapture)
-			if err := generateMotionRecording(root, lastMotion, start, end); err != nil {
+			if _, err := generateMotionRecording(root, hist, mo.segmentDuration, lastMotion, start, end, preroll); err != nil {
 				return err
 			}
 			if !event.start {
-				toGen = append(toGen, [...]time.Time{event.t, start, end})
+				toGen = append(toGen, pendingGen{t: lastMotion, start: start, end: end, preroll: preroll})
 				retryGen = time.After(reprocess)
 			}
+			snapshot := ""
+			if event.start && mo.snapshots {
+				var err error
+				if snapshot, err = saveSnapshot(ctx, root, tm, event.t); err != nil {
+					slog.Error("snapshot", "t", event.t.Format("2006-01-02T15:04:05.00"), "err", err)
+				} else {
+					slog.Info("snapshot", "p", snapshot)
+					m.lastSnapshot.Store(&snapshot)
+				}
+			}
+			photo := ""
+			if snapshot != "" {
+				photo = filepath.Join(root, snapshot)
+			}
+			if event.start && mo.telegram != nil {
+				text := telegramMessage(mo.name, event.t, event.yavg)
+				notifications.Add(1)
+				go func() {
+					defer notifications.Done()
+					if err := mo.telegram.send(ctx, text, photo); err != nil {
+						slog.Error("telegram", "t", event.t.Format("2006-01-02T15:04:05.00"), "err", err)
+					} else {
+						slog.Info("telegram", "t", event.t.Format("2006-01-02T15:04:05.00"))
+					}
+				}()
+			}
+			if event.start && mo.discord != "" {
+				msg := newDiscordMessage(mo.name, event.t, event.yavg, photo != "")
+				notifications.Add(1)
+				go func() {
+					defer notifications.Done()
+					if err := mo.discord.send(ctx, msg, photo); err != nil {
+						slog.Error("discord", "t", event.t.Format("2006-01-02T15:04:05.00"), "err", err)
+					} else {
+						slog.Info("discord", "t", event.t.Format("2006-01-02T15:04:05.00"))
+					}
+				}()
+			}
+			if event.start && mo.smtp != nil {
+				if mo.smtp.allow(event.t) {
+					notifications.Add(1)
+					go func() {
+						defer notifications.Done()
+						if err := mo.smtp.send(ctx, mo.name, event.t, event.yavg, photo); err != nil {
+							slog.Error("smtp", "t", event.t.Format("2006-01-02T15:04:05.00"), "err", err)
+						} else {
+							slog.Info("smtp", "t", event.t.Format("2006-01-02T15:04:05.00"), "to", mo.smtp.to)
+						}
+					}()
+				} else {
+					slog.Info("smtp", "msg", "throttled", "t", event.t.Format("2006-01-02T15:04:05.00"))
+				}
+			}
 			if event.start {
 				if mo.onEventStart != "" {
 					if err := runCmd(ctx, mo.onEventStart); err != nil {
@@ -294,30 +1348,50 @@ loop:
 					}
 				}
 			}
-			if mo.webhook != "" {
-				d, _ := json.Marshal(map[string]bool{"motion": event.start})
-				slog.Info("webhook", "url", mo.webhook, "motion", event.start)
-				ctx2, cancel := context.WithTimeout(ctx, 10*time.Second)
-				// #nosec G107
-				if req, err := http.NewRequestWithContext(ctx2, "POST", mo.webhook, bytes.NewReader(d)); err != nil {
-					slog.Error("webhook", "url", mo.webhook, "motion", event.start, "err", err)
-				} else {
-					req.Header.Set("Content-Type", "application/json")
-					if resp, err := http.DefaultClient.Do(req); err != nil {
-						slog.Error("webhook", "url", mo.webhook, "motion", event.start, "err", err)
-					} else if err = resp.Body.Close(); err != nil {
-						slog.Error("webhook", "url", mo.webhook, "motion", event.start, "err", err)
+			if wn != nil || mo.mqtt != nil || eb != nil || mo.eventLog != nil {
+				p := webhookPayload{Version: webhookVersion, Motion: event.start, Time: event.t, YAVG: event.yavg, Zone: event.zone, Name: mo.name, Snapshot: snapshot}
+				if !event.start {
+					p.Start = &start
+					p.End = &end
+					p.Playlist = lastMotion.Format("2006-01-02T15-04-05") + ".m3u8"
+					if mo.gif {
+						p.GIF = gifName(lastMotion)
+					}
+					if mo.clips {
+						p.Clip = lastMotion.Format("2006-01-02T15-04-05") + ".mp4"
 					}
 				}
-				cancel()
+				if mo.eventLog != nil {
+					mo.eventLog.write(event.t, &p)
+				}
+				if wn != nil {
+					wn.notify(p)
+				}
+				d, _ := json.Marshal(&p)
+				if mo.mqtt != nil {
+					mo.mqtt.publish(d)
+				}
+				if eb != nil {
+					eb.publish(d)
+				}
 			}
 		}
 	}
 	slog.Info("processMotion", "msg", "ending")
+	prerolls.Wait()
+	notifications.Wait()
+	media.Wait()
 	// We have to quit now.
+	if mo.overlap == "merge" {
+		toGen = mergePendingGen(root, toGen)
+	}
 	for _, l := range toGen {
-		if err := generateMotionRecording(root, l[0], l[1], l[2]); err != nil {
+		if found, err := generateMotionRecording(root, hist, mo.segmentDuration, l.t, l.start, l.end, l.preroll); err != nil {
 			return err
+		} else if found == 0 {
+			slog.Warn("processMotion", "msg", "no segment found", "t", l.t.Format("2006-01-02T15:04:05.00"))
+		} else {
+			m.recordings.Add(1)
 		}
 	}
 	return nil
@@ -0,0 +1,581 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteVTT(t *testing.T) {
+	origin := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	samples := []yLevel{
+		{frame: 1, t: origin.Add(100 * time.Millisecond), yavg: 0.1},
+		{frame: 2, t: origin.Add(200 * time.Millisecond), yavg: 0.1},
+		{frame: 3, t: origin.Add(300 * time.Millisecond), yavg: 1.5},
+	}
+	name := filepath.Join(t.TempDir(), "a.vtt")
+	if err := writeVTT(name, origin, samples); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "WEBVTT\n" +
+		"\n00:00:00.100 --> 00:00:00.300\nYAVG 0.10\n" +
+		"\n00:00:00.300 --> 00:00:00.400\nYAVG 1.50\n"
+	if got := string(b); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestCoalesceGen(t *testing.T) {
+	t0 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	at := func(s int) time.Time {
+		return t0.Add(time.Duration(s) * time.Second)
+	}
+	toGen := []pendingGen{
+		{t: at(0), start: at(-5), end: at(70)},
+		{t: at(30), start: at(25), end: at(100)},
+		{t: at(60), start: at(55), end: at(90)},
+		{t: at(200), start: at(195), end: at(270)},
+	}
+	got, folded := coalesceGen(toGen)
+	want := []pendingGen{
+		{t: at(0), start: at(-5), end: at(100)},
+		{t: at(200), start: at(195), end: at(270)},
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	if !slices.Equal(folded, toGen[1:3]) {
+		t.Fatalf("folded %v", folded)
+	}
+}
+
+func TestGenerateM3U8Midnight(t *testing.T) {
+	root := t.TempDir()
+	names := []string{
+		"2024-01-01T23-57-00.ts",
+		"2024-01-01T23-58-00.ts",
+		"2024-01-01T23-59-56.ts",
+		"2024-01-02T00-00-00.ts",
+		"2024-01-02T00-03-00.ts",
+		"2024-01-02T00-04-00.ts",
+	}
+	for _, n := range names {
+		if err := os.WriteFile(filepath.Join(root, n), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Temporary files are ignored.
+	if err := os.WriteFile(filepath.Join(root, "2024-01-01T23-59-00.tmp.ts"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 23, 58, 0, 0, time.Local)
+	end := time.Date(2024, 1, 2, 0, 3, 0, 0, time.Local)
+	files, err := findTSFiles(root, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := names[1:5]; !slices.Equal(files, want) {
+		t.Fatalf("got %q\nwant %q", files, want)
+	}
+	if n, err := generateM3U8(root, nil, 0, start, start, end, 0); err != nil {
+		t.Fatal(err)
+	} else if n != 4 {
+		t.Fatalf("got %d segments", n)
+	}
+	b, err := os.ReadFile(filepath.Join(root, "2024-01-01T23-58-00.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range names[1:5] {
+		if !strings.Contains(string(b), "\n"+n+"\n") {
+			t.Fatalf("missing %s:\n%s", n, b)
+		}
+	}
+}
+
+func TestGenerateM3U8MidnightDailyDirs(t *testing.T) {
+	root := t.TempDir()
+	names := []string{
+		// Written before -daily-dirs was used.
+		"2024-01-01T23-57-00.ts",
+		"2024-01-01T23-58-00.ts",
+		"2024-01-01/23-59-56.ts",
+		"2024-01-02/00-00-00.ts",
+		"2024-01-02/00-03-00.ts",
+		"2024-01-02/00-04-00.ts",
+	}
+	for _, n := range names {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(n)), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, n), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Date(2024, 1, 1, 23, 58, 0, 0, time.Local)
+	end := time.Date(2024, 1, 2, 0, 3, 0, 0, time.Local)
+	files, err := findTSFiles(root, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := names[1:5]; !slices.Equal(files, want) {
+		t.Fatalf("got %q\nwant %q", files, want)
+	}
+	if n, err := generateM3U8(root, nil, 0, start, start, end, 0); err != nil {
+		t.Fatal(err)
+	} else if n != 4 {
+		t.Fatalf("got %d segments", n)
+	}
+}
+
+func TestFilterMotionCooldown(t *testing.T) {
+	mo := motionOptions{yThreshold: 1, motionExpiration: 50 * time.Millisecond, cooldown: 200 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan yLevel)
+	events := make(chan motionEvent, 10)
+	go func() {
+		_ = filterMotion(ctx, &mo, &metrics{}, nil, ch, nil, events, make(chan struct{}, 1))
+	}()
+	ch <- yLevel{frame: 1, t: time.Now(), yavg: 2}
+	if e := <-events; !e.start || e.yavg != 2 {
+		t.Fatalf("%+v", e)
+	}
+	// The motion expired but it's within the cooldown so the event continues.
+	time.Sleep(100 * time.Millisecond)
+	t1 := time.Now()
+	ch <- yLevel{frame: 2, t: t1, yavg: 3}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(150 * time.Millisecond):
+	}
+	e := <-events
+	if e.start || e.t.Before(t1) {
+		t.Fatalf("%+v", e)
+	}
+}
+
+func TestFilterMotionMinEvent(t *testing.T) {
+	mo := motionOptions{yThreshold: 1, motionExpiration: 100 * time.Millisecond, minEvent: 200 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan yLevel)
+	events := make(chan motionEvent, 10)
+	go func() {
+		_ = filterMotion(ctx, &mo, &metrics{}, nil, ch, nil, events, make(chan struct{}, 1))
+	}()
+	// A blip is ignored.
+	ch <- yLevel{frame: 1, t: time.Now(), yavg: 2}
+	time.Sleep(150 * time.Millisecond)
+	// Sustained motion starts an event at the first frame.
+	t0 := time.Now()
+	for i := 0; i < 4; i++ {
+		if i != 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		ch <- yLevel{frame: 2 + i, t: t0.Add(time.Duration(i) * 50 * time.Millisecond), yavg: float32(3 + i)}
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+	ch <- yLevel{frame: 10, t: t0.Add(200 * time.Millisecond), yavg: 4}
+	e := <-events
+	if !e.start || !e.t.Equal(t0) || e.yavg != 3 {
+		t.Fatalf("%+v", e)
+	}
+	if e = <-events; e.start {
+		t.Fatalf("%+v", e)
+	}
+}
+
+func TestProcessMotionRetry(t *testing.T) {
+	root := t.TempDir()
+	mo := motionOptions{reprocess: 50 * time.Millisecond, genRetries: 10}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan motionEvent)
+	done := make(chan error)
+	go func() {
+		done <- processMotion(ctx, &mo, &metrics{}, root, nil, nil, nil, ch)
+	}()
+	t0 := time.Now()
+	ch <- motionEvent{t: t0, start: true}
+	ch <- motionEvent{t: t0}
+	// The segment shows up late, after the first attempt.
+	time.Sleep(120 * time.Millisecond)
+	name := t0.Format("2006-01-02T15-04-05")
+	if err := os.WriteFile(filepath.Join(root, name+".ts"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(root, name+".m3u8")); err == nil {
+			break
+		}
+		if time.Since(t0) > 5*time.Second {
+			t.Fatal("playlist was not generated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcessMotionHours(t *testing.T) {
+	root := t.TempDir()
+	t0 := time.Now()
+	name := t0.Format("2006-01-02T15-04-05")
+	if err := os.WriteFile(filepath.Join(root, name+".ts"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var s schedule
+	h := (t0.Hour() + 2) % 24
+	if err := s.Set(fmt.Sprintf("%02d:00-%02d:00", h, (h+1)%24)); err != nil {
+		t.Fatal(err)
+	}
+	mo := motionOptions{reprocess: time.Millisecond, motionHours: s}
+	ch := make(chan motionEvent, 2)
+	ch <- motionEvent{t: t0, start: true}
+	ch <- motionEvent{t: t0}
+	close(ch)
+	if err := processMotion(context.Background(), &mo, &metrics{}, root, nil, nil, nil, ch); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, name+".m3u8")); !os.IsNotExist(err) {
+		t.Fatalf("expected no playlist: %v", err)
+	}
+}
+
+func TestParseM3U8(t *testing.T) {
+	const data = "#EXTM3U\n" +
+		"#EXT-X-VERSION:6\n" +
+		"#EXT-X-TARGETDURATION:5\n" +
+		"#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXTINF:4.004000,\n" +
+		"2024-01-02T03-04-05.ts\n" +
+		"#EXTINF:2.502000,\n" +
+		"2024-01-02T03-04-09.ts\n"
+	got, err := parseM3U8(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"2024-01-02T03-04-05.ts": 4.004, "2024-01-02T03-04-09.ts": 2.502}
+	if !maps.Equal(got, want) {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	root := t.TempDir()
+	if err = os.WriteFile(filepath.Join(root, "all.m3u8"), []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	segs := segmentDurations(root, []string{"2024-01-02T03-04-09.ts", "2024-01-02T03-04-12.ts"}, 0)
+	wantSegs := []m3u8Segment{{Name: "2024-01-02T03-04-09.ts", Duration: 2.502}, {Name: "2024-01-02T03-04-12.ts", Duration: nominalSegmentDuration}}
+	if !slices.Equal(segs, wantSegs) {
+		t.Fatalf("got %v\nwant %v", segs, wantSegs)
+	}
+}
+
+func TestDurationCache(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "all.m3u8")
+	data := "#EXTM3U\n#EXT-X-VERSION:3\n#EXTINF:4.004000,\n2024-01-02T03-04-05.ts\n#EXTINF:2."
+	if err := os.WriteFile(p, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := durationCache{}
+	want := map[string]float64{"2024-01-02T03-04-05.ts": 4.004}
+	if got := c.get(p); !maps.Equal(got, want) {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	// ffmpeg completes the entry.
+	data += "502000,\n2024-01-02T03-04-09.ts\n"
+	if err := os.WriteFile(p, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	want["2024-01-02T03-04-09.ts"] = 2.502
+	if got := c.get(p); !maps.Equal(got, want) {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+	// ffmpeg restarted and rewrote the playlist; the old entries are kept.
+	data = "#EXTM3U\n#EXT-X-VERSION:3\n#EXTINF:3.000000,\n2024-01-02T04-00-00.ts\n#EXTINF:1.000000,\n2024-01-02T04-00-03.ts\n"
+	if err := os.WriteFile(p, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	want["2024-01-02T04-00-00.ts"] = 3
+	want["2024-01-02T04-00-03.ts"] = 1
+	if got := c.get(p); !maps.Equal(got, want) {
+		t.Fatalf("got %v\nwant %v", got, want)
+	}
+}
+
+func TestImageCoverage(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		img.SetGray(0, y, color.Gray{Y: 255})
+	}
+	if got := imageCoverage(img); got != 0.25 {
+		t.Fatal(got)
+	}
+}
+
+func TestFilterMotionTrigger(t *testing.T) {
+	mo := motionOptions{yThreshold: 1, motionExpiration: 50 * time.Millisecond, clips: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan yLevel)
+	triggers := make(chan triggerRequest)
+	events := make(chan motionEvent, 10)
+	go func() {
+		_ = filterMotion(ctx, &mo, &metrics{}, nil, ch, triggers, events, make(chan struct{}, 1))
+	}()
+	reply := make(chan triggerReply, 1)
+	triggers <- triggerRequest{d: 150 * time.Millisecond, reply: reply}
+	e := <-events
+	if !e.start || !e.forced {
+		t.Fatalf("%+v", e)
+	}
+	r := <-reply
+	if want := e.t.Format("2006-01-02T15-04-05"); r.Playlist != want+".m3u8" || r.Clip != want+".mp4" || r.Stopped || r.End == nil {
+		t.Fatalf("%+v", r)
+	}
+	// Motion during the forced event doesn't end it early.
+	ch <- yLevel{frame: 1, t: time.Now(), yavg: 2}
+	select {
+	case e = <-events:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if e = <-events; e.start {
+		t.Fatalf("%+v", e)
+	}
+
+	// A second call ends the forced event.
+	triggers <- triggerRequest{d: time.Hour, reply: reply}
+	if e = <-events; !e.start {
+		t.Fatalf("%+v", e)
+	}
+	<-reply
+	triggers <- triggerRequest{d: time.Hour, reply: reply}
+	if r = <-reply; !r.Stopped {
+		t.Fatalf("%+v", r)
+	}
+	if e = <-events; e.start {
+		t.Fatalf("%+v", e)
+	}
+}
+
+func TestProcessMetadataAudio(t *testing.T) {
+	in := "frame:0    pts:0       pts_time:0\n" +
+		"lavfi.astats.Overall.RMS_level=-inf\n" +
+		"frame:1    pts:800     pts_time:0.1\n" +
+		"lavfi.astats.Overall.RMS_level=-43.519581\n"
+	ch := make(chan yLevel, 10)
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	m := &metrics{}
+	if err := processMetadata(context.Background(), &ptsBase{t: start}, m, 0, strings.NewReader(in), ch); err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	var got []yLevel
+	for l := range ch {
+		got = append(got, l)
+	}
+	if len(got) != 2 || !got[0].audio || !math.IsInf(float64(got[0].rms), -1) || got[1].rms != -43.5 || !got[1].t.Equal(start.Add(100*time.Millisecond)) {
+		t.Fatalf("%+v", got)
+	}
+	// Audio samples are not a liveness signal.
+	if m.lastFrame.Load() != 0 {
+		t.Fatal("unexpected last frame")
+	}
+}
+
+func TestProcessMetadataRestart(t *testing.T) {
+	ch := make(chan yLevel, 10)
+	m := &metrics{}
+	// Each ffmpeg run has its own pts_time base and the channel stays open.
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := range 2 {
+		base := &ptsBase{t: start.Add(time.Duration(i) * time.Minute)}
+		in := "frame:0    pts:0       pts_time:0\n" +
+			"lavfi.signalstats.YAVG=1.0\n" +
+			// A corrupted line is skipped.
+			"fr\n" +
+			"lavfi.signalstats.YAVG=abc\n" +
+			"frame:1    pts:1       pts_time:0.5\n" +
+			"lavfi.signalstats.YAVG=2.0\n"
+		if err := processMetadata(context.Background(), base, m, 0, strings.NewReader(in), ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(ch)
+	var got []time.Time
+	for l := range ch {
+		got = append(got, l.t)
+	}
+	want := []time.Time{start, start.Add(500 * time.Millisecond), start.Add(time.Minute), start.Add(time.Minute + 500*time.Millisecond)}
+	if !slices.EqualFunc(got, want, time.Time.Equal) {
+		t.Fatalf("got  %v\nwant %v", got, want)
+	}
+}
+
+func TestPTSBase(t *testing.T) {
+	// The base is set on the first frame.
+	var p ptsBase
+	before := time.Now()
+	if got := p.time(2 * time.Second); got.Before(before.Add(-time.Second)) || got.After(time.Now().Add(time.Second)) {
+		t.Fatal(got)
+	}
+	if got := p.time(3 * time.Second).Sub(p.time(2 * time.Second)); got != time.Second {
+		t.Fatal(got)
+	}
+}
+
+func TestFilterMotionWatchdog(t *testing.T) {
+	mo := motionOptions{yThreshold: 1, motionExpiration: time.Second, watchdog: 100 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan yLevel)
+	stalled := make(chan struct{}, 1)
+	go func() {
+		_ = filterMotion(ctx, &mo, &metrics{}, nil, ch, nil, make(chan motionEvent, 10), stalled)
+	}()
+	// Dark frames are a sign of life.
+	for i := range 20 {
+		ch <- yLevel{frame: i, t: time.Now()}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-stalled:
+		t.Fatal("unexpected stall")
+	default:
+	}
+	// Audio samples are not.
+	start := time.Now()
+	for {
+		select {
+		case ch <- yLevel{t: time.Now(), audio: true, rms: -90}:
+			time.Sleep(10 * time.Millisecond)
+			continue
+		case <-stalled:
+		}
+		break
+	}
+	if d := time.Since(start); d < 50*time.Millisecond || d > 5*time.Second {
+		t.Fatal(d)
+	}
+}
+
+func TestFilterMotionHeartbeat(t *testing.T) {
+	buf := bytes.Buffer{}
+	old := slog.Default()
+	defer slog.SetDefault(old)
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	mo := motionOptions{yThreshold: 1, motionExpiration: time.Second, watchdog: 200 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan yLevel)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = filterMotion(ctx, &mo, &metrics{}, nil, ch, nil, make(chan motionEvent, 10), make(chan struct{}, 1))
+	}()
+	// A static scene is not logged by yLevel but it is by the heartbeat.
+	ch <- yLevel{frame: 42, t: time.Now()}
+	time.Sleep(320 * time.Millisecond)
+	cancel()
+	<-done
+	got := buf.String()
+	for _, want := range []string{"msg=heartbeat frames=1 f=42 ", "msg=\"heartbeat; no frame\" f=42 "} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in %q", want, got)
+		}
+	}
+}
+
+func TestFilterMotionZone2(t *testing.T) {
+	mo := motionOptions{yThreshold: 5, zone2Threshold: 1, motionExpiration: 50 * time.Millisecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan yLevel)
+	events := make(chan motionEvent, 10)
+	go func() {
+		_ = filterMotion(ctx, &mo, &metrics{}, nil, ch, nil, events, make(chan struct{}, 1))
+	}()
+	// Below the threshold of the first zone but above the second's.
+	ch <- yLevel{frame: 1, t: time.Now(), yavg: 2}
+	ch <- yLevel{frame: 1, t: time.Now(), yavg: 2, zone: 2}
+	e := <-events
+	if !e.start || e.zone != 2 || e.yavg != 2 {
+		t.Fatalf("%+v", e)
+	}
+	if e = <-events; e.start || e.zone != 2 {
+		t.Fatalf("%+v", e)
+	}
+	ch <- yLevel{frame: 2, t: time.Now(), yavg: 6}
+	if e = <-events; !e.start || e.zone != 1 || e.yavg != 6 {
+		t.Fatalf("%+v", e)
+	}
+}
+
+func TestProcessMetadataZone2(t *testing.T) {
+	in := "frame:0    pts:0       pts_time:0\n" +
+		"lavfi.signalstats.YAVG=1.5\n"
+	ch := make(chan yLevel, 10)
+	m := &metrics{}
+	if err := processMetadata(context.Background(), &ptsBase{}, m, 2, strings.NewReader(in), ch); err != nil {
+		t.Fatal(err)
+	}
+	if l := <-ch; l.zone != 2 || l.yavg != 1.5 {
+		t.Fatalf("%+v", l)
+	}
+	// The liveness is only tracked for the first zone.
+	if m.lastFrame.Load() != 0 {
+		t.Fatal("unexpected last frame")
+	}
+}
+
+func TestFilterMotionAudio(t *testing.T) {
+	mo := motionOptions{yThreshold: 1, motionExpiration: 50 * time.Millisecond, audio: true, audioThreshold: -30}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan yLevel)
+	events := make(chan motionEvent, 10)
+	go func() {
+		_ = filterMotion(ctx, &mo, &metrics{}, nil, ch, nil, events, make(chan struct{}, 1))
+	}()
+	// Quiet.
+	ch <- yLevel{t: time.Now(), audio: true, rms: -40}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected event %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+	t0 := time.Now()
+	ch <- yLevel{t: t0, audio: true, rms: -20}
+	if e := <-events; !e.start || !e.t.Equal(t0) {
+		t.Fatalf("%+v", e)
+	}
+	if e := <-events; e.start {
+		t.Fatalf("%+v", e)
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// mqttKeepAlive is the keep alive interval negotiated with the broker.
+const mqttKeepAlive = 60 * time.Second
+
+// mqttBackoff is the delay before reconnecting to the broker. It doubles on
+// each failure up to 30s.
+var mqttBackoff = time.Second
+
+// mqttClient publishes retained messages to a MQTT 3.1.1 broker.
+//
+// Only QoS 0 is supported. Since the messages are retained, the last one is
+// published again upon reconnection so the broker always has the current
+// state.
+type mqttClient struct {
+	broker   string
+	topic    string
+	user     string
+	password string
+	clientID string
+
+	mu      sync.Mutex
+	last    []byte
+	pending chan struct{}
+}
+
+// newMQTTClient returns a client for broker, which is either host:port or an
+// URL with the tcp://, mqtt://, ssl:// or mqtts:// scheme.
+func newMQTTClient(broker, topic, user, password, clientID string) (*mqttClient, error) {
+	if _, _, err := mqttAddr(broker); err != nil {
+		return nil, err
+	}
+	if topic == "" {
+		return nil, errors.New("empty MQTT topic")
+	}
+	return &mqttClient{
+		broker:   broker,
+		topic:    topic,
+		user:     user,
+		password: password,
+		clientID: clientID,
+		pending:  make(chan struct{}, 1),
+	}, nil
+}
+
+// mqttAddr returns the host:port to connect to and if TLS must be used.
+func mqttAddr(broker string) (string, bool, error) {
+	useTLS := false
+	host := broker
+	if u, err := url.Parse(broker); err == nil && u.Host != "" {
+		switch u.Scheme {
+		case "tcp", "mqtt":
+		case "ssl", "mqtts":
+			useTLS = true
+		default:
+			return "", false, fmt.Errorf("unsupported MQTT scheme %q", u.Scheme)
+		}
+		host = u.Host
+	}
+	if host == "" {
+		return "", false, errors.New("empty MQTT broker")
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "1883"
+		if useTLS {
+			port = "8883"
+		}
+		host = net.JoinHostPort(host, port)
+	}
+	return host, useTLS, nil
+}
+
+// publish queues payload to be published on the topic. It doesn't block; only
+// the latest payload is kept if the client is not connected.
+func (c *mqttClient) publish(payload []byte) {
+	c.mu.Lock()
+	c.last = payload
+	c.mu.Unlock()
+	select {
+	case c.pending <- struct{}{}:
+	default:
+	}
+}
+
+// run connects to the broker and publishes the messages until ctx is
+// canceled. It reconnects when the connection drops.
+func (c *mqttClient) run(ctx context.Context) error {
+	delay := mqttBackoff
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := c.session(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+		if time.Since(start) > time.Minute {
+			delay = mqttBackoff
+		}
+		slog.Error("mqtt", "broker", c.broker, "err", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+	return nil
+}
+
+// session runs a single connection to the broker.
+func (c *mqttClient) session(ctx context.Context) error {
+	host, useTLS, err := mqttAddr(c.broker)
+	if err != nil {
+		return err
+	}
+	d := net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	if useTLS {
+		h, _, _ := net.SplitHostPort(host)
+		conn, err = (&tls.Dialer{NetDialer: &d, Config: &tls.Config{ServerName: h, MinVersion: tls.VersionTLS12}}).DialContext(ctx, "tcp", host)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = conn.Write(c.connectPacket()); err != nil {
+		return err
+	}
+	typ, body, err := mqttReadPacket(r)
+	if err != nil {
+		return err
+	}
+	if typ != 0x20 || len(body) != 2 {
+		return fmt.Errorf("unexpected packet 0x%02x instead of CONNACK", typ)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("connection refused, code %d", body[1])
+	}
+	_ = conn.SetDeadline(time.Time{})
+	slog.Info("mqtt", "broker", c.broker, "msg", "connected")
+
+	// The broker only sends PINGRESP since nothing is subscribed.
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			typ, _, err := mqttReadPacket(r)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if typ != 0xD0 {
+				readErr <- fmt.Errorf("unexpected packet 0x%02x", typ)
+				return
+			}
+		}
+	}()
+
+	// Republish the current state, it may have been missed while disconnected.
+	c.mu.Lock()
+	last := c.last
+	c.mu.Unlock()
+	if last != nil {
+		if _, err = conn.Write(c.publishPacket(last)); err != nil {
+			return err
+		}
+	}
+	ping := time.NewTicker(mqttKeepAlive / 2)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			_, _ = conn.Write([]byte{0xE0, 0x00})
+			slog.Info("mqtt", "broker", c.broker, "msg", "disconnected")
+			return nil
+		case err = <-readErr:
+			return err
+		case <-ping.C:
+			if _, err = conn.Write([]byte{0xC0, 0x00}); err != nil {
+				return err
+			}
+		case <-c.pending:
+			c.mu.Lock()
+			last = c.last
+			c.mu.Unlock()
+			if _, err = conn.Write(c.publishPacket(last)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// connectPacket returns a CONNECT packet with a clean session.
+func (c *mqttClient) connectPacket() []byte {
+	flags := byte(0x02)
+	if c.user != "" {
+		flags |= 0x80
+		if c.password != "" {
+			flags |= 0x40
+		}
+	}
+	b := mqttString(nil, "MQTT")
+	b = append(b, 4, flags)
+	b = binary.BigEndian.AppendUint16(b, uint16(mqttKeepAlive/time.Second))
+	b = mqttString(b, c.clientID)
+	if c.user != "" {
+		b = mqttString(b, c.user)
+		if c.password != "" {
+			b = mqttString(b, c.password)
+		}
+	}
+	return mqttPacket(0x10, b)
+}
+
+// publishPacket returns a retained QoS 0 PUBLISH packet.
+func (c *mqttClient) publishPacket(payload []byte) []byte {
+	return mqttPacket(0x31, append(mqttString(nil, c.topic), payload...))
+}
+
+// mqttString appends a length prefixed string.
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket returns a packet with its fixed header.
+func mqttPacket(typ byte, body []byte) []byte {
+	b := []byte{typ}
+	// Remaining length is encoded as a variable length integer.
+	for l := len(body); ; {
+		v := byte(l % 128)
+		if l /= 128; l > 0 {
+			v |= 0x80
+		}
+		b = append(b, v)
+		if l == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+// mqttReadPacket reads a packet and returns its type and flags byte and its
+// body.
+func mqttReadPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	l := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("invalid remaining length")
+		}
+		v, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		l |= int(v&0x7F) << (7 * i)
+		if v&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, l)
+	_, err = io.ReadFull(r, body)
+	return typ, body, err
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMQTTClient(t *testing.T) {
+	mqttBackoff = time.Millisecond
+	defer func() { mqttBackoff = time.Second }()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := newMQTTClient("tcp://"+l.Addr().String(), "cam/motion", "user", "pass", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.run(ctx) }()
+
+	// accept accepts a connection and verifies the CONNECT packet.
+	accept := func() (net.Conn, *bufio.Reader) {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := bufio.NewReader(conn)
+		typ, body, err := mqttReadPacket(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := c.connectPacket(); typ != 0x10 || !bytes.Equal(mqttPacket(typ, body), want) {
+			t.Fatalf("unexpected CONNECT: %x", body)
+		}
+		if !bytes.Contains(body, []byte("user")) || !bytes.Contains(body, []byte("pass")) {
+			t.Fatalf("missing credentials: %q", body)
+		}
+		if _, err = conn.Write([]byte{0x20, 0x02, 0x00, 0x00}); err != nil {
+			t.Fatal(err)
+		}
+		return conn, r
+	}
+	expectPublish := func(r *bufio.Reader, payload string) {
+		typ, body, err := mqttReadPacket(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := mqttPacket(0x31, append(mqttString(nil, "cam/motion"), payload...)); !bytes.Equal(mqttPacket(typ, body), want) {
+			t.Fatalf("unexpected PUBLISH 0x%02x: %q", typ, body)
+		}
+	}
+
+	conn, r := accept()
+	c.publish([]byte(`{"motion":true}`))
+	expectPublish(r, `{"motion":true}`)
+	// The broker goes away; the retained state is sent again upon
+	// reconnection.
+	_ = conn.Close()
+	conn, r = accept()
+	expectPublish(r, `{"motion":true}`)
+	cancel()
+	if typ, _, err := mqttReadPacket(r); err != nil || typ != 0xE0 {
+		t.Fatalf("expected DISCONNECT, got 0x%02x, %v", typ, err)
+	}
+	_ = conn.Close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMQTTAddr(t *testing.T) {
+	data := []struct {
+		in   string
+		host string
+		tls  bool
+	}{
+		{"localhost", "localhost:1883", false},
+		{"localhost:1884", "localhost:1884", false},
+		{"tcp://localhost", "localhost:1883", false},
+		{"mqtts://localhost", "localhost:8883", true},
+	}
+	for _, l := range data {
+		host, useTLS, err := mqttAddr(l.in)
+		if err != nil || host != l.host || useTLS != l.tls {
+			t.Errorf("mqttAddr(%q) = %q, %t, %v", l.in, host, useTLS, err)
+		}
+	}
+	if _, _, err := mqttAddr("http://localhost"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	b := mqttPacket(0x31, make([]byte, 321))
+	typ, body, err := mqttReadPacket(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil || typ != 0x31 || len(body) != 321 {
+		t.Fatalf("0x%02x, %d, %v", typ, len(body), err)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// postConcurrency is the maximum number of recordings post-processed
+// concurrently.
+const postConcurrency = 2
+
+// validPostSteps is the valid post-processing steps.
+//
+// - "transcode" encodes the recording to a MP4 file. Options: codec (default
+// h264), preset (default fast), crf (default 28). The following steps use the
+// MP4 file.
+// - "upload" sends the file to an URL. Options: url (required), method
+// (default PUT).
+// - "notify" POSTs {"recording":"<name>","file":"<file>"} to an URL. Options:
+// url (required).
+// - "exec" runs a command with the file as argument. Options: cmd
+// (required).
+// - "delete" deletes the original .m3u8 playlist and .vtt track. The .ts
+// segments are not deleted since they are part of the continuous recording.
+var validPostSteps = []string{"transcode", "upload", "notify", "exec", "delete"}
+
+// postStep is a step of a post-processing pipeline.
+type postStep struct {
+	kind string
+	opts map[string]string
+}
+
+// postPipeline is an ordered list of steps run on each finalized motion
+// recording.
+//
+// It is parsed from a string like
+// "transcode:crf=32;upload:url=https://example.com/clips/;delete".
+type postPipeline []postStep
+
+func (p *postPipeline) Set(v string) error {
+	var out postPipeline
+	for _, item := range strings.Split(v, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kind, args, _ := strings.Cut(item, ":")
+		if !slices.Contains(validPostSteps, kind) {
+			return fmt.Errorf("invalid post-processing step %q. Supported values are: %s", kind, strings.Join(validPostSteps, ", "))
+		}
+		s := postStep{kind: kind, opts: map[string]string{}}
+		for _, a := range strings.Split(args, ",") {
+			if a == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(a, "=")
+			if !ok {
+				return fmt.Errorf("invalid option %q for step %s; use key=value", a, kind)
+			}
+			s.opts[k] = v
+		}
+		switch kind {
+		case "upload", "notify":
+			if s.opts["url"] == "" {
+				return fmt.Errorf("step %s requires url=", kind)
+			}
+		case "exec":
+			if s.opts["cmd"] == "" {
+				return errors.New("step exec requires cmd=")
+			}
+		}
+		out = append(out, s)
+	}
+	if len(out) == 0 {
+		return errors.New("empty post-processing pipeline")
+	}
+	*p = out
+	return nil
+}
+
+func (p *postPipeline) String() string {
+	var out []string
+	for _, s := range *p {
+		item := s.kind
+		var opts []string
+		for _, k := range slices.Sorted(maps.Keys(s.opts)) {
+			opts = append(opts, k+"="+s.opts[k])
+		}
+		if len(opts) != 0 {
+			item += ":" + strings.Join(opts, ",")
+		}
+		out = append(out, item)
+	}
+	return strings.Join(out, ";")
+}
+
+// postProcessor runs a post-processing pipeline asynchronously.
+type postProcessor struct {
+	root  string
+	steps postPipeline
+	sem   chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newPostProcessor(root string, steps postPipeline) *postProcessor {
+	return &postProcessor{root: root, steps: steps, sem: make(chan struct{}, postConcurrency)}
+}
+
+// process runs the pipeline on the motion recording named base in the
+// background.
+func (p *postProcessor) process(ctx context.Context, base string) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		select {
+		case p.sem <- struct{}{}:
+		case <-ctx.Done():
+			slog.Warn("post", "recording", base, "err", ctx.Err())
+			return
+		}
+		defer func() { <-p.sem }()
+		if err := p.run(ctx, base); err != nil {
+			slog.Error("post", "recording", base, "err", err)
+		}
+	}()
+}
+
+// wait waits for all the pending pipelines to complete.
+func (p *postProcessor) wait() {
+	p.wg.Wait()
+}
+
+// run runs the pipeline on the motion recording named base. It stops on the
+// first failing step.
+func (p *postProcessor) run(ctx context.Context, base string) error {
+	file := base + ".m3u8"
+	for i, s := range p.steps {
+		start := time.Now()
+		out, err := p.runStep(ctx, s, base, file)
+		if err != nil {
+			return fmt.Errorf("step #%d %s: %w", i+1, s.kind, err)
+		}
+		slog.Info("post", "recording", base, "step", s.kind, "file", out, "dur", time.Since(start).Round(time.Millisecond))
+		file = out
+	}
+	return nil
+}
+
+// runStep runs a single step on file and returns the file to use for the
+// next steps.
+func (p *postProcessor) runStep(ctx context.Context, s postStep, base, file string) (string, error) {
+	opt := func(k, def string) string {
+		if v := s.opts[k]; v != "" {
+			return v
+		}
+		return def
+	}
+	switch s.kind {
+	case "transcode":
+		dst := base + ".mp4"
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Minute)
+		defer cancel()
+		args := []string{
+			"ffmpeg", "-hide_banner", "-nostats", "-loglevel", "repeat+warning", "-y",
+			"-i", file,
+			"-c:v", opt("codec", "h264"),
+			"-preset", opt("preset", "fast"),
+			"-crf", opt("crf", "28"),
+			"-movflags", "+faststart",
+			dst,
+		}
+		return dst, cmdFFMPEG(ctx, p.root, args, nil, ffmpegStderr).Run()
+	case "upload":
+		// #nosec G304
+		f, err := os.Open(filepath.Join(p.root, file))
+		if err != nil {
+			return file, err
+		}
+		defer f.Close()
+		u := opt("url", "")
+		if strings.HasSuffix(u, "/") {
+			u += file
+		}
+		return file, p.do(ctx, opt("method", "PUT"), u, mime.TypeByExtension(filepath.Ext(file)), f)
+	case "notify":
+		d, _ := json.Marshal(map[string]string{"recording": base, "file": file})
+		return file, p.do(ctx, "POST", opt("url", ""), "application/json", bytes.NewReader(d))
+	case "exec":
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+		defer cancel()
+		// #nosec G204
+		c := exec.CommandContext(ctx, opt("cmd", ""), filepath.Join(p.root, file))
+		c.Dir = p.root
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+		return file, c.Run()
+	case "delete":
+		for _, n := range []string{base + ".m3u8", base + ".vtt"} {
+			if err := os.Remove(filepath.Join(p.root, n)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return file, err
+			}
+		}
+		return file, nil
+	default:
+		return file, errors.New("unknown step")
+	}
+}
+
+// do sends an HTTP request and returns an error if the response isn't a 2xx.
+func (p *postProcessor) do(ctx context.Context, method, url, contentType string, body io.Reader) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPostPipelineSet(t *testing.T) {
+	var p postPipeline
+	const v = "transcode:crf=32;upload:method=POST,url=https://example.com/;delete"
+	if err := p.Set(v); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.String(); got != v {
+		t.Fatalf("got %q", got)
+	}
+	for _, bad := range []string{"", "foo", "upload", "upload:url", "exec:"} {
+		if err := p.Set(bad); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
+
+func TestPostProcessor(t *testing.T) {
+	mu := sync.Mutex{}
+	var got []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, r.Method+" "+r.URL.Path+" "+string(b))
+		mu.Unlock()
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer s.Close()
+	root := t.TempDir()
+	const base = "2024-01-02T03-04-05"
+	if err := os.WriteFile(filepath.Join(root, base+".m3u8"), []byte("playlist"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var steps postPipeline
+	if err := steps.Set("upload:url=" + s.URL + "/;notify:url=" + s.URL + "/n;delete"); err != nil {
+		t.Fatal(err)
+	}
+	pp := newPostProcessor(root, steps)
+	pp.process(context.Background(), base)
+	pp.wait()
+	want := []string{
+		"PUT /" + base + ".m3u8 playlist",
+		`POST /n {"file":"` + base + `.m3u8","recording":"` + base + `"}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(root, base+".m3u8")); !os.IsNotExist(err) {
+		t.Fatalf("expected deleted: %v", err)
+	}
+
+	// A failure stops the chain.
+	if err := os.WriteFile(filepath.Join(root, base+".m3u8"), []byte("playlist"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := steps.Set("notify:url=" + s.URL + "/fail;delete"); err != nil {
+		t.Fatal(err)
+	}
+	if err := newPostProcessor(root, steps).run(context.Background(), base); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := os.Stat(filepath.Join(root, base+".m3u8")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// posterMaxWidth is the maximum width of the poster thumbnails. They are only
+// shown until the video is played.
+const posterMaxWidth = 320
+
+// posterName returns the name of the poster of the motion recording of the
+// event started at t.
+func posterName(t time.Time) string {
+	return t.Format("2006-01-02T15-04-05") + ".jpg"
+}
+
+// peakTime returns the time of the frame with the most motion between start
+// and end, or start if hist is nil or has no sample in the range.
+func peakTime(hist *yavgHistory, start, end time.Time) time.Time {
+	if hist == nil {
+		return start
+	}
+	out := start
+	var best float32
+	for _, l := range hist.get(start, end) {
+		if l.yavg > best {
+			best = l.yavg
+			out = l.t
+		}
+	}
+	return out
+}
+
+// buildPosterCmd builds the command line to exec ffmpeg to extract the frame
+// at t out of the segments files into the JPEG dst.
+//
+// files must be sorted and the first one must start at or before t.
+func buildPosterCmd(files []string, t time.Time, dst string) ([]string, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no segment to extract from")
+	}
+	first, err := fileTime(files[0])
+	if err != nil {
+		return nil, err
+	}
+	offset := max(t.Sub(first), 0)
+	return []string{
+		"ffmpeg",
+		"-hide_banner",
+		"-nostats",
+		"-loglevel", "repeat+warning",
+		"-y",
+		"-ss", fmt.Sprintf("%.3f", offset.Seconds()),
+		"-i", "concat:" + strings.Join(files, "|"),
+		"-frames:v", "1",
+		"-an",
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", posterMaxWidth),
+		"-q:v", "5",
+		dst,
+	}, nil
+}
+
+// generatePoster generates the poster of the motion recording of the event
+// that started at t and ended at end.
+//
+// The frame with the most motion is used when hist is set, the first frame of
+// the event otherwise.
+func generatePoster(ctx context.Context, root string, hist *yavgHistory, t, end time.Time) error {
+	at := peakTime(hist, t, end)
+	files, err := clipSegments(root, at, end)
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	name := posterName(t)
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	err = ffmpegToFile(ctx, root, name, nil, func(dst string) ([]string, error) {
+		return buildPosterCmd(files, at, dst)
+	})
+	if err == nil {
+		slog.Info("poster", "name", name)
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBuildPosterCmd(t *testing.T) {
+	files := []string{"2024-01-02T03-04-00.ts", "2024-01-02T03-04-04.ts"}
+	at := time.Date(2024, 1, 2, 3, 4, 5, 500000000, time.Local)
+	got, err := buildPosterCmd(files, at, "out.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ffmpeg", "-hide_banner", "-nostats", "-loglevel", "repeat+warning", "-y",
+		"-ss", "5.500",
+		"-i", "concat:2024-01-02T03-04-00.ts|2024-01-02T03-04-04.ts",
+		"-frames:v", "1",
+		"-an",
+		"-vf", "scale='min(320,iw)':-2",
+		"-q:v", "5",
+		"out.jpg",
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got  %q\nwant %q", got, want)
+	}
+	if _, err = buildPosterCmd(nil, at, "out.jpg"); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := posterName(at); got != "2024-01-02T03-04-05.jpg" {
+		t.Fatal(got)
+	}
+}
+
+func TestPeakTime(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+	end := start.Add(10 * time.Second)
+	if got := peakTime(nil, start, end); !got.Equal(start) {
+		t.Fatal(got)
+	}
+	hist := &yavgHistory{maxAge: time.Minute}
+	hist.add(yLevel{t: start.Add(-time.Second), yavg: 10})
+	hist.add(yLevel{t: start.Add(time.Second), yavg: 2})
+	hist.add(yLevel{t: start.Add(2 * time.Second), yavg: 5})
+	hist.add(yLevel{t: start.Add(3 * time.Second), yavg: 1})
+	if got := peakTime(hist, start, end); !got.Equal(start.Add(2 * time.Second)) {
+		t.Fatal(got)
+	}
+	if got := peakTime(hist, end, end.Add(time.Second)); !got.Equal(end) {
+		t.Fatal(got)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"sync"
+	"time"
+)
+
+// ringFrame is a JPEG frame kept in a frameRing.
+type ringFrame struct {
+	t time.Time
+	b []byte
+}
+
+// frameRing keeps the most recent recorded frames in memory.
+//
+// It guarantees that a motion recording includes the pre-capture even when
+// the segments covering it are missing, e.g. ffmpeg was restarted or the
+// segments were deleted. The frames are read from a dedicated ffmpeg output at
+// the recording's resolution and frame rate, not from the MJPEG stream which is
+// decimated, downscaled and decorated. The memory is bounded by maxAge * fps *
+// the JPEG frame size.
+type frameRing struct {
+	// maxAge is the age of the oldest frame kept.
+	maxAge time.Duration
+
+	mu     sync.Mutex
+	frames []ringFrame
+}
+
+// add adds a frame received at t and evicts the ones older than maxAge.
+func (r *frameRing) add(t time.Time, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames = append(r.frames, ringFrame{t: t, b: b})
+	i := 0
+	for ; i < len(r.frames) && t.Sub(r.frames[i].t) > r.maxAge; i++ {
+	}
+	if i != 0 {
+		n := copy(r.frames, r.frames[i:])
+		// Clear the references so the frames can be garbage collected.
+		clear(r.frames[n:])
+		r.frames = r.frames[:n]
+	}
+}
+
+// snapshot returns the frames received in the maxAge before t.
+func (r *frameRing) snapshot(t time.Time) []ringFrame {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]ringFrame, 0, len(r.frames))
+	for _, f := range r.frames {
+		if !f.t.After(t) && t.Sub(f.t) <= r.maxAge {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// listen adds the frames of the multipart stream rd, as written by ffmpeg,
+// until EOF or ctx is canceled.
+func (r *frameRing) listen(ctx context.Context, rd io.Reader) error {
+	mr := multipart.NewReader(rd, mpjpegBoundary)
+	for ctx.Err() == nil {
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(p)
+		if err != nil {
+			return err
+		}
+		r.add(time.Now(), b)
+	}
+	return nil
+}
+
+// prerollName returns the name of the pre-roll of the motion event that
+// started at t.
+func prerollName(t time.Time) string {
+	return t.Format("2006-01-02T15-04-05") + "-preroll.ts"
+}
+
+// prerollRate returns the frame rate and the duration of the video encoded
+// from frames.
+func prerollRate(frames []ringFrame) (float64, time.Duration) {
+	fps := 1.
+	if n := len(frames); n > 1 {
+		if span := frames[n-1].t.Sub(frames[0].t); span > 0 {
+			fps = float64(n-1) / span.Seconds()
+		}
+	}
+	return fps, time.Duration(float64(len(frames)) / fps * float64(time.Second))
+}
+
+// buildPrerollCmd builds the command line to exec ffmpeg to encode the JPEG
+// frames read from stdin at fps into the MPEG-TS file dst.
+//
+// It is always encoded as h264 so it can be played along the segments.
+func buildPrerollCmd(fps float64, dst string) []string {
+	return []string{
+		"ffmpeg",
+		"-hide_banner",
+		"-nostats",
+		"-loglevel", "repeat+warning",
+		"-y",
+		"-f", "image2pipe",
+		"-c:v", "mjpeg",
+		"-framerate", fmt.Sprintf("%.3f", fps),
+		"-i", "pipe:0",
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-pix_fmt", "yuv420p",
+		"-f", "mpegts",
+		dst,
+	}
+}
+
+// savePreroll encodes frames as the pre-roll of the motion event that started
+// at t.
+func savePreroll(ctx context.Context, root string, t time.Time, frames []ringFrame) error {
+	if len(frames) == 0 {
+		return errors.New("no frame to encode")
+	}
+	name := prerollName(t)
+	fps, d := prerollRate(frames)
+	buf := bytes.Buffer{}
+	for _, f := range frames {
+		buf.Write(f.b)
+	}
+	err := ffmpegToFile(ctx, root, name, &buf, func(dst string) ([]string, error) {
+		return buildPrerollCmd(fps, dst), nil
+	})
+	if err == nil {
+		slog.Info("preroll", "name", name, "frames", len(frames), "d", d)
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrameRing(t *testing.T) {
+	t0 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := frameRing{maxAge: time.Second}
+	for i := 0; i < 20; i++ {
+		r.add(t0.Add(time.Duration(i)*100*time.Millisecond), []byte{byte(i)})
+	}
+	// Only the last second is kept.
+	if len(r.frames) != 11 || r.frames[0].b[0] != 9 {
+		t.Fatal(len(r.frames), r.frames[0].b)
+	}
+	got := r.snapshot(t0.Add(1500 * time.Millisecond))
+	if len(got) != 7 || got[0].b[0] != 9 || got[6].b[0] != 15 {
+		t.Fatal(got)
+	}
+	// Stale frames are not returned.
+	if got = r.snapshot(t0.Add(time.Hour)); len(got) != 0 {
+		t.Fatal(got)
+	}
+	fps, d := prerollRate(r.frames)
+	if fps < 9.99 || fps > 10.01 || d < 1099*time.Millisecond || d > 1101*time.Millisecond {
+		t.Fatal(fps, d)
+	}
+	if fps, d = prerollRate(r.frames[:1]); fps != 1 || d != time.Second {
+		t.Fatal(fps, d)
+	}
+}
+
+func TestFrameRingListen(t *testing.T) {
+	r := frameRing{maxAge: time.Minute}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := mimeStream(t, mpjpegBoundary, []byte("a"), []byte("b"), []byte("c"))
+	if err := r.listen(ctx, bytes.NewReader(stream)); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.frames) != 3 || string(r.frames[0].b) != "a" || string(r.frames[2].b) != "c" {
+		t.Fatal(r.frames)
+	}
+}
+
+func TestBuildFFMPEGCmdPreroll(t *testing.T) {
+	o := ffmpegOptions{s: "normal", w: 1280, h: 720, fps: 15, codec: "h264", mpjpeg: true, mpjpegFPS: 1, mpjpegScale: scaleSpec{width: 640}, preroll: true}
+	args, err := buildFFMPEGCmd(&o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.Index(args, "[outPreroll]")
+	if i == -1 || args[len(args)-1] != "pipe:8" {
+		t.Fatalf("%q", args)
+	}
+	// The pre-roll is neither decimated nor downscaled like the MJPEG stream.
+	fg := args[slices.Index(args, "-filter_complex")+1]
+	if !strings.Contains(fg, "[outHLS][out2][outPreroll]") || strings.Contains(fg, "[outPreroll]fps") || strings.Contains(fg, "[outPreroll]scale") {
+		t.Fatal(fg)
+	}
+}
+
+func TestGenerateM3U8Preroll(t *testing.T) {
+	root := t.TempDir()
+	ev := time.Date(2024, 1, 2, 3, 4, 10, 0, time.Local)
+	// ffmpeg was restarted: the segments start after the pre-capture.
+	names := []string{
+		"2024-01-02T03-04-08.ts",
+		"2024-01-02T03-04-10.ts",
+		"2024-01-02T03-04-14.ts",
+		prerollName(ev),
+	}
+	for _, n := range names {
+		if err := os.WriteFile(filepath.Join(root, n), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := ev.Add(-5 * time.Second)
+	end := ev.Add(10 * time.Second)
+	files, err := findTSFiles(root, start.Add(-30*time.Second), end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := names[:3]; !slices.Equal(files, want) {
+		t.Fatalf("got %q\nwant %q", files, want)
+	}
+	if n, err := generateMotionRecording(root, nil, 0, ev, start, end, 5*time.Second); err != nil || n != 3 {
+		t.Fatal(n, err)
+	}
+	b, err := os.ReadFile(filepath.Join(root, "2024-01-02T03-04-10.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The segment before the event is covered by the pre-roll.
+	want := "#EXTINF:5.000000,\n2024-01-02T03-04-10-preroll.ts\n" +
+		"#EXT-X-DISCONTINUITY\n#EXTINF:4.000000,\n2024-01-02T03-04-10.ts\n" +
+		"#EXTINF:4.000000,\n2024-01-02T03-04-14.ts\n"
+	if !strings.HasSuffix(string(b), want) {
+		t.Fatalf("got:\n%s", b)
+	}
+
+	// The segments cover the pre-capture: the pre-roll is not used.
+	if err = os.WriteFile(filepath.Join(root, "2024-01-02T03-04-04.ts"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := generateMotionRecording(root, nil, 0, ev, start, end, 5*time.Second); err != nil || n != 4 {
+		t.Fatal(n, err)
+	}
+	if b, err = os.ReadFile(filepath.Join(root, "2024-01-02T03-04-10.m3u8")); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "preroll") {
+		t.Fatalf("got:\n%s", b)
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// retentionInterval is how often the old files are deleted.
+const retentionInterval = 10 * time.Minute
+
+// fileTime returns the time encoded in a file name like
+// 2006-01-02T15-04-05.ts, 2006-01-02/15-04-05.ts,
+// 2006-01-02T15-04-05-motion.jpg or 2006-01-02T15-04-05-preroll.ts, ignoring
+// the extension(s).
+func fileTime(name string) (time.Time, error) {
+	if i := strings.IndexByte(name, '.'); i != -1 {
+		name = name[:i]
+	}
+	name = strings.TrimSuffix(name, "-motion")
+	name = strings.TrimSuffix(name, "-preroll")
+	if strings.Contains(name, "/") {
+		return time.ParseInLocation(dailySegmentFormat, name, time.Local)
+	}
+	return time.ParseInLocation("2006-01-02T15-04-05", name, time.Local)
+}
+
+// cleanupOld deletes the segments and the motion recordings older than cutoff
+// in root and its day directories. Emptied day directories are deleted.
+//
+// Segments referenced by a motion playlist newer than cutoff are kept. It
+// returns the number of files and bytes deleted.
+func cleanupOld(root string, cutoff time.Time) (int, int64, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return 0, 0, err
+	}
+	// First pass: find the segments still needed.
+	keep := map[string]struct{}{}
+	for _, e := range entries {
+		n := e.Name()
+		if !strings.HasSuffix(n, ".m3u8") || e.IsDir() {
+			continue
+		}
+		if t, err2 := fileTime(n); err2 != nil || t.Before(cutoff) {
+			continue
+		}
+		// #nosec G304
+		f, err2 := os.Open(filepath.Join(root, n))
+		if err2 != nil {
+			continue
+		}
+		segments, err2 := parseM3U8(f)
+		_ = f.Close()
+		if err2 != nil {
+			slog.Warn("retention", "p", n, "err", err2)
+		}
+		for s := range segments {
+			keep[s] = struct{}{}
+		}
+	}
+	files := 0
+	var size int64
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() {
+			f, s, err2 := cleanupDay(root, n, cutoff, keep)
+			files += f
+			size += s
+			if err2 != nil {
+				err = err2
+			}
+			continue
+		}
+		// The DASH chunks are not named after their time; -retention is rejected
+		// with -container dash.
+		switch filepath.Ext(n) {
+		case ".ts", ".m3u8", ".vtt", ".mp4", ".jpg", ".gif":
+		default:
+			continue
+		}
+		if t, err2 := fileTime(n); err2 != nil || !t.Before(cutoff) {
+			// all.m3u8 is not a timestamp so it is never deleted.
+			continue
+		}
+		if _, ok := keep[n]; ok {
+			continue
+		}
+		fi, err2 := e.Info()
+		if err2 != nil {
+			continue
+		}
+		if err2 = os.Remove(filepath.Join(root, n)); err2 != nil {
+			if !errors.Is(err2, os.ErrNotExist) {
+				err = err2
+			}
+			continue
+		}
+		files++
+		size += fi.Size()
+	}
+	return files, size, err
+}
+
+// cleanupDay deletes the segments older than cutoff in the day directory dir
+// that are not in keep. dir is deleted once empty.
+//
+// Directories not named like a date are ignored.
+func cleanupDay(root, dir string, cutoff time.Time, keep map[string]struct{}) (int, int64, error) {
+	day, err := time.ParseInLocation(time.DateOnly, dir, time.Local)
+	if err != nil || !day.Before(cutoff) {
+		return 0, 0, nil
+	}
+	entries, err := os.ReadDir(filepath.Join(root, dir))
+	if err != nil {
+		return 0, 0, err
+	}
+	files := 0
+	var size int64
+	left := len(entries)
+	for _, e := range entries {
+		n := dir + "/" + e.Name()
+		if e.IsDir() || filepath.Ext(n) != ".ts" {
+			continue
+		}
+		if t, err2 := fileTime(n); err2 != nil || !t.Before(cutoff) {
+			continue
+		}
+		if _, ok := keep[n]; ok {
+			continue
+		}
+		fi, err2 := e.Info()
+		if err2 != nil {
+			continue
+		}
+		if err2 = os.Remove(filepath.Join(root, n)); err2 != nil {
+			if !errors.Is(err2, os.ErrNotExist) {
+				err = err2
+			}
+			continue
+		}
+		files++
+		size += fi.Size()
+		left--
+	}
+	if left == 0 {
+		if err2 := os.Remove(filepath.Join(root, dir)); err2 != nil && !errors.Is(err2, os.ErrNotExist) {
+			err = err2
+		}
+	}
+	return files, size, err
+}
+
+// deleteRecording deletes the file name in root. It returns the number of
+// files deleted.
+//
+// When name is a motion playlist, its .vtt track, .gif preview and .jpg
+// poster are deleted too. When segments is true, the segments it references
+// that are not referenced by another motion playlist are deleted too. all.m3u8
+// is ignored since it references all the segments.
+func deleteRecording(root, name string, segments bool) (int, error) {
+	p := filepath.Join(root, name)
+	var refs map[string]float64
+	if segments && strings.HasSuffix(name, ".m3u8") {
+		// #nosec G304
+		f, err := os.Open(p)
+		if err != nil {
+			return 0, err
+		}
+		refs, err = parseM3U8(f)
+		_ = f.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err := os.Remove(p); err != nil {
+		return 0, err
+	}
+	files := 1
+	if !strings.HasSuffix(name, ".m3u8") {
+		return files, nil
+	}
+	base := strings.TrimSuffix(name, ".m3u8")
+	for _, ext := range []string{".vtt", ".gif", ".jpg"} {
+		if err := os.Remove(filepath.Join(root, base+ext)); err == nil {
+			files++
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return files, err
+		}
+	}
+	if len(refs) == 0 {
+		return files, nil
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return files, err
+	}
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() || !strings.HasSuffix(n, ".m3u8") || n == "all.m3u8" {
+			continue
+		}
+		// #nosec G304
+		f, err2 := os.Open(filepath.Join(root, n))
+		if err2 != nil {
+			continue
+		}
+		other, err2 := parseM3U8(f)
+		_ = f.Close()
+		if err2 != nil {
+			slog.Warn("delete", "p", n, "err", err2)
+		}
+		for s := range other {
+			delete(refs, s)
+		}
+	}
+	for s := range refs {
+		// The playlist was generated by us but be paranoid.
+		if _, ok := rawPath(s); !ok || !strings.HasSuffix(s, ".ts") {
+			continue
+		}
+		if err2 := os.Remove(filepath.Join(root, s)); err2 == nil {
+			files++
+		} else if !errors.Is(err2, os.ErrNotExist) {
+			err = err2
+		}
+	}
+	return files, err
+}
+
+// tempFileMinAge is the age after which a temporary file is considered
+// orphaned, e.g. because the process was killed while writing it.
+const tempFileMinAge = 10 * time.Second
+
+// isTempFile returns true if name is a temporary file that is renamed once
+// complete, like 2006-01-02T15-04-05.m3u8.tmp or 2006-01-02T15-04-05.tmp.mp4.
+func isTempFile(name string) bool {
+	return strings.HasSuffix(name, ".tmp") || strings.Contains(name, ".tmp.")
+}
+
+// removeTempFiles deletes the orphaned temporary files in root and its day
+// directories. It returns the number of files deleted.
+//
+// Files modified less than tempFileMinAge before now are kept since they may
+// still be written to.
+func removeTempFiles(root string, now time.Time) (int, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+	var tmp []string
+	for _, e := range entries {
+		n := e.Name()
+		if !e.IsDir() {
+			if isTempFile(n) {
+				tmp = append(tmp, n)
+			}
+			continue
+		}
+		if _, err2 := time.Parse(time.DateOnly, n); err2 != nil {
+			continue
+		}
+		sub, err2 := os.ReadDir(filepath.Join(root, n))
+		if err2 != nil {
+			err = err2
+			continue
+		}
+		for _, e2 := range sub {
+			if !e2.IsDir() && isTempFile(e2.Name()) {
+				tmp = append(tmp, n+"/"+e2.Name())
+			}
+		}
+	}
+	files := 0
+	for _, n := range tmp {
+		p := filepath.Join(root, n)
+		fi, err2 := os.Stat(p)
+		if err2 != nil || now.Sub(fi.ModTime()) < tempFileMinAge {
+			continue
+		}
+		if err2 = os.Remove(p); err2 != nil {
+			if !errors.Is(err2, os.ErrNotExist) {
+				err = err2
+			}
+			continue
+		}
+		files++
+	}
+	return files, err
+}
+
+// enforceRetention deletes the files older than retention in root
+// periodically until ctx is canceled.
+func enforceRetention(ctx context.Context, root string, retention time.Duration) {
+	t := time.NewTicker(retentionInterval)
+	defer t.Stop()
+	for {
+		files, size, err := cleanupOld(root, time.Now().Add(-retention))
+		if err != nil {
+			slog.Error("retention", "err", err)
+		}
+		slog.Info("retention", "files", files, "bytes", size)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCleanupOld(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"all.m3u8":               "",
+		"2024-01-01T00-00-00.ts": "old",
+		"2024-01-01T00-00-04.ts": "kept",
+		"2024-01-01T00-00-08.ts": "",
+		"2024-01-01T00-00-00.m3u8": "#EXTM3U\n" +
+			"#EXTINF:4.000000,\n2024-01-01T00-00-00.ts\n",
+		"2024-01-01T00-00-00.vtt": "",
+		"2024-01-01T00-00-00.mp4": "",
+		"2024-01-01T00-00-08.m3u8": "#EXTM3U\n" +
+			"#EXTINF:4.000000,\n2024-01-01T00-00-04.ts\n" +
+			"#EXTINF:4.000000,\n2024-01-01T00-00-08.ts\n",
+		"notes.txt": "",
+	}
+	for n, c := range files {
+		if err := os.WriteFile(filepath.Join(root, n), []byte(c), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cutoff := time.Date(2024, 1, 1, 0, 0, 6, 0, time.Local)
+	n, size, err := cleanupOld(root, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 || size != int64(3+len(files["2024-01-01T00-00-00.m3u8"])) {
+		t.Fatalf("got %d files, %d bytes", n, size)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	want := []string{"2024-01-01T00-00-04.ts", "2024-01-01T00-00-08.m3u8", "2024-01-01T00-00-08.ts", "all.m3u8", "notes.txt"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got  %q\nwant %q", got, want)
+	}
+}
+
+func TestCleanupOldDailyDirs(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"2024-01-01/00-00-00.ts": "old",
+		"2024-01-02/00-00-00.ts": "old",
+		"2024-01-02/00-00-04.ts": "kept",
+		"2024-01-02/00-00-08.ts": "",
+		"2024-01-02T00-00-08.m3u8": "#EXTM3U\n" +
+			"#EXTINF:4.000000,\n2024-01-02/00-00-04.ts\n" +
+			"#EXTINF:4.000000,\n2024-01-02/00-00-08.ts\n",
+		"other/2024-01-01T00-00-00.ts": "",
+	}
+	for n, c := range files {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(n)), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, n), []byte(c), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cutoff := time.Date(2024, 1, 2, 0, 0, 6, 0, time.Local)
+	n, size, err := cleanupOld(root, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || size != 6 {
+		t.Fatalf("got %d files, %d bytes", n, size)
+	}
+	var got []string
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if !d.IsDir() {
+			got = append(got, filepath.ToSlash(path[len(root)+1:]))
+		}
+		return nil
+	})
+	want := []string{"2024-01-02/00-00-04.ts", "2024-01-02/00-00-08.ts", "2024-01-02T00-00-08.m3u8", "other/2024-01-01T00-00-00.ts"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got  %q\nwant %q", got, want)
+	}
+	if _, err = os.Stat(filepath.Join(root, "2024-01-01")); !os.IsNotExist(err) {
+		t.Fatalf("expected the empty day directory to be deleted: %v", err)
+	}
+}
+
+func TestDeleteRecording(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"all.m3u8": "#EXTM3U\n" +
+			"#EXTINF:4.000000,\n2024-01-01T00-00-00.ts\n" +
+			"#EXTINF:4.000000,\n2024-01-01T00-00-04.ts\n" +
+			"#EXTINF:4.000000,\n2024-01-01T00-00-08.ts\n",
+		"2024-01-01T00-00-00.ts": "",
+		"2024-01-01T00-00-04.ts": "",
+		"2024-01-01T00-00-08.ts": "",
+		"2024-01-01T00-00-00.m3u8": "#EXTM3U\n" +
+			"#EXTINF:4.000000,\n2024-01-01T00-00-00.ts\n" +
+			"#EXTINF:4.000000,\n2024-01-01T00-00-04.ts\n",
+		"2024-01-01T00-00-00.vtt": "",
+		"2024-01-01T00-00-04.m3u8": "#EXTM3U\n" +
+			"#EXTINF:4.000000,\n2024-01-01T00-00-04.ts\n" +
+			"#EXTINF:4.000000,\n2024-01-01T00-00-08.ts\n",
+	}
+	for n, c := range files {
+		if err := os.WriteFile(filepath.Join(root, n), []byte(c), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := deleteRecording(root, "2024-01-02T00-00-00.m3u8", true); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	n, err := deleteRecording(root, "2024-01-01T00-00-00.m3u8", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The playlist, its track and the first segment, the second is still
+	// referenced.
+	if n != 3 {
+		t.Fatalf("got %d", n)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Name())
+	}
+	want := []string{"2024-01-01T00-00-04.m3u8", "2024-01-01T00-00-04.ts", "2024-01-01T00-00-08.ts", "all.m3u8"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got  %q\nwant %q", got, want)
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "2024-01-01"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	old := now.Add(-time.Minute)
+	for _, n := range []string{
+		"2024-01-01T00-00-00.m3u8.tmp",
+		"2024-01-01T00-00-00.vtt.tmp",
+		"2024-01-01T00-00-00.tmp.mp4",
+		"2024-01-01T00-00-00-preroll.tmp.ts",
+		"2024-01-01T00-00-00.ts",
+		"2024-01-01T00-00-00.m3u8",
+		"2024-01-01/00-00-00.ts.tmp",
+		"2024-01-01/00-00-00.ts",
+		"recent.m3u8.tmp",
+	} {
+		p := filepath.Join(root, n)
+		if err := os.WriteFile(p, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if n != "recent.m3u8.tmp" {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	n, err := removeTempFiles(root, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("got %d", n)
+	}
+	var got []string
+	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if !d.IsDir() {
+			got = append(got, filepath.ToSlash(p[len(root)+1:]))
+		}
+		return nil
+	})
+	want := []string{"2024-01-01/00-00-00.ts", "2024-01-01T00-00-00.m3u8", "2024-01-01T00-00-00.ts", "recent.m3u8.tmp"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got  %q\nwant %q", got, want)
+	}
+}
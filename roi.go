@@ -0,0 +1,124 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// roiPoint is a point in normalized coordinates, between 0 and 1.
+type roiPoint struct {
+	x, y float64
+}
+
+// roi is a list of polygons defining the region of interest for motion
+// detection.
+//
+// It is parsed from a string like "0.1,0.1 0.9,0.1 0.9,0.9". Polygons are
+// separated with ";" or by repeating the flag.
+type roi [][]roiPoint
+
+func (r *roi) Set(v string) error {
+	out := *r
+	for _, poly := range strings.Split(v, ";") {
+		poly = strings.TrimSpace(poly)
+		if poly == "" {
+			continue
+		}
+		var p []roiPoint
+		for _, pt := range strings.Fields(poly) {
+			xs, ys, ok := strings.Cut(pt, ",")
+			if !ok {
+				return fmt.Errorf("invalid point %q; use x,y", pt)
+			}
+			x, err := strconv.ParseFloat(xs, 64)
+			if err != nil {
+				return fmt.Errorf("invalid point %q: %w", pt, err)
+			}
+			y, err := strconv.ParseFloat(ys, 64)
+			if err != nil {
+				return fmt.Errorf("invalid point %q: %w", pt, err)
+			}
+			if x < 0 || x > 1 || y < 0 || y > 1 {
+				return fmt.Errorf("invalid point %q; coordinates must be between 0 and 1", pt)
+			}
+			p = append(p, roiPoint{x, y})
+		}
+		if len(p) < 3 {
+			return fmt.Errorf("invalid polygon %q; it needs at least 3 points", poly)
+		}
+		out = append(out, p)
+	}
+	if len(out) == 0 {
+		return errors.New("empty region of interest")
+	}
+	*r = out
+	return nil
+}
+
+func (r *roi) String() string {
+	var out []string
+	for _, p := range *r {
+		var pts []string
+		for _, pt := range p {
+			pts = append(pts, strconv.FormatFloat(pt.x, 'f', -1, 64)+","+strconv.FormatFloat(pt.y, 'f', -1, 64))
+		}
+		out = append(out, strings.Join(pts, " "))
+	}
+	return strings.Join(out, ";")
+}
+
+// render returns a w x h mask, white inside the polygons and black outside.
+//
+// It uses the even-odd rule for each polygon, sampling the center of each
+// pixel.
+func (r *roi) render(w, h int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	var xs []float64
+	for y := 0; y < h; y++ {
+		cy := (float64(y) + 0.5) / float64(h)
+		for _, p := range *r {
+			// Find where the scanline crosses the edges.
+			xs = xs[:0]
+			for i := range p {
+				a, b := p[i], p[(i+1)%len(p)]
+				if (a.y <= cy) == (b.y <= cy) {
+					continue
+				}
+				xs = append(xs, a.x+(cy-a.y)*(b.x-a.x)/(b.y-a.y))
+			}
+			slices.Sort(xs)
+			for i := 0; i+1 < len(xs); i += 2 {
+				// The pixels whose center is in [xs[i], xs[i+1]).
+				x0 := max(int(math.Ceil(xs[i]*float64(w)-0.5)), 0)
+				x1 := min(int(math.Ceil(xs[i+1]*float64(w)-0.5)), w)
+				for x := x0; x < x1; x++ {
+					img.SetGray(x, y, color.Gray{Y: 255})
+				}
+			}
+		}
+	}
+	return img
+}
+
+// roiDataURI returns the mask as a PNG data URI, which ffmpeg accepts as an
+// input so no file has to be written.
+func roiDataURI(img image.Image) (string, error) {
+	var b bytes.Buffer
+	if err := (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&b, img); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
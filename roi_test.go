@@ -0,0 +1,65 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/base64"
+	"image/png"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestROISet(t *testing.T) {
+	var r roi
+	if err := r.Set("0,0 1,0 1,1; 0,0 0.5,0 0.5,0.5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Set("0.1,0.1 0.2,0.1 0.2,0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 3 {
+		t.Fatal(r)
+	}
+	if got, want := r.String(), "0,0 1,0 1,1;0,0 0.5,0 0.5,0.5;0.1,0.1 0.2,0.1 0.2,0.2"; got != want {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+	for _, v := range []string{"", "0,0 1,0", "0,0 1,0 1,1.5", "0,0 1;0 1,1", "a,0 1,0 1,1"} {
+		var r roi
+		if err := r.Set(v); err == nil {
+			t.Errorf("%q: expected error", v)
+		}
+	}
+}
+
+func TestROIRender(t *testing.T) {
+	var r roi
+	// Lower right triangle and a square in the upper left corner.
+	if err := r.Set("1,0 1,1 0,1;0,0 0.25,0 0.25,0.25 0,0.25"); err != nil {
+		t.Fatal(err)
+	}
+	img := r.render(64, 48)
+	if c := imageCoverage(img); math.Abs(c-(0.5+0.25*0.25)) > 0.02 {
+		t.Fatalf("coverage %f", c)
+	}
+	if img.GrayAt(1, 1).Y != 255 || img.GrayAt(20, 1).Y != 0 || img.GrayAt(63, 47).Y != 255 {
+		t.Fatal("unexpected pixels")
+	}
+	uri, err := roiDataURI(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(uri, "data:image/png;base64,"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := png.Decode(strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.Bounds() != img.Bounds() {
+		t.Fatal(dec.Bounds())
+	}
+}
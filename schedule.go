@@ -0,0 +1,293 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scheduleRange is a daily time range, optionally limited to some weekdays.
+type scheduleRange struct {
+	// days is the weekdays the range starts on. A range crossing midnight
+	// belongs to the day it starts on.
+	days [7]bool
+	// start and end are offsets from midnight. end is before start when the
+	// range crosses midnight.
+	start, end time.Duration
+}
+
+// schedule is a list of time ranges during which something is active.
+//
+// It is parsed from a string like "08:00-18:00" or
+// "mon-fri 08:00-18:00;sat,sun 10:00-14:00". A range like "22:00-06:00"
+// crosses midnight.
+//
+// An empty schedule is always active.
+type schedule []scheduleRange
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func (s *schedule) Set(v string) error {
+	var out schedule
+	for _, item := range strings.Split(v, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		r := scheduleRange{}
+		days, hours, ok := strings.Cut(item, " ")
+		if !ok {
+			hours = days
+			days = ""
+			for i := range r.days {
+				r.days[i] = true
+			}
+		}
+		for _, d := range strings.Split(days, ",") {
+			if d == "" {
+				continue
+			}
+			first, last, _ := strings.Cut(d, "-")
+			if last == "" {
+				last = first
+			}
+			f := slices.Index(weekdays, strings.ToLower(first))
+			l := slices.Index(weekdays, strings.ToLower(last))
+			if f == -1 || l == -1 {
+				return fmt.Errorf("invalid weekday in %q; use %s", d, strings.Join(weekdays, ", "))
+			}
+			for i := f; ; i = (i + 1) % 7 {
+				r.days[i] = true
+				if i == l {
+					break
+				}
+			}
+		}
+		a, b, ok := strings.Cut(strings.TrimSpace(hours), "-")
+		if !ok {
+			return fmt.Errorf("invalid range %q; use a format like 08:00-18:00", hours)
+		}
+		var err error
+		if r.start, err = parseTimeOfDay(a); err != nil {
+			return err
+		}
+		if r.end, err = parseTimeOfDay(b); err != nil {
+			return err
+		}
+		if r.start == r.end {
+			return fmt.Errorf("invalid empty range %q", hours)
+		}
+		out = append(out, r)
+	}
+	if len(out) == 0 {
+		return errors.New("empty schedule")
+	}
+	*s = out
+	return nil
+}
+
+func (s *schedule) String() string {
+	var out []string
+	for _, r := range *s {
+		var days []string
+		for i, d := range r.days {
+			if d {
+				days = append(days, weekdays[i])
+			}
+		}
+		item := formatTimeOfDay(r.start) + "-" + formatTimeOfDay(r.end)
+		if len(days) != 7 {
+			item = strings.Join(days, ",") + " " + item
+		}
+		out = append(out, item)
+	}
+	return strings.Join(out, ";")
+}
+
+// active returns true if t is within the schedule.
+func (s schedule) active(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+	tod := timeOfDay(t)
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, r := range s {
+		if r.start < r.end {
+			if r.days[today] && tod >= r.start && tod < r.end {
+				return true
+			}
+		} else if (r.days[today] && tod >= r.start) || (r.days[yesterday] && tod < r.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the next time after t the schedule changes state.
+//
+// It returns the zero time if the state never changes.
+func (s schedule) next(t time.Time) time.Time {
+	if len(s) == 0 {
+		return time.Time{}
+	}
+	a := s.active(t)
+	// Ranges have a one minute resolution, search for one week.
+	n := t.Truncate(time.Minute)
+	for i := 0; i < 7*24*60; i++ {
+		n = n.Add(time.Minute)
+		if s.active(n) != a {
+			return n
+		}
+	}
+	return time.Time{}
+}
+
+// waitActive waits until the schedule is active.
+func (s schedule) waitActive(ctx context.Context) error {
+	now := time.Now()
+	if s.active(now) {
+		return nil
+	}
+	n := s.next(now)
+	if n.IsZero() {
+		return errors.New("schedule is never active")
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(n)):
+		return nil
+	}
+}
+
+// run runs f during each active period of the schedule, canceling its context
+// at the end of the period. It returns when ctx is canceled or when f returns
+// before the end of its period, e.g. with -d.
+func (s schedule) run(ctx context.Context, f func(ctx context.Context) error) error {
+	for {
+		if err := s.waitActive(ctx); err != nil {
+			return err
+		}
+		n := s.next(time.Now())
+		if n.IsZero() {
+			return f(ctx)
+		}
+		slog.Info("schedule", "active", true, "until", n)
+		ctx2, cancel := context.WithDeadline(ctx, n)
+		err := f(ctx2)
+		ended := ctx2.Err() != nil
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !ended {
+			return err
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		slog.Info("schedule", "active", false, "until", s.next(time.Now()))
+	}
+}
+
+// thresholdBreakpoint is the threshold to use starting at a time of day.
+type thresholdBreakpoint struct {
+	start     time.Duration
+	threshold float32
+}
+
+// thresholdSchedule is a list of motion thresholds by time of day, sorted.
+//
+// It is parsed from a string like "06:00=1.0,20:00=2.5". Each threshold is
+// active from its time until the next one, wrapping around midnight.
+type thresholdSchedule []thresholdBreakpoint
+
+func (s *thresholdSchedule) Set(v string) error {
+	var out thresholdSchedule
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		a, b, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("invalid threshold %q; use a format like 06:00=1.0", item)
+		}
+		start, err := parseTimeOfDay(a)
+		if err != nil {
+			return err
+		}
+		if start >= 24*time.Hour {
+			return fmt.Errorf("invalid time %q; use 00:00 instead", a)
+		}
+		th, err := strconv.ParseFloat(strings.TrimSpace(b), 32)
+		if err != nil || th <= 0 {
+			return fmt.Errorf("invalid threshold %q; must be a positive number", b)
+		}
+		if slices.ContainsFunc(out, func(x thresholdBreakpoint) bool { return x.start == start }) {
+			return fmt.Errorf("duplicate time %q", a)
+		}
+		out = append(out, thresholdBreakpoint{start: start, threshold: float32(th)})
+	}
+	if len(out) == 0 {
+		return errors.New("empty threshold schedule")
+	}
+	slices.SortFunc(out, func(x, y thresholdBreakpoint) int { return int(x.start - y.start) })
+	*s = out
+	return nil
+}
+
+func (s *thresholdSchedule) String() string {
+	var out []string
+	for _, b := range *s {
+		out = append(out, formatTimeOfDay(b.start)+"="+strconv.FormatFloat(float64(b.threshold), 'f', -1, 32))
+	}
+	return strings.Join(out, ",")
+}
+
+// at returns the threshold active at t. Before the first breakpoint of the
+// day, the last one of the previous day is still active.
+func (s thresholdSchedule) at(t time.Time) float32 {
+	tod := timeOfDay(t)
+	out := s[len(s)-1].threshold
+	for _, b := range s {
+		if b.start > tod {
+			break
+		}
+		out = b.threshold
+	}
+	return out
+}
+
+// timeOfDay returns the wall clock time of t in t's location.
+//
+// It is not the elapsed time since midnight, which is off by an hour on the
+// days the clock changes for daylight saving time.
+func timeOfDay(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		if s == "24:00" {
+			return 24 * time.Hour, nil
+		}
+		return 0, fmt.Errorf("invalid time %q; use a format like 08:00", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d/time.Minute)%60)
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	var s schedule
+	if err := s.Set("mon-fri 08:00-18:00;sat 22:00-06:00"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.String(); got != "mon,tue,wed,thu,fri 08:00-18:00;sat 22:00-06:00" {
+		t.Fatal(got)
+	}
+	// 2024-01-01 is a Monday.
+	at := func(day, h, m int) time.Time {
+		return time.Date(2024, 1, day, h, m, 0, 0, time.UTC)
+	}
+	data := []struct {
+		t    time.Time
+		want bool
+	}{
+		{at(1, 7, 59), false},
+		{at(1, 8, 0), true},
+		{at(5, 17, 59), true},
+		{at(5, 18, 0), false},
+		{at(6, 12, 0), false},
+		{at(6, 22, 0), true},
+		{at(7, 5, 59), true},
+		{at(7, 6, 0), false},
+		{at(7, 23, 0), false},
+	}
+	for i, l := range data {
+		if got := s.active(l.t); got != l.want {
+			t.Errorf("#%d: active(%s) = %t", i, l.t, got)
+		}
+	}
+	if got := s.next(at(1, 7, 0)); !got.Equal(at(1, 8, 0)) {
+		t.Fatal(got)
+	}
+	if got := s.next(at(5, 18, 30)); !got.Equal(at(6, 22, 0)) {
+		t.Fatal(got)
+	}
+	if err := s.Set("8:00"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestThresholdSchedule(t *testing.T) {
+	var s thresholdSchedule
+	if err := s.Set("20:00=2.5,06:00=1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.String(); got != "06:00=1,20:00=2.5" {
+		t.Fatal(got)
+	}
+	at := func(h, m int) time.Time {
+		return time.Date(2024, 1, 1, h, m, 0, 0, time.UTC)
+	}
+	data := []struct {
+		t    time.Time
+		want float32
+	}{
+		// Before the first breakpoint, the previous day's last one applies.
+		{at(0, 0), 2.5},
+		{at(5, 59), 2.5},
+		{at(6, 0), 1},
+		{at(19, 59), 1},
+		{at(20, 0), 2.5},
+		{at(23, 59), 2.5},
+	}
+	for i, l := range data {
+		if got := s.at(l.t); got != l.want {
+			t.Errorf("#%d: at(%s) = %g", i, l.t, got)
+		}
+	}
+	// The wall clock is used on the days the clock changes.
+	if loc, err := time.LoadLocation("America/New_York"); err != nil {
+		t.Log(err)
+	} else if got := s.at(time.Date(2024, 3, 10, 6, 30, 0, 0, loc)); got != 1 {
+		t.Errorf("at(DST) = %g", got)
+	}
+	for _, v := range []string{"", "06:00", "06:00=0", "06:00=a", "25:00=1", "06:00=1,06:00=2", "24:00=1"} {
+		var s thresholdSchedule
+		if err := s.Set(v); err == nil {
+			t.Errorf("%q: expected error", v)
+		}
+	}
+}
+
+func TestScheduleRun(t *testing.T) {
+	// An empty schedule runs f once with the parent context.
+	var s schedule
+	n := 0
+	want := errors.New("done")
+	if err := s.run(context.Background(), func(ctx context.Context) error {
+		n++
+		if _, ok := ctx.Deadline(); ok {
+			t.Error("unexpected deadline")
+		}
+		return want
+	}); err != want || n != 1 {
+		t.Fatal(err, n)
+	}
+	// f returning before the end of the period stops the loop.
+	if err := s.Set("00:00-23:59"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.active(time.Now()) {
+		t.Skip("outside of the schedule")
+	}
+	n = 0
+	if err := s.run(context.Background(), func(ctx context.Context) error {
+		n++
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected a deadline")
+		}
+		return nil
+	}); err != nil || n != 1 {
+		t.Fatal(err, n)
+	}
+}
@@ -6,19 +6,29 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
 	"log/slog"
+	"math"
 	"mime/multipart"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
@@ -28,29 +38,312 @@ var (
 	//go:embed html/list.html
 	listHTML []byte
 
+	//go:embed html/live.html
+	liveHTML []byte
+
 	// Injected data to speed up page load, versus having to do an API call.
 	dataTmpl = template.Must(template.New("").Parse("<script>'use strict';const data = {{.}};</script>"))
 )
 
+// rawPath returns the file name relative to root for a /raw/ URL path.
+//
+// It refuses any path outside of root, except a day directory for segments,
+// and only accepts .m3u8, .ts, .vtt, .mpd, .m4s, .mp4, .jpg and .gif files.
+func rawPath(path string) (string, bool) {
+	f := strings.TrimPrefix(path, "/raw/")
+	n := f
+	if dir, rest, ok := strings.Cut(f, "/"); ok && strings.HasSuffix(rest, ".ts") {
+		if _, err := time.Parse(time.DateOnly, dir); err == nil {
+			n = rest
+		}
+	}
+	if strings.Contains(n, "/") || strings.Contains(n, "\\") || strings.Contains(n, "..") || (!strings.HasSuffix(n, ".m3u8") && !strings.HasSuffix(n, ".ts") && !strings.HasSuffix(n, ".vtt") && !strings.HasSuffix(n, ".mpd") && !strings.HasSuffix(n, ".m4s") && !strings.HasSuffix(n, ".mp4") && !strings.HasSuffix(n, ".jpg") && !strings.HasSuffix(n, ".gif")) {
+		return "", false
+	}
+	return f, true
+}
+
+// fileFilter restricts the files listed by /videos and /list, as specified
+// with the ?from=, ?to= and ?limit= query arguments.
+type fileFilter struct {
+	// from is inclusive and to is exclusive. Zero means unbounded.
+	from, to time.Time
+	// limit is the maximum number of files returned, the newest ones. 0 means
+	// unlimited.
+	limit int
+}
+
+// filterTimeFormats is the formats accepted for ?from= and ?to=, in local
+// time.
+var filterTimeFormats = []string{time.DateOnly, "2006-01-02T15:04", "2006-01-02T15:04:05"}
+
+// parseFileFilter parses the query arguments of /videos and /list.
+//
+// A date without a time for ?to= includes the whole day.
+func parseFileFilter(q url.Values) (fileFilter, error) {
+	var f fileFilter
+	for _, k := range []string{"from", "to"} {
+		v := q.Get(k)
+		if v == "" {
+			continue
+		}
+		var t time.Time
+		var err error
+		for _, layout := range filterTimeFormats {
+			if t, err = time.ParseInLocation(layout, v, time.Local); err == nil {
+				if k == "to" && layout == time.DateOnly {
+					t = t.AddDate(0, 0, 1)
+				}
+				break
+			}
+		}
+		if err != nil {
+			return f, fmt.Errorf("invalid %s %q; use YYYY-MM-DD or YYYY-MM-DDTHH:MM", k, v)
+		}
+		if k == "from" {
+			f.from = t
+		} else {
+			f.to = t
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if f.limit, err = strconv.Atoi(v); err != nil || f.limit < 0 {
+			return f, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	return f, nil
+}
+
+// apply returns the files in the time range sorted by time, and the time of
+// the oldest file returned when older files were left out because of the
+// limit.
+//
+// The files which name is not a time are only returned when there is no
+// filter.
+func (f *fileFilter) apply(files []string) ([]string, time.Time) {
+	if f.from.IsZero() && f.to.IsZero() && f.limit == 0 {
+		return files, time.Time{}
+	}
+	type file struct {
+		name string
+		t    time.Time
+	}
+	var l []file
+	for _, n := range files {
+		t, err := fileTime(n)
+		if err != nil || (!f.from.IsZero() && t.Before(f.from)) || (!f.to.IsZero() && !t.Before(f.to)) {
+			continue
+		}
+		l = append(l, file{n, t})
+	}
+	sort.SliceStable(l, func(i, j int) bool { return l[i].t.Before(l[j].t) })
+	var older time.Time
+	if f.limit > 0 && len(l) > f.limit {
+		l = l[len(l)-f.limit:]
+		older = l[0].t
+	}
+	out := make([]string, len(l))
+	for i := range l {
+		out[i] = l[i].name
+	}
+	return out, older
+}
+
+// filterData returns the data to inject in the page for the files kept by a
+// fileFilter.
+func filterData(files []string, older time.Time) map[string]any {
+	d := map[string]any{"files": files}
+	if !older.IsZero() {
+		d["older"] = older.Format("2006-01-02T15:04:05")
+	}
+	return d
+}
+
+// serverTLSConfig returns the TLS configuration to serve HTTPS, or nil to
+// serve plain HTTP.
+//
+// Either cert and key or acmeDomain can be specified. With acmeDomain, the
+// certificate is obtained from Let's Encrypt and cached on disk.
+func serverTLSConfig(cert, key, acmeDomain string) (*tls.Config, error) {
+	if (cert == "") != (key == "") {
+		return nil, errors.New("-cert and -key must be used together")
+	}
+	if cert != "" && acmeDomain != "" {
+		return nil, errors.New("-cert and -acme-domain are mutually exclusive")
+	}
+	if cert != "" {
+		c, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{c}, MinVersion: tls.VersionTLS12}, nil
+	}
+	if acmeDomain != "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(acmeDomain),
+			Cache:      autocert.DirCache(filepath.Join(dir, "record-videos", "autocert")),
+		}
+		cfg := m.TLSConfig()
+		cfg.MinVersion = tls.VersionTLS12
+		return cfg, nil
+	}
+	return nil, nil
+}
+
 // startServer starts the web server.
 //
 // It serves:
 // - /mpjpeg to retransmit mime multipart encoded jpeg.
+// - /ws to send the same jpeg frames as WebSocket binary messages.
+// - /live HTML page playing the live HLS stream, falling back to /mpjpeg.
 // - /videos HTML page that contains <video> tags for each .m3u8 file found.
-// - /list HTML page with a link to each .m3u8 file found.
-// - /raw/ to serve individual .m3u8 and .ts files
-func startServer(ctx context.Context, addr string, r io.Reader, root string) error {
-	m := http.ServeMux{}
-	tm := &teeMimePart{}
+// - /list HTML page with a link to each .m3u8, .mpd, .mp4 and .ts file found.
+// - /healthz returns 200 when ffmpeg reported a frame within healthTimeout.
+// - /metrics Prometheus metrics.
+// - /status JSON with the motion state, last event and ffmpeg restarts.
+// - /events Server-Sent Events stream of the motion events.
+// - /debug/clients JSON list of MJPEG clients with their dropped frames count.
+// - /raw/ to serve individual .m3u8, .ts, .vtt, .mpd, .m4s, .mp4, .jpg and .gif
+// files
+// - /clip/<event>.mp4 to download a motion recording as a single MP4 file
+// - /yavg JSON of the recent motion levels, ?stream=1 to stream them as SSE.
+// - DELETE /raw/ to delete a .m3u8 or .ts file, only with authentication
+// - POST /trigger to force a motion event, only with authentication
+// - POST /mask to replace the mask with a PNG and restart ffmpeg, only with
+// authentication
+//
+// With multiple cameras, the routes of each camera are served under
+// /cam/<index>/, e.g. /cam/1/mpjpeg. The first camera is also served at the
+// root. ?cam=<index> can be used instead of the prefix, e.g. /mpjpeg?cam=1,
+// except for the recordings since the playlists use relative URLs.
+//
+// All the routes except /healthz require authentication when auth is enabled.
+// HTTPS is served when tlsConfig is set.
+//
+// The server is shut down when ctx is canceled. The returned function waits
+// for the shutdown to complete.
+func startServer(ctx context.Context, addr string, cams []*camera, healthTimeout time.Duration, auth *httpAuth, tlsConfig *tls.Config) (func() error, error) {
+	handlers := make([]http.Handler, len(cams))
+	for i, c := range cams {
+		handlers[i] = auth.wrap(cameraMux(ctx, c, healthTimeout, auth))
+	}
+	s := http.Server{
+		Handler:     cameraRouter(handlers),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+		ReadTimeout: 10. * time.Second,
+		// The MJPEG streams and /events are long lived, including over TLS.
+		WriteTimeout: 366 * 24 * time.Hour,
+		IdleTimeout:  10. * time.Second,
+		TLSConfig:    tlsConfig,
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("http", "addr", l.Addr(), "tls", tlsConfig != nil)
 	go func() {
-		err2 := tm.listen(ctx, r, "ffmpeg")
-		slog.Info("teeMimePart", "msg", "exit", "err", err2)
+		var err2 error
+		if tlsConfig != nil {
+			// The certificates are already in tlsConfig.
+			err2 = s.ServeTLS(l, "", "")
+		} else {
+			err2 = s.Serve(l)
+		}
+		slog.Info("http", "msg", "exit", "err", err2)
+	}()
+	// Release the port when the context is canceled, e.g. when ffmpeg is
+	// stopped outside of the active hours. The handlers use ctx as their base
+	// context so the /mpjpeg streams terminate promptly.
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		ctx2, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err2 := s.Shutdown(ctx2)
+		if err2 != nil {
+			slog.Warn("http", "msg", "forcing shutdown", "err", err2)
+			err2 = s.Close()
+		}
+		done <- err2
 	}()
+	return func() error { return <-done }, nil
+}
+
+// tooManyClients rejects a streaming request because of -max-clients.
+func tooManyClients(w http.ResponseWriter, req *http.Request, maxClients int) {
+	slog.Warn("http", "remote", req.RemoteAddr, "msg", "too many clients", "max", maxClients)
+	w.Header().Set("Retry-After", "10")
+	http.Error(w, "Too many clients", http.StatusServiceUnavailable)
+}
+
+// camera is the live state of a camera served by the web server.
+type camera struct {
+	// root is the directory containing the camera's recordings.
+	root string
+	// tm is fed by runFFMPEG, it is kept across ffmpeg restarts.
+	tm *teeMimePart
+	// eb is fed by processMotion.
+	eb  *eventBroadcaster
+	met *metrics
+	// trigger is read by filterMotion to force an event.
+	trigger chan triggerRequest
+	// restart is read by runCamera to restart ffmpeg, e.g. to apply a new
+	// mask.
+	restart chan struct{}
+	// mask is the mask file replaced by POST /mask. It is empty when the mask
+	// can't be replaced, e.g. with -roi.
+	mask string
+	// w and h are the frame size, to validate the masks.
+	w, h int
+	// restartMask restarts ffmpeg for all the cameras using mask.
+	restartMask func()
+}
+
+// cameraRouter dispatches the requests to the handler of the camera selected
+// with the /cam/<index>/ prefix or the ?cam=<index> argument, defaulting to
+// the first one.
+func cameraRouter(handlers []http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		i := 0
+		if rest, ok := strings.CutPrefix(req.URL.Path, "/cam/"); ok {
+			n, p, ok := strings.Cut(rest, "/")
+			var err error
+			if i, err = strconv.Atoi(n); err != nil || i < 0 || i >= len(handlers) {
+				http.Error(w, "Unknown camera", http.StatusNotFound)
+				return
+			}
+			if !ok {
+				http.Redirect(w, req, "/cam/"+n+"/", http.StatusFound)
+				return
+			}
+			req = req.Clone(req.Context())
+			req.URL.Path = "/" + p
+			req.URL.RawPath = ""
+		} else if v := req.URL.Query().Get("cam"); v != "" {
+			var err error
+			if i, err = strconv.Atoi(v); err != nil || i < 0 || i >= len(handlers) {
+				http.Error(w, "Unknown camera", http.StatusNotFound)
+				return
+			}
+		}
+		handlers[i].ServeHTTP(w, req)
+	})
+}
 
+// cameraMux returns the routes of a camera, documented at startServer.
+func cameraMux(ctx context.Context, c *camera, healthTimeout time.Duration, auth *httpAuth) *http.ServeMux {
+	tm, eb, met, root := c.tm, c.eb, c.met, c.root
+	m := &http.ServeMux{}
 	go func() {
 		ctx2, cancel := context.WithCancel(ctx)
 		defer cancel()
-		ch := tm.relay(ctx)
+		ch := tm.relay(ctx2, "ready").ch
 		select {
 		case pkt := <-ch:
 			slog.Info("ready", "bytes", len(pkt.b))
@@ -62,6 +355,12 @@ func startServer(ctx context.Context, addr string, r io.Reader, root string) err
 	m.HandleFunc("GET /mpjpeg", func(w http.ResponseWriter, req *http.Request) {
 		start := time.Now()
 		slog.Info("http", "remote", req.RemoteAddr, "method", req.Method, "path", req.URL.Path)
+		ctx2 := req.Context()
+		l := tm.relayClient(ctx2, req.RemoteAddr)
+		if l == nil {
+			tooManyClients(w, req, tm.maxClients)
+			return
+		}
 		mw := multipart.NewWriter(w)
 		defer mw.Close()
 		h := w.Header()
@@ -71,8 +370,7 @@ func startServer(ctx context.Context, addr string, r io.Reader, root string) err
 		h.Set("Pragma", "no-cache")
 		h.Set("Expires", "0")
 		w.WriteHeader(200)
-		ctx2 := req.Context()
-		ch := tm.relay(ctx2)
+		ch := l.ch
 		done := ctx2.Done()
 		i := 0
 		for ; ctx2.Err() == nil; i++ {
@@ -90,7 +388,55 @@ func startServer(ctx context.Context, addr string, r io.Reader, root string) err
 			case <-done:
 			}
 		}
-		slog.Info("http", "remote", req.RemoteAddr, "d", time.Since(start).Round(100*time.Millisecond), "ctx1", ctx.Err(), "ctx2", ctx2.Err(), "num_img", i)
+		slog.Info("http", "remote", req.RemoteAddr, "d", time.Since(start).Round(100*time.Millisecond), "ctx1", ctx.Err(), "ctx2", ctx2.Err(), "num_img", i, "dropped", l.dropped.Load())
+	})
+	// JPEG frames as WebSocket binary messages, for browsers and proxies that
+	// do not handle multipart/x-mixed-replace well.
+	m.HandleFunc("GET /ws", func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		slog.Info("http", "remote", req.RemoteAddr, "method", req.Method, "path", req.URL.Path)
+		ctx2, cancel := context.WithCancel(req.Context())
+		defer cancel()
+		l := tm.relayClient(ctx2, req.RemoteAddr)
+		if l == nil {
+			tooManyClients(w, req, tm.maxClients)
+			return
+		}
+		ws, err := wsUpgrade(w, req)
+		if err != nil {
+			slog.Warn("http", "remote", req.RemoteAddr, "err", err)
+			return
+		}
+		defer ws.close()
+		go func() {
+			// The listener is removed once the client closes the socket.
+			defer cancel()
+			err2 := ws.readLoop()
+			slog.Debug("http", "remote", req.RemoteAddr, "msg", "websocket closed", "err", err2)
+		}()
+		t := time.NewTicker(wsPingInterval)
+		defer t.Stop()
+		i := 0
+	loop:
+		for {
+			select {
+			case p, ok := <-l.ch:
+				if !ok {
+					break loop
+				}
+				if err = ws.write(wsBinary, p.b); err != nil {
+					break loop
+				}
+				i++
+			case <-t.C:
+				if err = ws.write(wsPing, nil); err != nil {
+					break loop
+				}
+			case <-ctx2.Done():
+				break loop
+			}
+		}
+		slog.Info("http", "remote", req.RemoteAddr, "d", time.Since(start).Round(100*time.Millisecond), "num_img", i, "dropped", l.dropped.Load(), "err", err)
 	})
 	// Serve a single image.
 	m.HandleFunc("GET /jpeg", func(w http.ResponseWriter, req *http.Request) {
@@ -102,7 +448,7 @@ func startServer(ctx context.Context, addr string, r io.Reader, root string) err
 		h.Set("Pragma", "no-cache")
 		h.Set("Expires", "0")
 		ctx2 := req.Context()
-		ch := tm.relay(ctx2)
+		ch := tm.relay(ctx2, req.RemoteAddr).ch
 		done := ctx2.Done()
 		select {
 		case p := <-ch:
@@ -124,6 +470,78 @@ func startServer(ctx context.Context, addr string, r io.Reader, root string) err
 		}
 	})
 
+	// Liveness.
+	m.HandleFunc("GET /healthz", func(w http.ResponseWriter, req *http.Request) {
+		h := w.Header()
+		h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+		h.Set("Content-Type", "application/json")
+		age, ok := met.frameAge(time.Now())
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "no frame received yet"})
+			return
+		}
+		if age > healthTimeout {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "ffmpeg is stalled", "last_frame": age.Round(time.Second).String() + " ago"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"last_frame": age.Round(time.Millisecond).String() + " ago"})
+	})
+
+	// Prometheus metrics.
+	m.HandleFunc("GET /metrics", func(w http.ResponseWriter, req *http.Request) {
+		h := w.Header()
+		h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+		h.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = met.writePrometheus(w, tm.clientStats())
+	})
+
+	// Programmatic counterpart to /healthz.
+	m.HandleFunc("GET /status", func(w http.ResponseWriter, req *http.Request) {
+		h := w.Header()
+		h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+		h.Set("Pragma", "no-cache")
+		h.Set("Expires", "0")
+		h.Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(met.status(time.Now()))
+	})
+
+	// Motion events as they happen.
+	m.HandleFunc("GET /events", func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		slog.Info("http", "remote", req.RemoteAddr, "method", req.Method, "path", req.URL.Path)
+		n := serveSSE(w, req, eb)
+		slog.Info("http", "remote", req.RemoteAddr, "d", time.Since(start).Round(100*time.Millisecond), "events", n)
+	})
+
+	// Motion levels, to tune the threshold.
+	m.HandleFunc("GET /yavg", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("stream") == "1" {
+			start := time.Now()
+			slog.Info("http", "remote", req.RemoteAddr, "method", req.Method, "path", req.URL.Path)
+			n := serveSSE(w, req, &met.samples.eb)
+			slog.Info("http", "remote", req.RemoteAddr, "d", time.Since(start).Round(100*time.Millisecond), "samples", n)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"threshold": math.Float32frombits(met.threshold.Load()),
+			"samples":   met.samples.get(),
+		})
+	})
+
+	// Frames dropped per MJPEG client, to diagnose slow clients.
+	m.HandleFunc("GET /debug/clients", func(w http.ResponseWriter, req *http.Request) {
+		h := w.Header()
+		h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+		h.Set("Pragma", "no-cache")
+		h.Set("Expires", "0")
+		h.Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(tm.stats())
+	})
+
 	// Video serving.
 	m.HandleFunc("GET /raw/", func(w http.ResponseWriter, req *http.Request) {
 		path, err2 := url.QueryUnescape(req.URL.Path)
@@ -132,37 +550,181 @@ func startServer(ctx context.Context, addr string, r io.Reader, root string) err
 			http.Error(w, "Invalid path", 404)
 			return
 		}
-		f := path[len("/raw/"):]
-		// Limit to not path, only .m3u8 and .ts.
-		if strings.Contains(f, "/") || strings.Contains(f, "\\") || strings.Contains(f, "..") || (!strings.HasSuffix(f, ".m3u8") && !strings.HasSuffix(f, ".ts")) {
+		f, ok := rawPath(path)
+		if !ok {
 			slog.Error("http", "path", req.URL.Path)
 			http.Error(w, "Invalid path", 404)
 			return
 		}
 
 		// Cache for a long time, the exception is m3u8 since it could be a live
-		// playlist.
-		if h := w.Header(); strings.HasSuffix(f, ".m3u8") {
+		// playlist and vtt since it is rewritten along the motion playlist.
+		h := w.Header()
+		if strings.HasSuffix(f, ".m3u8") || strings.HasSuffix(f, ".vtt") || strings.HasSuffix(f, ".mpd") {
 			h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
 			h.Set("Pragma", "no-cache")
 			h.Set("Expires", "0")
 		} else {
 			h.Set("Cache-Control", "public, max-age=86400")
 		}
+		// These are not known by mime.TypeByExtension.
+		if strings.HasSuffix(f, ".mpd") {
+			h.Set("Content-Type", "application/dash+xml")
+		} else if strings.HasSuffix(f, ".m4s") {
+			h.Set("Content-Type", "video/iso.segment")
+		}
 		http.ServeFile(w, req, filepath.Join(root, f))
 	})
 
+	// Motion recording as a single file, muxed on the fly.
+	m.HandleFunc("GET /clip/{name}", func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		name := req.PathValue("name")
+		base, ok := strings.CutSuffix(name, ".mp4")
+		playlist, ok2 := rawPath("/raw/" + base + ".m3u8")
+		if !ok || !ok2 || base == "all" {
+			slog.Error("http", "path", req.URL.Path)
+			http.Error(w, "Invalid path", 404)
+			return
+		}
+		files, err2 := playlistSegments(root, playlist)
+		if err2 != nil || len(files) == 0 {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		h := w.Header()
+		h.Set("Content-Type", "video/mp4")
+		h.Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		h.Set("Cache-Control", "public, max-age=86400")
+		cmd := cmdFFMPEG(req.Context(), root, buildClipStreamCmd(files), nil, ffmpegStderr)
+		cmd.Stdout = w
+		if err2 = cmd.Run(); err2 != nil {
+			// The headers are likely already sent.
+			slog.Error("http", "path", req.URL.Path, "err", err2)
+			return
+		}
+		slog.Info("http", "remote", req.RemoteAddr, "path", req.URL.Path, "segments", len(files), "d", time.Since(start).Round(100*time.Millisecond))
+	})
+
+	// Deletion, only when authentication is enabled.
+	m.HandleFunc("DELETE /raw/", func(w http.ResponseWriter, req *http.Request) {
+		if !auth.enabled() {
+			http.Error(w, "Deletion requires authentication to be enabled", http.StatusForbidden)
+			return
+		}
+		path, err2 := url.QueryUnescape(req.URL.Path)
+		if err2 != nil {
+			http.Error(w, "Invalid path", 404)
+			return
+		}
+		f, ok := rawPath(path)
+		if !ok || (!strings.HasSuffix(f, ".m3u8") && !strings.HasSuffix(f, ".ts")) || f == "all.m3u8" {
+			slog.Error("http", "method", req.Method, "path", req.URL.Path)
+			http.Error(w, "Invalid path", 404)
+			return
+		}
+		n, err2 := deleteRecording(root, f, req.URL.Query().Get("segments") == "1")
+		if errors.Is(err2, os.ErrNotExist) {
+			http.Error(w, "Not found", 404)
+			return
+		}
+		if err2 != nil {
+			slog.Error("http", "method", req.Method, "path", req.URL.Path, "err", err2)
+			http.Error(w, "Failed to delete", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("http", "remote", req.RemoteAddr, "method", req.Method, "path", req.URL.Path, "files", n)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]int{"deleted": n})
+	})
+
+	m.HandleFunc("POST /trigger", func(w http.ResponseWriter, req *http.Request) {
+		if !auth.enabled() {
+			http.Error(w, "Trigger requires authentication to be enabled", http.StatusForbidden)
+			return
+		}
+		d := triggerDuration
+		if v := req.URL.Query().Get("d"); v != "" {
+			var err2 error
+			if d, err2 = time.ParseDuration(v); err2 != nil || d <= 0 || d > triggerMax {
+				http.Error(w, "Invalid duration", http.StatusBadRequest)
+				return
+			}
+		}
+		reply := make(chan triggerReply, 1)
+		ctx2, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+		defer cancel()
+		select {
+		case c.trigger <- triggerRequest{d: d, reply: reply}:
+		case <-ctx2.Done():
+			http.Error(w, "Motion detection is not running", http.StatusServiceUnavailable)
+			return
+		}
+		var r triggerReply
+		select {
+		case r = <-reply:
+		case <-ctx2.Done():
+			http.Error(w, "Motion detection is not running", http.StatusServiceUnavailable)
+			return
+		}
+		slog.Info("http", "remote", req.RemoteAddr, "method", req.Method, "path", req.URL.Path, "d", d, "playlist", r.Playlist, "stopped", r.Stopped)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&r)
+	})
+
+	m.HandleFunc("POST /mask", func(w http.ResponseWriter, req *http.Request) {
+		if !auth.enabled() {
+			http.Error(w, "Mask requires authentication to be enabled", http.StatusForbidden)
+			return
+		}
+		if c.mask == "" {
+			http.Error(w, "The mask can only be replaced when -mask is a PNG file or URL, without -mask-normalize", http.StatusConflict)
+			return
+		}
+		b, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxMaskSize))
+		if err != nil {
+			http.Error(w, "Mask is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err = checkMask(b, c.w, c.h); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = writeMask(c.mask, b); err != nil {
+			slog.Error("http", "path", req.URL.Path, "err", err)
+			http.Error(w, "Failed to write the mask", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("http", "remote", req.RemoteAddr, "method", req.Method, "path", req.URL.Path, "mask", c.mask, "bytes", len(b))
+		// ffmpeg reads the mask when it starts.
+		c.restartMask()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]bool{"restarting": true})
+	})
+
 	// HTML
 	m.HandleFunc("GET /list", func(w http.ResponseWriter, req *http.Request) {
+		ff, err := parseFileFilter(req.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		var files []string
 		offset := len(root) + 1
 		_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
-			if !d.IsDir() && strings.HasSuffix(path, ".m3u8") || strings.HasSuffix(path, ".ts") {
-				files = append(files, path[offset:])
+			if err != nil {
+				return nil
+			}
+			if isTempFile(path) {
+				return nil
+			}
+			if !d.IsDir() && (strings.HasSuffix(path, ".m3u8") || strings.HasSuffix(path, ".mpd") || strings.HasSuffix(path, ".mp4") || strings.HasSuffix(path, ".ts")) {
+				files = append(files, filepath.ToSlash(path[offset:]))
 			}
 			return nil
 		})
 		sort.Strings(files)
+		files, older := ff.apply(files)
 		h := w.Header()
 		h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
 		h.Set("Pragma", "no-cache")
@@ -171,18 +733,47 @@ func startServer(ctx context.Context, addr string, r io.Reader, root string) err
 		if _, err2 := w.Write(listHTML); err2 != nil {
 			return
 		}
-		_ = dataTmpl.Execute(w, map[string]any{"files": files})
+		_ = dataTmpl.Execute(w, filterData(files, older))
 	})
 	m.HandleFunc("GET /videos", func(w http.ResponseWriter, req *http.Request) {
-		var files []string
+		ff, err := parseFileFilter(req.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var files, vtt, posters []string
 		offset := len(root) + 1
 		_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d == nil {
+				return nil
+			}
+			// The day directories only contain segments.
+			if d.IsDir() && path != root {
+				return fs.SkipDir
+			}
+			if isTempFile(path) {
+				return nil
+			}
 			if !d.IsDir() && strings.HasSuffix(path, ".m3u8") {
 				files = append(files, path[offset:])
+			} else if !d.IsDir() && strings.HasSuffix(path, ".vtt") {
+				vtt = append(vtt, path[offset:])
+			} else if !d.IsDir() && strings.HasSuffix(path, ".jpg") {
+				// The snapshots are filtered out below.
+				posters = append(posters, path[offset:])
 			}
 			return nil
 		})
 		sort.Strings(files)
+		files, older := ff.apply(files)
+		// Only send the subtitles and the posters of the files kept.
+		kept := make(map[string]bool, len(files))
+		for _, f := range files {
+			kept[strings.TrimSuffix(f, ".m3u8")] = true
+		}
+		notKept := func(v string) bool { return !kept[strings.TrimSuffix(v, filepath.Ext(v))] }
+		vtt = slices.DeleteFunc(vtt, notKept)
+		posters = slices.DeleteFunc(posters, notKept)
 		h := w.Header()
 		h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
 		h.Set("Pragma", "no-cache")
@@ -191,7 +782,28 @@ func startServer(ctx context.Context, addr string, r io.Reader, root string) err
 		if _, err2 := w.Write(videosHTML); err2 != nil {
 			return
 		}
-		_ = dataTmpl.Execute(w, map[string]any{"files": files})
+		d := filterData(files, older)
+		d["vtt"] = vtt
+		d["posters"] = posters
+		_ = dataTmpl.Execute(w, d)
+	})
+
+	m.HandleFunc("GET /live", func(w http.ResponseWriter, req *http.Request) {
+		// The page falls back to /mpjpeg without a HLS playlist, e.g. with
+		// -container dash.
+		playlist := ""
+		if _, err := os.Stat(filepath.Join(c.root, "all.m3u8")); err == nil {
+			playlist = "raw/all.m3u8"
+		}
+		h := w.Header()
+		h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+		h.Set("Pragma", "no-cache")
+		h.Set("Expires", "0")
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		if _, err2 := w.Write(liveHTML); err2 != nil {
+			return
+		}
+		_ = dataTmpl.Execute(w, map[string]any{"playlist": playlist})
 	})
 
 	m.HandleFunc("GET /", func(w http.ResponseWriter, req *http.Request) {
@@ -202,23 +814,47 @@ func startServer(ctx context.Context, addr string, r io.Reader, root string) err
 		slog.Error("http", "path", req.URL.Path)
 		http.Error(w, "Not found", http.StatusNotFound)
 	})
-	s := http.Server{
-		Handler:      &m,
-		BaseContext:  func(net.Listener) context.Context { return ctx },
-		ReadTimeout:  10. * time.Second,
-		WriteTimeout: 366 * 24 * time.Hour,
-		IdleTimeout:  10. * time.Second,
+	return m
+}
+
+// serveSSE streams the messages published on eb as server-sent events until
+// the client disconnects. It returns the number of messages sent.
+func serveSSE(w http.ResponseWriter, req *http.Request, eb *eventBroadcaster) int {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return 0
 	}
-	l, err := net.Listen("tcp", addr)
-	if err != nil {
-		return err
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
+	h.Set("Pragma", "no-cache")
+	h.Set("Expires", "0")
+	w.WriteHeader(200)
+	f.Flush()
+	ctx := req.Context()
+	ch := eb.subscribe(ctx)
+	// Keep the connection alive through proxies.
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+	n := 0
+	for {
+		select {
+		case d, ok := <-ch:
+			if !ok {
+				return n
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", d); err != nil {
+				return n
+			}
+			n++
+		case <-t.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return n
+			}
+		case <-ctx.Done():
+			return n
+		}
+		f.Flush()
 	}
-	slog.Info("http", "addr", l.Addr())
-	go func() {
-		err2 := s.Serve(l)
-		slog.Info("http", "msg", "exit", "err", err2)
-	}()
-	// TODO: clean shutdown.
-	//s.Shutdown(context.Background())
-	return nil
 }
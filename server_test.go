@@ -0,0 +1,341 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartServerShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wait, err := startServer(ctx, "127.0.0.1:0", []*camera{{root: t.TempDir(), tm: &teeMimePart{}, eb: &eventBroadcaster{}, met: &metrics{}}}, 15*time.Second, &httpAuth{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	start := time.Now()
+	if err = wait(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("took %s", d)
+	}
+}
+
+func TestCameraRouter(t *testing.T) {
+	var handlers []http.Handler
+	for i := 0; i < 2; i++ {
+		handlers = append(handlers, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "%d %s", i, req.URL.Path)
+		}))
+	}
+	r := cameraRouter(handlers)
+	data := []struct {
+		path string
+		code int
+		want string
+	}{
+		{"/mpjpeg", 200, "0 /mpjpeg"},
+		{"/mpjpeg?cam=1", 200, "1 /mpjpeg"},
+		{"/cam/1/raw/all.m3u8", 200, "1 /raw/all.m3u8"},
+		{"/cam/0/", 200, "0 /"},
+		{"/cam/1", http.StatusFound, ""},
+		{"/cam/2/mpjpeg", 404, ""},
+		{"/mpjpeg?cam=a", 404, ""},
+	}
+	for _, l := range data {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", l.path, nil))
+		if w.Code != l.code || (l.want != "" && w.Body.String() != l.want) {
+			t.Errorf("%s: %d %q", l.path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	if c, err := serverTLSConfig("", "", ""); c != nil || err != nil {
+		t.Fatal(c, err)
+	}
+	if _, err := serverTLSConfig("cert.pem", "", ""); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := serverTLSConfig("cert.pem", "key.pem", "example.com"); err == nil {
+		t.Fatal("expected error")
+	}
+	if c, err := serverTLSConfig("", "", "example.com"); c == nil || err != nil || c.GetCertificate == nil {
+		t.Fatal(c, err)
+	}
+
+	// Self-signed certificate.
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cert := filepath.Join(dir, "cert.pem")
+	key := filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: k}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := serverTLSConfig(cert, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Certificates) != 1 {
+		t.Fatal(c.Certificates)
+	}
+}
+
+func TestRawPath(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"/raw/2024-01-02T03-04-05.m3u8", "2024-01-02T03-04-05.m3u8"},
+		{"/raw/2024-01-02/03-04-05.ts", "2024-01-02/03-04-05.ts"},
+		{"/raw/2024-01-02T03-04-05-motion.jpg", "2024-01-02T03-04-05-motion.jpg"},
+		{"/raw/../etc/passwd", ""},
+		{"/raw/foo/03-04-05.ts", ""},
+		{"/raw/2024-01-02/03-04-05.m3u8", ""},
+		{"/raw/..m3u8", ""},
+		{"/raw/notes.txt", ""},
+	}
+	for _, l := range data {
+		got, ok := rawPath(l.in)
+		if got != l.want || ok != (l.want != "") {
+			t.Errorf("rawPath(%q) = %q, %t", l.in, got, ok)
+		}
+	}
+}
+
+func TestMJPEGMaxClients(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &camera{root: t.TempDir(), tm: &teeMimePart{maxClients: 1}, eb: &eventBroadcaster{}, met: &metrics{}}
+	if c.tm.relayClient(ctx, "other") == nil {
+		t.Fatal("expected a listener")
+	}
+	w := httptest.NewRecorder()
+	cameraMux(ctx, c, time.Second, &httpAuth{}).ServeHTTP(w, httptest.NewRequest("GET", "/mpjpeg", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatal(w.Code, w.Header())
+	}
+}
+
+func TestLivePage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &camera{root: t.TempDir(), tm: &teeMimePart{}, eb: &eventBroadcaster{}, met: &metrics{}}
+	h := cameraMux(ctx, c, time.Second, &httpAuth{})
+	get := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/live", nil))
+		if w.Code != 200 {
+			t.Fatal(w.Code)
+		}
+		return w.Body.String()
+	}
+	if b := get(); !strings.Contains(b, `"playlist":""`) {
+		t.Fatal(b)
+	}
+	if err := os.WriteFile(filepath.Join(c.root, "all.m3u8"), []byte("#EXTM3U\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if b := get(); !strings.Contains(b, `"playlist":"raw/all.m3u8"`) {
+		t.Fatal(b)
+	}
+}
+
+func TestList(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &camera{root: t.TempDir(), tm: &teeMimePart{}, eb: &eventBroadcaster{}, met: &metrics{}}
+	for _, d := range []string{"2024-01-02", "dir.ts"} {
+		if err := os.Mkdir(filepath.Join(c.root, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range []string{"2024-01-01T00-00-00.ts", "2024-01-01T00-00-00.m3u8", "2024-01-02/00-00-00.ts"} {
+		if err := os.WriteFile(filepath.Join(c.root, n), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := cameraMux(ctx, c, time.Second, &httpAuth{})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/list", nil))
+	if w.Code != 200 {
+		t.Fatal(w.Code)
+	}
+	b := w.Body.String()
+	for _, n := range []string{"2024-01-01T00-00-00.ts", "2024-01-01T00-00-00.m3u8", "2024-01-02/00-00-00.ts"} {
+		if !strings.Contains(b, `"`+n+`"`) {
+			t.Fatalf("%s: %s", n, b)
+		}
+	}
+	// Directories are not files.
+	if strings.Contains(b, `"dir.ts"`) {
+		t.Fatal(b)
+	}
+}
+
+func TestFileFilter(t *testing.T) {
+	files := []string{
+		"2024-01-01T23-00-00.m3u8",
+		"2024-01-02/10-00-00.ts",
+		"2024-01-02T10-00-00.m3u8",
+		"2024-01-02T12-30-00.m3u8",
+		"2024-01-03T00-00-00.m3u8",
+		"all.m3u8",
+	}
+	data := []struct {
+		q     string
+		want  []string
+		older string
+	}{
+		{"", files, ""},
+		{"from=2024-01-02&to=2024-01-02", []string{"2024-01-02/10-00-00.ts", "2024-01-02T10-00-00.m3u8", "2024-01-02T12-30-00.m3u8"}, ""},
+		{"from=2024-01-02T10:00:01", []string{"2024-01-02T12-30-00.m3u8", "2024-01-03T00-00-00.m3u8"}, ""},
+		{"to=2024-01-02T12:30", []string{"2024-01-01T23-00-00.m3u8", "2024-01-02/10-00-00.ts", "2024-01-02T10-00-00.m3u8"}, ""},
+		{"limit=2", []string{"2024-01-02T12-30-00.m3u8", "2024-01-03T00-00-00.m3u8"}, "2024-01-02T12:30:00"},
+		{"limit=10", files[:5], ""},
+	}
+	for _, l := range data {
+		q, err := url.ParseQuery(l.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := parseFileFilter(q)
+		if err != nil {
+			t.Fatal(l.q, err)
+		}
+		got, older := f.apply(files)
+		if !slices.Equal(got, l.want) {
+			t.Errorf("%q: got %q", l.q, got)
+		}
+		if d := filterData(got, older); (d["older"] == nil) != (l.older == "") || (l.older != "" && d["older"] != l.older) {
+			t.Errorf("%q: older %v", l.q, d["older"])
+		}
+	}
+	for _, q := range []string{"from=yesterday", "to=2024-13-01", "limit=-1", "limit=a"} {
+		v, _ := url.ParseQuery(q)
+		if _, err := parseFileFilter(v); err == nil {
+			t.Errorf("%q: expected error", q)
+		}
+	}
+}
+
+func TestTrigger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &camera{root: t.TempDir(), tm: &teeMimePart{}, eb: &eventBroadcaster{}, met: &metrics{}, trigger: make(chan triggerRequest)}
+	post := func(auth *httpAuth, q string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cameraMux(ctx, c, time.Second, auth).ServeHTTP(w, httptest.NewRequest("POST", "/trigger"+q, nil))
+		return w
+	}
+	if w := post(&httpAuth{}, ""); w.Code != http.StatusForbidden {
+		t.Fatal(w.Code)
+	}
+	auth := &httpAuth{token: "secret"}
+	if w := post(auth, "?d=-1s"); w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code)
+	}
+	go func() {
+		tr := <-c.trigger
+		if tr.d != 10*time.Second {
+			t.Errorf("got %s", tr.d)
+		}
+		tr.reply <- triggerReply{Playlist: "2024-01-02T03-04-05.m3u8"}
+	}()
+	w := post(auth, "?d=10s")
+	if w.Code != 200 || w.Body.String() != "{\"playlist\":\"2024-01-02T03-04-05.m3u8\",\"stopped\":false}\n" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestPostMask(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	root := t.TempDir()
+	c := &camera{root: root, tm: &teeMimePart{}, eb: &eventBroadcaster{}, met: &metrics{}, restart: make(chan struct{}, 1), w: 1280, h: 720}
+	c.restartMask = func() { c.restart <- struct{}{} }
+	post := func(auth *httpAuth, b []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cameraMux(ctx, c, time.Second, auth).ServeHTTP(w, httptest.NewRequest("POST", "/mask", bytes.NewReader(b)))
+		return w
+	}
+	mask := encodeMask(t, 640, 360, "png")
+	if w := post(&httpAuth{}, mask); w.Code != http.StatusForbidden {
+		t.Fatal(w.Code)
+	}
+	auth := &httpAuth{token: "secret"}
+	// The mask is not a file.
+	if w := post(auth, mask); w.Code != http.StatusConflict {
+		t.Fatal(w.Code)
+	}
+	c.mask = filepath.Join(root, "mask.png")
+	if w := post(auth, encodeMask(t, 640, 480, "png")); w.Code != http.StatusBadRequest {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if w := post(auth, mask); w.Code != 200 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if b, err := os.ReadFile(c.mask); err != nil || !bytes.Equal(b, mask) {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.restart:
+	default:
+		t.Fatal("ffmpeg was not restarted")
+	}
+}
+
+func TestYAVG(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &camera{root: t.TempDir(), tm: &teeMimePart{}, eb: &eventBroadcaster{}, met: &metrics{}}
+	c.met.setThreshold(1.5)
+	c.met.samples.add(yavgSample{Frame: 3, YAVG: 0.25, Threshold: 1.5})
+	w := httptest.NewRecorder()
+	cameraMux(ctx, c, time.Second, &httpAuth{}).ServeHTTP(w, httptest.NewRequest("GET", "/yavg", nil))
+	if want := `{"samples":[{"frame":3,"t":"0001-01-01T00:00:00Z","yavg":0.25,"threshold":1.5}],"threshold":1.5}` + "\n"; w.Code != 200 || w.Body.String() != want {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// smtpMinInterval is the minimum delay between two emails. -cooldown is used
+// instead when longer.
+const smtpMinInterval = 5 * time.Minute
+
+// smtpMailer sends an email when the motion starts.
+type smtpMailer struct {
+	// addr is host:port. Port 465 uses implicit TLS, the others STARTTLS when
+	// the server supports it.
+	addr     string
+	from     string
+	to       []string
+	user     string
+	password string
+	// interval is the minimum delay between two emails.
+	interval time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// newSMTPMailer returns a mailer for addr, which defaults to port 587.
+func newSMTPMailer(addr, from, to, user, password string, interval time.Duration) (*smtpMailer, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "587")
+	}
+	if from == "" {
+		return nil, errors.New("-smtp-from is required with -smtp-host")
+	}
+	var rcpts []string
+	for _, r := range strings.Split(to, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			rcpts = append(rcpts, r)
+		}
+	}
+	if len(rcpts) == 0 {
+		return nil, errors.New("-smtp-to is required with -smtp-host")
+	}
+	return &smtpMailer{addr: addr, from: from, to: rcpts, user: user, password: password, interval: max(interval, smtpMinInterval)}, nil
+}
+
+// allow returns true if an email can be sent for an event at t, and records
+// it as sent.
+func (s *smtpMailer) allow(t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.last.IsZero() && t.Sub(s.last) < s.interval {
+		return false
+	}
+	s.last = t
+	return true
+}
+
+// buildEmail returns the RFC 5322 message sent when the motion starts. The
+// JPEG photo is attached when set.
+func buildEmail(from string, to []string, name string, t time.Time, yavg float32, photo string, img []byte) []byte {
+	subject := "Motion detected"
+	if name != "" {
+		subject += " on " + name
+	}
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", t.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", w.Boundary())
+	p, _ := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	fmt.Fprintf(p, "%s at %s.\r\nYAVG: %.1f\r\n", subject, t.Format("2006-01-02 15:04:05 MST"), yavg)
+	if len(img) != 0 {
+		p, _ = w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"image/jpeg"},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", filepath.Base(photo))},
+		})
+		e := base64.StdEncoding.EncodeToString(img)
+		for len(e) > 76 {
+			_, _ = p.Write([]byte(e[:76] + "\r\n"))
+			e = e[76:]
+		}
+		_, _ = p.Write([]byte(e + "\r\n"))
+	}
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+// send emails the motion start at t. photo is attached when set.
+//
+// Like runCmd, it gives the delivery at most 1 minute.
+func (s *smtpMailer) send(ctx context.Context, name string, t time.Time, yavg float32, photo string) error {
+	var img []byte
+	if photo != "" {
+		var err error
+		// #nosec G304
+		if img, err = os.ReadFile(photo); err != nil {
+			return err
+		}
+	}
+	msg := buildEmail(s.from, s.to, name, t, yavg, photo, img)
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	host, port, _ := net.SplitHostPort(s.addr)
+	tc := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	var conn net.Conn
+	var err error
+	if port == "465" {
+		d := tls.Dialer{Config: tc}
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+	} else {
+		d := net.Dialer{}
+		conn, err = d.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	// net/smtp doesn't support a context; bound the whole exchange instead.
+	if dl, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(dl)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok && port != "465" {
+		if err = c.StartTLS(tc); err != nil {
+			return err
+		}
+	}
+	if s.user != "" {
+		// PlainAuth refuses to send the password over an unencrypted
+		// connection, except to localhost.
+		if err = c.Auth(smtp.PlainAuth("", s.user, s.password, host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(s.from); err != nil {
+		return err
+	}
+	for _, r := range s.to {
+		if err = c.Rcpt(r); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSMTPMailer(t *testing.T) {
+	s, err := newSMTPMailer("smtp.example.com", "a@example.com", "b@example.com, c@example.com", "", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.addr != "smtp.example.com:587" || len(s.to) != 2 || s.to[1] != "c@example.com" || s.interval != smtpMinInterval {
+		t.Fatalf("unexpected %+v", s)
+	}
+	if _, err = newSMTPMailer("smtp.example.com:25", "", "b@example.com", "", "", 0); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err = newSMTPMailer("smtp.example.com:25", "a@example.com", " ", "", "", 0); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSMTPAllow(t *testing.T) {
+	s := &smtpMailer{interval: 10 * time.Minute}
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if !s.allow(now) {
+		t.Fatal("first email must be sent")
+	}
+	if s.allow(now.Add(9 * time.Minute)) {
+		t.Fatal("expected throttling")
+	}
+	if !s.allow(now.Add(10 * time.Minute)) {
+		t.Fatal("expected an email")
+	}
+}
+
+func TestBuildEmail(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := string(buildEmail("a@example.com", []string{"b@example.com", "c@example.com"}, "door", ts, 1.5, "/x/2024-01-02T03-04-05-motion.jpg", []byte("jpeg")))
+	for _, want := range []string{
+		"From: a@example.com\r\n",
+		"To: b@example.com, c@example.com\r\n",
+		"Subject: Motion detected on door\r\n",
+		"Date: Tue, 02 Jan 2024 03:04:05 +0000\r\n",
+		"Motion detected on door at 2024-01-02 03:04:05 UTC.\r\nYAVG: 1.5\r\n",
+		"Content-Disposition: attachment; filename=\"2024-01-02T03-04-05-motion.jpg\"",
+		"anBlZw==\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Fatalf("missing %q in:\n%s", want, msg)
+		}
+	}
+	if msg = string(buildEmail("a@example.com", []string{"b@example.com"}, "", ts, 1.5, "", nil)); strings.Contains(msg, "attachment") {
+		t.Fatalf("unexpected attachment:\n%s", msg)
+	}
+}
+
+func TestSMTPSend(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	got := make(chan []string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		r := bufio.NewReader(conn)
+		_, _ = conn.Write([]byte("220 localhost ESMTP\r\n"))
+		data := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				break
+			}
+			line = strings.TrimRight(line, "\r\n")
+			lines = append(lines, line)
+			switch {
+			case data:
+				if line == "." {
+					data = false
+					_, _ = conn.Write([]byte("250 OK\r\n"))
+				}
+			case strings.HasPrefix(line, "EHLO"):
+				_, _ = conn.Write([]byte("250-localhost\r\n250 8BITMIME\r\n"))
+			case line == "DATA":
+				data = true
+				_, _ = conn.Write([]byte("354 Go ahead\r\n"))
+			case line == "QUIT":
+				_, _ = conn.Write([]byte("221 Bye\r\n"))
+				got <- lines
+				return
+			default:
+				_, _ = conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+		got <- lines
+	}()
+	photo := filepath.Join(t.TempDir(), "a.jpg")
+	if err = os.WriteFile(photo, []byte("jpeg"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSMTPMailer(l.Addr().String(), "a@example.com", "b@example.com", "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.send(context.Background(), "door", time.Now(), 1.5, photo); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Join(<-got, "\n")
+	for _, want := range []string{"MAIL FROM:<a@example.com>", "RCPT TO:<b@example.com>", "DATA", "Subject: Motion detected on door", "QUIT"} {
+		if !strings.Contains(lines, want) {
+			t.Fatalf("missing %q in:\n%s", want, lines)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotName returns the name of the snapshot taken when the motion started
+// at t.
+func snapshotName(t time.Time) string {
+	return t.Format("2006-01-02T15-04-05") + "-motion.jpg"
+}
+
+// saveSnapshot writes a JPEG of the current frame in root and returns its
+// name.
+//
+// The last MJPEG frame is used when tm is running. Otherwise the last frame of
+// the most recent segment is extracted with ffmpeg; the camera can't be opened
+// a second time.
+func saveSnapshot(ctx context.Context, root string, tm *teeMimePart, t time.Time) (string, error) {
+	name := snapshotName(t)
+	if tm != nil {
+		if b := tm.lastFrame(); len(b) != 0 {
+			return name, os.WriteFile(filepath.Join(root, name), b, 0o644)
+		}
+	}
+	files, err := findTSFiles(root, t.Add(-30*time.Second), t.Add(time.Minute))
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", errors.New("no frame available")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	args := []string{
+		"ffmpeg", "-hide_banner", "-nostats", "-loglevel", "repeat+warning", "-y",
+		// The segment is likely still being written.
+		"-sseof", "-1",
+		"-i", files[len(files)-1],
+		"-frames:v", "1", "-q:v", "2", "-update", "1",
+		name,
+	}
+	if err = cmdFFMPEG(ctx, root, args, nil, ffmpegStderr).Run(); err != nil {
+		return "", fmt.Errorf("failed to extract the snapshot: %w", err)
+	}
+	return name, nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveSnapshot(t *testing.T) {
+	root := t.TempDir()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+	// No MJPEG stream nor segment.
+	if _, err := saveSnapshot(context.Background(), root, nil, now); err == nil {
+		t.Fatal("expected error")
+	}
+	tm := &teeMimePart{}
+	tm.last = mimePart{hdr: textproto.MIMEHeader{"Content-Type": {"image/jpeg"}}, b: []byte("jpeg")}
+	name, err := saveSnapshot(context.Background(), root, tm, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "2024-01-02T03-04-05-motion.jpg" {
+		t.Fatal(name)
+	}
+	b, err := os.ReadFile(filepath.Join(root, name))
+	if err != nil || string(b) != "jpeg" {
+		t.Fatalf("%q, %v", b, err)
+	}
+	if ft, err := fileTime(name); err != nil || !ft.Equal(now) {
+		t.Fatalf("%s, %v", ft, err)
+	}
+}
@@ -5,14 +5,30 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"io"
+	"log/slog"
 	"mime/multipart"
 	"net/textproto"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// mpjpegBoundary is the boundary ffmpeg is told to use for the mpjpeg stream.
+const mpjpegBoundary = "ffmpeg"
+
+// peakWindow is the window over which the best frame is selected when
+// teeMimePart.peak is set.
+const peakWindow = time.Second
+
+// defaultMaxPartSize is large enough for a 4K JPEG at high quality.
+const defaultMaxPartSize = 16 << 20
+
 type mimePart struct {
 	hdr textproto.MIMEHeader
 	b   []byte
@@ -21,20 +37,81 @@ type mimePart struct {
 type listener struct {
 	ctx context.Context
 	ch  chan mimePart
+	// name identifies the listener, e.g. the remote address.
+	name string
+	// dropped is the number of frames that were dropped because the listener
+	// was too slow.
+	dropped atomic.Int64
+	// client is set for the listeners counted against maxClients.
+	client bool
+}
+
+// clientStats is a snapshot of the clients of a teeMimePart.
+type clientStats struct {
+	// current and peak are the current and the highest number of clients.
+	current, peak int
+	// dropped is the number of frames dropped for all the listeners, including
+	// the ones that are gone.
+	dropped int64
+	// rejected is the number of clients rejected because of maxClients.
+	rejected int64
+}
+
+// listenerStats is a snapshot of a listener's state.
+type listenerStats struct {
+	Name    string `json:"name"`
+	Dropped int64  `json:"dropped"`
 }
 
 // teeMimePart duplicates mime multipart to multiple readers.
 type teeMimePart struct {
+	// maxPartSize is the maximum size of a part. Larger parts are skipped. It
+	// protects against unbounded memory usage if the stream is malformed.
+	// Defaults to defaultMaxPartSize.
+	maxPartSize int64
+	// peak is optional. When set, it returns the score of the part being
+	// received and only the part with the highest score in each peakWindow is
+	// relayed.
+	peak func() float32
+	// decorate is optional. When set, it transforms each part relayed, e.g. to
+	// draw the bounding box of the motion.
+	decorate func(b []byte) []byte
+	// maxClients is the maximum number of concurrent clients, as returned by
+	// relayClient. 0 means unlimited.
+	maxClients int
+
+	dropped  atomic.Int64
+	rejected atomic.Int64
+
 	mu        sync.Mutex
 	last      mimePart
 	listeners []*listener
+	clients   int
+	// peakClients is the highest value of clients.
+	peakClients int
 }
 
 // listen reads a mimepart stream, decodes it, then relay it to the current
 // readers.
+//
+// If the stream uses a different boundary than the one expected, the one found
+// in the stream is used.
 func (t *teeMimePart) listen(ctx context.Context, r io.Reader, boundary string) error {
-	mr := multipart.NewReader(r, boundary)
+	br := bufio.NewReader(r)
+	if b := sniffBoundary(br); b != "" && b != boundary {
+		slog.Warn("teeMimePart", "msg", "unexpected boundary", "want", boundary, "got", b)
+		boundary = b
+	}
+	mr := multipart.NewReader(br, boundary)
 	done := ctx.Done()
+	maxPart := t.maxPartSize
+	if maxPart <= 0 {
+		maxPart = defaultMaxPartSize
+	}
+	// Peak selection state.
+	var best mimePart
+	var bestScore float32
+	var windowStart time.Time
 	for i := 0; ctx.Err() == nil; i++ {
 		p, err := mr.NextPart()
 		if errors.Is(err, io.EOF) {
@@ -44,7 +121,7 @@ func (t *teeMimePart) listen(ctx context.Context, r io.Reader, boundary string)
 		if err != nil {
 			return err
 		}
-		b, err := io.ReadAll(p)
+		b, err := io.ReadAll(io.LimitReader(p, maxPart+1))
 		if errors.Is(err, io.EOF) {
 			// We're done.
 			return nil
@@ -52,7 +129,37 @@ func (t *teeMimePart) listen(ctx context.Context, r io.Reader, boundary string)
 		if err != nil {
 			return err
 		}
+		if int64(len(b)) > maxPart {
+			// The rest of the part is discarded by NextPart().
+			slog.Warn("teeMimePart", "msg", "part too large; skipping", "max", maxPart)
+			continue
+		}
 		pkt := mimePart{p.Header, b}
+		if t.peak != nil {
+			score := t.peak()
+			if best.b == nil || score > bestScore {
+				best = pkt
+				bestScore = score
+			}
+			now := time.Now()
+			if now.Sub(windowStart) < peakWindow {
+				continue
+			}
+			pkt = best
+			best = mimePart{}
+			windowStart = now
+		}
+		if t.decorate != nil {
+			b2 := t.decorate(pkt.b)
+			hdr := textproto.MIMEHeader{}
+			for k, v := range pkt.hdr {
+				hdr[k] = v
+			}
+			if hdr.Get("Content-Length") != "" {
+				hdr.Set("Content-Length", strconv.Itoa(len(b2)))
+			}
+			pkt = mimePart{hdr, b2}
+		}
 		t.mu.Lock()
 		t.last = pkt
 		l := make([]*listener, len(t.listeners))
@@ -70,6 +177,8 @@ func (t *teeMimePart) listen(ctx context.Context, r io.Reader, boundary string)
 				// have the channel always with a fresh frame.
 				select {
 				case <-x.ch:
+					x.dropped.Add(1)
+					t.dropped.Add(1)
 				case <-done:
 					return ctx.Err()
 				case <-x.ctx.Done():
@@ -83,6 +192,8 @@ func (t *teeMimePart) listen(ctx context.Context, r io.Reader, boundary string)
 				case <-x.ctx.Done():
 					return x.ctx.Err()
 				default:
+					x.dropped.Add(1)
+					t.dropped.Add(1)
 				}
 			}
 		}
@@ -90,10 +201,87 @@ func (t *teeMimePart) listen(ctx context.Context, r io.Reader, boundary string)
 	return nil
 }
 
+// sniffBoundary returns the boundary used by the first delimiter line of a
+// multipart stream without consuming it.
+//
+// It returns an empty string if it can't be determined.
+func sniffBoundary(br *bufio.Reader) string {
+	for n := 1; n <= 256; n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return ""
+		}
+		if b[n-1] != '\n' {
+			continue
+		}
+		l := bytes.TrimSpace(b)
+		if len(l) == 0 {
+			// Skip the leading empty lines.
+			continue
+		}
+		if l, ok := bytes.CutPrefix(l, []byte("--")); ok {
+			return string(l)
+		}
+		return ""
+	}
+	return ""
+}
+
+// lastFrame returns the last part received, if any.
+func (t *teeMimePart) lastFrame() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.last.b
+}
+
+// stats returns the current state of each listener.
+func (t *teeMimePart) stats() []listenerStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]listenerStats, len(t.listeners))
+	for i, l := range t.listeners {
+		out[i] = listenerStats{Name: l.name, Dropped: l.dropped.Load()}
+	}
+	return out
+}
+
+// clientStats returns the state of the clients.
+func (t *teeMimePart) clientStats() clientStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return clientStats{current: t.clients, peak: t.peakClients, dropped: t.dropped.Load(), rejected: t.rejected.Load()}
+}
+
 // relay relays data tee'd from the source.
-func (b *teeMimePart) relay(ctx context.Context) <-chan mimePart {
-	l := &listener{ctx, make(chan mimePart, 1)}
+//
+// The listener is removed when ctx is canceled.
+func (b *teeMimePart) relay(ctx context.Context, name string) *listener {
+	l, _ := b.add(ctx, name, false)
+	return l
+}
+
+// relayClient is like relay for a client, e.g. a HTTP request. It returns
+// nil when there are already maxClients clients.
+func (b *teeMimePart) relayClient(ctx context.Context, name string) *listener {
+	l, ok := b.add(ctx, name, true)
+	if !ok {
+		b.rejected.Add(1)
+		return nil
+	}
+	return l
+}
+
+func (b *teeMimePart) add(ctx context.Context, name string, client bool) (*listener, bool) {
+	l := &listener{ctx: ctx, ch: make(chan mimePart, 1), name: name, client: client}
 	b.mu.Lock()
+	if client {
+		if b.maxClients > 0 && b.clients >= b.maxClients {
+			b.mu.Unlock()
+			return nil, false
+		}
+		b.clients++
+		b.peakClients = max(b.peakClients, b.clients)
+	}
 	b.listeners = append(b.listeners, l)
 	last := b.last
 	b.mu.Unlock()
@@ -112,10 +300,12 @@ func (b *teeMimePart) relay(ctx context.Context) <-chan mimePart {
 					break
 				}
 			}
+			if client {
+				b.clients--
+			}
 			b.mu.Unlock()
-
 		}()
 		<-ctx.Done()
 	}()
-	return l.ch
+	return l, true
 }
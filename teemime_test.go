@@ -0,0 +1,149 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mimeStream returns a multipart stream with one part per item in parts.
+func mimeStream(t *testing.T, boundary string, parts ...[]byte) []byte {
+	buf := bytes.Buffer{}
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range parts {
+		w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"image/jpeg"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTeeMimePartMaxPartSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tm := &teeMimePart{maxPartSize: 10}
+	l := tm.relay(ctx, "test")
+	r := bytes.NewReader(mimeStream(t, mpjpegBoundary, bytes.Repeat([]byte("a"), 100), []byte("small")))
+	if err := tm.listen(ctx, r, mpjpegBoundary); err != nil {
+		t.Fatal(err)
+	}
+	p := <-l.ch
+	if got := string(p.b); got != "small" {
+		t.Fatalf("got %q", got)
+	}
+	if got := string(tm.last.b); got != "small" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestTeeMimePartBoundary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tm := &teeMimePart{}
+	l := tm.relay(ctx, "test")
+	r := bytes.NewReader(mimeStream(t, "somethingelse", []byte("frame")))
+	if err := tm.listen(ctx, r, mpjpegBoundary); err != nil {
+		t.Fatal(err)
+	}
+	p := <-l.ch
+	if got := string(p.b); got != "frame" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestSniffBoundary(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"--ffmpeg\r\nContent-Type: image/jpeg\r\n", "ffmpeg"},
+		{"\r\n--foo\r\n", "foo"},
+		{"garbage\r\n", ""},
+		{"--truncated", ""},
+	}
+	for i, l := range data {
+		if got := sniffBoundary(bufio.NewReader(strings.NewReader(l.in))); got != l.want {
+			t.Errorf("#%d: got %q, want %q", i, got, l.want)
+		}
+	}
+}
+
+func TestTeeMimePartPeak(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scores := []float32{0, 1, 5, 2, 0}
+	i := 0
+	tm := &teeMimePart{peak: func() float32 { i++; return scores[i-1] }}
+	l := tm.relay(ctx, "test")
+	s := mimeStream(t, mpjpegBoundary, []byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e"))
+	// Cut the stream before "e" to wait for the window to expire.
+	cut := bytes.Index(s, []byte("e\r\n--"))
+	cut = bytes.LastIndex(s[:cut], []byte("\r\n--"))
+	r, w := io.Pipe()
+	go func() {
+		_, _ = w.Write(s[:cut])
+		time.Sleep(peakWindow + 100*time.Millisecond)
+		_, _ = w.Write(s[cut:])
+		_ = w.Close()
+	}()
+	var got []string
+	go func() {
+		if err := tm.listen(ctx, r, mpjpegBoundary); err != nil {
+			t.Error(err)
+		}
+		cancel()
+	}()
+	for p := range l.ch {
+		got = append(got, string(p.b))
+	}
+	// The first frame is sent right away, then the best of the next window.
+	if want := []string{"a", "c"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestTeeMimePartMaxClients(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tm := &teeMimePart{maxClients: 1}
+	ctx1, cancel1 := context.WithCancel(ctx)
+	if tm.relayClient(ctx1, "1") == nil {
+		t.Fatal("expected a listener")
+	}
+	if tm.relayClient(ctx, "2") != nil {
+		t.Fatal("expected rejection")
+	}
+	// Internal listeners are not limited.
+	tm.relay(ctx, "internal")
+	cancel1()
+	for tm.clientStats().current != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if tm.relayClient(ctx, "3") == nil {
+		t.Fatal("expected a listener")
+	}
+	if got := tm.clientStats(); got.current != 1 || got.peak != 1 || got.rejected != 1 {
+		t.Fatalf("%+v", got)
+	}
+}
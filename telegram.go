@@ -0,0 +1,103 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// telegramAPI is the Telegram Bot API server. It is overridden in tests.
+var telegramAPI = "https://api.telegram.org"
+
+// telegramBot sends the motion notifications to a Telegram chat through the
+// Bot API.
+type telegramBot struct {
+	token string
+	// chat is the chat ID or the @username of a channel.
+	chat string
+}
+
+// telegramMessage returns the text sent when the motion starts.
+func telegramMessage(name string, t time.Time, yavg float32) string {
+	s := "Motion detected"
+	if name != "" {
+		s += " on " + name
+	}
+	return fmt.Sprintf("%s at %s (%.1f)", s, t.Format("2006-01-02 15:04:05"), yavg)
+}
+
+// send sends text to the chat. When photo is set, the JPEG is sent with sendPhoto
+// and text as its caption instead.
+//
+// Like runCmd, it gives the call at most 1 minute.
+func (b *telegramBot) send(ctx context.Context, text, photo string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	method := "sendMessage"
+	var body io.Reader
+	contentType := "application/x-www-form-urlencoded"
+	if photo == "" {
+		body = bytes.NewBufferString(url.Values{"chat_id": {b.chat}, "text": {text}}.Encode())
+	} else {
+		// #nosec G304
+		img, err := os.ReadFile(photo)
+		if err != nil {
+			return err
+		}
+		method = "sendPhoto"
+		buf := &bytes.Buffer{}
+		w := multipart.NewWriter(buf)
+		_ = w.WriteField("chat_id", b.chat)
+		_ = w.WriteField("caption", text)
+		f, err := w.CreateFormFile("photo", "snapshot.jpg")
+		if err != nil {
+			return err
+		}
+		_, _ = f.Write(img)
+		if err = w.Close(); err != nil {
+			return err
+		}
+		body = buf
+		contentType = w.FormDataContentType()
+	}
+	// #nosec G107
+	req, err := http.NewRequestWithContext(ctx, "POST", telegramAPI+"/bot"+b.token+"/"+method, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// The URL contains the token; don't log it.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	// The API always replies with JSON, with a description on error.
+	r := struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("%s: %w", resp.Status, err)
+	}
+	if !r.OK {
+		return fmt.Errorf("%s: %s", method, r.Description)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTelegramMessage(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+	if got, want := telegramMessage("door", ts, 1.25), "Motion detected on door at 2024-01-02 03:04:05 (1.2)"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if got, want := telegramMessage("", ts, 2), "Motion detected at 2024-01-02 03:04:05 (2.0)"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestTelegramSend(t *testing.T) {
+	type call struct {
+		path, chat, text, photo string
+	}
+	var calls []call
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c := call{path: req.URL.Path}
+		if strings.HasSuffix(req.URL.Path, "/sendPhoto") {
+			if err := req.ParseMultipartForm(1 << 20); err != nil {
+				t.Error(err)
+			}
+			c.text = req.FormValue("caption")
+			if f, _, err := req.FormFile("photo"); err == nil {
+				b, _ := io.ReadAll(f)
+				c.photo = string(b)
+			}
+		} else {
+			c.text = req.FormValue("text")
+		}
+		c.chat = req.FormValue("chat_id")
+		calls = append(calls, c)
+		if c.chat == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `{"ok":false,"description":"Bad Request: chat not found"}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"ok":true}`)
+	}))
+	defer srv.Close()
+	old := telegramAPI
+	telegramAPI = srv.URL
+	defer func() { telegramAPI = old }()
+
+	ctx := context.Background()
+	b := &telegramBot{token: "123:abc", chat: "42"}
+	if err := b.send(ctx, "hi", ""); err != nil {
+		t.Fatal(err)
+	}
+	photo := filepath.Join(t.TempDir(), "a.jpg")
+	if err := os.WriteFile(photo, []byte("jpeg"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.send(ctx, "motion", photo); err != nil {
+		t.Fatal(err)
+	}
+	b.chat = "bad"
+	if err := b.send(ctx, "hi", ""); err == nil || !strings.Contains(err.Error(), "chat not found") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []call{
+		{path: "/bot123:abc/sendMessage", chat: "42", text: "hi"},
+		{path: "/bot123:abc/sendPhoto", chat: "42", text: "motion", photo: "jpeg"},
+		{path: "/bot123:abc/sendMessage", chat: "bad", text: "hi"},
+	}
+	if len(calls) != len(want) {
+		t.Fatalf("got %d calls, want %d", len(calls), len(want))
+	}
+	for i := range want {
+		if calls[i] != want[i] {
+			t.Fatalf("#%d: got %+v, want %+v", i, calls[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+)
+
+// triggerDuration is the default duration of an event forced with
+// POST /trigger.
+const triggerDuration = 30 * time.Second
+
+// triggerMax is the maximum duration of an event forced with POST /trigger.
+const triggerMax = time.Hour
+
+// triggerRequest forces a motion event, e.g. from a doorbell. It is processed
+// by filterMotion.
+//
+// When an event is already forced, the request ends it instead.
+type triggerRequest struct {
+	// d is the duration of the forced event.
+	d time.Duration
+	// reply receives the outcome. It must be buffered.
+	reply chan<- triggerReply
+}
+
+// triggerReply is the response to POST /trigger.
+type triggerReply struct {
+	// Playlist is the motion recording of the event. It is generated like the
+	// ones of the real events, once the event ended.
+	Playlist string `json:"playlist"`
+	// Clip is the MP4 clip, with -clips.
+	Clip string `json:"clip,omitempty"`
+	// Stopped is true when the request ended the forced event.
+	Stopped bool `json:"stopped"`
+	// End is when the forced event ends, not counting -post-capture.
+	End *time.Time `json:"end,omitempty"`
+}
+
+// newTriggerReply returns the reply for the event started at t.
+func newTriggerReply(t time.Time, clips bool) triggerReply {
+	base := t.Format("2006-01-02T15-04-05")
+	r := triggerReply{Playlist: base + ".m3u8"}
+	if clips {
+		r.Clip = base + ".mp4"
+	}
+	return r
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// v4l2Mode is a resolution supported by a v4l2 device for a pixel format.
+type v4l2Mode struct {
+	// format is the pixel format fourcc, e.g. MJPG or YUYV.
+	format string
+	w, h   int
+	// fps is the supported frame rates.
+	fps []float64
+}
+
+func (m *v4l2Mode) String() string {
+	s := fmt.Sprintf("%s %dx%d", m.format, m.w, m.h)
+	for i, f := range m.fps {
+		if i == 0 {
+			s += " @ "
+		} else {
+			s += ", "
+		}
+		s += strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	if len(m.fps) != 0 {
+		s += " fps"
+	}
+	return s
+}
+
+// parseV4L2Devices returns the device paths listed by
+// "v4l2-ctl --list-devices".
+func parseV4L2Devices(b []byte) []string {
+	var out []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if l = strings.TrimSpace(l); strings.HasPrefix(l, "/dev/video") {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+// parseV4L2Formats parses the output of "v4l2-ctl --list-formats-ext".
+//
+// Only the discrete sizes are returned. Devices reporting a stepwise range
+// return no mode.
+func parseV4L2Formats(r io.Reader) ([]v4l2Mode, error) {
+	var out []v4l2Mode
+	format := ""
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		switch {
+		case strings.HasPrefix(l, "["):
+			// [0]: 'MJPG' (Motion-JPEG, compressed)
+			if _, rest, ok := strings.Cut(l, "'"); ok {
+				format, _, _ = strings.Cut(rest, "'")
+			}
+		case strings.HasPrefix(l, "Size: Discrete "):
+			// Size: Discrete 1280x720
+			ws, hs, ok := strings.Cut(strings.TrimPrefix(l, "Size: Discrete "), "x")
+			w, err1 := strconv.Atoi(ws)
+			h, err2 := strconv.Atoi(hs)
+			if !ok || err1 != nil || err2 != nil {
+				return out, fmt.Errorf("unexpected v4l2-ctl line: %q", l)
+			}
+			out = append(out, v4l2Mode{format: format, w: w, h: h})
+		case strings.HasPrefix(l, "Interval: Discrete ") && len(out) != 0:
+			// Interval: Discrete 0.033s (30.000 fps)
+			_, rest, ok := strings.Cut(l, "(")
+			fps, _, ok2 := strings.Cut(rest, " fps)")
+			f, err := strconv.ParseFloat(fps, 64)
+			if !ok || !ok2 || err != nil {
+				return out, fmt.Errorf("unexpected v4l2-ctl line: %q", l)
+			}
+			m := &out[len(out)-1]
+			m.fps = append(m.fps, f)
+		}
+	}
+	return out, s.Err()
+}
+
+// listV4L2Formats returns the modes supported by the v4l2 device dev.
+func listV4L2Formats(ctx context.Context, dev string) ([]v4l2Mode, error) {
+	// #nosec G204
+	out, err := exec.CommandContext(ctx, "v4l2-ctl", "--list-formats-ext", "-d", dev).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("fail to run v4l2-ctl, try 'sudo apt install v4l-utils'? %w", err)
+	}
+	return parseV4L2Formats(bytes.NewReader(out))
+}
+
+// checkV4L2Mode returns an error listing the supported modes when w x h at
+// fps is not one of them.
+//
+// Nothing is validated when modes is empty since the device may only report
+// a stepwise range.
+func checkV4L2Mode(modes []v4l2Mode, w, h, fps int) error {
+	if len(modes) == 0 {
+		return nil
+	}
+	for _, m := range modes {
+		if m.w != w || m.h != h {
+			continue
+		}
+		if len(m.fps) == 0 {
+			return nil
+		}
+		for _, f := range m.fps {
+			if math.Round(f) == float64(fps) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("-w %d -h %d -fps %d is not supported by the device; valid modes are:\n%s", w, h, fps, formatV4L2Modes(modes))
+}
+
+// formatV4L2Modes returns one mode per line.
+func formatV4L2Modes(modes []v4l2Mode) string {
+	var b strings.Builder
+	for _, m := range modes {
+		b.WriteString("  " + m.String() + "\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseV4L2Devices(t *testing.T) {
+	out := "UVC Camera (046d:0825) (usb-0000:00:14.0-1):\n\t/dev/video0\n\t/dev/video1\n\t/dev/media0\n\n" +
+		"bcm2835-codec-decode (platform:bcm2835-codec):\n\t/dev/video10\n"
+	if got, want := parseV4L2Devices([]byte(out)), []string{"/dev/video0", "/dev/video1", "/dev/video10"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+}
+
+func TestParseV4L2Formats(t *testing.T) {
+	out := `ioctl: VIDIOC_ENUM_FMT
+	Type: Video Capture
+
+	[0]: 'MJPG' (Motion-JPEG, compressed)
+		Size: Discrete 1280x720
+			Interval: Discrete 0.033s (30.000 fps)
+			Interval: Discrete 0.067s (15.000 fps)
+		Size: Discrete 640x480
+			Interval: Discrete 0.033s (30.000 fps)
+	[1]: 'YUYV' (YUYV 4:2:2)
+		Size: Discrete 640x480
+			Interval: Discrete 0.200s (5.000 fps)
+`
+	modes, err := parseV4L2Formats(strings.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "  MJPG 1280x720 @ 30, 15 fps\n  MJPG 640x480 @ 30 fps\n  YUYV 640x480 @ 5 fps"
+	if got := formatV4L2Modes(modes); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if err = checkV4L2Mode(modes, 1280, 720, 15); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkV4L2Mode(modes, 640, 480, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkV4L2Mode(modes, 1280, 720, 5); err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatal(err)
+	}
+	if err = checkV4L2Mode(modes, 1920, 1080, 30); err == nil {
+		t.Fatal("expected error")
+	}
+	// Stepwise ranges are not validated.
+	if err = checkV4L2Mode(nil, 1920, 1080, 30); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = parseV4L2Formats(strings.NewReader("[0]: 'MJPG'\nSize: Discrete 1280\n")); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhookTimeout is the maximum duration of each webhook call.
+const webhookTimeout = 10 * time.Second
+
+// webhookBackoff is the delay before the first retry. It doubles on each
+// retry.
+var webhookBackoff = time.Second
+
+// webhookVersion is the version of webhookPayload. Version 1 only had the
+// "motion" field.
+const webhookVersion = 2
+
+// webhookPayload is the JSON content sent to the webhooks.
+//
+// Fields are only added so consumers that only look at "motion" keep working.
+type webhookPayload struct {
+	Version int  `json:"version"`
+	Motion  bool `json:"motion"`
+	// Time is when the motion started or ended.
+	Time time.Time `json:"time"`
+	// YAVG is the motion level that triggered the event.
+	YAVG float32 `json:"yavg"`
+	// Zone is the detection zone that started the event, 1 for -mask and 2
+	// for -mask2. Only set with -mask2.
+	Zone int `json:"zone,omitempty"`
+	// Name is the camera name, as specified with -name.
+	Name string `json:"name,omitempty"`
+	// Snapshot is the JPEG saved in root when the motion started, with
+	// -snapshots. Only set when the motion started.
+	Snapshot string `json:"snapshot,omitempty"`
+	// Start, End and Playlist describe the motion recording. They are only
+	// set when the motion ended.
+	Start    *time.Time `json:"start,omitempty"`
+	End      *time.Time `json:"end,omitempty"`
+	Playlist string     `json:"playlist,omitempty"`
+	// GIF is the animated GIF preview, with -gif. Only set when the motion
+	// ended. Like the playlist, it is generated once the recording is
+	// finalized.
+	GIF string `json:"gif,omitempty"`
+	// Clip is the MP4 clip, with -clips. Only set when the motion ended. It is
+	// generated once the recording is finalized.
+	Clip string `json:"clip,omitempty"`
+}
+
+// webhookQueue is the number of notifications that can be pending per URL.
+const webhookQueue = 16
+
+// webhooks is a list of URLs to notify, specified by repeating the flag.
+type webhooks []string
+
+func (w *webhooks) Set(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid webhook %q; must be an http or https URL", v)
+	}
+	*w = append(*w, v)
+	return nil
+}
+
+func (w *webhooks) String() string {
+	return strings.Join(*w, ",")
+}
+
+// webhookNotifier POSTs a webhookPayload to each URL in the background.
+//
+// Each URL has its own queue so a failing URL doesn't delay the others, and
+// the notifications to a URL are delivered in order.
+type webhookNotifier struct {
+	queues map[string]chan webhookPayload
+	wg     sync.WaitGroup
+}
+
+func newWebhookNotifier(ctx context.Context, urls []string, retries int) *webhookNotifier {
+	w := &webhookNotifier{queues: make(map[string]chan webhookPayload, len(urls))}
+	for _, u := range urls {
+		if _, ok := w.queues[u]; ok {
+			continue
+		}
+		q := make(chan webhookPayload, webhookQueue)
+		w.queues[u] = q
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for p := range q {
+				deliverWebhook(ctx, u, &p, retries)
+			}
+		}()
+	}
+	return w
+}
+
+// notify queues a notification to each URL. It doesn't block.
+func (w *webhookNotifier) notify(p webhookPayload) {
+	for u, q := range w.queues {
+		select {
+		case q <- p:
+		default:
+			slog.Error("webhook", "url", u, "motion", p.Motion, "err", "queue full, dropping")
+		}
+	}
+}
+
+// wait waits for the queued notifications to be delivered. notify must not be
+// called afterward.
+func (w *webhookNotifier) wait() {
+	for _, q := range w.queues {
+		close(q)
+	}
+	w.wg.Wait()
+}
+
+// deliverWebhook POSTs p to u, retrying with exponential backoff. It logs the
+// final outcome.
+func deliverWebhook(ctx context.Context, u string, p *webhookPayload, retries int) {
+	d, _ := json.Marshal(p)
+	motion := p.Motion
+	start := time.Now()
+	delay := webhookBackoff
+	for i := 0; ; i++ {
+		err := sendWebhook(ctx, u, d)
+		if err == nil {
+			slog.Info("webhook", "url", u, "motion", motion, "attempts", i+1, "dur", time.Since(start).Round(time.Millisecond))
+			return
+		}
+		if i >= retries || ctx.Err() != nil {
+			slog.Error("webhook", "url", u, "motion", motion, "attempts", i+1, "err", err)
+			return
+		}
+		slog.Warn("webhook", "url", u, "motion", motion, "attempt", i+1, "retry_in", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			slog.Error("webhook", "url", u, "motion", motion, "attempts", i+1, "err", ctx.Err())
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// sendWebhook POSTs d to u. It returns an error if the response isn't a 2xx.
+func sendWebhook(ctx context.Context, u string, d []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	// #nosec G107
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(d))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if err = resp.Body.Close(); err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = time.Second }()
+	mu := sync.Mutex{}
+	var got []string
+	attempts := 0
+	// Fails the first two calls then succeeds.
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if attempts++; attempts <= 2 {
+			http.Error(w, "nope", http.StatusServiceUnavailable)
+			return
+		}
+		got = append(got, string(b))
+	}))
+	defer flaky.Close()
+	failing := 0
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		failing++
+		mu.Unlock()
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	var w webhooks
+	if err := w.Set("ftp://example.com"); err == nil {
+		t.Fatal("expected error")
+	}
+	for _, u := range []string{down.URL, flaky.URL} {
+		if err := w.Set(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wn := newWebhookNotifier(context.Background(), w, 3)
+	t0 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	start, end := t0.Add(-5*time.Second), t0.Add(time.Minute)
+	wn.notify(webhookPayload{Version: webhookVersion, Motion: true, Time: t0, YAVG: 1.5, Name: "door"})
+	wn.notify(webhookPayload{Version: webhookVersion, Time: t0.Add(time.Minute), YAVG: 1.5, Name: "door", Start: &start, End: &end, Playlist: "2024-01-02T03-04-05.m3u8"})
+	wn.wait()
+	want := []string{
+		`{"version":2,"motion":true,"time":"2024-01-02T03:04:05Z","yavg":1.5,"name":"door"}`,
+		`{"version":2,"motion":false,"time":"2024-01-02T03:05:05Z","yavg":1.5,"name":"door","start":"2024-01-02T03:04:00Z","end":"2024-01-02T03:05:05Z","playlist":"2024-01-02T03-04-05.m3u8"}`,
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+	// Two notifications, each tried once and retried 3 times.
+	if failing != 8 {
+		t.Fatalf("got %d calls", failing)
+	}
+}
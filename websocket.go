@@ -0,0 +1,204 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1" // #nosec G505
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket opcodes as per RFC 6455 section 5.2.
+const (
+	wsBinary = 0x2
+	wsClose  = 0x8
+	wsPing   = 0x9
+	wsPong   = 0xA
+)
+
+// wsPingInterval is the interval between pings. A client that doesn't send
+// anything, including the pongs, for two intervals is disconnected.
+var wsPingInterval = 30 * time.Second
+
+// wsMaxMessage is the maximum size of a message accepted from a client. The
+// clients are not expected to send anything but control frames.
+const wsMaxMessage = 4096
+
+// wsAccept returns the Sec-WebSocket-Accept value for key.
+func wsAccept(key string) string {
+	// #nosec G401
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains returns true if the comma separated header k contains v,
+// case insensitive.
+func headerContains(h http.Header, k, v string) bool {
+	for _, l := range h.Values(k) {
+		for _, s := range strings.Split(l, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wsConn is a server side WebSocket connection.
+//
+// Only the minimum is implemented: the server sends unfragmented messages and
+// the messages received from the client are discarded, except for the
+// control frames.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	mu sync.Mutex
+}
+
+// wsUpgrade upgrades the HTTP request to a WebSocket connection.
+//
+// An error response is written when it fails.
+func wsUpgrade(w http.ResponseWriter, req *http.Request) (*wsConn, error) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(req.Header, "Connection", "upgrade") || !headerContains(req.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "Expected a WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket upgrade")
+	}
+	if v := req.Header.Get("Sec-WebSocket-Version"); v != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported WebSocket version %q", v)
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't upgrade", http.StatusInternalServerError)
+		return nil, errors.New("the connection can't be hijacked")
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// The server's deadlines do not apply anymore.
+	_ = conn.SetDeadline(time.Time{})
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n"
+	if _, err = brw.WriteString(resp); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// write sends an unfragmented message.
+func (c *wsConn) write(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(appendWSFrame(nil, op, payload))
+	return err
+}
+
+// appendWSFrame appends an unmasked frame to b.
+func appendWSFrame(b []byte, op byte, payload []byte) []byte {
+	b = append(b, 0x80|op)
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, byte(n))
+	case n <= 0xFFFF:
+		b = append(b, 126)
+		b = binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, 127)
+		b = binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+	return append(b, payload...)
+}
+
+// readWSFrame reads a frame sent by a client, which must be masked.
+func readWSFrame(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	op := hdr[0] & 0x0F
+	if hdr[1]&0x80 == 0 {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+	n := uint64(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > wsMaxMessage {
+		return 0, nil, fmt.Errorf("frame too large: %d bytes", n)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// readLoop processes the frames sent by the client until the connection is
+// closed. It answers the pings and returns when the client closes the
+// connection or didn't send anything for two wsPingInterval.
+func (c *wsConn) readLoop() error {
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		op, payload, err := readWSFrame(c.br)
+		if err != nil {
+			return err
+		}
+		switch op {
+		case wsPing:
+			if err = c.write(wsPong, payload); err != nil {
+				return err
+			}
+		case wsClose:
+			// Echo the status code as per RFC 6455 section 5.5.1.
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			_ = c.write(wsClose, payload)
+			return nil
+		}
+	}
+}
+
+func (c *wsConn) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSAccept(t *testing.T) {
+	// RFC 6455 section 1.3.
+	if got := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal(got)
+	}
+}
+
+func TestAppendWSFrame(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		b := appendWSFrame(nil, wsBinary, make([]byte, n))
+		op, payload, err := readServerFrame(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil || op != wsBinary || len(payload) != n {
+			t.Fatal(n, op, len(payload), err)
+		}
+	}
+}
+
+func TestReadWSFrame(t *testing.T) {
+	op, payload, err := readWSFrame(bufio.NewReader(bytes.NewReader(maskedFrame(wsPing, []byte("hello")))))
+	if err != nil || op != wsPing || string(payload) != "hello" {
+		t.Fatal(op, payload, err)
+	}
+	// Unmasked.
+	if _, _, err = readWSFrame(bufio.NewReader(bytes.NewReader(appendWSFrame(nil, wsPing, nil)))); err == nil {
+		t.Fatal("expected error")
+	}
+	// Too large.
+	if _, _, err = readWSFrame(bufio.NewReader(bytes.NewReader(maskedFrame(wsBinary, make([]byte, wsMaxMessage+1))))); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestServerWebSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &camera{root: t.TempDir(), tm: &teeMimePart{}, eb: &eventBroadcaster{}, met: &metrics{}}
+	// The last frame is sent right away to a new listener.
+	if err := c.tm.listen(ctx, bytes.NewReader(mimeStream(t, mpjpegBoundary, []byte("jpeg"))), mpjpegBoundary); err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(cameraMux(ctx, c, time.Second, &httpAuth{}))
+	defer s.Close()
+
+	// A plain request is rejected.
+	resp, err := http.Get(s.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal(resp.StatusCode)
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req := "GET /ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	if _, err = io.WriteString(conn, req); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal(resp.StatusCode, resp.Header)
+	}
+	op, payload, err := readServerFrame(br)
+	if err != nil || op != wsBinary || string(payload) != "jpeg" {
+		t.Fatal(op, payload, err)
+	}
+	if _, err = conn.Write(maskedFrame(wsPing, []byte("p"))); err != nil {
+		t.Fatal(err)
+	}
+	if op, payload, err = readServerFrame(br); err != nil || op != wsPong || string(payload) != "p" {
+		t.Fatal(op, payload, err)
+	}
+	if _, err = conn.Write(maskedFrame(wsClose, []byte{0x03, 0xE8})); err != nil {
+		t.Fatal(err)
+	}
+	if op, _, err = readServerFrame(br); err != nil || op != wsClose {
+		t.Fatal(op, err)
+	}
+	// The listener is removed.
+	for c.tm.clientStats().current != 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// maskedFrame returns a frame as sent by a client.
+func maskedFrame(op byte, payload []byte) []byte {
+	b := []byte{0x80 | op}
+	mask := []byte{1, 2, 3, 4}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, 0x80|byte(n))
+	case n <= 0xFFFF:
+		b = append(b, 0x80|126, byte(n>>8), byte(n))
+	}
+	b = append(b, mask...)
+	for i, c := range payload {
+		b = append(b, c^mask[i%4])
+	}
+	return b
+}
+
+// readServerFrame reads an unmasked frame.
+func readServerFrame(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(hdr[1] & 0x7F)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = int(b[0])<<8 | int(b[1])
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = 0
+		for _, x := range b {
+			n = n<<8 | int(x)
+		}
+	}
+	payload := make([]byte, n)
+	_, err := io.ReadFull(r, payload)
+	return hdr[0] & 0x0F, payload, err
+}
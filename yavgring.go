@@ -0,0 +1,61 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// yavgRingSize is the number of samples kept for /yavg, about 2 minutes at
+// 25fps.
+const yavgRingSize = 3000
+
+// yavgSample is a motion level sample served by /yavg.
+type yavgSample struct {
+	Frame int       `json:"frame"`
+	T     time.Time `json:"t"`
+	YAVG  float32   `json:"yavg"`
+	// Threshold is the threshold that was active for this frame.
+	Threshold float32 `json:"threshold"`
+}
+
+// yavgRing keeps the last yavgRingSize samples to help tune the threshold.
+//
+// The zero value is ready to use.
+type yavgRing struct {
+	mu      sync.Mutex
+	samples []yavgSample
+	// next is the index to overwrite once samples is full.
+	next int
+	// eb streams the samples to the /yavg?stream=1 clients.
+	eb eventBroadcaster
+}
+
+// add records s and publishes it to the subscribers.
+func (y *yavgRing) add(s yavgSample) {
+	y.mu.Lock()
+	if len(y.samples) < yavgRingSize {
+		y.samples = append(y.samples, s)
+	} else {
+		y.samples[y.next] = s
+		y.next = (y.next + 1) % yavgRingSize
+	}
+	y.mu.Unlock()
+	if y.eb.active() {
+		b, _ := json.Marshal(&s)
+		y.eb.publish(b)
+	}
+}
+
+// get returns the samples, oldest first.
+func (y *yavgRing) get() []yavgSample {
+	y.mu.Lock()
+	defer y.mu.Unlock()
+	out := make([]yavgSample, 0, len(y.samples))
+	out = append(out, y.samples[y.next:]...)
+	return append(out, y.samples[:y.next]...)
+}
@@ -0,0 +1,33 @@
+// Copyright 2024 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestYAVGRing(t *testing.T) {
+	y := yavgRing{}
+	if got := y.get(); len(got) != 0 {
+		t.Fatal(got)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := y.eb.subscribe(ctx)
+	y.add(yavgSample{Frame: 1, YAVG: 0.5, Threshold: 1})
+	var s yavgSample
+	if err := json.Unmarshal(<-ch, &s); err != nil || s.Frame != 1 || s.Threshold != 1 {
+		t.Fatal(s, err)
+	}
+	for i := 2; i <= yavgRingSize+10; i++ {
+		y.add(yavgSample{Frame: i})
+	}
+	got := y.get()
+	if len(got) != yavgRingSize || got[0].Frame != 11 || got[len(got)-1].Frame != yavgRingSize+10 {
+		t.Fatal(len(got), got[0], got[len(got)-1])
+	}
+}